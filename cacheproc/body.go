@@ -0,0 +1,178 @@
+package cacheproc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/bradfitz/go-tool-cache/wire"
+)
+
+// DefaultSpoolThreshold is the size above which put bodies are spooled to
+// a temporary file rather than held in memory.
+const DefaultSpoolThreshold = 8 << 20
+
+// storedBody is the body of a put of an output the cache already stores,
+// which was skipped rather than read.
+type storedBody struct{}
+
+func (storedBody) Read([]byte) (int, error) { return 0, io.EOF }
+
+// refusedBody is the body of a put refused while the disk is under
+// pressure, which was skipped rather than read.
+type refusedBody struct{}
+
+func (refusedBody) Read([]byte) (int, error) { return 0, io.EOF }
+
+// readPutBody reads the body of the put req from br. If the cache already
+// stores the output, which is content-addressed, the body is skipped
+// without being decoded, buffered or written, and a storedBody returned;
+// while the disk is under pressure, a refusedBody is. Bodies are always
+// read when recording, to be replayed.
+func (p *Process) readPutBody(ctx context.Context, br *bufio.Reader, req *wire.Request) (io.Reader, error) {
+	if p.recorder == nil && p.pressure.high() {
+		if err := skipBody(br); err != nil {
+			return nil, err
+		}
+		return refusedBody{}, nil
+	}
+	if los, ok := p.cache.(cachers.LocalOutputStore); ok && p.recorder == nil {
+		outputID := fmt.Sprintf("%x", req.OutputID)
+		if outputID != "" && los.HasOutput(ctx, outputID, req.BodySize) {
+			if err := skipBody(br); err != nil {
+				return nil, err
+			}
+			return storedBody{}, nil
+		}
+	}
+	return p.readBody(br, req.BodySize)
+}
+
+// readBody reads the body of a put request of the given size, sent as a
+// base64-encoded JSON string, from br. Bodies larger than the spool
+// threshold are written to a temporary file, which is removed when the
+// returned body is closed; smaller ones are held in memory, in a slice from
+// the pool of sbytes, which handlePut gives back.
+func (p *Process) readBody(br *bufio.Reader, size int64) (io.Reader, error) {
+	if size <= p.spoolThreshold {
+		b := sbytes.Get(int(size))
+		buf := bytes.NewBuffer(b[:0])
+		if err := decodeBody(br, buf, size); err != nil {
+			sbytes.Put(b)
+			return nil, err
+		}
+		return sbytes.NewBuffer(buf.Bytes()), nil
+	}
+	f, err := os.CreateTemp(p.spoolDir, "go-cacher-put-")
+	if err != nil {
+		return nil, err
+	}
+	sf := &spoolFile{File: f, sum: sha256.New()}
+	if err := decodeBody(br, io.MultiWriter(f, sf.sum), size); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+// decodeBody decodes a base64-encoded JSON string of size bytes from br to w,
+// without buffering it whole.
+func decodeBody(br *bufio.Reader, w io.Writer, size int64) error {
+	if err := openString(br); err != nil {
+		return err
+	}
+	n, err := sbytes.Copy(w, base64.NewDecoder(base64.StdEncoding, &stringReader{br: br}))
+	if err != nil {
+		return fmt.Errorf("put body: %w", err)
+	}
+	if n != size {
+		return protocolError{fmt.Errorf("only got %d bytes of declared %d", n, size)}
+	}
+	return nil
+}
+
+// skipBody skips a body, without decoding it.
+func skipBody(br *bufio.Reader) error {
+	if err := openString(br); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, &stringReader{br: br}); err != nil {
+		return fmt.Errorf("put body: %w", err)
+	}
+	return nil
+}
+
+// openString consumes the whitespace and opening quote before a JSON string.
+func openString(br *bufio.Reader) error {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == '"' {
+			return nil
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return protocolError{fmt.Errorf("put body: unexpected %q before string", b)}
+		}
+	}
+}
+
+// stringReader reads the contents of a JSON string, whose opening quote
+// has been consumed, up to its closing quote.
+type stringReader struct {
+	br   *bufio.Reader
+	done bool
+}
+
+func (r *stringReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf, err := r.br.Peek(min(max(r.br.Buffered(), 1), len(p)))
+	if len(buf) == 0 {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if i := bytes.IndexByte(buf, '"'); i >= 0 {
+		n := copy(p, buf[:i])
+		r.br.Discard(i + 1)
+		r.done = true
+		return n, nil
+	}
+	n := copy(p, buf)
+	r.br.Discard(n)
+	return n, nil
+}
+
+// spoolFile is a put body spooled to a temporary file, removed on Close.
+type spoolFile struct {
+	*os.File
+	sum hash.Hash // SHA-256 of the content, computed while spooling
+}
+
+func (f *spoolFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
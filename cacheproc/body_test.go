@@ -0,0 +1,117 @@
+package cacheproc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeBody(t *testing.T) {
+	body := strings.Repeat("0123456789", 10)
+	in := "\"" + base64.StdEncoding.EncodeToString([]byte(body)) + "\"\n{\"ID\":2}\n"
+	// A small buffer makes the string span several reads.
+	br := bufio.NewReaderSize(strings.NewReader(in), 16)
+	var out bytes.Buffer
+	require.NoError(t, decodeBody(br, &out, int64(len(body))))
+	assert.Equal(t, body, out.String())
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "\n{\"ID\":2}\n", string(rest))
+
+	t.Run("short", func(t *testing.T) {
+		br := bufio.NewReader(strings.NewReader(`"aGVsbG8="`))
+		assert.EqualError(t, decodeBody(br, io.Discard, 6), "only got 5 bytes of declared 6")
+	})
+	t.Run("truncated", func(t *testing.T) {
+		br := bufio.NewReader(strings.NewReader(`"aGVsbG8=`))
+		assert.ErrorIs(t, decodeBody(br, io.Discard, 5), io.ErrUnexpectedEOF)
+	})
+	t.Run("not a string", func(t *testing.T) {
+		br := bufio.NewReader(strings.NewReader(`123`))
+		assert.Error(t, decodeBody(br, io.Discard, 5))
+	})
+}
+
+// spoolCheckingCache is a LocalCache that records whether put bodies were
+// spooled to a file.
+type spoolCheckingCache struct {
+	cachers.LocalCache
+	spooled []string // names of the spool files seen
+}
+
+func (c *spoolCheckingCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	if f, ok := body.(*spoolFile); ok {
+		c.spooled = append(c.spooled, f.Name())
+	}
+	return c.LocalCache.Put(ctx, actionID, outputID, size, body)
+}
+
+func TestProcessSpoolsLargeBodies(t *testing.T) {
+	spoolDir := t.TempDir()
+	cache := &spoolCheckingCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+	p := NewCacheProc(cache, WithSpool(spoolDir, 8))
+	_, res := serve(t, p,
+		putRequest(1, "small", "hello"),
+		putRequest(2, "large", "hello, world"),
+		&wire.Request{ID: 3, Command: wire.CmdClose},
+	)
+	require.Empty(t, res[1].Err)
+	require.Empty(t, res[2].Err)
+	require.Len(t, cache.spooled, 1)
+	assert.Equal(t, spoolDir, filepath.Dir(cache.spooled[0]))
+
+	got, err := os.ReadFile(res[2].DiskPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(got))
+
+	left, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, left, "spool files must be removed")
+}
+
+// putActionCache is a LocalCache that counts the puts that came without a
+// body.
+type putActionCache struct {
+	*cachers.SimpleDiskCache
+	putActions atomic.Int32
+}
+
+func (c *putActionCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (string, error) {
+	c.putActions.Add(1)
+	return c.SimpleDiskCache.PutAction(ctx, actionID, outputID, size)
+}
+
+func TestProcessSkipsStoredBodies(t *testing.T) {
+	cache := &putActionCache{SimpleDiskCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+	_, res := serve(t, NewCacheProc(cache), putRequest(1, "a1", "hello"))
+	require.Empty(t, res[1].Err)
+	assert.Zero(t, cache.putActions.Load())
+
+	// The output of a2 is already stored, under a1.
+	_, res = serve(t, NewCacheProc(cache), putRequest(2, "a2", "hello"), putRequest(3, "a3", "world"))
+	require.Empty(t, res[2].Err)
+	require.Empty(t, res[3].Err)
+	assert.Equal(t, int32(1), cache.putActions.Load())
+	got, err := os.ReadFile(res[2].DiskPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	outputID, _, err := cache.Get(context.Background(), hex.EncodeToString([]byte("a2")))
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte("hello"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), outputID)
+}
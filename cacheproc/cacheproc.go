@@ -8,119 +8,548 @@ package cacheproc
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bradfitz/go-tool-cache/cachers"
 	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/bradfitz/go-tool-cache/internal/trace"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/bradfitz/go-tool-cache/wire"
 )
 
-type cacherCtxKey string
-
 var (
 	ErrUnknownCommand = errors.New("unknown command")
 	ErrNoOutputID     = errors.New("no outputID")
-	requestIDKey      = cacherCtxKey("requestID")
+	ErrClosed         = errors.New("cache is closed")
+	ErrTimeout        = errors.New("timed out")
+	// ErrProtocol wraps the errors of Serve about what it reads not being
+	// requests of the protocol.
+	ErrProtocol = errors.New("protocol error")
 )
 
+// A protocolError is an error that is an ErrProtocol, with the message of
+// the error it wraps.
+type protocolError struct{ err error }
+
+func (e protocolError) Error() string   { return e.err.Error() }
+func (e protocolError) Unwrap() []error { return []error{ErrProtocol, e.err} }
+
 // Process implements the cmd/go JSON protocol over stdin & stdout via three
 // funcs that callers can optionally implement.
 type Process struct {
-	cache    cachers.LocalCache
+	cache    Handler
 	closer   sync.Once
 	errClose error
+
+	// handlers are the commands the process advertises to cmd/go.
+	handlers map[wire.Cmd]cmdHandler
+	// maxConcurrency, if positive, bounds the requests handled at once.
+	maxConcurrency int
+	// Put bodies larger than spoolThreshold are spooled to temporary
+	// files in spoolDir (or the default directory for temporary files).
+	spoolDir       string
+	spoolThreshold int64
+	// timeouts bound the handling of each command.
+	timeouts map[wire.Cmd]time.Duration
+	// shared is set if the caller starts and closes the cache.
+	shared bool
+	// recorder, if non-nil, records the session.
+	recorder *recorder
+	// pressure tracks whether the disk is short of space.
+	pressure diskPressure
+	// errorMode controls how failed requests are answered.
+	errorMode ErrorMode
+	// onPanic, if non-nil, is told of the panics of the handlers.
+	onPanic func(cmd wire.Cmd, v any, stack []byte)
+
+	// inflight tracks the get and put requests being handled, which a
+	// close request waits for; active counts them.
+	inflight sync.WaitGroup
+	active   atomic.Int64
+
+	// latency has a histogram of the latencies of each command.
+	latency map[wire.Cmd]*histogram
+
+	gets, hits, misses, getErrors atomic.Int64
+	puts, putErrors               atomic.Int64
+}
+
+// cmdHandler handles one command of the protocol.
+type cmdHandler func(p *Process, ctx context.Context, req *wire.Request, res *wire.Response) error
+
+// allCommands lists the commands Process supports, in the order they are
+// advertised.
+var allCommands = []wire.Cmd{wire.CmdGet, wire.CmdPut, wire.CmdClose}
+
+var handlers = map[wire.Cmd]cmdHandler{
+	wire.CmdGet: (*Process).handleCountedGet,
+	wire.CmdPut: (*Process).handleCountedPut,
+	wire.CmdClose: func(p *Process, _ context.Context, _ *wire.Request, res *wire.Response) error {
+		return p.handleClose(res)
+	},
+}
+
+// Option configures a Process.
+type Option func(*Process)
+
+// WithCommands restricts the commands the process advertises, and answers,
+// to cmds. cmd/go only sends advertised commands and degrades gracefully
+// without them: without "put" it treats the cache as read-only, and
+// without "close" it just closes stdin. Commands the process doesn't
+// support are ignored.
+func WithCommands(cmds ...wire.Cmd) Option {
+	return func(p *Process) {
+		p.handlers = map[wire.Cmd]cmdHandler{}
+		for _, cmd := range cmds {
+			if h, ok := handlers[cmd]; ok {
+				p.handlers[cmd] = h
+			}
+		}
+	}
+}
+
+// WithMaxConcurrency makes the process handle at most n requests at once,
+// protecting slow disks and rate-limited remotes from cmd/go's unbounded
+// parallelism. Further requests are not read until a slot frees up.
+// n <= 0 means no limit.
+func WithMaxConcurrency(n int) Option {
+	return func(p *Process) {
+		p.maxConcurrency = n
+	}
+}
+
+// WithSpool makes the process write put bodies larger than threshold bytes
+// to temporary files in dir while they are handled, instead of holding them
+// in memory, so that memory use stays flat however big the outputs are.
+// An empty dir means the default directory for temporary files; it should
+// not be a RAM-backed file system. The default threshold is
+// DefaultSpoolThreshold.
+func WithSpool(dir string, threshold int64) Option {
+	return func(p *Process) {
+		p.spoolDir = dir
+		p.spoolThreshold = threshold
+	}
+}
+
+// WithTimeout bounds the handling of each cmd request to d. A request
+// that takes longer is answered with ErrTimeout and abandoned, with its
+// context canceled, so that a stuck backend fails the request instead of
+// stalling the build. d <= 0 means no limit, the default.
+func WithTimeout(cmd wire.Cmd, d time.Duration) Option {
+	return func(p *Process) {
+		if p.timeouts == nil {
+			p.timeouts = map[wire.Cmd]time.Duration{}
+		}
+		p.timeouts[cmd] = d
+	}
 }
 
-func NewCacheProc(cache cachers.LocalCache) *Process {
-	return &Process{
-		cache: cache,
+// WithSharedCache makes the process leave starting and closing the cache to
+// the caller, so that several processes, each serving a cmd/go, can share a
+// cache. A close request then only waits for the requests in flight.
+func WithSharedCache() Option {
+	return func(p *Process) {
+		p.shared = true
 	}
 }
 
+// WithPanicHandler makes the process call f with the value and the stack
+// trace of every panic while handling a request, besides logging it, to
+// report crashes that the process otherwise survives.
+func WithPanicHandler(f func(cmd wire.Cmd, v any, stack []byte)) Option {
+	return func(p *Process) {
+		p.onPanic = f
+	}
+}
+
+// NewCacheProc returns a process answering cmd/go's requests with h, which
+// is usually a cachers.LocalCache.
+func NewCacheProc(h Handler, opts ...Option) *Process {
+	p := &Process{
+		cache:          h,
+		handlers:       handlers,
+		spoolThreshold: DefaultSpoolThreshold,
+		latency:        map[wire.Cmd]*histogram{},
+	}
+	for _, cmd := range allCommands {
+		p.latency[cmd] = new(histogram)
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// KnownCommands returns the commands the process advertises.
+func (p *Process) KnownCommands() []wire.Cmd {
+	var cmds []wire.Cmd
+	for _, cmd := range allCommands {
+		if _, ok := p.handlers[cmd]; ok {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// Run serves the protocol over stdin and stdout.
 func (p *Process) Run(ctx context.Context) error {
-	br := bufio.NewReader(os.Stdin)
-	jd := json.NewDecoder(br)
+	return p.Serve(ctx, os.Stdin, os.Stdout)
+}
+
+// Serve serves the protocol, reading requests from r and writing
+// responses to w, until r is exhausted or ctx is done. When ctx is done,
+// no new requests are read, but the ones in flight are finished and the
+// cache is closed before Serve returns.
+func (p *Process) Serve(ctx context.Context, r io.Reader, w io.Writer) (retErr error) {
+	br := bufio.NewReader(r)
 
-	bw := bufio.NewWriter(os.Stdout)
+	bw := bufio.NewWriter(w)
 	je := json.NewEncoder(bw)
-	caps := []wire.Cmd{"get", "put", "close"}
-	if err := je.Encode(&wire.Response{KnownCommands: caps}); err != nil {
+	hello := &wire.Response{KnownCommands: p.KnownCommands()}
+	if err := je.Encode(hello); err != nil {
 		return err
 	}
+	if p.recorder != nil {
+		p.recorder.response(hello)
+	}
 	if err := bw.Flush(); err != nil {
 		return err
 	}
 
 	var wmu sync.Mutex // guards writing responses
 
-	wg, ctx := errgroup.WithContext(ctx)
-	if err := p.cache.Start(ctx); err != nil {
-		return err
+	// Stopping, by ctx, must not cancel the requests in flight.
+	stop := ctx.Done()
+	wg, ctx := errgroup.WithContext(context.WithoutCancel(ctx))
+	if p.maxConcurrency > 0 {
+		wg.SetLimit(p.maxConcurrency)
+	}
+	if s, ok := p.cache.(starter); ok && !p.shared {
+		if err := s.Start(ctx); err != nil {
+			return err
+		}
 	}
+	failed := make(chan error, 1) // ends the session in strict error mode
 	defer func() {
-		_ = p.close()
+		// Let in-flight requests finish before closing the cache under them.
 		_ = wg.Wait()
+		_ = p.close()
+		if retErr == nil {
+			select {
+			case retErr = <-failed:
+			default:
+			}
+		}
 	}()
+	// Reading can't be interrupted, so it runs on its own and is abandoned
+	// if ctx is done first.
+	reqs := make(chan *wire.Request)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		readErr <- p.readRequests(ctx, br, reqs, done)
+	}()
+	closed := false // a close request was read
 	for {
-		var req wire.Request
-		if err := jd.Decode(&req); err != nil {
+		var req *wire.Request
+		select {
+		case <-stop:
+			return nil
+		case err := <-failed:
+			return err
+		case err := <-readErr:
 			if errors.Is(err, io.EOF) {
 				return nil
 			}
 			return err
+		case req = <-reqs:
 		}
-		if req.Command == wire.CmdPut && req.BodySize > 0 {
-			// TODO(bradfitz): stream this and pass a checksum-validating
-			// io.Reader that validates on EOF.
-			var bodyb []byte
-			if err := jd.Decode(&bodyb); err != nil {
-				log.Fatal(err)
-			}
-			if int64(len(bodyb)) != req.BodySize {
-				log.Fatalf("only got %d bytes of declared %d", len(bodyb), req.BodySize)
-			}
-			req.Body = sbytes.NewBuffer(bodyb)
+		start := time.Now()
+		if p.recorder != nil {
+			p.recorder.request(req)
+		}
+		// Requests read after a close are refused, even if they would be
+		// handled before it.
+		refused := closed && req.Command != wire.CmdClose
+		switch {
+		case req.Command == wire.CmdClose:
+			closed = true
+		case !refused:
+			p.inflight.Add(1)
+			p.active.Add(1)
 		}
 		wg.Go(func() error {
+			if c, ok := req.Body.(io.Closer); ok {
+				defer c.Close()
+			}
 			res := &wire.Response{ID: req.ID}
-			ctx := context.WithValue(ctx, requestIDKey, &req)
-			if err := p.handleRequest(ctx, &req, res); err != nil {
-				res.Err = err.Error()
+			ctx := cachers.WithRequestID(ctx, req.ID)
+			ctx, span := trace.Start(ctx, "gocacheprog "+string(req.Command), trace.Server, requestAttrs(req)...)
+			if refused {
+				res.Err = ErrClosed.Error()
+				span.End(ErrClosed)
+			} else {
+				if req.Command != wire.CmdClose {
+					defer p.inflight.Done()
+					defer p.active.Add(-1)
+				}
+				err := p.handleRequest(ctx, req, res)
+				if req.Command == wire.CmdGet && err == nil {
+					span.SetAttrs(trace.Bool("gocacheprog.hit", !res.Miss))
+				}
+				span.End(err)
+				if err != nil {
+					if err := p.answerError(req, res, err); err != nil {
+						select {
+						case failed <- err:
+						default:
+						}
+						return nil
+					}
+				}
 			}
 			wmu.Lock()
 			defer wmu.Unlock()
+			if p.recorder != nil {
+				p.recorder.response(res)
+			}
 			_ = je.Encode(res)
 			_ = bw.Flush()
+			if !refused {
+				elapsed := time.Since(start)
+				if h := p.latency[req.Command]; h != nil {
+					h.observe(elapsed)
+				}
+				logRequest(ctx, req, res, elapsed)
+			}
 			return nil
 		})
 	}
 }
 
-func (p *Process) handleRequest(ctx context.Context, req *wire.Request, res *wire.Response) error {
-	switch req.Command {
+// requestAttrs returns the attributes of the span of req.
+func requestAttrs(req *wire.Request) []trace.Attr {
+	attrs := []trace.Attr{trace.Int("gocacheprog.request_id", req.ID)}
+	if req.ActionID != nil {
+		attrs = append(attrs, trace.String("gocacheprog.action_id", hex.EncodeToString(req.ActionID)))
+	}
+	if req.Command == wire.CmdPut {
+		attrs = append(attrs, trace.Int("gocacheprog.body_size", req.BodySize))
+	}
+	return attrs
+}
+
+// logRequest logs the answer res to req, which took elapsed, as one debug
+// event per request.
+func logRequest(ctx context.Context, req *wire.Request, res *wire.Response, elapsed time.Duration) {
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := []any{"command", req.Command}
+	if len(req.ActionID) > 0 {
+		attrs = append(attrs, "action", fmt.Sprintf("%x", req.ActionID))
+	}
+	switch {
+	case res.Err != "":
+		attrs = append(attrs, "outcome", "error", "err", res.Err)
+	case req.Command == wire.CmdGet && res.Miss:
+		attrs = append(attrs, "outcome", "miss")
+	case req.Command == wire.CmdGet:
+		attrs = append(attrs, "outcome", "hit", "output", fmt.Sprintf("%x", res.OutputID), "size", res.Size)
+	case req.Command == wire.CmdPut:
+		attrs = append(attrs, "outcome", "stored", "output", fmt.Sprintf("%x", req.OutputID), "size", req.BodySize)
 	default:
+		attrs = append(attrs, "outcome", "ok")
+	}
+	attrs = append(attrs, "elapsed", elapsed)
+	slog.DebugContext(ctx, "request", attrs...)
+}
+
+// answerError answers req, which failed with err, according to the error
+// mode. In strict mode, failed gets and puts are left unanswered and the
+// error ending the session is returned instead.
+func (p *Process) answerError(req *wire.Request, res *wire.Response, err error) error {
+	if req.Command == wire.CmdGet || req.Command == wire.CmdPut {
+		switch p.errorMode {
+		case ErrorsStrict:
+			return fmt.Errorf("%s %d failed in strict error mode: %w", req.Command, req.ID, err)
+		case ErrorsDegrade:
+			if req.Command == wire.CmdGet {
+				// The failure has been logged as a warning.
+				res.Miss = true
+				return nil
+			}
+		}
+	}
+	res.Err = err.Error()
+	return nil
+}
+
+// readRequests reads requests, one JSON object per line, with their
+// bodies, and sends them to reqs until reading fails or done is closed.
+func (p *Process) readRequests(ctx context.Context, br *bufio.Reader, reqs chan<- *wire.Request, done <-chan struct{}) error {
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				return err
+			}
+			continue // the newline after a body
+		}
+		req := new(wire.Request)
+		if err := json.Unmarshal(line, req); err != nil {
+			return protocolError{err}
+		}
+		if req.OutputID == nil {
+			// Sent by the go commands that predate Go 1.24.
+			req.OutputID = req.ObjectID
+		}
+		if req.Command == wire.CmdPut && req.BodySize > 0 {
+			if req.Body, err = p.readPutBody(ctx, br, req); err != nil {
+				return err
+			}
+		}
+		select {
+		case reqs <- req:
+		case <-done:
+			if c, ok := req.Body.(io.Closer); ok {
+				c.Close()
+			}
+			return nil
+		}
+	}
+}
+
+func (p *Process) handleRequest(ctx context.Context, req *wire.Request, res *wire.Response) error {
+	h, ok := p.handlers[req.Command]
+	if !ok {
 		return ErrUnknownCommand
-	case "close":
-		return p.close()
-	case "get":
-		return p.handleGet(ctx, req, res)
-	case "put":
-		return p.handlePut(ctx, req, res)
+	}
+	d := p.timeouts[req.Command]
+	if d <= 0 {
+		return p.recovering(ctx, req, func() error { return h(p, ctx, req, res) })
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	// An abandoned handler must not write to res while it is sent, so it
+	// gets a response of its own.
+	hres := &wire.Response{ID: req.ID}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.recovering(ctx, req, func() error { return h(p, ctx, req, hres) })
+	}()
+	select {
+	case err := <-errc:
+		*res = *hres
+		return err
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "request timed out", "command", req.Command, "timeout", d)
+		return fmt.Errorf("%s: %w after %v", req.Command, ErrTimeout, d)
+	}
+}
+
+// recovering returns the result of f, or an error if f panics. A panic
+// while handling a request fails only that request; it is logged with its
+// stack trace and passed to the panic handler, if any, and the process
+// carries on.
+func (p *Process) recovering(ctx context.Context, req *wire.Request, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			slog.ErrorContext(ctx, "panic", "command", req.Command, "panic", r, "stack", string(stack))
+			if p.onPanic != nil {
+				p.onPanic(req.Command, r, stack)
+			}
+			err = fmt.Errorf("%s: panic: %v", req.Command, r)
+		}
+	}()
+	return f()
+}
+
+func (p *Process) handleCountedGet(ctx context.Context, req *wire.Request, res *wire.Response) error {
+	// Recover here too, so that panics are counted as errors.
+	err := p.recovering(ctx, req, func() error { return p.handleGet(ctx, req, res) })
+	p.gets.Add(1)
+	switch {
+	case err != nil:
+		p.getErrors.Add(1)
+	case res.Miss:
+		p.misses.Add(1)
+	default:
+		p.hits.Add(1)
+	}
+	return err
+}
+
+func (p *Process) handleCountedPut(ctx context.Context, req *wire.Request, res *wire.Response) error {
+	err := p.recovering(ctx, req, func() error { return p.handlePut(ctx, req, res) })
+	p.puts.Add(1)
+	if err != nil {
+		p.putErrors.Add(1)
+	}
+	return err
+}
+
+// handleClose waits for the requests in flight, then closes the cache,
+// which flushes its pending work, and reports what was served.
+func (p *Process) handleClose(res *wire.Response) error {
+	p.inflight.Wait()
+	err := p.close()
+	for _, cmd := range []wire.Cmd{wire.CmdGet, wire.CmdPut} {
+		if l := p.latency[cmd].latencies(); l.Count > 0 {
+			slog.Debug("latencies", "command", cmd, "count", l.Count, "p50", l.P50, "p95", l.P95, "p99", l.P99)
+		}
+	}
+	stats := p.Stats()
+	res.Stats = &stats
+	return err
+}
+
+// InFlight returns the number of get and put requests being handled.
+func (p *Process) InFlight() int64 {
+	return p.active.Load()
+}
+
+// Stats returns the counts of the requests served so far.
+func (p *Process) Stats() wire.Stats {
+	return wire.Stats{
+		Gets:      p.gets.Load(),
+		Hits:      p.hits.Load(),
+		Misses:    p.misses.Load(),
+		GetErrors: p.getErrors.Load(),
+		Puts:      p.puts.Load(),
+		PutErrors: p.putErrors.Load(),
 	}
 }
 
 func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
-	outputID, diskPath, err := p.cache.Get(ctx, fmt.Sprintf("%x", req.ActionID))
+	actionID := fmt.Sprintf("%x", req.ActionID)
+	defer func() {
+		if retErr != nil {
+			slog.WarnContext(ctx, "get failed", "action", actionID, "err", retErr)
+		}
+	}()
+	outputID, diskPath, err := p.cache.Get(ctx, actionID)
+	if p.pressure.failed(err) {
+		// A hit that couldn't be stored locally is as good as a miss.
+		slog.DebugContext(ctx, "get failed for lack of space; answering a miss", "action", actionID, "err", err)
+		res.Miss = true
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -157,17 +586,59 @@ func (p *Process) handlePut(ctx context.Context, req *wire.Request, res *wire.Re
 	actionID, outputID := fmt.Sprintf("%x", req.ActionID), fmt.Sprintf("%x", req.OutputID)
 	defer func() {
 		if retErr != nil {
-			log.Printf("put(action %s, obj %s, %v bytes): %v", actionID, outputID, req.BodySize, retErr)
+			slog.WarnContext(ctx, "put failed", "action", actionID, "output", outputID, "size", req.BodySize, "err", retErr)
 		}
 	}()
+	switch req.Body.(type) {
+	case storedBody:
+		return p.handleStoredPut(ctx, req, res, actionID, outputID)
+	case refusedBody:
+		return ErrDiskPressure
+	}
 	var body = req.Body
 	if body == nil {
 		body = sbytes.NewBuffer(nil)
 	}
+	// A body that doesn't match its ID, from a corrupted pipe or a buggy
+	// client, must not be recorded, here or remotely. Bodies read by the
+	// process are checked upfront, keeping their types, which the caches
+	// use to write them to several tiers at once.
+	var err error
+	switch b := body.(type) {
+	case *sbytes.Buffer:
+		// The caches are done with the body once Put returns, and its
+		// slice, if read by the process, is reused for the next ones.
+		defer sbytes.Put(b.Bytes())
+		err = cachers.VerifyOutput(b.Bytes(), outputID)
+	case *spoolFile:
+		err = cachers.VerifyOutputHash(b.sum, outputID)
+	default:
+		body = cachers.NewVerifyingReader(body, outputID)
+	}
+	if err != nil {
+		return err
+	}
 	diskPath, err := p.cache.Put(ctx, actionID, outputID, req.BodySize, body)
 	if err != nil {
+		p.pressure.failed(err)
 		return err
 	}
+	return checkPut(req, res, diskPath)
+}
+
+// handleStoredPut handles a put of an output the cache already stores,
+// whose body was skipped.
+func (p *Process) handleStoredPut(ctx context.Context, req *wire.Request, res *wire.Response, actionID, outputID string) error {
+	diskPath, err := p.cache.(cachers.LocalOutputStore).PutAction(ctx, actionID, outputID, req.BodySize)
+	if err != nil {
+		return err
+	}
+	return checkPut(req, res, diskPath)
+}
+
+// checkPut checks that the put of req stored its output at diskPath, and
+// answers with it.
+func checkPut(req *wire.Request, res *wire.Response, diskPath string) error {
 	fi, err := os.Stat(diskPath)
 	if err != nil {
 		return fmt.Errorf("stat after successful Put: %w", err)
@@ -180,10 +651,13 @@ func (p *Process) handlePut(ctx context.Context, req *wire.Request, res *wire.Re
 }
 
 func (p *Process) close() error {
+	if p.shared {
+		return nil
+	}
 	p.closer.Do(func() {
 		p.errClose = p.cache.Close()
 		if p.errClose != nil {
-			log.Printf("cache stop failed: %v", p.errClose)
+			slog.Error("cache stop failed", "err", p.errClose)
 		}
 	})
 	return p.errClose
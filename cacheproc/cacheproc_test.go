@@ -0,0 +1,413 @@
+package cacheproc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/internal/trace"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a Process over the given requests and returns its responses
+// by ID, along with the advertised commands.
+func serve(t *testing.T, p *Process, reqs ...*wire.Request) ([]wire.Cmd, map[int64]*wire.Response) {
+	t.Helper()
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for _, req := range reqs {
+		require.NoError(t, enc.Encode(req))
+		if req.BodySize > 0 {
+			var body bytes.Buffer
+			_, err := body.ReadFrom(req.Body)
+			require.NoError(t, err)
+			require.NoError(t, enc.Encode(body.Bytes()))
+		}
+	}
+	var out bytes.Buffer
+	require.NoError(t, p.Serve(context.Background(), &in, &out))
+
+	responses := map[int64]*wire.Response{}
+	var known []wire.Cmd
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		res := new(wire.Response)
+		require.NoError(t, json.Unmarshal(sc.Bytes(), res))
+		if res.ID == 0 {
+			known = res.KnownCommands
+			continue
+		}
+		responses[res.ID] = res
+	}
+	return known, responses
+}
+
+func putRequest(id int64, actionID, body string) *wire.Request {
+	outputID := sha256.Sum256([]byte(body))
+	return &wire.Request{
+		ID:       id,
+		Command:  wire.CmdPut,
+		ActionID: []byte(actionID),
+		OutputID: outputID[:],
+		Body:     strings.NewReader(body),
+		BodySize: int64(len(body)),
+	}
+}
+
+func TestProcessCommands(t *testing.T) {
+	t.Run("all", func(t *testing.T) {
+		p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+		known, res := serve(t, p,
+			putRequest(1, "action", "hello"),
+			&wire.Request{ID: 2, Command: wire.CmdClose},
+		)
+		assert.Equal(t, []wire.Cmd{wire.CmdGet, wire.CmdPut, wire.CmdClose}, known)
+		assert.Empty(t, res[1].Err)
+		assert.NotEmpty(t, res[1].DiskPath)
+		assert.Equal(t, &wire.Stats{Puts: 1}, res[2].Stats)
+	})
+	t.Run("restricted", func(t *testing.T) {
+		p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()), WithCommands(wire.CmdGet, wire.CmdClose, "get2"))
+		known, res := serve(t, p,
+			putRequest(1, "action", "hello"),
+			&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("action")},
+		)
+		assert.Equal(t, []wire.Cmd{wire.CmdGet, wire.CmdClose}, known)
+		assert.Equal(t, ErrUnknownCommand.Error(), res[1].Err)
+		assert.True(t, res[2].Miss)
+	})
+}
+
+func TestProcessRefusesRequestsAfterClose(t *testing.T) {
+	p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+	_, res := serve(t, p,
+		&wire.Request{ID: 1, Command: wire.CmdClose},
+		&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("action")},
+	)
+	assert.Empty(t, res[1].Err)
+	assert.Equal(t, ErrClosed.Error(), res[2].Err)
+}
+
+func TestProcessProtocolErrors(t *testing.T) {
+	for _, in := range []string{
+		"not json\n",
+		`{"ID":1,"Command":"put","BodySize":3}` + "\n" + `x"AAAA"` + "\n",
+	} {
+		p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+		err := p.Serve(context.Background(), strings.NewReader(in), io.Discard)
+		assert.ErrorIs(t, err, ErrProtocol, in)
+	}
+}
+
+func TestProcessStopsOnContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe() // never closed, like the stdin of a stuck cmd/go
+	defer pw.Close()
+	var out bytes.Buffer
+	p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+	done := make(chan error)
+	go func() { done <- p.Serve(ctx, pr, &out) }()
+
+	req := putRequest(1, "action", "hello")
+	enc := json.NewEncoder(pw)
+	require.NoError(t, enc.Encode(req))
+	require.NoError(t, enc.Encode([]byte("hello")))
+	assert.Eventually(t, func() bool { return p.Stats().Puts == 1 }, time.Second, time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't stop")
+	}
+	assert.Contains(t, out.String(), `"ID":1,"DiskPath"`)
+}
+
+// countingCache is a LocalCache that records how many gets run at once.
+type countingCache struct {
+	cachers.LocalCache
+	running, peak atomic.Int32
+}
+
+func (c *countingCache) Get(ctx context.Context, actionID string) (string, string, error) {
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+	for {
+		p := c.peak.Load()
+		if n <= p || c.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return c.LocalCache.Get(ctx, actionID)
+}
+
+func TestProcessMaxConcurrency(t *testing.T) {
+	cache := &countingCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+	var reqs []*wire.Request
+	for i := int64(1); i <= 20; i++ {
+		reqs = append(reqs, &wire.Request{ID: i, Command: wire.CmdGet, ActionID: []byte("action")})
+	}
+	_, res := serve(t, NewCacheProc(cache, WithMaxConcurrency(3)), reqs...)
+	assert.Len(t, res, 20)
+	assert.LessOrEqual(t, cache.peak.Load(), int32(3))
+}
+
+// requestIDCache is a LocalCache that records the request ID of each get.
+type requestIDCache struct {
+	cachers.LocalCache
+	ids sync.Map // actionID -> request ID
+}
+
+func (c *requestIDCache) Get(ctx context.Context, actionID string) (string, string, error) {
+	if id, ok := cachers.RequestID(ctx); ok {
+		c.ids.Store(actionID, id)
+	}
+	return c.LocalCache.Get(ctx, actionID)
+}
+
+func TestProcessRequestIDs(t *testing.T) {
+	cache := &requestIDCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+	serve(t, NewCacheProc(cache),
+		&wire.Request{ID: 7, Command: wire.CmdGet, ActionID: []byte{0xaa}},
+		&wire.Request{ID: 9, Command: wire.CmdGet, ActionID: []byte{0xbb}},
+	)
+	for actionID, want := range map[string]int64{"aa": 7, "bb": 9} {
+		id, ok := cache.ids.Load(actionID)
+		require.True(t, ok, actionID)
+		assert.Equal(t, want, id, actionID)
+	}
+}
+
+func TestProcessLogsRequests(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+	serve(t, p,
+		&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte{0xaa}},
+		putRequest(2, "action", "hello"),
+	)
+	events := map[string]map[string]any{}
+	sc := bufio.NewScanner(&logs)
+	for sc.Scan() {
+		var ev map[string]any
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &ev))
+		if ev["msg"] == "request" {
+			events[ev["command"].(string)] = ev
+		}
+	}
+	require.Len(t, events, 2)
+	assert.Equal(t, "aa", events["get"]["action"])
+	assert.Equal(t, "miss", events["get"]["outcome"])
+	assert.Equal(t, "stored", events["put"]["outcome"])
+	assert.Equal(t, float64(5), events["put"]["size"])
+	assert.Contains(t, events["put"], "elapsed")
+}
+
+// panickyCache is a LocalCache whose gets of "bad" panic.
+type panickyCache struct {
+	cachers.LocalCache
+}
+
+func (c *panickyCache) Get(ctx context.Context, actionID string) (string, string, error) {
+	if actionID == hex.EncodeToString([]byte("bad")) {
+		panic("corrupt index")
+	}
+	return c.LocalCache.Get(ctx, actionID)
+}
+
+func TestProcessRecoversPanics(t *testing.T) {
+	p := NewCacheProc(&panickyCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())})
+	_, res := serve(t, p,
+		&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte("bad")},
+		&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("good")},
+		&wire.Request{ID: 3, Command: wire.CmdClose},
+	)
+	assert.Equal(t, "get: panic: corrupt index", res[1].Err)
+	assert.Empty(t, res[2].Err)
+	assert.True(t, res[2].Miss)
+	assert.Equal(t, &wire.Stats{Gets: 2, Misses: 1, GetErrors: 1}, res[3].Stats)
+
+	t.Run("handler", func(t *testing.T) {
+		var panics []any
+		p := NewCacheProc(&panickyCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())},
+			WithPanicHandler(func(cmd wire.Cmd, v any, stack []byte) {
+				assert.Equal(t, wire.CmdGet, cmd)
+				assert.Contains(t, string(stack), "panickyCache")
+				panics = append(panics, v)
+			}))
+		serve(t, p,
+			&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte("bad")},
+			&wire.Request{ID: 2, Command: wire.CmdClose},
+		)
+		assert.Equal(t, []any{"corrupt index"}, panics)
+	})
+}
+
+// stuckCache is a LocalCache whose gets of "stuck" block, whatever their
+// context, until unblock is closed.
+type stuckCache struct {
+	cachers.LocalCache
+	unblock chan struct{}
+}
+
+func (c *stuckCache) Get(ctx context.Context, actionID string) (string, string, error) {
+	if actionID == hex.EncodeToString([]byte("stuck")) {
+		<-c.unblock
+	}
+	return c.LocalCache.Get(ctx, actionID)
+}
+
+func TestProcessTimeouts(t *testing.T) {
+	cache := &stuckCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir()), unblock: make(chan struct{})}
+	defer close(cache.unblock)
+	p := NewCacheProc(cache, WithTimeout(wire.CmdGet, 20*time.Millisecond), WithTimeout(wire.CmdPut, 0))
+	_, res := serve(t, p,
+		&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte("stuck")},
+		&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("fine")},
+		putRequest(3, "a3", "hello"),
+		&wire.Request{ID: 4, Command: wire.CmdClose},
+	)
+	assert.Equal(t, "get: timed out after 20ms", res[1].Err)
+	assert.Empty(t, res[2].Err)
+	assert.True(t, res[2].Miss)
+	assert.Empty(t, res[3].Err)
+	assert.NotEmpty(t, res[3].DiskPath)
+	assert.Empty(t, res[4].Err)
+}
+
+// lifecycleCache is a LocalCache that counts its starts and closes.
+type lifecycleCache struct {
+	cachers.LocalCache
+	starts, closes atomic.Int32
+}
+
+func (c *lifecycleCache) Start(ctx context.Context) error {
+	c.starts.Add(1)
+	return c.LocalCache.Start(ctx)
+}
+
+func (c *lifecycleCache) Close() error {
+	c.closes.Add(1)
+	return c.LocalCache.Close()
+}
+
+func TestProcessSharedCache(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		t.Run(fmt.Sprint(shared), func(t *testing.T) {
+			cache := &lifecycleCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+			var opts []Option
+			if shared {
+				opts = append(opts, WithSharedCache())
+			}
+			_, res := serve(t, NewCacheProc(cache, opts...),
+				putRequest(1, "a1", "hello"),
+				&wire.Request{ID: 2, Command: wire.CmdClose},
+			)
+			assert.Empty(t, res[1].Err)
+			assert.Empty(t, res[2].Err)
+			want := int32(1)
+			if shared {
+				want = 0
+			}
+			assert.Equal(t, want, cache.starts.Load())
+			assert.Equal(t, want, cache.closes.Load())
+		})
+	}
+}
+
+func TestProcessExperimentalProtocol(t *testing.T) {
+	// Before Go 1.24, puts named the output ID ObjectID.
+	req := putRequest(1, "a1", "hello")
+	req.ObjectID, req.OutputID = req.OutputID, nil
+	cache := cachers.NewSimpleDiskCache(false, t.TempDir())
+	_, res := serve(t, NewCacheProc(cache),
+		req,
+		&wire.Request{ID: 2, Command: wire.CmdClose},
+	)
+	require.Empty(t, res[1].Err)
+
+	require.NoError(t, cache.Start(context.Background()))
+	outputID, _, err := cache.Get(context.Background(), hex.EncodeToString([]byte("a1")))
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(req.ObjectID), outputID)
+}
+
+func TestProcessRejectsCorruptPuts(t *testing.T) {
+	for _, threshold := range []int64{DefaultSpoolThreshold, 1} {
+		t.Run(fmt.Sprint(threshold), func(t *testing.T) {
+			cache := cachers.NewSimpleDiskCache(false, t.TempDir())
+			bad := putRequest(1, "a1", "hello")
+			bad.Body = strings.NewReader("hellO")
+			_, res := serve(t, NewCacheProc(cache, WithSpool(t.TempDir(), threshold)),
+				bad,
+				putRequest(2, "a2", "hello"),
+				&wire.Request{ID: 3, Command: wire.CmdClose},
+			)
+			assert.Contains(t, res[1].Err, "output does not match its ID")
+			assert.Empty(t, res[2].Err)
+			assert.Equal(t, &wire.Stats{Puts: 2, PutErrors: 1}, res[3].Stats)
+
+			require.NoError(t, cache.Start(context.Background()))
+			outputID, _, err := cache.Get(context.Background(), hex.EncodeToString([]byte("a1")))
+			require.NoError(t, err)
+			assert.Empty(t, outputID)
+		})
+	}
+}
+
+func TestProcessTracing(t *testing.T) {
+	type span struct {
+		Name, SpanID, ParentSpanID string
+	}
+	var (
+		mu    sync.Mutex
+		spans []span
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct{ Spans []span }
+			}
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+	tracer := trace.NewTracer(trace.Config{Endpoint: collector.URL})
+
+	var in, out bytes.Buffer
+	require.NoError(t, json.NewEncoder(&in).Encode(&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte("a1")}))
+	p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+	require.NoError(t, p.Serve(trace.WithTracer(context.Background(), tracer), &in, &out))
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	require.Len(t, spans, 2)
+	assert.Equal(t, "disk get", spans[0].Name)
+	assert.Equal(t, "gocacheprog get", spans[1].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+}
@@ -0,0 +1,44 @@
+package cacheproc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrorMode controls how the process answers requests the cache fails.
+type ErrorMode int
+
+const (
+	// ErrorsReport answers failed requests with their error, the default.
+	// cmd/go treats a failed get as a miss and carries on after a failed
+	// put, quietly.
+	ErrorsReport ErrorMode = iota
+	// ErrorsStrict ends the session on the first failed get or put,
+	// without answering it, which makes cmd/go fail the build.
+	ErrorsStrict
+	// ErrorsDegrade answers failed gets as misses, with a warning. Failed
+	// puts are answered with their error, as there is nothing else to
+	// answer them with.
+	ErrorsDegrade
+)
+
+// ParseErrorMode parses "report", "strict" or "degrade". The empty string
+// is ErrorsReport.
+func ParseErrorMode(s string) (ErrorMode, error) {
+	switch strings.ToLower(s) {
+	case "", "report":
+		return ErrorsReport, nil
+	case "strict":
+		return ErrorsStrict, nil
+	case "degrade":
+		return ErrorsDegrade, nil
+	}
+	return 0, fmt.Errorf("unknown error mode %q", s)
+}
+
+// WithErrorMode sets how the process answers requests the cache fails.
+func WithErrorMode(mode ErrorMode) Option {
+	return func(p *Process) {
+		p.errorMode = mode
+	}
+}
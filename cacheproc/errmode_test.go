@@ -0,0 +1,50 @@
+package cacheproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorMode(t *testing.T) {
+	for s, want := range map[string]ErrorMode{"": ErrorsReport, "report": ErrorsReport, "Strict": ErrorsStrict, "degrade": ErrorsDegrade} {
+		got, err := ParseErrorMode(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	_, err := ParseErrorMode("lenient")
+	assert.Error(t, err)
+}
+
+func TestProcessDegradeErrorMode(t *testing.T) {
+	p := NewCacheProc(&panickyCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}, WithErrorMode(ErrorsDegrade))
+	_, res := serve(t, p,
+		&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte("bad")},
+		&wire.Request{ID: 2, Command: wire.CmdClose},
+	)
+	assert.Empty(t, res[1].Err)
+	assert.True(t, res[1].Miss)
+	assert.Equal(t, &wire.Stats{Gets: 1, GetErrors: 1}, res[2].Stats)
+}
+
+func TestProcessStrictErrorMode(t *testing.T) {
+	p := NewCacheProc(&panickyCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}, WithErrorMode(ErrorsStrict))
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	require.NoError(t, enc.Encode(&wire.Request{ID: 1, Command: wire.CmdGet, ActionID: []byte("bad")}))
+	var out bytes.Buffer
+	err := p.Serve(context.Background(), &in, &out)
+	assert.ErrorContains(t, err, "get 1 failed in strict error mode: get: panic: corrupt index")
+
+	// The failed get is left unanswered, so that cmd/go fails the build.
+	dec := json.NewDecoder(&out)
+	var hello wire.Response
+	require.NoError(t, dec.Decode(&hello))
+	assert.False(t, dec.More())
+}
@@ -0,0 +1,41 @@
+package cacheproc
+
+import (
+	"context"
+	"io"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// A Handler answers the gets and puts of cmd/go, and is closed when it
+// ends the session. Every cachers.LocalCache is a Handler, but tools
+// embedding a GOCACHEPROG server can implement one over any storage.
+//
+// If a Handler also has a Start method, like a cachers.Cache, it is called
+// before the first request is served. A Handler implementing
+// cachers.LocalOutputStore is spared the bodies of the puts of outputs it
+// already stores.
+type Handler interface {
+	// Get returns the output of actionID, and the path of a file on the
+	// local disk holding it, or empty strings if it isn't stored.
+	Get(ctx context.Context, actionID string) (outputID, diskPath string, err error)
+	// Put stores the output of actionID, of the given size, read from body,
+	// and returns the path of a file on the local disk holding it.
+	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error)
+	// Close flushes any pending work, before the process exits.
+	Close() error
+}
+
+var _ Handler = cachers.LocalCache(nil)
+
+// starter is implemented by Handlers that must be started.
+type starter interface {
+	Start(ctx context.Context) error
+}
+
+// Run serves the protocol with h, reading requests from r and writing
+// responses to w, until r is exhausted or ctx is done. It is the same as
+// NewCacheProc(h, opts...).Serve(ctx, r, w).
+func Run(ctx context.Context, h Handler, r io.Reader, w io.Writer, opts ...Option) error {
+	return NewCacheProc(h, opts...).Serve(ctx, r, w)
+}
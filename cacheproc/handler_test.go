@@ -0,0 +1,84 @@
+package cacheproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dirHandler is a minimal Handler, without a Start method, storing
+// outputs as files in dir and actions in memory.
+type dirHandler struct {
+	dir     string
+	mu      sync.Mutex
+	actions map[string]string // actionID -> outputID
+	closed  bool
+}
+
+func (h *dirHandler) Get(ctx context.Context, actionID string) (string, string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	outputID, ok := h.actions[actionID]
+	if !ok {
+		return "", "", nil
+	}
+	return outputID, filepath.Join(h.dir, outputID), nil
+}
+
+func (h *dirHandler) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(h.dir, outputID)
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return "", err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.actions[actionID] = outputID
+	return path, nil
+}
+
+func (h *dirHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	h := &dirHandler{dir: t.TempDir(), actions: map[string]string{}}
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	put := putRequest(1, "a1", "hello")
+	require.NoError(t, enc.Encode(put))
+	require.NoError(t, enc.Encode([]byte("hello")))
+	require.NoError(t, enc.Encode(&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("a1")}))
+	require.NoError(t, enc.Encode(&wire.Request{ID: 3, Command: wire.CmdClose}))
+	var out bytes.Buffer
+	require.NoError(t, Run(context.Background(), h, &in, &out, WithMaxConcurrency(1)))
+
+	dec := json.NewDecoder(&out)
+	responses := map[int64]*wire.Response{}
+	for dec.More() {
+		res := new(wire.Response)
+		require.NoError(t, dec.Decode(res))
+		responses[res.ID] = res
+	}
+	require.Empty(t, responses[1].Err)
+	require.Empty(t, responses[2].Err)
+	assert.False(t, responses[2].Miss)
+	assert.Equal(t, put.OutputID, responses[2].OutputID)
+	assert.Equal(t, int64(5), responses[2].Size)
+	assert.True(t, h.closed)
+}
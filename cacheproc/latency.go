@@ -0,0 +1,90 @@
+package cacheproc
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/wire"
+)
+
+// Latencies are percentiles of the time taken to answer the requests of a
+// command, from when they are read to when their response is written.
+// Each is accurate to within a fifth.
+type Latencies struct {
+	Count         int64
+	P50, P95, P99 time.Duration
+}
+
+func (l Latencies) String() string {
+	return fmt.Sprintf("p50 %v, p95 %v, p99 %v", l.P50, l.P95, l.P99)
+}
+
+const (
+	// latencyMin is the upper bound of the first bucket of a histogram;
+	// every latencySteps buckets the bound doubles, up to over a week.
+	latencyMin     = time.Microsecond
+	latencySteps   = 4
+	latencyBuckets = 40*latencySteps + 1
+)
+
+// histogram counts durations in buckets of exponentially growing size, so
+// that its memory use stays constant however many requests are served.
+type histogram struct {
+	mu      sync.Mutex
+	n       int64
+	buckets [latencyBuckets]int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	if d > latencyMin {
+		i = int(math.Ceil(latencySteps * math.Log2(float64(d)/float64(latencyMin))))
+		i = min(i, latencyBuckets-1)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.n++
+	h.buckets[i]++
+}
+
+// quantile returns the upper bound of the bucket holding the q-quantile,
+// for q in (0, 1], of the durations observed. h.mu must be held.
+func (h *histogram) quantile(q float64) time.Duration {
+	rank := int64(math.Ceil(q * float64(h.n)))
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			return time.Duration(float64(latencyMin) * math.Exp2(float64(i)/latencySteps)).Round(time.Microsecond)
+		}
+	}
+	return 0
+}
+
+func (h *histogram) latencies() Latencies {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.n == 0 {
+		return Latencies{}
+	}
+	return Latencies{
+		Count: h.n,
+		P50:   h.quantile(0.50),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+	}
+}
+
+// Latencies returns the latencies of the requests answered so far, by
+// command. Commands without any are omitted.
+func (p *Process) Latencies() map[wire.Cmd]Latencies {
+	m := map[wire.Cmd]Latencies{}
+	for cmd, h := range p.latency {
+		if l := h.latencies(); l.Count > 0 {
+			m[cmd] = l
+		}
+	}
+	return m
+}
@@ -0,0 +1,53 @@
+package cacheproc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	assert.Equal(t, Latencies{}, h.latencies())
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	l := h.latencies()
+	assert.Equal(t, int64(1000), l.Count)
+	for _, c := range []struct {
+		got, want time.Duration
+	}{
+		{l.P50, 500 * time.Millisecond},
+		{l.P95, 950 * time.Millisecond},
+		{l.P99, 990 * time.Millisecond},
+	} {
+		assert.GreaterOrEqual(t, c.got, c.want)
+		assert.LessOrEqual(t, c.got, c.want*6/5)
+	}
+
+	// Durations out of range land in the first and last buckets.
+	h = histogram{}
+	h.observe(0)
+	h.observe(1000 * time.Hour)
+	l = h.latencies()
+	assert.Equal(t, time.Microsecond, l.P50)
+	assert.Greater(t, l.P99, 100*time.Hour)
+}
+
+func TestProcessLatencies(t *testing.T) {
+	p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+	_, res := serve(t, p,
+		putRequest(1, "a1", "hello"),
+		&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("a2")},
+		&wire.Request{ID: 3, Command: wire.CmdClose},
+	)
+	require.Empty(t, res[1].Err)
+	lat := p.Latencies()
+	assert.Equal(t, int64(1), lat[wire.CmdGet].Count)
+	assert.Equal(t, int64(1), lat[wire.CmdPut].Count)
+	assert.Positive(t, lat[wire.CmdPut].P99)
+}
@@ -0,0 +1,81 @@
+package cacheproc
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrDiskPressure answers the puts refused, without being stored, while
+// the disk is under pressure.
+var ErrDiskPressure = errors.New("not stored: the disk is short of space")
+
+const (
+	// pressureRetry is how long puts are refused after a write failed
+	// for lack of space, before they are tried again.
+	pressureRetry = 10 * time.Second
+	// freeSpaceInterval is how often the free space is checked.
+	freeSpaceInterval = time.Second
+)
+
+// WithMinFreeSpace makes the process refuse puts while the file system of
+// dir, usually that of the cache, has less than min bytes free. Whatever
+// the minimum, puts are refused for a while after one fails for lack of
+// space, and gets that fail for lack of space are answered as misses: the
+// build carries on without the cache rather than failing.
+func WithMinFreeSpace(dir string, min int64) Option {
+	return func(p *Process) {
+		p.pressure.dir = dir
+		p.pressure.min = min
+	}
+}
+
+// diskPressure tracks whether the disk is short of space.
+type diskPressure struct {
+	dir string
+	min int64 // if positive, the free space below which the disk is under pressure
+
+	mu      sync.Mutex
+	until   time.Time // after a write failed for lack of space
+	checked time.Time // of the free space
+	low     bool      // the free space was below min when checked
+	active  bool      // the disk was under pressure when last asked
+}
+
+// high reports whether the disk is under pressure.
+func (d *diskPressure) high() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.min > 0 && now.Sub(d.checked) >= freeSpaceInterval {
+		d.checked = now
+		free, err := FreeSpace(d.dir)
+		if err != nil {
+			slog.Warn("failed to check free space", "dir", d.dir, "err", err)
+		}
+		d.low = err == nil && free < d.min
+	}
+	high := now.Before(d.until) || d.low
+	if high != d.active {
+		d.active = high
+		if high {
+			slog.Warn("disk short of space; refusing puts", "dir", d.dir)
+		} else {
+			slog.Info("disk no longer short of space", "dir", d.dir)
+		}
+	}
+	return high
+}
+
+// failed reports whether err is a failure to write for lack of space, and
+// if so puts the disk under pressure for a while.
+func (d *diskPressure) failed(err error) bool {
+	if err == nil || !isDiskFull(err) {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.until = time.Now().Add(pressureRetry)
+	return true
+}
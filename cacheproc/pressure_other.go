@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package cacheproc
+
+import "errors"
+
+// FreeSpace returns errors.ErrUnsupported: the free space of a file system
+// can't be told on this platform.
+func FreeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func isDiskFull(err error) bool {
+	return false
+}
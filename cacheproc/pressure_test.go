@@ -0,0 +1,66 @@
+//go:build unix
+
+package cacheproc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fullDiskCache fails every get and put for lack of space.
+type fullDiskCache struct {
+	cachers.LocalCache
+	puts atomic.Int32
+}
+
+func (c *fullDiskCache) Get(ctx context.Context, actionID string) (string, string, error) {
+	return "", "", fmt.Errorf("write o-1234: %w", syscall.ENOSPC)
+}
+
+func (c *fullDiskCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	c.puts.Add(1)
+	return "", fmt.Errorf("write o-1234: %w", syscall.ENOSPC)
+}
+
+func TestProcessDiskPressure(t *testing.T) {
+	cache := &fullDiskCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+	p := NewCacheProc(cache, WithSharedCache())
+	_, res := serve(t, p, putRequest(1, "a1", "hello"))
+	assert.Contains(t, res[1].Err, "no space left")
+
+	// The next puts are refused without being tried, and the failed gets
+	// are answered as misses.
+	_, res = serve(t, p,
+		putRequest(2, "a2", "world"),
+		&wire.Request{ID: 3, Command: wire.CmdGet, ActionID: []byte("a1")},
+	)
+	assert.Equal(t, ErrDiskPressure.Error(), res[2].Err)
+	assert.Empty(t, res[3].Err)
+	assert.True(t, res[3].Miss)
+	assert.Equal(t, int32(1), cache.puts.Load())
+}
+
+func TestProcessMinFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	cache := cachers.NewSimpleDiskCache(false, dir)
+	_, res := serve(t, NewCacheProc(cache, WithMinFreeSpace(dir, 1<<62)),
+		putRequest(1, "a1", "hello"),
+		&wire.Request{ID: 2, Command: wire.CmdClose},
+	)
+	assert.Equal(t, ErrDiskPressure.Error(), res[1].Err)
+
+	_, res = serve(t, NewCacheProc(cache, WithMinFreeSpace(dir, 1)),
+		putRequest(1, "a1", "hello"),
+		&wire.Request{ID: 2, Command: wire.CmdClose},
+	)
+	require.Empty(t, res[1].Err)
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package cacheproc
+
+import (
+	"errors"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to unprivileged users in the file
+// system of dir.
+func FreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
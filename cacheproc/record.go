@@ -0,0 +1,167 @@
+package cacheproc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/wire"
+)
+
+// A Record is an entry of a recorded session, written as a JSON object per
+// line: a request from cmd/go, with its body, or a response to one.
+type Record struct {
+	Time     time.Duration  // since the start of the session
+	Request  *wire.Request  `json:",omitempty"`
+	Body     []byte         `json:",omitempty"` // of a put request
+	Response *wire.Response `json:",omitempty"`
+}
+
+// WithRecording makes the process record its session, every request and
+// response, to w, to be replayed with Replay.
+func WithRecording(w io.Writer) Option {
+	return func(p *Process) {
+		p.recorder = &recorder{enc: json.NewEncoder(w)}
+	}
+}
+
+// recorder writes the records of a session.
+type recorder struct {
+	mu    sync.Mutex // guards enc and start
+	enc   *json.Encoder
+	start time.Time
+}
+
+func (r *recorder) write(rec Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	rec.Time = time.Since(r.start)
+	if err := r.enc.Encode(rec); err != nil {
+		slog.Warn("failed to record session", "err", err)
+	}
+}
+
+// request records req. Its body is read and rewound.
+func (r *recorder) request(req *wire.Request) {
+	rec := Record{Request: req}
+	if rs, ok := req.Body.(io.ReadSeeker); ok {
+		b, err := io.ReadAll(rs)
+		if err == nil {
+			_, err = rs.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			slog.Warn("failed to record put body", "err", err)
+		}
+		rec.Body = b
+	}
+	r.write(rec)
+}
+
+func (r *recorder) response(res *wire.Response) {
+	r.write(Record{Response: res})
+}
+
+// ReplayStats are the results of a replay.
+type ReplayStats struct {
+	wire.Stats
+
+	// Requests is the number of requests replayed, and Elapsed how long
+	// they took to be answered.
+	Requests int
+	Elapsed  time.Duration
+	// Changed is the number of responses whose outcome, a hit, a miss or
+	// an error, differs from the recorded one.
+	Changed int
+}
+
+// Replay serves the requests of a session recorded with WithRecording
+// through p, as fast as p answers them, and compares the responses with
+// the recorded ones. p should not have been used before.
+func Replay(ctx context.Context, p *Process, r io.Reader) (*ReplayStats, error) {
+	var (
+		reqs     []Record
+		recorded = map[int64]*wire.Response{}
+	)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		switch {
+		case rec.Request != nil:
+			reqs = append(reqs, rec)
+		case rec.Response != nil && rec.Response.ID != 0:
+			recorded[rec.Response.ID] = rec.Response
+		}
+	}
+
+	inr, inw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(inw)
+		for _, rec := range reqs {
+			if err := enc.Encode(rec.Request); err != nil {
+				return
+			}
+			if rec.Request.BodySize > 0 {
+				if err := enc.Encode(rec.Body); err != nil {
+					return
+				}
+			}
+		}
+		inw.Close()
+	}()
+	outr, outw := io.Pipe()
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		err := p.Serve(ctx, inr, outw)
+		outw.CloseWithError(err)
+		inr.Close()
+		errc <- err
+	}()
+
+	st := &ReplayStats{Requests: len(reqs)}
+	dec = json.NewDecoder(outr)
+	for {
+		res := new(wire.Response)
+		if err := dec.Decode(res); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if want, ok := recorded[res.ID]; ok && outcome(res) != outcome(want) {
+			st.Changed++
+		}
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	st.Elapsed = time.Since(start)
+	st.Stats = p.Stats()
+	return st, nil
+}
+
+// outcome summarizes a response as a hit, a miss or an error.
+func outcome(res *wire.Response) string {
+	switch {
+	case res.Err != "":
+		return "error"
+	case res.Miss:
+		return "miss"
+	default:
+		return "hit"
+	}
+}
@@ -0,0 +1,60 @@
+package cacheproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var rec bytes.Buffer
+	p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()), WithRecording(&rec))
+	serve(t, p,
+		putRequest(1, "a1", "hello"),
+		&wire.Request{ID: 2, Command: wire.CmdGet, ActionID: []byte("a2")},
+		&wire.Request{ID: 3, Command: wire.CmdClose},
+	)
+
+	var records []Record
+	dec := json.NewDecoder(bytes.NewReader(rec.Bytes()))
+	for dec.More() {
+		var r Record
+		require.NoError(t, dec.Decode(&r))
+		records = append(records, r)
+	}
+	require.Len(t, records, 7) // the advertised commands, then 3 requests and their responses
+	assert.Equal(t, allCommands, records[0].Response.KnownCommands)
+	for _, r := range records[1:] {
+		if r.Request != nil && r.Request.Command == wire.CmdPut {
+			assert.Equal(t, "hello", string(r.Body))
+		}
+	}
+
+	t.Run("same", func(t *testing.T) {
+		p := NewCacheProc(cachers.NewSimpleDiskCache(false, t.TempDir()))
+		st, err := Replay(context.Background(), p, bytes.NewReader(rec.Bytes()))
+		require.NoError(t, err)
+		assert.Equal(t, 3, st.Requests)
+		assert.Zero(t, st.Changed)
+		assert.Equal(t, wire.Stats{Gets: 1, Misses: 1, Puts: 1}, st.Stats)
+	})
+	t.Run("changed", func(t *testing.T) {
+		ctx := context.Background()
+		cache := cachers.NewSimpleDiskCache(false, t.TempDir())
+		require.NoError(t, cache.Start(ctx))
+		_, err := cache.Put(ctx, hex.EncodeToString([]byte("a2")), "0123", 3, sbytes.NewBuffer([]byte("abc")))
+		require.NoError(t, err)
+		st, err := Replay(ctx, NewCacheProc(cache), bytes.NewReader(rec.Bytes()))
+		require.NoError(t, err)
+		assert.Equal(t, 1, st.Changed)
+		assert.Equal(t, wire.Stats{Gets: 1, Hits: 1, Puts: 1}, st.Stats)
+	})
+}
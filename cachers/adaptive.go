@@ -0,0 +1,266 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// The defaults of AdaptiveLimits.
+const (
+	DefaultAdaptiveInitial = 8
+	DefaultAdaptiveMax     = 256
+)
+
+const (
+	// adaptiveErrorCut and adaptiveLatencyCut are the factors the limit is
+	// cut by when the remote fails with a congestion error, and when its
+	// latency rises.
+	adaptiveErrorCut   = 0.5
+	adaptiveLatencyCut = 0.75
+	// adaptiveLatencyTolerance is how many times the baseline latency the
+	// smoothed latency may rise to before the limit is cut.
+	adaptiveLatencyTolerance = 2
+	// adaptiveSampleMaxSize is the largest size of the operations whose
+	// latency is sampled; that of larger ones is their transfer time.
+	adaptiveSampleMaxSize = 64 << 10
+)
+
+// AdaptiveLimits bound the number of simultaneous operations of an
+// AdaptiveRemoteCache. Zero values are the defaults.
+type AdaptiveLimits struct {
+	Initial int // the limit to start from, DefaultAdaptiveInitial
+	Min     int // the lowest limit, 1
+	Max     int // the highest limit, DefaultAdaptiveMax
+}
+
+// AdaptiveRemoteCache is a RemoteCache that tunes the number of
+// simultaneous operations it allows on the cache it wraps to what the
+// remote and the network in between can take, additive-increase,
+// multiplicative-decrease: the limit grows by one for every limit
+// operations that succeed while it is reached, and is cut by a factor when
+// an operation fails with a network or throttling error, or when the
+// latency of the small operations rises well above the lowest seen. The
+// operations that started before a cut don't cut it again. A get holds
+// its slot until its output is closed.
+type AdaptiveRemoteCache struct {
+	forwarder
+	min, max int
+	now      func() time.Time // for tests
+
+	mu        sync.Mutex
+	limit     int
+	inFlight  int
+	saturated bool          // whether the limit was reached since it last grew
+	successes int           // since the limit last changed, while saturated
+	smoothed  time.Duration // moving average of the sampled latencies
+	baseline  time.Duration // the lowest smoothed latency, drifting up
+	lastCut   time.Time     // when limit was last cut
+	wake      chan struct{} // closed, and replaced, when a slot frees up
+}
+
+var _ RemoteCache = &AdaptiveRemoteCache{}
+var _ HealthChecker = &AdaptiveRemoteCache{}
+var _ StatsReporter = &AdaptiveRemoteCache{}
+var _ OutputStore = &AdaptiveRemoteCache{}
+var _ BatchChecker = &AdaptiveRemoteCache{}
+
+func NewAdaptiveRemoteCache(cache RemoteCache, limits AdaptiveLimits) *AdaptiveRemoteCache {
+	lo := max(limits.Min, 1)
+	hi := limits.Max
+	if hi <= 0 {
+		hi = DefaultAdaptiveMax
+	}
+	hi = max(hi, lo)
+	initial := limits.Initial
+	if initial <= 0 {
+		initial = DefaultAdaptiveInitial
+	}
+	return &AdaptiveRemoteCache{
+		forwarder: forwarder{cache},
+		min:       lo,
+		max:       hi,
+		now:       time.Now,
+		limit:     min(max(initial, lo), hi),
+		wake:      make(chan struct{}),
+	}
+}
+
+// Limit returns the current limit of simultaneous operations.
+func (c *AdaptiveRemoteCache) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// acquire waits for a slot under the limit, and returns when the
+// operation started.
+func (c *AdaptiveRemoteCache) acquire(ctx context.Context) (time.Time, error) {
+	for {
+		c.mu.Lock()
+		if c.inFlight < c.limit {
+			c.inFlight++
+			if c.inFlight == c.limit {
+				c.saturated = true
+			}
+			c.mu.Unlock()
+			return c.now(), nil
+		}
+		c.saturated = true
+		wake := c.wake
+		c.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		}
+	}
+}
+
+// release frees the slot of an operation.
+func (c *AdaptiveRemoteCache) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.wakeWaiters()
+}
+
+// wakeWaiters wakes up the operations waiting for a slot. c.mu must be
+// held.
+func (c *AdaptiveRemoteCache) wakeWaiters() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// observe adjusts the limit after an operation that started at start, of
+// size, or -1 for those whose latency is not sampled, returned err.
+func (c *AdaptiveRemoteCache) observe(start time.Time, size int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if class := ClassifyError(err); class == ErrorNetwork || class == ErrorThrottled {
+			c.cut(start, now, adaptiveErrorCut, "err", err)
+		}
+		return
+	}
+	if size >= 0 && size <= adaptiveSampleMaxSize {
+		latency := now.Sub(start)
+		if c.smoothed == 0 {
+			c.smoothed = latency
+		} else {
+			c.smoothed += (latency - c.smoothed) / 5
+		}
+		if c.baseline == 0 || c.smoothed < c.baseline {
+			c.baseline = c.smoothed
+		} else {
+			// Follow a lasting change of the network, slowly.
+			c.baseline += (c.smoothed - c.baseline) / 100
+		}
+		if c.smoothed > adaptiveLatencyTolerance*c.baseline {
+			c.cut(start, now, adaptiveLatencyCut, "latency", c.smoothed, "baseline", c.baseline)
+			return
+		}
+	}
+	if !c.saturated || c.limit >= c.max {
+		return
+	}
+	c.successes++
+	if c.successes >= c.limit {
+		c.limit++
+		c.successes, c.saturated = 0, false
+		c.wakeWaiters()
+	}
+}
+
+// cut cuts the limit by factor, unless the operation that started at start
+// began before the last cut. c.mu must be held.
+func (c *AdaptiveRemoteCache) cut(start, now time.Time, factor float64, args ...any) {
+	if !start.After(c.lastCut) {
+		return
+	}
+	c.lastCut = now
+	c.successes, c.saturated = 0, false
+	// Take a few samples of the new limit before cutting it again.
+	c.smoothed = c.baseline
+	limit := max(int(float64(c.limit)*factor), c.min)
+	if limit == c.limit {
+		return
+	}
+	c.limit = limit
+	slog.Debug("reducing remote concurrency", append([]any{"remote", c.cache.Kind(), "concurrency", limit}, args...)...)
+}
+
+func (c *AdaptiveRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	start, err := c.acquire(ctx)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	c.observe(start, size, err)
+	if err != nil || output == nil {
+		c.release()
+		return outputID, size, output, err
+	}
+	return outputID, size, &releaseOnClose{ReadCloser: output, release: c.release}, nil
+}
+
+func (c *AdaptiveRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
+	start, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	defer func() { c.observe(start, size, err) }()
+	return c.cache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (c *AdaptiveRemoteCache) HasOutput(ctx context.Context, outputID string) (_ bool, err error) {
+	store, ok := c.cache.(OutputStore)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	start, err := c.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.release()
+	defer func() { c.observe(start, 0, err) }()
+	return store.HasOutput(ctx, outputID)
+}
+
+func (c *AdaptiveRemoteCache) BatchExists(ctx context.Context, actionIDs []string) (_ []bool, err error) {
+	// Don't wait for a slot to find out that the cache can't answer.
+	if _, ok := c.cache.(BatchChecker); !ok {
+		return nil, errors.ErrUnsupported
+	}
+	start, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release()
+	// A batch takes as long as it has actions: only its errors count.
+	defer func() { c.observe(start, -1, err) }()
+	return c.forwarder.BatchExists(ctx, actionIDs)
+}
+
+func (c *AdaptiveRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (err error) {
+	store, ok := c.cache.(OutputStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	start, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	defer func() { c.observe(start, 0, err) }()
+	return store.PutAction(ctx, actionID, outputID, size)
+}
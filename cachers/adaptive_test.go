@@ -0,0 +1,86 @@
+package cachers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("remote")
+	remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+	c := NewAdaptiveRemoteCache(remote, AdaptiveLimits{Initial: 2, Max: 4})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	// op runs an operation taking latency that fails with err.
+	op := func(latency time.Duration, err error) {
+		start, aerr := c.acquire(ctx)
+		require.NoError(t, aerr)
+		now = now.Add(latency)
+		c.observe(start, 0, err)
+		c.release()
+	}
+	// round runs as many operations at once as the limit allows.
+	round := func(latency time.Duration) {
+		n := c.Limit()
+		starts := make([]time.Time, n)
+		for i := range starts {
+			var err error
+			starts[i], err = c.acquire(ctx)
+			require.NoError(t, err)
+		}
+		now = now.Add(latency)
+		for _, start := range starts {
+			c.observe(start, 0, nil)
+			c.release()
+		}
+	}
+
+	// Hold both slots: the limit is reached.
+	_, _, out1, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	_, _, out2, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err = c.Get(tctx, "a1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "waits for a slot")
+	require.NoError(t, out1.Close())
+	require.NoError(t, out2.Close())
+	op(10*time.Millisecond, nil)
+	assert.Equal(t, 3, c.Limit(), "one more after as many successes as the limit")
+
+	for i := 0; i < 10; i++ {
+		op(10*time.Millisecond, nil)
+	}
+	assert.Equal(t, 3, c.Limit(), "no more unless the limit is reached")
+
+	throttled := &StatusError{Method: "GET", Path: "/action/a1", Status: "503 Service Unavailable", StatusCode: http.StatusServiceUnavailable}
+	early, err := c.acquire(ctx)
+	require.NoError(t, err)
+	now = now.Add(time.Millisecond)
+	op(10*time.Millisecond, throttled)
+	assert.Equal(t, 1, c.Limit(), "halved after a throttling")
+	c.observe(early, 0, throttled)
+	c.release()
+	assert.Equal(t, 1, c.Limit(), "not cut again by what started before the cut")
+	op(10*time.Millisecond, context.Canceled)
+	op(10*time.Millisecond, &StatusError{Method: "GET", Path: "/action/a1", Status: "403 Forbidden", StatusCode: http.StatusForbidden})
+	assert.Equal(t, 1, c.Limit(), "only the congestion errors cut it")
+
+	// Up to the maximum, then down when the latency rises.
+	for i := 0; i < 5; i++ {
+		round(10 * time.Millisecond)
+	}
+	assert.Equal(t, 4, c.Limit())
+	for i := 0; i < 5 && c.Limit() == 4; i++ {
+		round(50 * time.Millisecond)
+	}
+	assert.Equal(t, 3, c.Limit())
+	assert.Zero(t, c.inFlight)
+}
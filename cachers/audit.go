@@ -0,0 +1,96 @@
+package cachers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// AuditRemoteCache is a RemoteCache that records every write to the cache
+// it wraps to an audit log, one JSON AuditRecord per line, with who and
+// which CI job wrote it, so that the operators of a shared cache can trace
+// where any of its entries came from. Failed writes, which store nothing,
+// aren't recorded.
+type AuditRemoteCache struct {
+	forwarder
+	w        io.Writer
+	identity string
+	job      string
+
+	mu  sync.Mutex // guards enc
+	enc *json.Encoder
+}
+
+// An AuditRecord is an entry of the log written by an AuditRemoteCache.
+type AuditRecord struct {
+	Time     time.Time
+	Remote   string // the Kind of the remote written to
+	ActionID string
+	OutputID string
+	Size     int64
+	// Dedup is set for the actions recorded for an output the remote
+	// already had, without its body being uploaded.
+	Dedup    bool              `json:",omitempty"`
+	Identity string            `json:",omitempty"`
+	Job      string            `json:",omitempty"`
+	Tags     map[string]string `json:",omitempty"` // of the write, as UploadTags returns them
+}
+
+var _ RemoteCache = &AuditRemoteCache{}
+var _ HealthChecker = &AuditRemoteCache{}
+var _ StatsReporter = &AuditRemoteCache{}
+var _ OutputStore = &AuditRemoteCache{}
+var _ BatchChecker = &AuditRemoteCache{}
+
+// NewAuditRemoteCache returns cache wrapped to record its writes to w, as
+// made by identity, like a user or a CI actor, in job, like the URL of a
+// CI job. Both may be empty. If w is an io.Closer, it is closed with the
+// cache.
+func NewAuditRemoteCache(cache RemoteCache, w io.Writer, identity, job string) *AuditRemoteCache {
+	return &AuditRemoteCache{forwarder: forwarder{cache}, w: w, identity: identity, job: job, enc: json.NewEncoder(w)}
+}
+
+func (c *AuditRemoteCache) Close() error {
+	err := c.cache.Close()
+	if wc, ok := c.w.(io.Closer); ok {
+		err = errors.Join(err, wc.Close())
+	}
+	return err
+}
+
+func (c *AuditRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	return c.cache.Get(ctx, actionID)
+}
+
+func (c *AuditRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	err := c.cache.Put(ctx, actionID, outputID, size, body)
+	if err == nil {
+		c.record(ctx, AuditRecord{ActionID: actionID, OutputID: outputID, Size: size})
+	}
+	return err
+}
+
+func (c *AuditRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	err := c.forwarder.PutAction(ctx, actionID, outputID, size)
+	if err == nil {
+		c.record(ctx, AuditRecord{ActionID: actionID, OutputID: outputID, Size: size, Dedup: true})
+	}
+	return err
+}
+
+func (c *AuditRemoteCache) record(ctx context.Context, rec AuditRecord) {
+	rec.Time = time.Now().UTC()
+	rec.Remote = c.cache.Kind()
+	rec.Identity, rec.Job = c.identity, c.job
+	rec.Tags = UploadTags(ctx)
+	c.mu.Lock()
+	err := c.enc.Encode(rec)
+	c.mu.Unlock()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to audit a write", "action", rec.ActionID, "err", err)
+	}
+}
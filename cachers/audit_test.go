@@ -0,0 +1,44 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	var log bytes.Buffer
+	remote := &dedupRemote{fakeRemote: newFakeRemote("fake")}
+	c := NewAuditRemoteCache(remote, &log, "alice", "https://ci.example.com/jobs/7")
+
+	require.NoError(t, c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+	require.NoError(t, c.PutAction(ctx, "a2", "0123", 5))
+	assert.Error(t, c.PutAction(ctx, "a3", "4567", 5))
+	remote.err = errors.New("boom")
+	assert.Error(t, c.Put(ctx, "a4", "89ab", 5, strings.NewReader("hello")))
+	_, _, _, _ = c.Get(ctx, "a1")
+
+	var recs []AuditRecord
+	dec := json.NewDecoder(&log)
+	for dec.More() {
+		var rec AuditRecord
+		require.NoError(t, dec.Decode(&rec))
+		assert.False(t, rec.Time.IsZero())
+		recs = append(recs, rec)
+	}
+	require.Len(t, recs, 2, "only the writes that succeeded")
+	for i := range recs {
+		recs[i].Time = recs[0].Time
+	}
+	assert.Equal(t, []AuditRecord{
+		{Time: recs[0].Time, Remote: "fake", ActionID: "a1", OutputID: "0123", Size: 5, Identity: "alice", Job: "https://ci.example.com/jobs/7"},
+		{Time: recs[0].Time, Remote: "fake", ActionID: "a2", OutputID: "0123", Size: 5, Dedup: true, Identity: "alice", Job: "https://ci.example.com/jobs/7"},
+	}, recs)
+}
@@ -0,0 +1,183 @@
+package cachers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchRemote is a fakeRemote that answers BatchExists.
+type batchRemote struct {
+	*fakeRemote
+	batches atomic.Int64
+}
+
+func (b *batchRemote) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.batches.Add(1)
+	exists := make([]bool, len(actionIDs))
+	for i, id := range actionIDs {
+		exists[i] = b.has(id)
+	}
+	return exists, nil
+}
+
+func TestHTTPBatchExists(t *testing.T) {
+	ctx := context.Background()
+	stored := map[string]bool{"a1": true, "a3": true}
+	var mu sync.Mutex
+	var requests []string
+	handler := func(batch bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			mu.Unlock()
+			switch {
+			case r.Method == "POST" && r.URL.Path == "/exists" && batch:
+				var req BatchExistsRequest
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				res := BatchExistsResponse{Exists: make([]bool, len(req.ActionIDs))}
+				for i, id := range req.ActionIDs {
+					res.Exists[i] = stored[id]
+				}
+				_ = json.NewEncoder(w).Encode(&res)
+			case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/action/"):
+				if !stored[strings.TrimPrefix(r.URL.Path, "/action/")] {
+					http.NotFound(w, r)
+					return
+				}
+				_ = json.NewEncoder(w).Encode(&ActionValue{OutputID: "0123", Size: 4})
+			default:
+				http.Error(w, "bad method", http.StatusBadRequest)
+			}
+		}
+	}
+	ids := []string{"a1", "a2", "a3"}
+
+	t.Run("batch", func(t *testing.T) {
+		requests = nil
+		srv := httptest.NewServer(handler(true))
+		defer srv.Close()
+		exists, err := NewHttpCache(srv.URL, false).BatchExists(ctx, ids)
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true, false, true}, exists)
+		assert.Equal(t, []string{"POST /exists"}, requests)
+
+		// The large batches are split.
+		many := make([]string, MaxBatchExists+1)
+		for i := range many {
+			many[i] = fmt.Sprintf("b%d", i)
+		}
+		many[MaxBatchExists] = "a1"
+		requests = nil
+		exists, err = NewHttpCache(srv.URL, false).BatchExists(ctx, many)
+		require.NoError(t, err)
+		require.Len(t, exists, len(many))
+		assert.True(t, exists[MaxBatchExists])
+		assert.False(t, exists[0])
+		assert.Len(t, requests, 2)
+	})
+
+	t.Run("old server", func(t *testing.T) {
+		requests = nil
+		srv := httptest.NewServer(handler(false))
+		defer srv.Close()
+		c := NewHttpCache(srv.URL, false)
+		for i := 0; i < 2; i++ {
+			exists, err := c.BatchExists(ctx, ids)
+			require.NoError(t, err)
+			assert.Equal(t, []bool{true, false, true}, exists)
+		}
+		assert.Len(t, requests, 1+2*len(ids), "the endpoint is only tried once")
+		assert.Equal(t, "POST /exists", requests[0])
+	})
+}
+
+func TestS3BatchExists(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeS3{objects: map[string]fakeObject{}, page: 3}
+	c := NewS3Cache(client, "bucket", "prefix", false)
+	var ids []string
+	var want []bool
+	// Many actions under one prefix of the keys, half of them stored, and
+	// a few under others.
+	for i := 0; i < 2*batchListMin; i++ {
+		id := fmt.Sprintf("abc%04d", i)
+		ids = append(ids, id)
+		want = append(want, i%2 == 0)
+		if i%2 == 0 {
+			client.objects[c.actionKey(id)] = fakeObject{}
+		}
+	}
+	client.objects[c.actionKey("abc9999")] = fakeObject{} // listed after the last
+	for _, id := range []string{"def1", "fed2"} {
+		ids = append(ids, id)
+		want = append(want, id == "def1")
+	}
+	client.objects[c.actionKey("def1")] = fakeObject{}
+
+	exists, err := c.BatchExists(ctx, ids)
+	require.NoError(t, err)
+	assert.Equal(t, want, exists)
+	assert.Equal(t, 2, client.heads, "the actions alone under their prefixes are headed")
+	assert.Equal(t, 3, client.lists, "the prefix is listed up to its last action")
+}
+
+func TestMultiRemoteCacheBatchExists(t *testing.T) {
+	ctx := context.Background()
+	first := &batchRemote{fakeRemote: newFakeRemote("first")}
+	second := &batchRemote{fakeRemote: newFakeRemote("second")}
+	first.entries["a1"] = fakeEntry{outputID: "o1"}
+	second.entries["a1"] = fakeEntry{outputID: "o1"}
+	second.entries["a2"] = fakeEntry{outputID: "o2"}
+	m := NewMultiRemoteCache([]RemoteCache{first, second}, ReadOrdered, WriteAll, false)
+
+	exists, err := m.BatchExists(ctx, []string{"a1", "a2", "a3"})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, exists)
+
+	first.err = errors.New("boom")
+	exists, err = m.BatchExists(ctx, []string{"a1", "a2", "a3"})
+	require.NoError(t, err, "a healthy remote's answer wins over another's error")
+	assert.Equal(t, []bool{true, true, false}, exists)
+
+	m = NewMultiRemoteCache([]RemoteCache{newFakeRemote("plain")}, ReadOrdered, WriteAll, false)
+	_, err = m.BatchExists(ctx, []string{"a1"})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestTieredCacheBatchExists(t *testing.T) {
+	ctx := context.Background()
+	remote := &batchRemote{fakeRemote: newFakeRemote("remote")}
+	remote.entries["a2"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), NewReloadableRemoteCache(NewTimeoutRemoteCache(remote, time.Minute)))
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+	_, err = c.Put(ctx, "a1", helloID, 5, sbytes.NewBuffer([]byte("hello")))
+	require.NoError(t, err)
+
+	exists, err := BatchExists(ctx, NewSingleflightCache(c), []string{"a1", "a2", "a3"})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, exists)
+	assert.EqualValues(t, 1, remote.batches.Load())
+
+	c, err = NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), newFakeRemote("plain"))
+	require.NoError(t, err)
+	_, err = c.BatchExists(ctx, []string{"a1"})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
@@ -2,6 +2,7 @@ package cachers
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
@@ -14,6 +15,8 @@ type Cache interface {
 
 // LocalCache is the basic interface for a local cache.
 // It supposed to write to Disk, thus the signature include diskPath.
+// Like for RemoteCache, the body of Put must not be read once it returns,
+// as its bytes may be reused.
 type LocalCache interface {
 	Cache
 	Get(ctx context.Context, actionID string) (outputID, diskPath string, err error)
@@ -21,8 +24,65 @@ type LocalCache interface {
 }
 
 // RemoteCache is the basic interface for a remote cache.
+// The body of Put must not be read once it returns, as its bytes may be
+// reused.
 type RemoteCache interface {
 	Cache
 	Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error)
 	Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error)
 }
+
+// LocalOutputStore is implemented by local caches that store outputs by
+// their OutputID, and by wrappers of caches that do, so that a put of an
+// output they already store doesn't need its body.
+type LocalOutputStore interface {
+	// HasOutput reports whether the output of the given size is stored.
+	HasOutput(ctx context.Context, outputID string, size int64) bool
+	// PutAction records that actionID produced the stored output, like a
+	// Put of it would.
+	PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error)
+}
+
+// HealthChecker is implemented by caches that can cheaply probe whether
+// their backend is reachable.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// CheckHealth checks the backend of c, if it can. Caches that do not
+// implement HealthChecker are reported healthy.
+func CheckHealth(ctx context.Context, c Cache) error {
+	if hc, ok := c.(HealthChecker); ok {
+		return hc.HealthCheck(ctx)
+	}
+	return nil
+}
+
+// BatchChecker is implemented by caches that can tell which of many actions
+// they store in fewer round trips than a Get of each, and by the wrappers
+// of caches that do.
+type BatchChecker interface {
+	// BatchExists reports, for each of actionIDs, whether the action is
+	// stored: exists[i] is about actionIDs[i].
+	BatchExists(ctx context.Context, actionIDs []string) (exists []bool, err error)
+}
+
+// BatchExists asks c which of actionIDs it stores. It fails with
+// errors.ErrUnsupported if c is not a BatchChecker.
+func BatchExists(ctx context.Context, c Cache, actionIDs []string) ([]bool, error) {
+	bc, ok := c.(BatchChecker)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return bc.BatchExists(ctx, actionIDs)
+}
+
+// OutputStore is implemented by remote caches that store outputs by their
+// OutputID. Since outputs are content-addressed, an action whose output is
+// already stored can be recorded without uploading the body again.
+type OutputStore interface {
+	// HasOutput reports whether the output is stored.
+	HasOutput(ctx context.Context, outputID string) (bool, error)
+	// PutAction records that actionID produced the stored output.
+	PutAction(ctx context.Context, actionID, outputID string, size int64) error
+}
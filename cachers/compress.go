@@ -0,0 +1,169 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compression modes of the bodies sent to the remotes.
+const (
+	// CompressionAuto compresses with zstd for the cacher servers that
+	// accept it, and with s2 for S3, which every version of go-cacher
+	// reads. It is the default.
+	CompressionAuto = "auto"
+	// CompressionZstd also compresses with zstd for S3, whose objects then
+	// can't be read by versions of go-cacher without zstd.
+	CompressionZstd = "zstd"
+	// CompressionOff sends the bodies as they are.
+	CompressionOff = "off"
+)
+
+// DefaultCompressionMinSize is the size under which bodies are sent as they
+// are, where compressing them saves less than it costs.
+const DefaultCompressionMinSize = 8 << 10
+
+// A Compression says how the bodies sent to a remote are compressed. The
+// zero value is CompressionAuto from DefaultCompressionMinSize.
+type Compression struct {
+	Mode    string // CompressionAuto, CompressionZstd or CompressionOff
+	MinSize int64  // bodies smaller than this are sent as they are
+}
+
+// compresses reports whether a body of size is compressed.
+func (c Compression) compresses(size int64) bool {
+	minSize := c.MinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	return c.Mode != CompressionOff && size >= minSize
+}
+
+type incompressibleBodyKey struct{}
+
+// withIncompressibleBody returns a copy of ctx whose puts have bodies that
+// don't compress, like ciphertext, which the remotes then send as they are.
+func withIncompressibleBody(ctx context.Context) context.Context {
+	return context.WithValue(ctx, incompressibleBodyKey{}, true)
+}
+
+// incompressibleBody reports whether the bodies of the puts of ctx don't
+// compress.
+func incompressibleBody(ctx context.Context) bool {
+	return ctx.Value(incompressibleBodyKey{}) != nil
+}
+
+// decodedSizeHeader is the header of a zstd-compressed put to a cacher
+// server with the size of the body once decompressed.
+const decodedSizeHeader = "X-Gocache-Decoded-Size"
+
+// AcceptsZstd reports whether h, the Accept-Encoding header of a request or
+// of the response of a cacher server, lists zstd.
+func AcceptsZstd(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			enc, _, _ = strings.Cut(enc, ";")
+			if strings.EqualFold(strings.TrimSpace(enc), "zstd") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// zstdEncoder compresses whole bodies, with EncodeAll, which is safe for
+// concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// zstdStreams are the encoders of the bodies compressed as they are sent.
+var zstdStreams = sync.Pool{
+	New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	},
+}
+
+// NewZstdWriter returns a writer compressing what is written to it to w,
+// until it is closed.
+func NewZstdWriter(w io.Writer) io.WriteCloser {
+	enc := zstdStreams.Get().(*zstd.Encoder)
+	enc.Reset(w)
+	return &zstdWriter{enc: enc}
+}
+
+type zstdWriter struct {
+	enc *zstd.Encoder
+}
+
+func (w *zstdWriter) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+func (w *zstdWriter) Close() error {
+	err := w.enc.Close()
+	w.enc.Reset(nil)
+	zstdStreams.Put(w.enc)
+	return err
+}
+
+// zstdMaxMemory bounds the memory the decompression of a body may take,
+// whatever its frames claim.
+const zstdMaxMemory = 256 << 20
+
+// NewZstdReader returns a reader decompressing r, which it closes when it is
+// closed.
+func NewZstdReader(r io.ReadCloser) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(zstdMaxMemory))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{dec: dec, body: r}, nil
+}
+
+type zstdReader struct {
+	dec  *zstd.Decoder
+	body io.Closer
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	return r.dec.Read(p)
+}
+
+func (r *zstdReader) Close() error {
+	r.dec.Close()
+	return r.body.Close()
+}
+
+// compressedBody returns a reader of body compressed with zstd as it is
+// read. Closing it stops the compression, and waits for it to stop reading
+// body.
+func compressedBody(body io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	r := &compressingReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		zw := NewZstdWriter(pw)
+		_, err := sbytes.Copy(zw, body)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return r
+}
+
+type compressingReader struct {
+	*io.PipeReader
+	done chan struct{} // closed once body is no longer read
+}
+
+func (r *compressingReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
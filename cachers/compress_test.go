@@ -0,0 +1,312 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an s3Client storing the objects in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	gets    []string // the ranges of the gets, or ""
+	heads   int
+	lists   int // pages listed
+	page    int // the most keys of a page listed; 0 is 1000
+}
+
+type fakeObject struct {
+	body     []byte
+	metadata map[string]string
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets = append(f.gets, aws.ToString(params.Range))
+	o, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	out := &s3.GetObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.body))),
+		Metadata:      o.metadata,
+		ETag:          aws.String(`"1"`),
+	}
+	body := o.body
+	if params.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(*params.Range, "bytes=%d-%d", &start, &end); err != nil || start >= len(body) {
+			return nil, &smithy.GenericAPIError{Code: "InvalidRange"}
+		}
+		end = min(end, len(body)-1)
+		out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+		body = body[start : end+1]
+		out.ContentLength = aws.Int64(int64(len(body)))
+	}
+	if params.IfMatch != nil && *params.IfMatch != *out.ETag {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	return out, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	b, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[*params.Key] = fakeObject{body: b, metadata: params.Metadata}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.heads++
+	o, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(o.body))), Metadata: o.metadata}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.ToString(params.Prefix)) && k > aws.ToString(params.ContinuationToken) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	page := f.page
+	if page == 0 {
+		page = 1000
+	}
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > page)}
+	if len(keys) > page {
+		keys = keys[:page]
+		out.NextContinuationToken = aws.String(keys[page-1])
+	}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func TestS3Compression(t *testing.T) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("go build object file "), 1000)
+	for _, tc := range []struct {
+		compression Compression
+		size        int
+		codec       string
+	}{
+		{Compression{}, len(body), "s2"},
+		{Compression{}, 100, ""},
+		{Compression{Mode: CompressionZstd}, len(body), "zstd"},
+		{Compression{Mode: CompressionZstd, MinSize: 1 << 20}, len(body), ""},
+		{Compression{Mode: CompressionOff}, len(body), ""},
+	} {
+		client := &fakeS3{objects: map[string]fakeObject{}}
+		c := NewS3Cache(client, "bucket", "prefix", false)
+		c.SetCompression(tc.compression)
+		data := body[:tc.size]
+		require.NoError(t, c.Put(ctx, "a1b2c3", "0123", int64(len(data)), sbytes.NewBuffer(bytes.Clone(data))))
+		o := client.objects[c.actionKey("a1b2c3")]
+		assert.Equal(t, tc.codec, o.metadata[compressedMetadataKey], "%+v", tc)
+		if tc.codec != "" {
+			assert.Less(t, len(o.body), len(data))
+		}
+
+		// The objects read whatever the compression of the reader.
+		c.SetCompression(Compression{Mode: CompressionOff})
+		outputID, size, output, err := c.Get(ctx, "a1b2c3")
+		require.NoError(t, err)
+		assert.Equal(t, "0123", outputID)
+		assert.EqualValues(t, len(data), size)
+		got, err := io.ReadAll(output)
+		require.NoError(t, err)
+		require.NoError(t, output.Close())
+		assert.Equal(t, data, got)
+	}
+}
+
+// zstdServer is a cacher server storing the outputs in memory, which
+// accepts and serves zstd bodies if zstd is set.
+type zstdServer struct {
+	zstd bool
+
+	mu       sync.Mutex
+	outputs  map[string][]byte
+	encoding []string // the Content-Encoding of the puts and the gets of outputs
+}
+
+func (s *zstdServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.zstd {
+		w.Header().Set("Accept-Encoding", "zstd")
+	}
+	switch {
+	case r.Method == "PUT":
+		_, outputID, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		body := r.Body
+		if enc := r.Header.Get("Content-Encoding"); enc == "zstd" && s.zstd {
+			var err error
+			if body, err = NewZstdReader(r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if enc != "" {
+			http.Error(w, "unsupported encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n := r.Header.Get(decodedSizeHeader); n != "" && n != strconv.Itoa(len(b)) {
+			http.Error(w, "bad size", http.StatusBadRequest)
+			return
+		}
+		s.outputs[outputID] = b
+		s.encoding = append(s.encoding, "put "+r.Header.Get("Content-Encoding"))
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/action/"):
+		b, ok := s.outputs["0123"]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&ActionValue{OutputID: "0123", Size: int64(len(b))})
+	case strings.HasPrefix(r.URL.Path, "/output/"):
+		b := s.outputs[strings.TrimPrefix(r.URL.Path, "/output/")]
+		if s.zstd && AcceptsZstd(r.Header) {
+			s.encoding = append(s.encoding, "get zstd")
+			w.Header().Set("Content-Encoding", "zstd")
+			zw := NewZstdWriter(w)
+			_, _ = zw.Write(b)
+			_ = zw.Close()
+			return
+		}
+		s.encoding = append(s.encoding, "get ")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		_, _ = w.Write(b)
+	default:
+		_, _ = io.WriteString(w, "hi")
+	}
+}
+
+func TestHTTPCompression(t *testing.T) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("go build object file "), 1000)
+	get := func(t *testing.T, c *HTTPCache) []byte {
+		_, size, output, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		defer output.Close()
+		got, err := io.ReadAll(output)
+		require.NoError(t, err)
+		assert.EqualValues(t, len(got), size)
+		return got
+	}
+
+	t.Run("negotiated", func(t *testing.T) {
+		s := &zstdServer{zstd: true, outputs: map[string][]byte{}}
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		c := NewHttpCache(srv.URL, false)
+		require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+		require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+		require.NoError(t, c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+		assert.Equal(t, []byte("hello"), get(t, c))
+		require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+		assert.Equal(t, body, get(t, c))
+		assert.Equal(t, []string{"put ", "put zstd", "put ", "get ", "put zstd", "get zstd"}, s.encoding,
+			"zstd once the server said it accepts it, and for large bodies only")
+	})
+
+	t.Run("old server", func(t *testing.T) {
+		s := &zstdServer{outputs: map[string][]byte{}}
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		c := NewHttpCache(srv.URL, false)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+		}
+		assert.Equal(t, body, get(t, c))
+		assert.Equal(t, []string{"put ", "put ", "get "}, s.encoding)
+	})
+
+	t.Run("off", func(t *testing.T) {
+		s := &zstdServer{zstd: true, outputs: map[string][]byte{}}
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+		c := NewHttpCache(srv.URL, false)
+		c.SetCompression(Compression{Mode: CompressionOff})
+		for i := 0; i < 2; i++ {
+			require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+		}
+		assert.Equal(t, body, get(t, c))
+		assert.Equal(t, []string{"put ", "put ", "get "}, s.encoding)
+	})
+}
+
+func TestHTTPCompressionEncrypted(t *testing.T) {
+	ctx := context.Background()
+	// Large enough to be compressed once compressed.
+	var body []byte
+	for i := 0; i < 20000; i++ {
+		body = fmt.Appendf(body, "symbol %d at %#x\n", i, i*i)
+	}
+	s := &zstdServer{zstd: true, outputs: map[string][]byte{}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c, err := NewEncryptedRemoteCache(NewHttpCache(srv.URL, false), bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), sbytes.NewBuffer(bytes.Clone(body))))
+	}
+	assert.Equal(t, []string{"put ", "put "}, s.encoding, "the ciphertext is sent as it is")
+	assert.Less(t, len(s.outputs["0123"]), len(body)*3/4, "the plaintext was compressed")
+}
+
+func TestAcceptsZstd(t *testing.T) {
+	for v, want := range map[string]bool{
+		"":                    false,
+		"gzip":                false,
+		"zstd":                true,
+		"gzip, ZSTD;q=0.5":    true,
+		"gzip, zstandard, br": false,
+	} {
+		assert.Equal(t, want, AcceptsZstd(http.Header{"Accept-Encoding": {v}}), v)
+	}
+}
@@ -2,59 +2,203 @@ package cachers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Counts keeps counts cache events
 type Counts struct {
-	gets      atomic.Int64
-	hits      atomic.Int64
-	misses    atomic.Int64
-	puts      atomic.Int64
-	getErrors atomic.Int64
-	putErrors atomic.Int64
+	gets       atomic.Int64
+	hits       atomic.Int64
+	misses     atomic.Int64
+	puts       atomic.Int64
+	getErrors  atomic.Int64
+	putErrors  atomic.Int64
+	hitBytes   atomic.Int64
+	putBytes   atomic.Int64
+	getLatency latencyHistogram
+	putLatency latencyHistogram
+
+	errMu sync.Mutex
+	errs  map[string]int64 // by ClassifyError class
 }
 
 func (c *Counts) Summary() string {
+	return c.Stats().String()
+}
+
+// Stats returns a snapshot of the counts.
+func (c *Counts) Stats() Stats {
+	return Stats{
+		Gets:      c.gets.Load(),
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		GetErrors: c.getErrors.Load(),
+		Puts:      c.puts.Load(),
+		PutErrors: c.putErrors.Load(),
+		HitBytes:  c.hitBytes.Load(),
+		PutBytes:  c.putBytes.Load(),
+	}
+}
+
+// countError counts err, an error of a get or a put, in its class.
+func (c *Counts) countError(err error) {
+	class := ClassifyError(err)
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if c.errs == nil {
+		c.errs = map[string]int64{}
+	}
+	c.errs[class]++
+}
+
+// errorsByClass returns the counts of countError, or nil if there are
+// none.
+func (c *Counts) errorsByClass() map[string]int64 {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	if len(c.errs) == 0 {
+		return nil
+	}
+	return maps.Clone(c.errs)
+}
+
+// tierStats returns the stats of tier, of kind, with the time spent in
+// its gets and puts.
+func (c *Counts) tierStats(tier, kind string) TierStats {
+	return TierStats{
+		Tier:       tier,
+		Kind:       kind,
+		Stats:      c.Stats(),
+		GetTime:    time.Duration(c.getLatency.sum.Load()),
+		PutTime:    time.Duration(c.putLatency.sum.Load()),
+		GetLatency: c.getLatency.snapshot(),
+		PutLatency: c.putLatency.snapshot(),
+		Errors:     c.errorsByClass(),
+	}
+}
+
+// Stats is a snapshot of the Counts of a cache.
+type Stats struct {
+	Gets      int64
+	Hits      int64
+	Misses    int64
+	GetErrors int64
+	Puts      int64
+	PutErrors int64
+
+	// HitBytes is the total size of the bodies returned by hits.
+	// It is only tracked for remote caches, as local hits are not stat'ed.
+	HitBytes int64
+	// PutBytes is the total size of the bodies successfully put.
+	PutBytes int64
+}
+
+func (s Stats) String() string {
 	return fmt.Sprintf("%d gets (%d hits, %d misses, %d errors); %d puts (%d errors)",
-		c.gets.Load(), c.hits.Load(), c.misses.Load(), c.getErrors.Load(), c.puts.Load(), c.putErrors.Load())
+		s.Gets, s.Hits, s.Misses, s.GetErrors, s.Puts, s.PutErrors)
+}
+
+// TierStats are the Stats of one tier of a cache.
+type TierStats struct {
+	// Tier names the role of the cache, like "local" or "remote".
+	Tier string
+	// Kind is the Kind of the cache, like "disk" or "s3".
+	Kind string
+	Stats
+	// GetTime and PutTime are the total time spent in gets and puts. The
+	// time of a remote get ends with its response, before the output is
+	// read.
+	GetTime, PutTime time.Duration `json:",omitempty"`
+	// GetLatency and PutLatency are the histograms of the latencies of the
+	// gets and puts, or nil before the first.
+	GetLatency, PutLatency *Histogram `json:",omitempty"`
+	// Errors are the numbers of failed operations by the class
+	// ClassifyError gives their errors, like "auth" or "throttled". They
+	// include the hits of a remote whose output was corrupt, which a
+	// TieredCache treats as misses.
+	Errors map[string]int64 `json:",omitempty"`
+}
+
+// StatsReporter is implemented by caches that keep statistics,
+// including wrappers of caches that do.
+type StatsReporter interface {
+	TierStats() []TierStats
+}
+
+// CacheStats returns the statistics kept by c, if any.
+func CacheStats(c Cache) []TierStats {
+	if sr, ok := c.(StatsReporter); ok {
+		return sr.TierStats()
+	}
+	return nil
 }
 
 type LocalCacheWithCounts struct {
 	Counts
-	cache LocalCache
+	cache   LocalCache
+	tier    string
+	verbose bool
 }
 
 func (l *LocalCacheWithCounts) Kind() string {
 	return l.cache.Kind()
 }
 
+// TierStats returns the stats of l followed by those of the cache it wraps.
+func (l *LocalCacheWithCounts) TierStats() []TierStats {
+	return append([]TierStats{l.tierStats(l.tier, l.cache.Kind())}, CacheStats(l.cache)...)
+}
+
+func (l *LocalCacheWithCounts) QueueStats() QueueStats {
+	return CacheQueues(l.cache)
+}
+
+func (l *LocalCacheWithCounts) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, l.cache)
+}
+
 type RemoteCacheWithCounts struct {
 	Counts
-	cache RemoteCache
+	cache   RemoteCache
+	tier    string
+	verbose bool
 }
 
 func (r *RemoteCacheWithCounts) Kind() string {
 	return r.cache.Kind()
 }
 
+// TierStats returns the stats of r followed by those of the cache it wraps.
+func (r *RemoteCacheWithCounts) TierStats() []TierStats {
+	return append([]TierStats{r.tierStats(r.tier, r.cache.Kind())}, CacheStats(r.cache)...)
+}
+
 func (r *RemoteCacheWithCounts) Start(ctx context.Context) error {
 	return r.cache.Start(ctx)
 }
 
 func (r *RemoteCacheWithCounts) Close() error {
-	log.Printf("[%s]\t%s", r.cache.Kind(), r.Summary())
+	if r.verbose {
+		slog.Info("stats", "cache", r.cache.Kind(), "summary", r.Summary())
+	}
 	return r.cache.Close()
 }
 
 func (r *RemoteCacheWithCounts) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
 	r.gets.Add(1)
+	start := time.Now()
 	outputID, size, output, err = r.cache.Get(ctx, actionID)
+	r.getLatency.observe(time.Since(start))
 	if err != nil {
 		r.getErrors.Add(1)
+		r.countError(err)
 		return
 	}
 	if outputID == "" {
@@ -62,16 +206,21 @@ func (r *RemoteCacheWithCounts) Get(ctx context.Context, actionID string) (outpu
 		return
 	}
 	r.hits.Add(1)
+	r.hitBytes.Add(size)
 	return
 }
 
 func (r *RemoteCacheWithCounts) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
+	start := time.Now()
 	err = r.cache.Put(ctx, actionID, outputID, size, body)
+	r.putLatency.observe(time.Since(start))
 	if err != nil {
 		r.putErrors.Add(1)
+		r.countError(err)
 		return
 	}
 	r.puts.Add(1)
+	r.putBytes.Add(size)
 	return
 }
 
@@ -80,15 +229,28 @@ func (l *LocalCacheWithCounts) Start(ctx context.Context) error {
 }
 
 func (l *LocalCacheWithCounts) Close() error {
-	log.Printf("[%s]\t%s", l.cache.Kind(), l.Summary())
+	if l.verbose {
+		slog.Info("stats", "cache", l.cache.Kind(), "summary", l.Summary())
+	}
 	return l.cache.Close()
 }
 
+func (l *LocalCacheWithCounts) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	bc, ok := l.cache.(BatchChecker)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return bc.BatchExists(ctx, actionIDs)
+}
+
 func (l *LocalCacheWithCounts) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
 	l.gets.Add(1)
+	start := time.Now()
 	outputID, diskPath, err = l.cache.Get(ctx, actionID)
+	l.getLatency.observe(time.Since(start))
 	if err != nil {
 		l.getErrors.Add(1)
+		l.countError(err)
 		return
 	}
 	if outputID == "" {
@@ -100,26 +262,80 @@ func (l *LocalCacheWithCounts) Get(ctx context.Context, actionID string) (output
 }
 
 func (l *LocalCacheWithCounts) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	start := time.Now()
 	diskPath, err = l.cache.Put(ctx, actionID, outputID, size, body)
+	l.putLatency.observe(time.Since(start))
 	if err != nil {
 		l.putErrors.Add(1)
+		l.countError(err)
 		return
 	}
 	l.puts.Add(1)
+	l.putBytes.Add(size)
 	return
 }
 
+func (l *LocalCacheWithCounts) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := l.cache.(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+// PutAction is counted as a put.
+func (l *LocalCacheWithCounts) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := l.cache.(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	start := time.Now()
+	diskPath, err = los.PutAction(ctx, actionID, outputID, size)
+	l.putLatency.observe(time.Since(start))
+	if err != nil {
+		l.putErrors.Add(1)
+		l.countError(err)
+		return
+	}
+	l.puts.Add(1)
+	l.putBytes.Add(size)
+	return
+}
+
+// NewLocalCacheStates returns cache wrapped to count its events, logging a
+// summary on Close.
 func NewLocalCacheStates(cache LocalCache) *LocalCacheWithCounts {
+	return NewLocalCacheWithCounts(cache, cache.Kind(), true)
+}
+
+// NewRemoteCacheStats returns cache wrapped to count its events, logging a
+// summary on Close.
+func NewRemoteCacheStats(cache RemoteCache) *RemoteCacheWithCounts {
+	return NewRemoteCacheWithCounts(cache, cache.Kind(), true)
+}
+
+// NewLocalCacheWithCounts returns cache wrapped to count its events,
+// reported as the given tier. If verbose, a summary is logged on Close.
+func NewLocalCacheWithCounts(cache LocalCache, tier string, verbose bool) *LocalCacheWithCounts {
 	return &LocalCacheWithCounts{
-		cache: cache,
+		cache:   cache,
+		tier:    tier,
+		verbose: verbose,
 	}
 }
 
-func NewRemoteCacheStats(cache RemoteCache) *RemoteCacheWithCounts {
+// NewRemoteCacheWithCounts returns cache wrapped to count its events,
+// reported as the given tier. If verbose, a summary is logged on Close.
+func NewRemoteCacheWithCounts(cache RemoteCache, tier string, verbose bool) *RemoteCacheWithCounts {
 	return &RemoteCacheWithCounts{
-		cache: cache,
+		cache:   cache,
+		tier:    tier,
+		verbose: verbose,
 	}
 }
 
 var _ LocalCache = &LocalCacheWithCounts{}
+var _ HealthChecker = &LocalCacheWithCounts{}
 var _ RemoteCache = &RemoteCacheWithCounts{}
+var _ StatsReporter = &LocalCacheWithCounts{}
+var _ LocalOutputStore = &LocalCacheWithCounts{}
+var _ QueueReporter = &LocalCacheWithCounts{}
+var _ BatchChecker = &LocalCacheWithCounts{}
+var _ StatsReporter = &RemoteCacheWithCounts{}
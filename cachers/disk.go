@@ -8,10 +8,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/bradfitz/go-tool-cache/internal/trace"
 )
 
 // indexEntry is the metadata that SimpleDiskCache stores on disk for an ActionID.
@@ -40,13 +43,16 @@ func NewSimpleDiskCache(verbose bool, dir string) *SimpleDiskCache {
 }
 
 var _ LocalCache = &SimpleDiskCache{}
+var _ LocalOutputStore = &SimpleDiskCache{}
 
 func (dc *SimpleDiskCache) Start(context.Context) error {
-	log.Printf("[%s]\tlocal cache in  %s", dc.Kind(), dc.dir)
+	slog.Info("local cache", "cache", dc.Kind(), "dir", dc.dir)
 	return os.MkdirAll(dc.dir, 0755)
 }
 
-func (dc *SimpleDiskCache) Get(_ context.Context, actionID string) (outputID, diskPath string, err error) {
+func (dc *SimpleDiskCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	ctx, span := trace.Start(ctx, "disk get", trace.Internal, trace.String("gocacheprog.action_id", actionID))
+	defer func() { endGetSpan(span, outputID, err) }()
 	actionFile := filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
 	ij, err := os.ReadFile(actionFile)
 	if err != nil {
@@ -57,18 +63,20 @@ func (dc *SimpleDiskCache) Get(_ context.Context, actionID string) (outputID, di
 	}
 	var ie indexEntry
 	if err := json.Unmarshal(ij, &ie); err != nil {
-		log.Printf("Warning: JSON error for action %q: %v", actionID, err)
+		slog.WarnContext(ctx, "invalid index entry", "cache", dc.Kind(), "action", actionID, "err", err)
 		return "", "", nil
 	}
 	if _, err := hex.DecodeString(ie.OutputID); err != nil {
-		log.Printf("Warning: Output ID for action %q: %v", actionID, err)
+		slog.WarnContext(ctx, "invalid output ID", "cache", dc.Kind(), "action", actionID, "err", err)
 		// Protect against malicious non-hex OutputID on disk
 		return "", "", nil
 	}
 	return ie.OutputID, filepath.Join(dc.dir, fmt.Sprintf("o-%v", ie.OutputID)), nil
 }
 
-func (dc *SimpleDiskCache) Put(_ context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+func (dc *SimpleDiskCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	_, span := trace.Start(ctx, "disk put", trace.Internal, trace.String("gocacheprog.action_id", actionID), trace.Int("gocacheprog.body_size", size))
+	defer func() { span.End(err) }()
 	if outputID == "" {
 		return "", errors.New("empty outputID")
 	}
@@ -82,15 +90,41 @@ func (dc *SimpleDiskCache) Put(_ context.Context, actionID, outputID string, siz
 		}
 		_ = zf.Close()
 	} else {
-		wrote, err := writeAtomic(file, body)
-		if err != nil {
+		if err := writeAtomicSize(file, body, size); err != nil {
 			return "", err
 		}
-		if wrote != size {
-			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
-		}
 	}
 
+	if err := dc.writeIndex(actionID, outputID, size); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// HasOutput reports whether the output of the given size is in the cache.
+func (dc *SimpleDiskCache) HasOutput(_ context.Context, outputID string, size int64) bool {
+	fi, err := os.Stat(filepath.Join(dc.dir, fmt.Sprintf("o-%s", outputID)))
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == size
+}
+
+// PutAction records that actionID produced an output that is already in
+// the cache, without writing the output again.
+func (dc *SimpleDiskCache) PutAction(_ context.Context, actionID, outputID string, size int64) (diskPath string, _ error) {
+	file := filepath.Join(dc.dir, fmt.Sprintf("o-%s", outputID))
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() != size {
+		return "", fmt.Errorf("output %s has %d bytes, expected %d", outputID, fi.Size(), size)
+	}
+	if err := dc.writeIndex(actionID, outputID, size); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+func (dc *SimpleDiskCache) writeIndex(actionID, outputID string, size int64) error {
 	ij, err := json.Marshal(indexEntry{
 		Version:   1,
 		OutputID:  outputID,
@@ -98,13 +132,11 @@ func (dc *SimpleDiskCache) Put(_ context.Context, actionID, outputID string, siz
 		TimeNanos: time.Now().UnixNano(),
 	})
 	if err != nil {
-		return "", err
+		return err
 	}
 	actionFile := filepath.Join(dc.dir, fmt.Sprintf("a-%s", actionID))
-	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
-		return "", err
-	}
-	return file, nil
+	_, err = writeAtomic(actionFile, bytes.NewReader(ij))
+	return err
 }
 
 func (dc *SimpleDiskCache) Close() error {
@@ -123,13 +155,32 @@ func writeTempFile(dest string, r io.Reader) (string, int64, error) {
 			_ = os.Remove(fileName)
 		}
 	}()
-	size, err := io.Copy(tf, r)
+	size, err := sbytes.Copy(tf, r)
 	if err != nil {
 		return "", 0, err
 	}
 	return fileName, size, nil
 }
 
+// writeAtomicSize is writeAtomic of r, which must be size bytes long:
+// dest is left as it was otherwise, and no more than one byte past size is
+// read.
+func writeAtomicSize(dest string, r io.Reader, size int64) error {
+	tempFile, wrote, err := writeTempFile(dest, io.LimitReader(r, size+1))
+	if err != nil {
+		return err
+	}
+	if wrote != size {
+		_ = os.Remove(tempFile)
+		return fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+	}
+	if err := os.Rename(tempFile, dest); err != nil {
+		_ = os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
+
 func writeAtomic(dest string, r io.Reader) (int64, error) {
 	tempFile, size, err := writeTempFile(dest, r)
 	if err != nil {
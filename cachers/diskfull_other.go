@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package cachers
+
+func isDiskFull(err error) bool {
+	return false
+}
@@ -0,0 +1,251 @@
+package cachers
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskUsage counts entries of a SimpleDiskCache.
+type DiskUsage struct {
+	Actions int
+	Outputs int
+	Bytes   int64
+}
+
+func (u DiskUsage) String() string {
+	return fmt.Sprintf("%d actions, %d outputs, %s", u.Actions, u.Outputs, formatBytes(float64(u.Bytes)))
+}
+
+func (u *DiskUsage) add(fi fs.FileInfo) {
+	if strings.HasPrefix(fi.Name(), "a-") {
+		u.Actions++
+	} else {
+		u.Outputs++
+	}
+	u.Bytes += fi.Size()
+}
+
+// isEntry reports whether name is that of an action or output file, rather
+// than a temporary file or another of the go-cacher files kept in the
+// directory.
+func isEntry(name string) bool {
+	if !strings.HasPrefix(name, "a-") && !strings.HasPrefix(name, "o-") {
+		return false
+	}
+	_, err := hex.DecodeString(name[2:])
+	return err == nil && len(name) > 2
+}
+
+// entries calls f for every action and output file of the cache.
+func (dc *SimpleDiskCache) entries(f func(fi fs.FileInfo) error) error {
+	des, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range des {
+		if !de.Type().IsRegular() || !isEntry(de.Name()) {
+			continue
+		}
+		fi, err := de.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // removed since
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns the number and size of the entries of the cache.
+func (dc *SimpleDiskCache) Usage() (DiskUsage, error) {
+	var u DiskUsage
+	err := dc.entries(func(fi fs.FileInfo) error {
+		u.add(fi)
+		return nil
+	})
+	return u, err
+}
+
+// Clean removes the entries of the cache last written before t, and
+// returns what was removed. A zero t removes all of them.
+func (dc *SimpleDiskCache) Clean(t time.Time) (DiskUsage, error) {
+	var removed DiskUsage
+	err := dc.entries(func(fi fs.FileInfo) error {
+		if !t.IsZero() && !fi.ModTime().Before(t) {
+			return nil
+		}
+		if err := os.Remove(filepath.Join(dc.dir, fi.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed.add(fi)
+		return nil
+	})
+	return removed, err
+}
+
+// A DiskProblem is an entry of a SimpleDiskCache found broken by Verify.
+type DiskProblem struct {
+	Name string // of the file
+	Err  error
+}
+
+func (p DiskProblem) String() string {
+	return p.Name + ": " + p.Err.Error()
+}
+
+// Verify checks every entry of the cache: that outputs match their IDs,
+// and that actions are readable and refer to an output of the recorded
+// size. If fix is set, the broken entries are removed.
+func (dc *SimpleDiskCache) Verify(fix bool) (DiskUsage, []DiskProblem, error) {
+	var (
+		checked  DiskUsage
+		problems []DiskProblem
+	)
+	err := dc.entries(func(fi fs.FileInfo) error {
+		checked.add(fi)
+		path := filepath.Join(dc.dir, fi.Name())
+		var err error
+		if strings.HasPrefix(fi.Name(), "o-") {
+			err = verifyOutputFile(path, fi.Name()[2:])
+		} else {
+			err = dc.verifyActionFile(path)
+		}
+		if err == nil {
+			return nil
+		}
+		problems = append(problems, DiskProblem{Name: fi.Name(), Err: err})
+		if fix {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+	return checked, problems, err
+}
+
+func verifyOutputFile(path, outputID string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(io.Discard, NewVerifyingReader(f, outputID))
+	return err
+}
+
+func (dc *SimpleDiskCache) verifyActionFile(path string) error {
+	ij, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return fmt.Errorf("invalid index entry: %w", err)
+	}
+	if _, err := hex.DecodeString(ie.OutputID); err != nil || ie.OutputID == "" {
+		return fmt.Errorf("invalid output ID %q", ie.OutputID)
+	}
+	fi, err := os.Stat(filepath.Join(dc.dir, "o-"+ie.OutputID))
+	if err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+	if fi.Size() != ie.Size {
+		return fmt.Errorf("output has %d bytes, expected %d", fi.Size(), ie.Size)
+	}
+	return nil
+}
+
+// Export writes the entries of the cache to w as a tar archive, outputs
+// first, to be imported elsewhere with Import.
+func (dc *SimpleDiskCache) Export(w io.Writer) (DiskUsage, error) {
+	var (
+		exported DiskUsage
+		actions  []fs.FileInfo
+	)
+	tw := tar.NewWriter(w)
+	write := func(fi fs.FileInfo) error {
+		f, err := os.Open(filepath.Join(dc.dir, fi.Name()))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed since
+			}
+			return err
+		}
+		defer f.Close()
+		hdr := &tar.Header{Name: fi.Name(), Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, f, fi.Size()); err != nil {
+			return fmt.Errorf("%s: %w", fi.Name(), err)
+		}
+		exported.add(fi)
+		return nil
+	}
+	err := dc.entries(func(fi fs.FileInfo) error {
+		if strings.HasPrefix(fi.Name(), "a-") {
+			actions = append(actions, fi)
+			return nil
+		}
+		return write(fi)
+	})
+	if err != nil {
+		return exported, err
+	}
+	for _, fi := range actions {
+		if err := write(fi); err != nil {
+			return exported, err
+		}
+	}
+	return exported, tw.Close()
+}
+
+// Import adds the entries of a tar archive written by Export to the cache.
+// Outputs that don't match their IDs are refused, and so is everything
+// that isn't an entry.
+func (dc *SimpleDiskCache) Import(r io.Reader) (DiskUsage, error) {
+	var imported DiskUsage
+	if err := os.MkdirAll(dc.dir, 0755); err != nil {
+		return imported, err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !isEntry(hdr.Name) {
+			return imported, fmt.Errorf("%q is not a cache entry", hdr.Name)
+		}
+		var body io.Reader = tr
+		if strings.HasPrefix(hdr.Name, "o-") {
+			body = NewVerifyingReader(tr, hdr.Name[2:])
+		}
+		path := filepath.Join(dc.dir, hdr.Name)
+		if _, err := writeAtomic(path, body); err != nil {
+			return imported, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return imported, err
+		}
+		imported.add(fi)
+	}
+}
@@ -0,0 +1,121 @@
+package cachers
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putDisk puts body under actionID in dc.
+func putDisk(t *testing.T, dc *SimpleDiskCache, actionID, body string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(body))
+	outputID := hex.EncodeToString(sum[:])
+	_, err := dc.Put(context.Background(), actionID, outputID, int64(len(body)), strings.NewReader(body))
+	require.NoError(t, err)
+	return outputID
+}
+
+func TestSimpleDiskCacheUsageAndClean(t *testing.T) {
+	dir := t.TempDir()
+	dc := NewSimpleDiskCache(false, dir)
+	putDisk(t, dc, "a1", "hello")
+	putDisk(t, dc, "a2", "hello")
+	putDisk(t, dc, "b1", "world")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "uploads.json"), []byte("[]"), 0644))
+
+	u, err := dc.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, 3, u.Actions)
+	assert.Equal(t, 2, u.Outputs)
+
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a-a1", "a-a2"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), old, old))
+	}
+	removed, err := dc.Clean(time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed.Actions)
+	assert.Zero(t, removed.Outputs)
+
+	removed, err = dc.Clean(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, DiskUsage{Actions: 1, Outputs: 2, Bytes: removed.Bytes}, removed)
+	assert.FileExists(t, filepath.Join(dir, "uploads.json"), "only entries are removed")
+}
+
+func TestSimpleDiskCacheVerify(t *testing.T) {
+	dir := t.TempDir()
+	dc := NewSimpleDiskCache(false, dir)
+	putDisk(t, dc, "a1", "hello")
+	corrupt := putDisk(t, dc, "b1", "world")
+	putDisk(t, dc, "c1", "gone")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "o-"+corrupt), []byte("World"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "o-"+putDisk(t, dc, "c1", "gone"))))
+
+	checked, problems, err := dc.Verify(false)
+	require.NoError(t, err)
+	assert.Equal(t, 3, checked.Actions)
+	var names []string
+	for _, p := range problems {
+		names = append(names, p.Name)
+	}
+	assert.ElementsMatch(t, []string{"o-" + corrupt, "a-c1"}, names)
+
+	_, problems, err = dc.Verify(true)
+	require.NoError(t, err)
+	assert.Len(t, problems, 2)
+	_, problems, err = dc.Verify(false)
+	require.NoError(t, err)
+	// The action of the corrupt output now refers to a missing one.
+	require.Len(t, problems, 1)
+	assert.Equal(t, "a-b1", problems[0].Name)
+}
+
+func TestSimpleDiskCacheExportImport(t *testing.T) {
+	src := NewSimpleDiskCache(false, t.TempDir())
+	putDisk(t, src, "a1", "hello")
+	putDisk(t, src, "b1", "")
+	var archive bytes.Buffer
+	exported, err := src.Export(&archive)
+	require.NoError(t, err)
+	assert.Equal(t, 2, exported.Actions)
+
+	dst := NewSimpleDiskCache(false, filepath.Join(t.TempDir(), "new"))
+	imported, err := dst.Import(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, exported, imported)
+	outputID, diskPath, err := dst.Get(context.Background(), "a1")
+	require.NoError(t, err)
+	assert.NotEmpty(t, outputID)
+	b, err := os.ReadFile(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	for name, body := range map[string]string{
+		"../a-a1":                                "{}",
+		"o-" + strings.Repeat("00", sha256.Size): "corrupt",
+	} {
+		var bad bytes.Buffer
+		tw := tar.NewWriter(&bad)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}))
+		_, err := tw.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		_, err = dst.Import(&bad)
+		assert.Error(t, err, name)
+	}
+	_, problems, err := dst.Verify(false)
+	require.NoError(t, err)
+	assert.Empty(t, problems, "refused entries are not written")
+}
@@ -0,0 +1,71 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// DryRunCache is a LocalCache that answers every get as a miss and doesn't
+// store puts anywhere they would last: it keeps their outputs in a
+// temporary directory, for cmd/go to read during the session, and reports
+// what would have been transferred. It measures what a build would upload
+// to a cache before it is pointed at a shared one.
+type DryRunCache struct {
+	disk       *SimpleDiskCache
+	gets, puts atomic.Int64
+	putBytes   atomic.Int64
+}
+
+var _ LocalCache = &DryRunCache{}
+
+// NewDryRunCache returns a DryRunCache.
+func NewDryRunCache() *DryRunCache {
+	return &DryRunCache{}
+}
+
+func (d *DryRunCache) Kind() string {
+	return "dry-run"
+}
+
+func (d *DryRunCache) Start(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "go-cacher-dry-run-")
+	if err != nil {
+		return err
+	}
+	d.disk = NewSimpleDiskCache(false, dir)
+	return nil
+}
+
+func (d *DryRunCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	d.gets.Add(1)
+	return "", "", nil
+}
+
+func (d *DryRunCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	diskPath, err = d.disk.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", err
+	}
+	d.puts.Add(1)
+	d.putBytes.Add(size)
+	slog.DebugContext(ctx, "dry run: not storing put", "action", actionID, "output", outputID, "size", size)
+	return diskPath, nil
+}
+
+// Report returns the counts of the session: the gets answered as misses,
+// and the puts that would have been stored with their total size.
+func (d *DryRunCache) Report() (gets, puts, putBytes int64) {
+	return d.gets.Load(), d.puts.Load(), d.putBytes.Load()
+}
+
+func (d *DryRunCache) Close() error {
+	gets, puts, putBytes := d.Report()
+	slog.Info("dry run: nothing was stored", "gets", gets, "puts", puts, "put_bytes", formatBytes(float64(putBytes)))
+	if d.disk == nil {
+		return nil
+	}
+	return os.RemoveAll(d.disk.dir)
+}
@@ -0,0 +1,31 @@
+package cachers
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRunCache(t *testing.T) {
+	ctx := context.Background()
+	d := NewDryRunCache()
+	require.NoError(t, d.Start(ctx))
+	diskPath, err := d.Put(ctx, "a1", "o1", 5, strings.NewReader("hello"))
+	require.NoError(t, err)
+	b, err := os.ReadFile(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b), "the output is readable during the session")
+
+	outputID, _, err := d.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "every get is a miss")
+
+	gets, puts, putBytes := d.Report()
+	assert.Equal(t, []int64{1, 1, 5}, []int64{gets, puts, putBytes})
+	require.NoError(t, d.Close())
+	assert.NoFileExists(t, diskPath)
+}
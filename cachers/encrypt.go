@@ -0,0 +1,358 @@
+package cachers
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+)
+
+// The encrypted bodies stored by an EncryptedRemoteCache are a header of
+// encMagic and a random nonce prefix, followed by the body in chunks of
+// encChunkSize bytes, the last one possibly shorter or empty, each sealed
+// with AES-256-GCM under the nonce prefix and the index of the chunk. The
+// last chunk is authenticated as such, so a body can't be truncated at a
+// chunk boundary.
+//
+// The bodies encZstdMagic starts were compressed before being encrypted:
+// their plaintext is the size of the body, 8 bytes big-endian, followed by
+// its zstd compression. Their chunks are authenticated as such.
+const (
+	encMagic       = "GCE\x01"
+	encZstdMagic   = "GCE\x02"
+	encPrefixSize  = 8
+	encHeaderSize  = len(encMagic) + encPrefixSize
+	encChunkSize   = 64 << 10
+	encTagSize     = 16
+	encSealedChunk = encChunkSize + encTagSize
+)
+
+// EncryptedRemoteCache is a RemoteCache that encrypts the bodies it puts
+// to the cache it wraps, and decrypts those it gets, with a key only the
+// clients have, so that the storage provider can't read them. Bodies that
+// don't decrypt with the key, like those stored without encryption, fail
+// to read with ErrCorruptOutput, which a TieredCache treats as a miss.
+//
+// Ciphertext doesn't compress, so the buffered bodies are compressed
+// before they are encrypted, as the compression set with SetCompression
+// says, and the cache it wraps is told to send them as they are.
+//
+// Its HasOutput and PutAction fail with errors.ErrUnsupported: the
+// outputs of other writers may not be encrypted with the key.
+type EncryptedRemoteCache struct {
+	forwarder
+	aead        cipher.AEAD
+	compression Compression
+}
+
+var _ RemoteCache = &EncryptedRemoteCache{}
+var _ HealthChecker = &EncryptedRemoteCache{}
+var _ StatsReporter = &EncryptedRemoteCache{}
+var _ BatchChecker = &EncryptedRemoteCache{}
+
+// NewEncryptedRemoteCache returns cache wrapped to encrypt its bodies with
+// key, which must be 32 bytes long.
+func NewEncryptedRemoteCache(cache RemoteCache, key []byte) (*EncryptedRemoteCache, error) {
+	aead, err := newEncAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedRemoteCache{forwarder: forwarder{cache}, aead: aead}, nil
+}
+
+// newEncAEAD returns the AES-256-GCM of key, which must be 32 bytes long.
+func newEncAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key of %d bytes; want 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetCompression sets which bodies are compressed before they are
+// encrypted, with zstd for both CompressionAuto and CompressionZstd.
+func (c *EncryptedRemoteCache) SetCompression(compression Compression) {
+	c.compression = compression
+}
+
+func (c *EncryptedRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err != nil || outputID == "" || output == nil {
+		return outputID, size, output, err
+	}
+	if size, err = plaintextSize(size); err != nil {
+		output.Close()
+		return outputID, 0, nil, fmt.Errorf("%w: %v", ErrCorruptOutput, err)
+	}
+	if size, output, err = openEncrypted(c.aead, bufio.NewReaderSize(output, encSealedChunk), output, size); err != nil {
+		return outputID, 0, nil, err
+	}
+	return outputID, size, output, nil
+}
+
+func (c *EncryptedRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	plain, plainSize, compressed, release := compressPlaintext(c.compression, body, size)
+	defer release()
+	r, err := newEncryptingReader(c.aead, plain, compressed)
+	if err != nil {
+		return err
+	}
+	return c.cache.Put(withIncompressibleBody(ctx), actionID, outputID, ciphertextSize(plainSize), r)
+}
+
+func (c *EncryptedRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func (c *EncryptedRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return errors.ErrUnsupported
+}
+
+// compressPlaintext returns what to encrypt of body, of size: body itself,
+// or, if compression says to and it is smaller that way, the size of body
+// followed by its zstd compression, with compressed set. Only the buffered
+// bodies are compressed, whose size once compressed is known ahead. The
+// compressed bytes are to be given back with release.
+func compressPlaintext(compression Compression, body io.Reader, size int64) (plain io.Reader, plainSize int64, compressed bool, release func()) {
+	bb, ok := body.(*sbytes.Buffer)
+	if !ok || !compression.compresses(size) {
+		return body, size, false, func() {}
+	}
+	b := sbytes.Get(int(size / 2))
+	dst := binary.BigEndian.AppendUint64(b[:0], uint64(size))
+	dst = zstdEncoder.EncodeAll(bb.Bytes(), dst)
+	if int64(len(dst)) >= size {
+		sbytes.Put(b)
+		return body, size, false, func() {}
+	}
+	return sbytes.NewBuffer(dst), int64(len(dst)), true, func() { sbytes.Put(b) }
+}
+
+// openEncrypted returns the decryption with aead of the body r reads, of
+// size bytes once decrypted, which c closes, and its size once
+// decompressed, if it was compressed before being encrypted. It closes c
+// on error.
+func openEncrypted(aead cipher.AEAD, r *bufio.Reader, c io.Closer, size int64) (int64, io.ReadCloser, error) {
+	d := &decryptingReader{aead: aead, r: r, c: c}
+	if magic, err := r.Peek(len(encZstdMagic)); err != nil || string(magic) != encZstdMagic {
+		// The errors are those of the first read.
+		return size, d, nil
+	}
+	var prefix [8]byte
+	if _, err := io.ReadFull(d, prefix[:]); err != nil {
+		c.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("%w: truncated compressed body", ErrCorruptOutput)
+		}
+		return 0, nil, err
+	}
+	zr, err := NewZstdReader(d)
+	if err != nil {
+		c.Close()
+		return 0, nil, err
+	}
+	return int64(binary.BigEndian.Uint64(prefix[:])), zr, nil
+}
+
+// ciphertextSize returns the size of the encryption of a body of size
+// bytes.
+func ciphertextSize(size int64) int64 {
+	chunks := size/encChunkSize + 1
+	if size > 0 && size%encChunkSize == 0 {
+		chunks--
+	}
+	return int64(encHeaderSize) + size + chunks*encTagSize
+}
+
+// plaintextSize returns the size of the body of an encryption of size
+// bytes.
+func plaintextSize(size int64) (int64, error) {
+	if size < int64(encHeaderSize+encTagSize) {
+		return 0, fmt.Errorf("encrypted body of %d bytes is too short", size)
+	}
+	sealed := size - int64(encHeaderSize)
+	chunks := (sealed + encSealedChunk - 1) / encSealedChunk
+	if sealed%encSealedChunk != 0 && sealed%encSealedChunk < encTagSize {
+		return 0, fmt.Errorf("encrypted body of %d bytes has a truncated chunk", size)
+	}
+	return sealed - chunks*encTagSize, nil
+}
+
+// encNonce returns the nonce of the chunk at index i of a body encrypted
+// under prefix.
+func encNonce(prefix []byte, i uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], i)
+	return nonce
+}
+
+// encAAD authenticates whether a chunk is the last one, and whether the
+// body was compressed.
+func encAAD(last, compressed bool) []byte {
+	aad := []byte{0}
+	if last {
+		aad[0] = 1
+	}
+	if compressed {
+		aad = append(aad, 'z')
+	}
+	return aad
+}
+
+// newEncryptingReader returns a reader of the encryption of r with aead,
+// under a random nonce prefix; compressed says r reads a compressed body.
+func newEncryptingReader(aead cipher.AEAD, r io.Reader, compressed bool) (*encryptingReader, error) {
+	e := &encryptingReader{aead: aead, r: r, header: make([]byte, encHeaderSize), compressed: compressed}
+	copy(e.header, encMagic)
+	if compressed {
+		copy(e.header, encZstdMagic)
+	}
+	if _, err := rand.Read(e.header[len(encMagic):]); err != nil {
+		return nil, err
+	}
+	e.out = e.header
+	return e, nil
+}
+
+// encryptingReader reads the encryption of r.
+type encryptingReader struct {
+	aead       cipher.AEAD
+	r          io.Reader
+	header     []byte
+	compressed bool
+
+	out   []byte // encrypted bytes not read yet
+	buf   []byte
+	ahead []byte // the first byte of the next chunk
+	index uint32
+	done  bool
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk of r into out.
+func (e *encryptingReader) seal() error {
+	if e.buf == nil {
+		e.buf = make([]byte, encChunkSize+1, encSealedChunk+1)
+	}
+	// One byte read ahead tells whether the chunk is the last one.
+	buf := e.buf[:encChunkSize+1]
+	ahead := copy(buf, e.ahead)
+	n, err := io.ReadFull(e.r, buf[ahead:])
+	n += ahead
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		e.done = true
+	default:
+		return err
+	}
+	e.ahead = e.ahead[:0]
+	if !e.done {
+		e.ahead = append(e.ahead, buf[encChunkSize])
+		n = encChunkSize
+	}
+	e.out = e.aead.Seal(buf[:0], encNonce(e.header[len(encMagic):], e.index), buf[:n], encAAD(e.done, e.compressed))
+	e.index++
+	return nil
+}
+
+// decryptingReader reads the decryption of r, which c closes.
+type decryptingReader struct {
+	aead cipher.AEAD
+	r    *bufio.Reader
+	c    io.Closer
+
+	prefix     []byte // nil until the header is read
+	compressed bool   // read from the header
+	out        []byte // decrypted bytes not read yet
+	buf        []byte
+	index      uint32
+	done       bool
+	err        error
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk of r into out. A body that doesn't decrypt
+// is an ErrCorruptOutput; the errors reading r are returned as they are.
+func (d *decryptingReader) open() error {
+	if d.prefix == nil {
+		header := make([]byte, encHeaderSize)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("%w: truncated encryption header", ErrCorruptOutput)
+			}
+			return err
+		}
+		switch string(header[:len(encMagic)]) {
+		case encMagic:
+		case encZstdMagic:
+			d.compressed = true
+		default:
+			return fmt.Errorf("%w: body is not encrypted", ErrCorruptOutput)
+		}
+		d.prefix = header[len(encMagic):]
+		d.buf = make([]byte, encSealedChunk)
+	}
+	n, err := io.ReadFull(d.r, d.buf)
+	switch err {
+	case nil:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			d.done = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		d.done = true
+	default:
+		return err
+	}
+	out, err := d.aead.Open(d.buf[:0], encNonce(d.prefix, d.index), d.buf[:n], encAAD(d.done, d.compressed))
+	if err != nil {
+		return fmt.Errorf("%w: decrypting chunk %d: %v", ErrCorruptOutput, d.index, err)
+	}
+	d.out = out
+	d.index++
+	return nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.c.Close()
+}
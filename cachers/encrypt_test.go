@@ -0,0 +1,143 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 17} {
+			t.Run(fmt.Sprint(size), func(t *testing.T) {
+				remote := newFakeRemote("fake")
+				c, err := NewEncryptedRemoteCache(remote, key)
+				require.NoError(t, err)
+				body := make([]byte, size)
+				_, _ = rand.Read(body)
+				require.NoError(t, c.Put(ctx, "a1", "0123", int64(size), bytes.NewReader(body)))
+
+				stored := remote.entries["a1"].body
+				assert.Equal(t, ciphertextSize(int64(size)), int64(len(stored)))
+				if size > 16 {
+					assert.False(t, bytes.Contains(stored, body[:16]), "the body is stored encrypted")
+				}
+
+				outputID, gotSize, output, err := c.Get(ctx, "a1")
+				require.NoError(t, err)
+				assert.Equal(t, "0123", outputID)
+				assert.Equal(t, int64(size), gotSize)
+				got, err := io.ReadAll(output)
+				require.NoError(t, err)
+				require.NoError(t, output.Close())
+				assert.Equal(t, body, got)
+			})
+		}
+	})
+
+	t.Run("miss", func(t *testing.T) {
+		c, err := NewEncryptedRemoteCache(newFakeRemote("fake"), key)
+		require.NoError(t, err)
+		outputID, _, output, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.Empty(t, outputID)
+		assert.Nil(t, output)
+	})
+
+	t.Run("undecryptable", func(t *testing.T) {
+		remote := newFakeRemote("fake")
+		c, err := NewEncryptedRemoteCache(remote, key)
+		require.NoError(t, err)
+		body := bytes.Repeat([]byte("hello"), encChunkSize/4)
+		require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+
+		read := func(c RemoteCache, stored []byte) error {
+			remote.entries["a1"] = fakeEntry{outputID: "0123", body: stored}
+			_, _, output, err := c.Get(ctx, "a1")
+			if err != nil {
+				return err
+			}
+			defer output.Close()
+			_, err = io.ReadAll(output)
+			return err
+		}
+		stored := remote.entries["a1"].body
+
+		other, err := NewEncryptedRemoteCache(remote, bytes.Repeat([]byte{8}, 32))
+		require.NoError(t, err)
+		assert.ErrorIs(t, read(other, stored), ErrCorruptOutput, "wrong key")
+
+		tampered := bytes.Clone(stored)
+		tampered[len(tampered)/2] ^= 1
+		assert.ErrorIs(t, read(c, tampered), ErrCorruptOutput, "tampered")
+
+		truncated := stored[:encHeaderSize+encSealedChunk]
+		assert.ErrorIs(t, read(c, truncated), ErrCorruptOutput, "truncated at a chunk boundary")
+
+		assert.ErrorIs(t, read(c, bytes.Repeat([]byte("x"), 100)), ErrCorruptOutput, "not encrypted")
+		assert.ErrorIs(t, read(c, []byte("short")), ErrCorruptOutput, "too short")
+
+		assert.NoError(t, read(c, stored))
+	})
+
+	t.Run("key size", func(t *testing.T) {
+		_, err := NewEncryptedRemoteCache(newFakeRemote("fake"), []byte("short"))
+		assert.ErrorContains(t, err, "want 32")
+	})
+}
+
+func TestEncryptedS3Compression(t *testing.T) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("go build object file "), 1000)
+	for name, newCache := range map[string]func(RemoteCache) RemoteCache{
+		"key": func(remote RemoteCache) RemoteCache {
+			c, err := NewEncryptedRemoteCache(remote, bytes.Repeat([]byte{7}, 32))
+			require.NoError(t, err)
+			return c
+		},
+		"envelope": func(remote RemoteCache) RemoteCache {
+			return NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{keyID: "k1"})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := &fakeS3{objects: map[string]fakeObject{}}
+			s3c := NewS3Cache(client, "bucket", "prefix", false)
+			c := newCache(s3c)
+			require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), sbytes.NewBuffer(bytes.Clone(body))))
+
+			o := client.objects[s3c.actionKey("a1")]
+			assert.Less(t, len(o.body), len(body)/4, "stored compressed")
+			assert.Empty(t, o.metadata[compressedMetadataKey], "the ciphertext isn't compressed again")
+
+			_, size, output, err := c.Get(ctx, "a1")
+			require.NoError(t, err)
+			assert.EqualValues(t, len(body), size)
+			got, err := io.ReadAll(output)
+			require.NoError(t, err)
+			require.NoError(t, output.Close())
+			assert.Equal(t, body, got)
+
+			if name == "key" {
+				// The compression is authenticated.
+				tampered := bytes.Clone(o.body)
+				copy(tampered, encMagic)
+				client.objects[s3c.actionKey("a1")] = fakeObject{body: tampered, metadata: o.metadata}
+				_, _, output, err := c.Get(ctx, "a1")
+				require.NoError(t, err)
+				_, err = io.ReadAll(output)
+				assert.ErrorIs(t, err, ErrCorruptOutput)
+				output.Close()
+			}
+		})
+	}
+}
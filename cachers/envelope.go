@@ -0,0 +1,216 @@
+package cachers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A KeyWrapper wraps and unwraps the data keys of an
+// EnvelopeRemoteCache with a master key it holds, like a key of AWS KMS,
+// which the clients of a cache use without ever having it.
+type KeyWrapper interface {
+	// GenerateDataKey returns a new 32-byte data key, and the data key
+	// wrapped with the master key.
+	GenerateDataKey(ctx context.Context) (key, wrapped []byte, err error)
+	// UnwrapDataKey returns the data key wrapped in wrapped.
+	UnwrapDataKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// The bodies stored by an EnvelopeRemoteCache are a header of envMagic and
+// the size and the bytes of their wrapped data key, followed by the body
+// encrypted with the data key as an EncryptedRemoteCache does.
+const (
+	envMagic      = "GCK\x01"
+	envHeaderSize = len(envMagic) + 2
+	// envMaxWrapped bounds the wrapped data keys read, which are a few
+	// hundred bytes from KMS.
+	envMaxWrapped = 4 << 10
+)
+
+const (
+	// envDataKeyUses is how many bodies a data key encrypts before a new one
+	// is generated. Each body has a random 64-bit nonce prefix, so this
+	// keeps the odds of reusing a nonce under a key negligible, while
+	// saving a call to the KeyWrapper for each put.
+	envDataKeyUses = 4096
+	// envMaxUnwrapped bounds the unwrapped data keys kept, by their wrapped
+	// form, so the gets of the bodies of a same writer unwrap its key once.
+	envMaxUnwrapped = 1024
+)
+
+// EnvelopeRemoteCache is a RemoteCache that encrypts the bodies it puts to
+// the cache it wraps, and decrypts those it gets, like an
+// EncryptedRemoteCache, but with data keys a KeyWrapper generates, their
+// wrapped form stored with the bodies. Clients sharing a cache thus only
+// need the right to use the master key, which can be rotated, or revoked,
+// without sharing nor changing any secret. Bodies that aren't
+// envelope-encrypted fail to read with ErrCorruptOutput, which a
+// TieredCache treats as a miss; those whose data key can't be unwrapped,
+// like when the master key was revoked, fail with the error of the
+// KeyWrapper.
+//
+// Its HasOutput and PutAction fail with errors.ErrUnsupported: the
+// outputs of other writers may not be encrypted.
+type EnvelopeRemoteCache struct {
+	forwarder
+	wrapper     KeyWrapper
+	compression Compression
+
+	mu        sync.Mutex
+	aead      cipher.AEAD // of the current data key; nil until the first put
+	wrapped   []byte      // the current data key, wrapped
+	uses      int         // of the current data key
+	unwrapped map[string]cipher.AEAD
+}
+
+var _ RemoteCache = &EnvelopeRemoteCache{}
+var _ HealthChecker = &EnvelopeRemoteCache{}
+var _ StatsReporter = &EnvelopeRemoteCache{}
+var _ BatchChecker = &EnvelopeRemoteCache{}
+
+// NewEnvelopeRemoteCache returns cache wrapped to encrypt its bodies with
+// data keys wrapped by wrapper.
+func NewEnvelopeRemoteCache(cache RemoteCache, wrapper KeyWrapper) *EnvelopeRemoteCache {
+	return &EnvelopeRemoteCache{forwarder: forwarder{cache}, wrapper: wrapper, unwrapped: map[string]cipher.AEAD{}}
+}
+
+// SetCompression sets which bodies are compressed before they are
+// encrypted, as for an EncryptedRemoteCache.
+func (c *EnvelopeRemoteCache) SetCompression(compression Compression) {
+	c.compression = compression
+}
+
+func (c *EnvelopeRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err != nil || outputID == "" || output == nil {
+		return outputID, size, output, err
+	}
+	r := bufio.NewReaderSize(output, encSealedChunk)
+	wrapped, err := readEnvelopeHeader(r)
+	if err == nil {
+		size, err = plaintextSize(size - int64(envHeaderSize+len(wrapped)))
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrCorruptOutput, err)
+		}
+	}
+	var aead cipher.AEAD
+	if err == nil {
+		aead, err = c.unwrap(ctx, wrapped)
+	}
+	if err != nil {
+		output.Close()
+		return outputID, 0, nil, err
+	}
+	if size, output, err = openEncrypted(aead, r, output, size); err != nil {
+		return outputID, 0, nil, err
+	}
+	return outputID, size, output, nil
+}
+
+// readEnvelopeHeader reads the header of an envelope-encrypted body from
+// r, returning its wrapped data key.
+func readEnvelopeHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, envHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated envelope header", ErrCorruptOutput)
+		}
+		return nil, err
+	}
+	if string(header[:len(envMagic)]) != envMagic {
+		return nil, fmt.Errorf("%w: body is not envelope-encrypted", ErrCorruptOutput)
+	}
+	n := binary.BigEndian.Uint16(header[len(envMagic):])
+	if n == 0 || n > envMaxWrapped {
+		return nil, fmt.Errorf("%w: wrapped data key of %d bytes", ErrCorruptOutput, n)
+	}
+	wrapped := make([]byte, n)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated envelope header", ErrCorruptOutput)
+		}
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// unwrap returns the AEAD of the data key wrapped in wrapped.
+func (c *EnvelopeRemoteCache) unwrap(ctx context.Context, wrapped []byte) (cipher.AEAD, error) {
+	c.mu.Lock()
+	aead, ok := c.unwrapped[string(wrapped)]
+	c.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	key, err := c.wrapper.UnwrapDataKey(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping the data key: %w", err)
+	}
+	if aead, err = newEncAEAD(key); err != nil {
+		return nil, fmt.Errorf("%w: unwrapped data key: %v", ErrCorruptOutput, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.unwrapped) >= envMaxUnwrapped {
+		clear(c.unwrapped)
+	}
+	c.unwrapped[string(wrapped)] = aead
+	return aead, nil
+}
+
+func (c *EnvelopeRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	aead, wrapped, err := c.dataKey(ctx)
+	if err != nil {
+		return err
+	}
+	plain, plainSize, compressed, release := compressPlaintext(c.compression, body, size)
+	defer release()
+	r, err := newEncryptingReader(aead, plain, compressed)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, envHeaderSize, envHeaderSize+len(wrapped))
+	copy(header, envMagic)
+	binary.BigEndian.PutUint16(header[len(envMagic):], uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	return c.cache.Put(withIncompressibleBody(ctx), actionID, outputID, int64(len(header))+ciphertextSize(plainSize), io.MultiReader(bytes.NewReader(header), r))
+}
+
+func (c *EnvelopeRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func (c *EnvelopeRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return errors.ErrUnsupported
+}
+
+// dataKey returns the AEAD of the data key to encrypt a body with, and the
+// data key wrapped, generating a new one every envDataKeyUses bodies.
+func (c *EnvelopeRemoteCache) dataKey(ctx context.Context) (cipher.AEAD, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aead == nil || c.uses >= envDataKeyUses {
+		key, wrapped, err := c.wrapper.GenerateDataKey(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generating a data key: %w", err)
+		}
+		if len(wrapped) == 0 || len(wrapped) > envMaxWrapped {
+			return nil, nil, fmt.Errorf("generating a data key: wrapped data key of %d bytes", len(wrapped))
+		}
+		aead, err := newEncAEAD(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generating a data key: %w", err)
+		}
+		c.aead, c.wrapped, c.uses = aead, wrapped, 0
+		c.unwrapped[string(wrapped)] = aead
+	}
+	c.uses++
+	return c.aead, c.wrapped, nil
+}
@@ -0,0 +1,108 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKeyWrapper "wraps" data keys by prefixing them with its key ID,
+// counting its calls.
+type fakeKeyWrapper struct {
+	keyID     string
+	revoked   bool
+	generated int
+	unwrapped int
+}
+
+func (w *fakeKeyWrapper) GenerateDataKey(ctx context.Context) (key, wrapped []byte, err error) {
+	w.generated++
+	key = make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key, append([]byte(w.keyID+":"), key...), nil
+}
+
+func (w *fakeKeyWrapper) UnwrapDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	w.unwrapped++
+	if w.revoked {
+		return nil, errors.New("AccessDeniedException: key revoked")
+	}
+	_, key, _ := strings.Cut(string(wrapped), ":")
+	return []byte(key), nil
+}
+
+func TestEnvelopeRemoteCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("round trip", func(t *testing.T) {
+		remote := newFakeRemote("fake")
+		w := &fakeKeyWrapper{keyID: "k1"}
+		c := NewEnvelopeRemoteCache(remote, w)
+		body := bytes.Repeat([]byte("hello"), encChunkSize/2)
+		require.NoError(t, c.Put(ctx, "a1", "0123", int64(len(body)), bytes.NewReader(body)))
+		require.NoError(t, c.Put(ctx, "a2", "4567", 0, bytes.NewReader(nil)))
+		assert.Equal(t, 1, w.generated, "the data key is reused")
+
+		stored := remote.entries["a1"].body
+		assert.Equal(t, int64(envHeaderSize+len("k1:")+32)+ciphertextSize(int64(len(body))), int64(len(stored)))
+		assert.False(t, bytes.Contains(stored, body[:16]), "the body is stored encrypted")
+
+		// Another client unwraps the data key once.
+		other := NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{keyID: "k1"})
+		for _, c := range []*EnvelopeRemoteCache{c, other} {
+			outputID, size, output, err := c.Get(ctx, "a1")
+			require.NoError(t, err)
+			assert.Equal(t, "0123", outputID)
+			assert.Equal(t, int64(len(body)), size)
+			got, err := io.ReadAll(output)
+			require.NoError(t, err)
+			require.NoError(t, output.Close())
+			assert.Equal(t, body, got)
+
+			_, size, output, err = c.Get(ctx, "a2")
+			require.NoError(t, err)
+			assert.Zero(t, size)
+			got, err = io.ReadAll(output)
+			require.NoError(t, err)
+			assert.Empty(t, got)
+		}
+		assert.Zero(t, w.unwrapped)
+		assert.Equal(t, 1, other.wrapper.(*fakeKeyWrapper).unwrapped)
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		remote := newFakeRemote("fake")
+		require.NoError(t, NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{keyID: "k1"}).Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+		c := NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{keyID: "k1", revoked: true})
+		_, _, output, err := c.Get(ctx, "a1")
+		assert.ErrorContains(t, err, "key revoked")
+		assert.NotErrorIs(t, err, ErrCorruptOutput)
+		assert.Nil(t, output)
+	})
+
+	t.Run("not envelope-encrypted", func(t *testing.T) {
+		remote := newFakeRemote("fake")
+		require.NoError(t, remote.Put(ctx, "a1", "0123", 64, bytes.NewReader(make([]byte, 64))))
+		_, _, _, err := NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{keyID: "k1"}).Get(ctx, "a1")
+		assert.ErrorIs(t, err, ErrCorruptOutput)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		remote := newFakeRemote("fake")
+		c := NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{keyID: "k1"})
+		require.NoError(t, c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+		stored := remote.entries["a1"].body
+		stored[len(stored)-1] ^= 1
+		_, _, output, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		_, err = io.ReadAll(output)
+		assert.ErrorIs(t, err, ErrCorruptOutput)
+	})
+}
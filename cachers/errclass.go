@@ -0,0 +1,86 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+)
+
+// The classes of the errors of the backends, as ClassifyError returns
+// them.
+const (
+	ErrorAuth      = "auth"      // credentials missing, invalid or denied
+	ErrorNetwork   = "network"   // the backend couldn't be reached, or timed out
+	ErrorNotFound  = "not-found" // the bucket or the endpoint doesn't exist
+	ErrorThrottled = "throttled" // the backend asked to slow down
+	ErrorCorrupt   = "corrupt"   // an output didn't match its ID
+	ErrorQuota     = "quota"     // the backend, or the local disk, is full
+	ErrorOther     = "other"
+)
+
+// ErrorClasses lists the classes of ClassifyError.
+var ErrorClasses = []string{ErrorAuth, ErrorNetwork, ErrorNotFound, ErrorThrottled, ErrorCorrupt, ErrorQuota, ErrorOther}
+
+// ClassifyError returns the class of err, an error of a backend, like
+// ErrorAuth or ErrorThrottled, so that failures can be counted by what
+// would fix them.
+func ClassifyError(err error) string {
+	if errors.Is(err, ErrCorruptOutput) {
+		return ErrorCorrupt
+	}
+	if isDiskFull(err) {
+		return ErrorQuota
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken", "TokenRefreshRequired",
+			"AccessDeniedException", "DisabledException":
+			return ErrorAuth
+		case "NoSuchBucket":
+			return ErrorNotFound
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+			return ErrorThrottled
+		case "QuotaExceeded", "EntityTooLarge":
+			return ErrorQuota
+		}
+	}
+	var se interface{ HTTPStatusCode() int }
+	if errors.As(err, &se) {
+		switch code := se.HTTPStatusCode(); {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return ErrorAuth
+		case code == http.StatusNotFound:
+			return ErrorNotFound
+		case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+			return ErrorThrottled
+		case code == http.StatusRequestEntityTooLarge || code == http.StatusInsufficientStorage:
+			return ErrorQuota
+		}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, ErrStalled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorNetwork
+	}
+	return ErrorOther
+}
+
+// isWriteDenied reports whether err, the error of a write to a backend,
+// means that the credentials don't allow writing, rather than being wrong
+// or expired: an HTTP 403 or an AccessDenied of S3 or KMS.
+func isWriteDenied(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "AccessDenied", "AccessDeniedException":
+			return true
+		}
+	}
+	var se interface{ HTTPStatusCode() int }
+	return errors.As(err, &se) && se.HTTPStatusCode() == http.StatusForbidden
+}
@@ -0,0 +1,73 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{&StatusError{StatusCode: 401}, ErrorAuth},
+		{fmt.Errorf("put: %w", &StatusError{StatusCode: 403}), ErrorAuth},
+		{&smithy.GenericAPIError{Code: "InvalidAccessKeyId"}, ErrorAuth},
+		{fmt.Errorf("unwrapping the data key: %w", &smithy.GenericAPIError{Code: "DisabledException"}), ErrorAuth},
+		{&smithy.GenericAPIError{Code: "NoSuchBucket"}, ErrorNotFound},
+		{&StatusError{StatusCode: 404}, ErrorNotFound},
+		{&StatusError{StatusCode: 429}, ErrorThrottled},
+		{&smithy.GenericAPIError{Code: "SlowDown"}, ErrorThrottled},
+		{&StatusError{StatusCode: 507}, ErrorQuota},
+		{fmt.Errorf("write: %w", syscall.ENOSPC), ErrorQuota},
+		{fmt.Errorf("%w: got sha256 00", ErrCorruptOutput), ErrorCorrupt},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorNetwork},
+		{context.DeadlineExceeded, ErrorNetwork},
+		{fmt.Errorf("%w: no progress for 1s", ErrStalled), ErrorNetwork},
+		{io.ErrUnexpectedEOF, ErrorNetwork},
+		{&StatusError{StatusCode: 500}, ErrorOther},
+		{errors.New("boom"), ErrorOther},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			assert.Equal(t, tc.want, ClassifyError(tc.err))
+		})
+	}
+}
+
+func TestIsWriteDenied(t *testing.T) {
+	assert.True(t, isWriteDenied(fmt.Errorf("put: %w", &StatusError{StatusCode: 403})))
+	assert.True(t, isWriteDenied(&smithy.GenericAPIError{Code: "AccessDenied"}))
+	assert.False(t, isWriteDenied(&StatusError{StatusCode: 401}), "bad credentials may be fixed by a refresh")
+	assert.False(t, isWriteDenied(&smithy.GenericAPIError{Code: "ExpiredToken"}))
+	assert.False(t, isWriteDenied(errors.New("boom")))
+	assert.False(t, isWriteDenied(nil))
+}
+
+func TestCountsErrorClasses(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	c := NewRemoteCacheWithCounts(remote, "remote", false)
+	assert.Nil(t, CacheStats(c)[0].Errors)
+
+	remote.err = &StatusError{StatusCode: 429}
+	_, _, _, err := c.Get(ctx, "a1")
+	require.Error(t, err)
+	remote.err = &StatusError{StatusCode: 403}
+	require.Error(t, c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+	_, _, _, err = c.Get(ctx, "a1")
+	require.Error(t, err)
+	assert.Equal(t, map[string]int64{ErrorThrottled: 1, ErrorAuth: 2}, CacheStats(c)[0].Errors)
+
+	sum := NewSummaryCache(NewLocalCacheWithCounts(NewSimpleDiskCache(false, t.TempDir()), "local", false))
+	assert.Nil(t, sum.Summary().BackendErrors)
+}
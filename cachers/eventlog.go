@@ -0,0 +1,155 @@
+package cachers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// EventLogCache is a LocalCache that records every get and put of the
+// cache it wraps to a writer, one JSON object per line, for the offline
+// analysis of the hit patterns of builds and of the size a cache needs.
+type EventLogCache struct {
+	cache LocalCache
+
+	mu  sync.Mutex // guards enc
+	enc *json.Encoder
+}
+
+// An Event is an entry of the log written by an EventLogCache.
+type Event struct {
+	Time     time.Time
+	Op       string // "get" or "put"
+	ActionID string
+	OutputID string `json:",omitempty"`
+	// Result is "hit", "miss" or "error" for a get, "ok" or "error" for a
+	// put.
+	Result string
+	// Tier is the tier that answered a hit, like "local" or "remote".
+	Tier     string `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+	Request  int64  `json:",omitempty"` // the protocol request ID, if known
+}
+
+var _ LocalCache = &EventLogCache{}
+var _ HealthChecker = &EventLogCache{}
+var _ StatsReporter = &EventLogCache{}
+var _ QueueReporter = &EventLogCache{}
+var _ LocalOutputStore = &EventLogCache{}
+
+func NewEventLogCache(cache LocalCache, w io.Writer) *EventLogCache {
+	return &EventLogCache{cache: cache, enc: json.NewEncoder(w)}
+}
+
+func (e *EventLogCache) Kind() string {
+	return e.cache.Kind()
+}
+
+func (e *EventLogCache) TierStats() []TierStats {
+	return CacheStats(e.cache)
+}
+
+func (e *EventLogCache) QueueStats() QueueStats {
+	return CacheQueues(e.cache)
+}
+
+func (e *EventLogCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, e.cache)
+}
+
+func (e *EventLogCache) Start(ctx context.Context) error {
+	return e.cache.Start(ctx)
+}
+
+func (e *EventLogCache) Close() error {
+	return e.cache.Close()
+}
+
+func (e *EventLogCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	start := time.Now()
+	ctx, tier := withHitTier(ctx)
+	outputID, diskPath, err = e.cache.Get(ctx, actionID)
+	ev := Event{Time: start, Op: "get", ActionID: actionID, OutputID: outputID, Duration: time.Since(start)}
+	switch {
+	case err != nil:
+		ev.Result, ev.Error = "error", err.Error()
+	case outputID == "":
+		ev.Result = "miss"
+	default:
+		ev.Result, ev.Tier = "hit", *tier
+		if ev.Tier == "" {
+			ev.Tier = "local"
+		}
+		if fi, err := os.Stat(diskPath); err == nil {
+			ev.Size = fi.Size()
+		}
+	}
+	e.record(ctx, ev)
+	return outputID, diskPath, err
+}
+
+func (e *EventLogCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	start := time.Now()
+	diskPath, err = e.cache.Put(ctx, actionID, outputID, size, body)
+	e.recordPut(ctx, start, actionID, outputID, size, err)
+	return diskPath, err
+}
+
+func (e *EventLogCache) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := e.cache.(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+// PutAction is recorded as a put.
+func (e *EventLogCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := e.cache.(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	start := time.Now()
+	diskPath, err = los.PutAction(ctx, actionID, outputID, size)
+	e.recordPut(ctx, start, actionID, outputID, size, err)
+	return diskPath, err
+}
+
+func (e *EventLogCache) recordPut(ctx context.Context, start time.Time, actionID, outputID string, size int64, err error) {
+	ev := Event{Time: start, Op: "put", ActionID: actionID, OutputID: outputID, Result: "ok", Size: size, Duration: time.Since(start)}
+	if err != nil {
+		ev.Result, ev.Error = "error", err.Error()
+	}
+	e.record(ctx, ev)
+}
+
+func (e *EventLogCache) record(ctx context.Context, ev Event) {
+	ev.Request, _ = RequestID(ctx)
+	e.mu.Lock()
+	err := e.enc.Encode(ev)
+	e.mu.Unlock()
+	if err != nil {
+		slog.WarnContext(ctx, "failed to log event", "op", ev.Op, "action", ev.ActionID, "err", err)
+	}
+}
+
+type hitTierKey struct{}
+
+// withHitTier returns a copy of ctx in which a TieredCache records the
+// tier that answers a get, and where it records it.
+func withHitTier(ctx context.Context) (context.Context, *string) {
+	tier := new(string)
+	return context.WithValue(ctx, hitTierKey{}, tier), tier
+}
+
+// setHitTier records tier as the one that answered the get of ctx, if an
+// EventLogCache asked for it.
+func setHitTier(ctx context.Context, tier string) {
+	if p, ok := ctx.Value(hitTierKey{}).(*string); ok {
+		*p = tier
+	}
+}
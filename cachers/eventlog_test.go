@@ -0,0 +1,49 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLogCache(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.entries["r1"] = fakeEntry{outputID: sha256Hex("remote"), body: []byte("remote")}
+	var buf bytes.Buffer
+	c := NewEventLogCache(NewCombinedCache(NewSimpleDiskCache(false, t.TempDir()), remote, false), &buf)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	_, err := c.Put(WithRequestID(ctx, 3), "a1", "0123", 5, sbytes.NewBuffer([]byte("hello")))
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "a1") // local hit
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "r1") // remote hit
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "a2") // miss
+	require.NoError(t, err)
+
+	var events []Event
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev Event
+		require.NoError(t, dec.Decode(&ev))
+		assert.False(t, ev.Time.IsZero())
+		assert.Positive(t, ev.Duration)
+		ev.Time, ev.Duration = time.Time{}, 0
+		events = append(events, ev)
+	}
+	assert.Equal(t, []Event{
+		{Op: "put", ActionID: "a1", OutputID: "0123", Result: "ok", Size: 5, Request: 3},
+		{Op: "get", ActionID: "a1", OutputID: "0123", Result: "hit", Tier: "local", Size: 5},
+		{Op: "get", ActionID: "r1", OutputID: sha256Hex("remote"), Result: "hit", Tier: "remote", Size: 6},
+		{Op: "get", ActionID: "a2", Result: "miss"},
+	}, events)
+}
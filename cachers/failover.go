@@ -0,0 +1,207 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FailoverRemoteCache is a RemoteCache that sends all operations to the
+// first healthy remote of an ordered list. Remotes are probed periodically;
+// when the primary comes back it is used again.
+type FailoverRemoteCache struct {
+	remotes  []RemoteCache
+	healthy  []atomic.Bool
+	interval time.Duration
+	verbose  bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+var _ RemoteCache = &FailoverRemoteCache{}
+var _ HealthChecker = &FailoverRemoteCache{}
+var _ BatchChecker = &FailoverRemoteCache{}
+
+// NewFailoverRemoteCache returns a FailoverRemoteCache that probes remotes
+// every interval. Remotes that do not implement HealthChecker are assumed
+// healthy at every probe and only marked down when an operation fails.
+func NewFailoverRemoteCache(remotes []RemoteCache, interval time.Duration, verbose bool) *FailoverRemoteCache {
+	f := &FailoverRemoteCache{
+		remotes:  remotes,
+		healthy:  make([]atomic.Bool, len(remotes)),
+		interval: interval,
+		verbose:  verbose,
+		stop:     make(chan struct{}),
+	}
+	for i := range f.healthy {
+		f.healthy[i].Store(true)
+	}
+	return f
+}
+
+func (f *FailoverRemoteCache) Kind() string {
+	kinds := make([]string, len(f.remotes))
+	for i, r := range f.remotes {
+		kinds[i] = r.Kind()
+	}
+	return "failover(" + strings.Join(kinds, ",") + ")"
+}
+
+func (f *FailoverRemoteCache) Start(ctx context.Context) error {
+	for i, r := range f.remotes {
+		if err := r.Start(ctx); err != nil {
+			for _, started := range f.remotes[:i] {
+				_ = started.Close()
+			}
+			return fmt.Errorf("%s start failed: %w", r.Kind(), err)
+		}
+	}
+	f.probe(ctx)
+	f.wg.Add(1)
+	go f.probeLoop(ctx)
+	return nil
+}
+
+func (f *FailoverRemoteCache) probeLoop(ctx context.Context) {
+	defer f.wg.Done()
+	t := time.NewTicker(f.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.probe(ctx)
+		}
+	}
+}
+
+// probe checks all remotes concurrently and updates their health.
+func (f *FailoverRemoteCache) probe(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i, r := range f.remotes {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if hc, ok := r.(HealthChecker); ok {
+				pctx, cancel := context.WithTimeout(ctx, f.interval)
+				err = hc.HealthCheck(pctx)
+				cancel()
+			}
+			f.setHealthy(i, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func (f *FailoverRemoteCache) setHealthy(i int, err error) {
+	healthy := err == nil
+	if f.healthy[i].Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		slog.Info("remote is healthy again", "cache", f.remotes[i].Kind())
+	} else {
+		slog.Warn("remote marked down", "cache", f.remotes[i].Kind(), "err", err)
+	}
+}
+
+// active returns the index of the first healthy remote, or -1.
+func (f *FailoverRemoteCache) active() int {
+	for i := range f.remotes {
+		if f.healthy[i].Load() {
+			return i
+		}
+	}
+	return -1
+}
+
+var errNoHealthyRemote = errors.New("no healthy remote")
+
+func (f *FailoverRemoteCache) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	var errs []error
+	// Each failure marks the remote down, so this moves on to the next one.
+	for i := f.active(); i >= 0; i = f.active() {
+		r := f.remotes[i]
+		outputID, size, output, err := r.Get(ctx, actionID)
+		if err == nil {
+			return outputID, size, output, nil
+		}
+		if ctx.Err() != nil {
+			return "", 0, nil, err
+		}
+		if f.verbose {
+			slog.DebugContext(ctx, "get failed", "cache", r.Kind(), "action", actionID, "err", err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r.Kind(), err))
+		f.setHealthy(i, err)
+	}
+	if len(errs) == 0 {
+		return "", 0, nil, errNoHealthyRemote
+	}
+	return "", 0, nil, errors.Join(errs...)
+}
+
+// BatchExists asks the active remote which of the actions it stores, moving
+// on to the next healthy one if it fails, like Get.
+func (f *FailoverRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	var errs []error
+	for i := f.active(); i >= 0; i = f.active() {
+		r := f.remotes[i]
+		exists, err := BatchExists(ctx, r, actionIDs)
+		if err == nil || ctx.Err() != nil || errors.Is(err, errors.ErrUnsupported) {
+			return exists, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", r.Kind(), err))
+		f.setHealthy(i, err)
+	}
+	if len(errs) == 0 {
+		return nil, errNoHealthyRemote
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (f *FailoverRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	// The body can only be read once, so a failed put is not retried
+	// elsewhere; the next one goes to the new active remote.
+	i := f.active()
+	if i < 0 {
+		return errNoHealthyRemote
+	}
+	r := f.remotes[i]
+	err := r.Put(ctx, actionID, outputID, size, body)
+	if err != nil && ctx.Err() == nil {
+		f.setHealthy(i, err)
+		return fmt.Errorf("%s: %w", r.Kind(), err)
+	}
+	return err
+}
+
+// HealthCheck reports whether any remote is healthy, probing them all.
+func (f *FailoverRemoteCache) HealthCheck(ctx context.Context) error {
+	return anyHealthy(ctx, f.remotes)
+}
+
+func (f *FailoverRemoteCache) Close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	f.wg.Wait()
+	var errAll error
+	for _, r := range f.remotes {
+		if err := r.Close(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("%s stop failed: %w", r.Kind(), err))
+		}
+	}
+	return errAll
+}
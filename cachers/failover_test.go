@@ -0,0 +1,36 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverRemoteCache(t *testing.T) {
+	primary, secondary := newFakeRemote("primary"), newFakeRemote("secondary")
+	secondary.entries["a1"] = fakeEntry{outputID: "o1", body: []byte("x")}
+	f := NewFailoverRemoteCache([]RemoteCache{primary, secondary}, time.Hour, false)
+	require.NoError(t, f.Start(context.Background()))
+	defer f.Close()
+
+	outputID, _, _, err := f.Get(context.Background(), "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "primary should answer while healthy")
+
+	primary.err = errors.New("connection refused")
+	outputID, _, _, err = f.Get(context.Background(), "a1")
+	require.NoError(t, err)
+	assert.Equal(t, "o1", outputID, "should fail over to the secondary")
+	assert.Equal(t, 1, f.active())
+
+	primary.err = nil
+	f.probe(context.Background())
+	assert.Equal(t, 0, f.active(), "should fail back once the primary recovers")
+
+	require.NoError(t, f.Close())
+	assert.NoError(t, f.Close(), "closing again")
+}
@@ -0,0 +1,90 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// FailureReportRemoteCache is a RemoteCache that reports when the cache it
+// wraps keeps failing: once threshold operations in a row have failed, it
+// calls report with the number of failures and the last error, and not
+// again until an operation has succeeded. Failures of operations whose
+// context is done, which are the caller's, and of the ones the wrapped
+// cache doesn't support don't count, and neither do health checks.
+type FailureReportRemoteCache struct {
+	forwarder
+	threshold int
+	report    func(failures int, err error)
+
+	mu       sync.Mutex
+	failures int // in a row
+}
+
+var _ RemoteCache = &FailureReportRemoteCache{}
+var _ HealthChecker = &FailureReportRemoteCache{}
+var _ StatsReporter = &FailureReportRemoteCache{}
+var _ OutputStore = &FailureReportRemoteCache{}
+var _ BatchChecker = &FailureReportRemoteCache{}
+
+// NewFailureReportRemoteCache returns cache reporting its failures with
+// report, which is called outside of the operation that failed last and
+// should not block.
+func NewFailureReportRemoteCache(cache RemoteCache, threshold int, report func(failures int, err error)) *FailureReportRemoteCache {
+	return &FailureReportRemoteCache{
+		forwarder: forwarder{cache},
+		threshold: max(threshold, 1),
+		report:    report,
+	}
+}
+
+// done records the outcome of an operation with ctx, reporting the failures
+// once there are c.threshold in a row.
+func (c *FailureReportRemoteCache) done(ctx context.Context, err error) {
+	if err != nil && (ctx.Err() != nil || errors.Is(err, errors.ErrUnsupported)) {
+		return
+	}
+	c.mu.Lock()
+	if err == nil {
+		c.failures = 0
+		c.mu.Unlock()
+		return
+	}
+	c.failures++
+	n := c.failures
+	c.mu.Unlock()
+	if n == c.threshold {
+		c.report(n, err)
+	}
+}
+
+func (c *FailureReportRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	c.done(ctx, err)
+	return outputID, size, output, err
+}
+
+func (c *FailureReportRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	err := c.cache.Put(ctx, actionID, outputID, size, body)
+	c.done(ctx, err)
+	return err
+}
+
+func (c *FailureReportRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	has, err := c.forwarder.HasOutput(ctx, outputID)
+	c.done(ctx, err)
+	return has, err
+}
+
+func (c *FailureReportRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	exists, err := c.forwarder.BatchExists(ctx, actionIDs)
+	c.done(ctx, err)
+	return exists, err
+}
+
+func (c *FailureReportRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	err := c.forwarder.PutAction(ctx, actionID, outputID, size)
+	c.done(ctx, err)
+	return err
+}
@@ -0,0 +1,60 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureReportRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("http")
+	remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+	var reports []int
+	var last error
+	c := NewFailureReportRemoteCache(remote, 3, func(failures int, err error) {
+		reports = append(reports, failures)
+		last = err
+	})
+
+	remote.err = errors.New("dial tcp: connection refused")
+	for i := 0; i < 5; i++ {
+		_, _, _, err := c.Get(ctx, "a1")
+		require.Error(t, err)
+	}
+	assert.Equal(t, []int{3}, reports, "reported once per streak")
+	assert.Equal(t, remote.err, last)
+
+	remote.err = nil
+	require.NoError(t, c.Put(ctx, "a2", "4567", 5, strings.NewReader("hello")))
+	remote.err = errors.New("503 Service Unavailable")
+	for i := 0; i < 3; i++ {
+		require.Error(t, c.Put(ctx, "a2", "4567", 5, strings.NewReader("hello")))
+	}
+	assert.Equal(t, []int{3, 3}, reports, "re-armed by the success")
+
+	t.Run("canceled", func(t *testing.T) {
+		reports = nil
+		c := NewFailureReportRemoteCache(remote, 1, func(failures int, err error) { reports = append(reports, failures) })
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		remote.err = context.Canceled
+		_, _, _, err := c.Get(cctx, "a1")
+		require.Error(t, err)
+		assert.Empty(t, reports, "the caller's failure")
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		reports = nil
+		c := NewFailureReportRemoteCache(newFakeRemote("http"), 1, func(failures int, err error) { reports = append(reports, failures) })
+		_, err := c.BatchExists(ctx, []string{"a1"})
+		assert.ErrorIs(t, err, errors.ErrUnsupported)
+		_, err = c.HasOutput(ctx, "0123")
+		assert.ErrorIs(t, err, errors.ErrUnsupported)
+		assert.Empty(t, reports)
+	})
+}
@@ -0,0 +1,155 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is the error of the operations a FaultyRemoteCache fails.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultConfig configures the faults a FaultyRemoteCache injects.
+type FaultConfig struct {
+	// Latency is added to every operation, plus a random extra of up to
+	// Jitter.
+	Latency, Jitter time.Duration
+	// ErrorRate is the fraction of operations, from 0 to 1, that fail
+	// with ErrInjectedFault.
+	ErrorRate float64
+	// CorruptRate is the fraction of hits whose body is corrupted.
+	CorruptRate float64
+	// Seed seeds the random choices, for reproducible runs. Zero means a
+	// random seed.
+	Seed int64
+}
+
+// FaultyRemoteCache is a RemoteCache that injects latency, errors and
+// corrupted bodies into the operations on the cache it wraps, to test how
+// builds behave when the cache misbehaves. Health checks are not faulted.
+type FaultyRemoteCache struct {
+	forwarder
+	cfg FaultConfig
+
+	mu   sync.Mutex // guards rand
+	rand *rand.Rand
+}
+
+var _ RemoteCache = &FaultyRemoteCache{}
+var _ HealthChecker = &FaultyRemoteCache{}
+var _ OutputStore = &FaultyRemoteCache{}
+var _ BatchChecker = &FaultyRemoteCache{}
+
+func NewFaultyRemoteCache(cache RemoteCache, cfg FaultConfig) *FaultyRemoteCache {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultyRemoteCache{
+		forwarder: forwarder{cache},
+		cfg:       cfg,
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// chance reports whether an event of the given probability happens.
+func (f *FaultyRemoteCache) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64() < p
+}
+
+// inject waits for the configured latency, then fails at the error rate.
+func (f *FaultyRemoteCache) inject(ctx context.Context) error {
+	d := f.cfg.Latency
+	if f.cfg.Jitter > 0 {
+		f.mu.Lock()
+		d += time.Duration(f.rand.Int63n(int64(f.cfg.Jitter) + 1))
+		f.mu.Unlock()
+	}
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if f.chance(f.cfg.ErrorRate) {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+func (f *FaultyRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	if err := f.inject(ctx); err != nil {
+		return "", 0, nil, err
+	}
+	outputID, size, output, err = f.cache.Get(ctx, actionID)
+	if err == nil && output != nil && size > 0 && f.chance(f.cfg.CorruptRate) {
+		output = &corruptingReader{ReadCloser: output}
+	}
+	return outputID, size, output, err
+}
+
+func (f *FaultyRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if err := f.inject(ctx); err != nil {
+		return err
+	}
+	return f.cache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (f *FaultyRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	store, ok := f.cache.(OutputStore)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	if err := f.inject(ctx); err != nil {
+		return false, err
+	}
+	return store.HasOutput(ctx, outputID)
+}
+
+func (f *FaultyRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	bc, ok := f.cache.(BatchChecker)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	if err := f.inject(ctx); err != nil {
+		return nil, err
+	}
+	return bc.BatchExists(ctx, actionIDs)
+}
+
+func (f *FaultyRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	store, ok := f.cache.(OutputStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := f.inject(ctx); err != nil {
+		return err
+	}
+	return store.PutAction(ctx, actionID, outputID, size)
+}
+
+// corruptingReader flips the bits of the first byte read.
+type corruptingReader struct {
+	io.ReadCloser
+	done bool
+}
+
+func (r *corruptingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.done {
+		p[0] ^= 0xff
+		r.done = true
+	}
+	return n, err
+}
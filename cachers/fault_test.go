@@ -0,0 +1,76 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultyRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+
+	t.Run("errors", func(t *testing.T) {
+		f := NewFaultyRemoteCache(remote, FaultConfig{ErrorRate: 1})
+		_, _, _, err := f.Get(ctx, "a1")
+		assert.ErrorIs(t, err, ErrInjectedFault)
+		err = f.Put(ctx, "a2", "4567", 3, strings.NewReader("bye"))
+		assert.ErrorIs(t, err, ErrInjectedFault)
+		assert.NotContains(t, remote.entries, "a2", "failed puts must not reach the cache")
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		f := NewFaultyRemoteCache(remote, FaultConfig{CorruptRate: 1})
+		outputID, size, body, err := f.Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.Equal(t, "0123", outputID)
+		assert.Equal(t, int64(5), size)
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.NotEqual(t, "hello", string(got))
+		assert.Len(t, got, 5)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		f := NewFaultyRemoteCache(remote, FaultConfig{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+		start := time.Now()
+		_, _, body, err := f.Get(ctx, "a1")
+		require.NoError(t, err)
+		body.Close()
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, _, _, err = f.Get(ctx, "a1")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		f := NewFaultyRemoteCache(remote, FaultConfig{})
+		_, _, body, err := f.Get(ctx, "a1")
+		require.NoError(t, err)
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(got))
+	})
+}
+
+func TestTieredCacheRejectsInjectedCorruption(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: sha256Hex("hello"), body: []byte("hello")}
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), NewFaultyRemoteCache(remote, FaultConfig{CorruptRate: 1}))
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	outputID, _, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "a corrupted hit is a miss")
+}
@@ -0,0 +1,68 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+)
+
+// forwarder is embedded by the RemoteCache wrappers to forward to the cache
+// they wrap the methods whose calls they don't change: Kind, TierStats,
+// Start, Close and the optional interfaces. A wrapper implements Get and
+// Put, and overrides the other methods it changes the calls of.
+type forwarder struct {
+	cache RemoteCache
+}
+
+func (f forwarder) Kind() string {
+	return f.cache.Kind()
+}
+
+func (f forwarder) TierStats() []TierStats {
+	return CacheStats(f.cache)
+}
+
+func (f forwarder) Start(ctx context.Context) error {
+	return f.cache.Start(ctx)
+}
+
+func (f forwarder) Close() error {
+	return f.cache.Close()
+}
+
+// HealthCheck checks the wrapped cache. Caches that do not implement
+// HealthChecker are reported healthy.
+func (f forwarder) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, f.cache)
+}
+
+func (f forwarder) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	return BatchExists(ctx, f.cache, actionIDs)
+}
+
+func (f forwarder) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	return hasOutput(ctx, f.cache, outputID)
+}
+
+func (f forwarder) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return putAction(ctx, f.cache, actionID, outputID, size)
+}
+
+// hasOutput reports whether c stores the output, or fails with
+// errors.ErrUnsupported if c is not an OutputStore.
+func hasOutput(ctx context.Context, c Cache, outputID string) (bool, error) {
+	store, ok := c.(OutputStore)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	return store.HasOutput(ctx, outputID)
+}
+
+// putAction records in c that actionID produced the stored output, or
+// fails with errors.ErrUnsupported if c is not an OutputStore.
+func putAction(ctx context.Context, c Cache, actionID, outputID string, size int64) error {
+	store, ok := c.(OutputStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return store.PutAction(ctx, actionID, outputID, size)
+}
@@ -0,0 +1,52 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwarder(t *testing.T) {
+	ctx := context.Background()
+	remote := &dedupRemote{fakeRemote: newFakeRemote("http")}
+	require.NoError(t, remote.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+
+	f := forwarder{remote}
+	assert.Equal(t, "http", f.Kind())
+	assert.NoError(t, f.HealthCheck(ctx))
+	_, err := f.BatchExists(ctx, []string{"a1"})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	has, err := f.HasOutput(ctx, "0123")
+	require.NoError(t, err)
+	assert.True(t, has)
+	require.NoError(t, f.PutAction(ctx, "a2", "0123", 5))
+	assert.True(t, remote.has("a2"))
+
+	f = forwarder{newFakeRemote("http")}
+	_, err = f.HasOutput(ctx, "0123")
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	assert.ErrorIs(t, f.PutAction(ctx, "a2", "0123", 5), errors.ErrUnsupported)
+
+	t.Run("encoding wrappers", func(t *testing.T) {
+		encrypted, err := NewEncryptedRemoteCache(remote, bytes.Repeat([]byte{7}, 32))
+		require.NoError(t, err)
+		_, key, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		for _, c := range []OutputStore{
+			encrypted,
+			NewEnvelopeRemoteCache(remote, &fakeKeyWrapper{}),
+			NewSignedRemoteCache(remote, key, nil),
+		} {
+			_, err := c.HasOutput(ctx, "0123")
+			assert.ErrorIs(t, err, errors.ErrUnsupported)
+			assert.ErrorIs(t, c.PutAction(ctx, "a3", "0123", 5), errors.ErrUnsupported)
+		}
+		assert.False(t, remote.has("a3"))
+	})
+}
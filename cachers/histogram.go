@@ -0,0 +1,68 @@
+package cachers
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the latency
+// histograms of the backends, from the half millisecond of a warm local
+// disk to the minute of the upload of a large output, for service-level
+// objectives like "99% of the gets of the remote in under 250ms".
+var LatencyBuckets = [...]time.Duration{
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// A Histogram is a snapshot of the latencies of the operations of a
+// backend.
+type Histogram struct {
+	// Counts are the number of operations that took up to each of
+	// LatencyBuckets, and not less than the previous one, followed by the
+	// number of the longer ones.
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// latencyHistogram counts operations by their latency in LatencyBuckets.
+type latencyHistogram struct {
+	counts [len(LatencyBuckets) + 1]atomic.Int64
+	sum    atomic.Int64 // in nanoseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// snapshot returns the Histogram of h, or nil if it is empty.
+func (h *latencyHistogram) snapshot() *Histogram {
+	s := &Histogram{Counts: make([]int64, len(h.counts)), Sum: time.Duration(h.sum.Load())}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+		s.Count += s.Counts[i]
+	}
+	if s.Count == 0 {
+		return nil
+	}
+	return s
+}
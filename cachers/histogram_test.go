@@ -0,0 +1,45 @@
+package cachers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	assert.Nil(t, h.snapshot())
+
+	h.observe(100 * time.Microsecond)
+	h.observe(time.Millisecond) // bounds are inclusive
+	h.observe(3 * time.Millisecond)
+	h.observe(2 * time.Minute)
+	s := h.snapshot()
+	require.NotNil(t, s)
+	assert.Equal(t, int64(4), s.Count)
+	assert.Equal(t, 100*time.Microsecond+time.Millisecond+3*time.Millisecond+2*time.Minute, s.Sum)
+	require.Len(t, s.Counts, len(LatencyBuckets)+1)
+	assert.Equal(t, int64(1), s.Counts[0], "<= 0.5ms")
+	assert.Equal(t, int64(1), s.Counts[1], "<= 1ms")
+	assert.Equal(t, int64(1), s.Counts[3], "<= 5ms")
+	assert.Equal(t, int64(1), s.Counts[len(LatencyBuckets)], "> 1m")
+}
+
+func TestCountsLatency(t *testing.T) {
+	ctx := context.Background()
+	c := NewLocalCacheWithCounts(NewSimpleDiskCache(false, t.TempDir()), "local", false)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+	_, _, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+
+	stats := CacheStats(c)
+	require.NotEmpty(t, stats)
+	require.NotNil(t, stats[0].GetLatency)
+	assert.Equal(t, int64(1), stats[0].GetLatency.Count)
+	assert.Equal(t, stats[0].GetTime, stats[0].GetLatency.Sum)
+	assert.Nil(t, stats[0].PutLatency, "no puts yet")
+}
@@ -0,0 +1,215 @@
+package cachers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+)
+
+// The headers of the HMAC signatures of the requests to a cacher server. A
+// signature is the hex HMAC-SHA256, keyed with a secret shared by the
+// clients and the server, of hmacScheme, the Unix time of the request, its
+// method, its path and the hex SHA-256 of its body, each on a line,
+// followed by a line "<name>:<value>" for each of hmacSignedHeaders the
+// request has, which change how the server takes the body. The timestamp
+// bounds the replay of a signed request to HMACMaxSkew.
+const (
+	HMACSignatureHeader = "X-Gocache-Signature"
+	HMACTimestampHeader = "X-Gocache-Timestamp"
+	HMACBodyHashHeader  = "X-Gocache-Content-Sha256"
+
+	hmacScheme = "GOCACHE-HMAC-SHA256"
+)
+
+// hmacSignedHeaders are the headers covered by the signatures. The requests
+// without them are signed as before they were covered.
+var hmacSignedHeaders = []string{"Content-Encoding", decodedSizeHeader}
+
+// HMACMaxSkew is how far from the clock of the server the timestamp of a
+// signed request may be.
+const HMACMaxSkew = 5 * time.Minute
+
+// hmacSpoolSize is the size from which the bodies that can't be read twice
+// are spooled to a temporary file, rather than to memory, to be hashed
+// before they are sent.
+const hmacSpoolSize = 1 << 20
+
+// hmacSignature returns the signature of a request with header.
+func hmacSignature(secret []byte, timestamp, method, path, bodyHash string, header http.Header) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", hmacScheme, timestamp, method, path, bodyHash)
+	for _, name := range hmacSignedHeaders {
+		if v := header.Values(name); len(v) > 0 {
+			fmt.Fprintf(mac, "\n%s:%s", strings.ToLower(name), strings.Join(v, ","))
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewHMACTransport returns a RoundTripper sending the requests through
+// base, or http.DefaultTransport if it is nil, signed with secret. The
+// bodies that can't be read twice are spooled to spoolDir, or
+// os.TempDir if it is "", to be hashed before they are sent.
+func NewHMACTransport(base http.RoundTripper, secret []byte, spoolDir string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &hmacTransport{base: base, secret: secret, spoolDir: spoolDir}
+}
+
+type hmacTransport struct {
+	base     http.RoundTripper
+	secret   []byte
+	spoolDir string
+}
+
+func (t *hmacTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	bodyHash, cleanup, err := hashBody(req, t.spoolDir)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("hashing the body to sign: %w", err)
+	}
+	defer cleanup()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(HMACTimestampHeader, timestamp)
+	req.Header.Set(HMACBodyHashHeader, bodyHash)
+	req.Header.Set(HMACSignatureHeader, hmacSignature(t.secret, timestamp, req.Method, req.URL.EscapedPath(), bodyHash, req.Header))
+	return t.base.RoundTrip(req)
+}
+
+// hashBody returns the hex SHA-256 of the body of req, leaving req with a
+// body to send again. Bodies that can't be got again are spooled, to a file
+// in dir from hmacSpoolSize, to be removed by cleanup once req is sent.
+func hashBody(req *http.Request, dir string) (bodyHash string, cleanup func(), err error) {
+	h := sha256.New()
+	cleanup = func() {}
+	switch {
+	case req.Body == nil || req.Body == http.NoBody:
+	case req.GetBody != nil:
+		body, err := req.GetBody()
+		if err != nil {
+			return "", cleanup, err
+		}
+		_, err = sbytes.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return "", cleanup, err
+		}
+	default:
+		var spooled io.ReadCloser
+		spooled, cleanup, err = spoolBody(req.Body, h, dir)
+		req.Body.Close()
+		if err != nil {
+			return "", cleanup, err
+		}
+		req.Body = spooled
+	}
+	return hex.EncodeToString(h.Sum(nil)), cleanup, nil
+}
+
+// spoolBody reads body into a pooled buffer, or into a temporary file in
+// dir from hmacSpoolSize bytes, writing it to h as well, and returns a
+// reader of what it read.
+func spoolBody(body io.Reader, h hash.Hash, dir string) (_ io.ReadCloser, cleanup func(), err error) {
+	buf := sbytes.Get(hmacSpoolSize)
+	n, err := io.ReadFull(body, buf)
+	h.Write(buf[:n])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// The transport may still read the body after RoundTrip returns:
+		// fence it off before giving buf back.
+		fence := sbytes.NewFence(sbytes.NewBuffer(buf[:n]))
+		return fence, func() {
+			fence.Close()
+			sbytes.Put(buf)
+		}, nil
+	}
+	defer sbytes.Put(buf)
+	cleanup = func() {}
+	if err != nil {
+		return nil, cleanup, err
+	}
+	f, err := os.CreateTemp(dir, "go-cacher-body-*")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err := f.Write(buf); err != nil {
+		return nil, cleanup, err
+	}
+	if _, err := sbytes.Copy(io.MultiWriter(f, h), body); err != nil {
+		return nil, cleanup, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, cleanup, err
+	}
+	// The transport closes the body it sent, but the file is only removed
+	// by cleanup.
+	return io.NopCloser(f), cleanup, nil
+}
+
+// ErrBadSignature is the error of a request whose HMAC signature is
+// missing or wrong.
+var ErrBadSignature = errors.New("bad request signature")
+
+// VerifyHMAC checks the signature of a request to a cacher server with
+// secret, shared with the clients, at time now. The body of r, which can't
+// be hashed before it is read, is replaced by one failing with
+// ErrBadSignature at its end if it doesn't match its signed hash, so that
+// it can be read as it comes, but must be read to its end before being
+// trusted.
+func VerifyHMAC(r *http.Request, secret []byte, now time.Time) error {
+	timestamp, bodyHash, sig := r.Header.Get(HMACTimestampHeader), r.Header.Get(HMACBodyHashHeader), r.Header.Get(HMACSignatureHeader)
+	if timestamp == "" || bodyHash == "" || sig == "" {
+		return fmt.Errorf("%w: unsigned request", ErrBadSignature)
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp %q", ErrBadSignature, timestamp)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > HMACMaxSkew || skew < -HMACMaxSkew {
+		return fmt.Errorf("%w: timestamp %v off by %v", ErrBadSignature, time.Unix(unix, 0).UTC(), skew.Round(time.Second))
+	}
+	want := hmacSignature(secret, timestamp, r.Method, r.URL.EscapedPath(), bodyHash, r.Header)
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(want)) != 1 {
+		return ErrBadSignature
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &hashCheckingReader{ReadCloser: r.Body, h: sha256.New(), want: bodyHash}
+	}
+	return nil
+}
+
+// hashCheckingReader fails at the end of its body if the body doesn't have
+// the hex SHA-256 want.
+type hashCheckingReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	want string
+}
+
+func (r *hashCheckingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.h.Sum(nil)) != r.want {
+		return n, fmt.Errorf("%w: body doesn't match its hash", ErrBadSignature)
+	}
+	return n, err
+}
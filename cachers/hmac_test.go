@@ -0,0 +1,131 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMACTransport(t *testing.T) {
+	secret := []byte("s3cret")
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := VerifyHMAC(r, secret, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "PUT" {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			bodies = append(bodies, body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := NewHttpCacheWithClient(srv.URL, &http.Client{Transport: NewHMACTransport(nil, secret, t.TempDir())}, false)
+	_, _, _, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	require.NoError(t, c.Put(ctx, "a1", "o1", 2, strings.NewReader("hi")))
+	// A body that can't be read twice, large enough to be spooled to a file.
+	big := bytes.Repeat([]byte("x"), hmacSpoolSize+10)
+	require.NoError(t, c.Put(ctx, "a2", "o2", int64(len(big)), struct{ io.Reader }{bytes.NewReader(big)}))
+	require.NoError(t, c.PutAction(ctx, "a3", "o2", int64(len(big))))
+	require.Len(t, bodies, 3)
+	assert.Equal(t, "hi", string(bodies[0]))
+	assert.Equal(t, big, bodies[1])
+
+	wrong := NewHttpCacheWithClient(srv.URL, &http.Client{Transport: NewHMACTransport(nil, []byte("guess"), "")}, false)
+	_, _, _, err = wrong.Get(ctx, "a1")
+	var se *StatusError
+	require.ErrorAs(t, err, &se)
+	assert.Equal(t, http.StatusUnauthorized, se.StatusCode)
+
+	// The bodies are spooled to the given directory.
+	missing := filepath.Join(t.TempDir(), "missing")
+	spooling := NewHttpCacheWithClient(srv.URL, &http.Client{Transport: NewHMACTransport(nil, secret, missing)}, false)
+	assert.Error(t, spooling.Put(ctx, "a4", "o4", int64(len(big)), struct{ io.Reader }{bytes.NewReader(big)}))
+	// Smaller ones are kept in memory.
+	require.NoError(t, spooling.Put(ctx, "a5", "o5", 5, struct{ io.Reader }{strings.NewReader("small")}))
+	require.Len(t, bodies, 4)
+	assert.Equal(t, "small", string(bodies[3]))
+
+	unsigned := NewHttpCache(srv.URL, false)
+	_, _, _, err = unsigned.Get(ctx, "a1")
+	assert.ErrorAs(t, err, &se)
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Unix(1700000000, 0)
+	signed := func(method, path, body, signedBody string, at time.Time) *http.Request {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		h := sha256Hex(signedBody)
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		r.Header.Set(HMACTimestampHeader, timestamp)
+		r.Header.Set(HMACBodyHashHeader, h)
+		r.Header.Set(HMACSignatureHeader, hmacSignature(secret, timestamp, method, r.URL.EscapedPath(), h, r.Header))
+		return r
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		r := signed("PUT", "/a1/o1", "hello", "hello", now)
+		require.NoError(t, VerifyHMAC(r, secret, now.Add(time.Minute)))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		r := signed("PUT", "/a1/o1", "hellO", "hello", now)
+		require.NoError(t, VerifyHMAC(r, secret, now))
+		_, err := io.ReadAll(r.Body)
+		assert.ErrorIs(t, err, ErrBadSignature)
+	})
+
+	t.Run("tampered request", func(t *testing.T) {
+		r := signed("GET", "/action/a1", "", "", now)
+		r.URL.Path = "/action/a2"
+		assert.ErrorIs(t, VerifyHMAC(r, secret, now), ErrBadSignature)
+
+		r = signed("GET", "/action/a1", "", "", now)
+		r.Method = "DELETE"
+		assert.ErrorIs(t, VerifyHMAC(r, secret, now), ErrBadSignature)
+
+		r = signed("PUT", "/a1/o1", "hello", "hello", now)
+		r.Header.Set("Content-Encoding", "zstd")
+		assert.ErrorIs(t, VerifyHMAC(r, secret, now), ErrBadSignature)
+
+		r = signed("PUT", "/a1/o1", "hello", "hello", now)
+		r.Header.Set(decodedSizeHeader, "5")
+		assert.ErrorIs(t, VerifyHMAC(r, secret, now), ErrBadSignature)
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		r := signed("GET", "/action/a1", "", "", now)
+		err := VerifyHMAC(r, secret, now.Add(HMACMaxSkew+time.Minute))
+		assert.ErrorIs(t, err, ErrBadSignature)
+		assert.ErrorContains(t, err, "timestamp")
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/action/a1", nil)
+		assert.ErrorIs(t, VerifyHMAC(r, secret, now), ErrBadSignature)
+	})
+}
@@ -4,10 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/bradfitz/go-tool-cache/internal/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 // ActionValue is the JSON value returned by the cacher server for an GET /action request.
@@ -16,6 +24,25 @@ type ActionValue struct {
 	Size     int64  `json:"size"`
 }
 
+// BatchExistsRequest is the JSON body of a POST /exists request to the
+// cacher server, asking which of the actions it stores.
+type BatchExistsRequest struct {
+	ActionIDs []string `json:"actionIDs"`
+}
+
+// BatchExistsResponse is the JSON value returned by the cacher server for a
+// POST /exists request: Exists[i] is about ActionIDs[i].
+type BatchExistsResponse struct {
+	Exists []bool `json:"exists"`
+}
+
+// MaxBatchExists is the most actions a POST /exists request asks about.
+const MaxBatchExists = 1000
+
+// batchFallbackConcurrency is the number of the lookups of the actions run
+// at once, for the servers without POST /exists.
+const batchFallbackConcurrency = 16
+
 // HTTPCache is a RemoteCache that talks to a cacher server over HTTP.
 type HTTPCache struct {
 	// baseURL is the base URL of the cacher server, like "http://localhost:31364".
@@ -27,17 +54,57 @@ type HTTPCache struct {
 
 	// verbose optionally specifies whether to log verbose messages.
 	verbose bool
+
+	// compression says which bodies are compressed with zstd, once the
+	// server has said, with the Accept-Encoding of a response, that it
+	// accepts zstd puts, in zstdPuts.
+	compression Compression
+	zstdPuts    atomic.Bool
+
+	// ranged says which outputs are downloaded in ranges, unless the server
+	// has answered a range with the whole output, in noRanges.
+	ranged   RangedDownloads
+	noRanges atomic.Bool
+
+	// noBatch is set once the server answered POST /exists with an error,
+	// like old servers do, so that the batches are looked up one by one.
+	noBatch atomic.Bool
 }
 
 func NewHttpCache(baseURL string, verbose bool) *HTTPCache {
+	return NewHttpCacheWithClient(baseURL, nil, verbose)
+}
+
+// NewHttpCacheWithClient is like NewHttpCache but uses client for all requests.
+// If client is nil, http.DefaultClient is used.
+func NewHttpCacheWithClient(baseURL string, client *http.Client, verbose bool) *HTTPCache {
 	return &HTTPCache{
 		baseURL: baseURL,
+		client:  client,
 		verbose: verbose,
 	}
 }
 
+// SetCompression sets which bodies are compressed with zstd, in both
+// directions, for the servers that support it.
+func (c *HTTPCache) SetCompression(compression Compression) {
+	c.compression = compression
+}
+
+// SetRangedDownloads sets which outputs are downloaded in ranges.
+func (c *HTTPCache) SetRangedDownloads(ranged RangedDownloads) {
+	c.ranged = ranged
+}
+
+// negotiate records whether the server that sent res accepts zstd puts.
+func (c *HTTPCache) negotiate(res *http.Response) {
+	if c.compression.Mode != CompressionOff && AcceptsZstd(res.Header) {
+		c.zstdPuts.Store(true)
+	}
+}
+
 func (c *HTTPCache) Start(context.Context) error {
-	log.Printf("[%s]\tconfigured to %s", c.Kind(), c.baseURL)
+	slog.Info("configured", "cache", c.Kind(), "url", c.baseURL)
 	return nil
 }
 
@@ -50,17 +117,20 @@ func (c *HTTPCache) Kind() string {
 }
 
 func (c *HTTPCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	ctx, span := trace.Start(ctx, "http get", trace.Client, trace.String("gocacheprog.action_id", actionID))
+	defer func() { endGetSpan(span, outputID, err) }()
 	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/action/"+actionID, nil)
 	res, err := c.httpClient().Do(req)
 	if err != nil {
 		return "", 0, nil, err
 	}
 	defer res.Body.Close()
+	c.negotiate(res)
 	if res.StatusCode == http.StatusNotFound {
 		return "", 0, nil, nil
 	}
 	if res.StatusCode != http.StatusOK {
-		return "", 0, nil, fmt.Errorf("unexpected GET /action/%s status %v", actionID, res.Status)
+		return "", 0, nil, newStatusError(res, "/action/"+actionID, false)
 	}
 	var av ActionValue
 	if err := json.NewDecoder(res.Body).Decode(&av); err != nil {
@@ -70,7 +140,25 @@ func (c *HTTPCache) Get(ctx context.Context, actionID string) (outputID string,
 	if av.Size == 0 {
 		return outputID, av.Size, io.NopCloser(bytes.NewReader(nil)), nil
 	}
+	if c.ranged.Threshold > 0 && av.Size > c.ranged.Threshold && !c.noRanges.Load() {
+		body, err := c.ranged.download(ctx, nil, 0, av.Size, func(ctx context.Context, off, n int64) (io.ReadCloser, error) {
+			return c.getRange(ctx, outputID, off, n)
+		})
+		var se *StatusError
+		switch {
+		case err == nil:
+			return outputID, av.Size, body, nil
+		case errors.As(err, &se) && se.StatusCode == http.StatusNotFound:
+			return "", 0, nil, nil
+		case !errors.Is(err, errRangesUnsupported):
+			return "", 0, nil, err
+		}
+		c.noRanges.Store(true)
+	}
 	req, _ = http.NewRequestWithContext(ctx, "GET", c.baseURL+"/output/"+outputID, nil)
+	if c.compression.compresses(av.Size) {
+		req.Header.Set("Accept-Encoding", "zstd")
+	}
 	res, err = c.httpClient().Do(req)
 	if err != nil {
 		return "", 0, nil, err
@@ -79,16 +167,51 @@ func (c *HTTPCache) Get(ctx context.Context, actionID string) (outputID string,
 		return "", 0, nil, nil
 	}
 	if res.StatusCode != http.StatusOK {
-		return "", 0, nil, fmt.Errorf("unexpected GET /output/%s status %v", outputID, res.Status)
+		return "", 0, nil, newStatusError(res, "/output/"+outputID, false)
 	}
-	if res.ContentLength == -1 {
-		return "", 0, nil, fmt.Errorf("no Content-Length from server")
+	switch enc := res.Header.Get("Content-Encoding"); enc {
+	case "":
+		if res.ContentLength == -1 {
+			res.Body.Close()
+			return "", 0, nil, fmt.Errorf("no Content-Length from server")
+		}
+	case "zstd":
+		body, err := NewZstdReader(res.Body)
+		if err != nil {
+			res.Body.Close()
+			return "", 0, nil, err
+		}
+		return outputID, av.Size, body, nil
+	default:
+		res.Body.Close()
+		return "", 0, nil, fmt.Errorf("unsupported Content-Encoding %q from server", enc)
 	}
 	return outputID, av.Size, res.Body, nil
 
 }
 
+// getRange returns the body of the n bytes from off of an output.
+func (c *HTTPCache) getRange(ctx context.Context, outputID string, off, n int64) (io.ReadCloser, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/output/"+outputID, nil)
+	req.Header.Set("Range", rangeHeader(off, n))
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return res.Body, nil
+	case http.StatusOK:
+		res.Body.Close()
+		return nil, errRangesUnsupported
+	}
+	res.Body.Close()
+	return nil, newStatusError(res, "/output/"+outputID, false)
+}
+
 func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
+	ctx, span := trace.Start(ctx, "http put", trace.Client, trace.String("gocacheprog.action_id", actionID), trace.Int("gocacheprog.body_size", size))
+	defer func() { span.End(err) }()
 	var putBody io.Reader
 	if size == 0 {
 		// Special case the empty file so NewRequest sets "Content-Length: 0",
@@ -98,22 +221,222 @@ func (c *HTTPCache) Put(ctx context.Context, actionID, outputID string, size int
 	} else {
 		putBody = body
 	}
+	if size > 0 {
+		// The transport may still be sending the body after Do returns,
+		// when the caller reuses its bytes, if only those of a buffer the
+		// wrappers, like SignedRemoteCache, read it from.
+		fence := sbytes.FenceReader(putBody)
+		defer fence.Close()
+		putBody = fence
+	}
+	compressed := c.compression.compresses(size) && c.zstdPuts.Load() && !incompressibleBody(ctx)
+	if compressed {
+		zbody := compressedBody(putBody)
+		defer zbody.Close()
+		putBody = zbody
+	}
 	req, _ := http.NewRequestWithContext(ctx, "PUT", c.baseURL+"/"+actionID+"/"+outputID, putBody)
 	req.ContentLength = size
+	if compressed {
+		// The compressed size is only known once sent.
+		req.ContentLength = -1
+		req.Header.Set("Content-Encoding", "zstd")
+		req.Header.Set(decodedSizeHeader, strconv.FormatInt(size, 10))
+	}
+	if tags := encodeTags(ctx); tags != "" {
+		req.Header.Set(tagsHeader, tags)
+	}
 	res, err := c.httpClient().Do(req)
 	if err != nil {
-		log.Printf("error PUT /%s/%s: %v", actionID, outputID, err)
+		slog.WarnContext(ctx, "put failed", "cache", c.Kind(), "action", actionID, "output", outputID, "err", err)
 		return err
 	}
 	defer res.Body.Close()
+	c.negotiate(res)
+	if compressed && res.StatusCode == http.StatusUnsupportedMediaType {
+		// The server no longer accepts zstd; the retries of the upload
+		// send it as it is.
+		c.zstdPuts.Store(false)
+	}
 	if res.StatusCode != http.StatusNoContent {
-		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
-		return fmt.Errorf("unexpected PUT /%s/%s status %v: %s", actionID, outputID, res.Status, all)
+		return newStatusError(res, "/"+actionID+"/"+outputID, true)
+	}
+	return nil
+}
+
+// HasOutput asks the cacher server whether it has the output, with a HEAD
+// request. Servers that don't know the endpoint answer with an error.
+func (c *HTTPCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", c.baseURL+"/output/"+outputID, nil)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newStatusError(res, "/output/"+outputID, false)
+}
+
+// PutAction records an action whose output the server already has.
+func (c *HTTPCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	body, err := json.Marshal(&ActionValue{OutputID: outputID, Size: size})
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequestWithContext(ctx, "PUT", c.baseURL+"/action/"+actionID, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if tags := encodeTags(ctx); tags != "" {
+		req.Header.Set(tagsHeader, tags)
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return newStatusError(res, "/action/"+actionID, true)
 	}
 	return nil
 }
 
+// BatchExists asks the cacher server which of the actions it stores, with
+// a POST /exists request per MaxBatchExists of them, or with a lookup of
+// each for the servers without the endpoint.
+func (c *HTTPCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	exists := make([]bool, 0, len(actionIDs))
+	for len(actionIDs) > 0 {
+		n := min(len(actionIDs), MaxBatchExists)
+		part, err := c.batchExists(ctx, actionIDs[:n])
+		if err != nil {
+			return nil, err
+		}
+		exists = append(exists, part...)
+		actionIDs = actionIDs[n:]
+	}
+	return exists, nil
+}
+
+func (c *HTTPCache) batchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	if !c.noBatch.Load() {
+		body, err := json.Marshal(&BatchExistsRequest{ActionIDs: actionIDs})
+		if err != nil {
+			return nil, err
+		}
+		req, _ := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/exists", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		switch res.StatusCode {
+		case http.StatusOK:
+			var br BatchExistsResponse
+			if err := json.NewDecoder(res.Body).Decode(&br); err != nil {
+				return nil, err
+			}
+			if len(br.Exists) != len(actionIDs) {
+				return nil, fmt.Errorf("POST /exists: got %d answers for %d actions", len(br.Exists), len(actionIDs))
+			}
+			return br.Exists, nil
+		case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			c.noBatch.Store(true)
+		default:
+			return nil, newStatusError(res, "/exists", true)
+		}
+	}
+	exists := make([]bool, len(actionIDs))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(batchFallbackConcurrency)
+	for i, actionID := range actionIDs {
+		i, actionID := i, actionID
+		g.Go(func() (err error) {
+			exists[i], err = c.hasAction(gctx, actionID)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// hasAction reports whether the cacher server stores the action, without
+// downloading its output.
+func (c *HTTPCache) hasAction(ctx context.Context, actionID string) (bool, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/action/"+actionID, nil)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newStatusError(res, "/action/"+actionID, false)
+}
+
+// HealthCheck verifies that the cacher server answers on its root path.
+func (c *HTTPCache) HealthCheck(ctx context.Context) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.baseURL+"/", nil)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	c.negotiate(res)
+	if res.StatusCode != http.StatusOK {
+		return newStatusError(res, "/", false)
+	}
+	return nil
+}
+
+// A StatusError is the error of a request the cacher server answered with
+// an unexpected status. Its HTTPStatusCode method is the one of the errors
+// of the S3 client, so that callers can tell, say, denied credentials from
+// either.
+type StatusError struct {
+	Method, Path string
+	Status       string
+	StatusCode   int
+	Body         string        // the start of the response body, for puts
+	RetryAfter   time.Duration // of the Retry-After header, if any
+}
+
+// newStatusError returns the StatusError of res, the response to a request
+// for path, with the start of its body if withBody is set.
+func newStatusError(res *http.Response, path string, withBody bool) *StatusError {
+	e := &StatusError{Method: res.Request.Method, Path: path, Status: res.Status, StatusCode: res.StatusCode}
+	e.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	if withBody {
+		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		e.Body = string(all)
+	}
+	return e
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("unexpected %s %s status %v", e.Method, e.Path, e.Status)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *StatusError) HTTPStatusCode() int { return e.StatusCode }
+
 var _ RemoteCache = &HTTPCache{}
+var _ HealthChecker = &HTTPCache{}
+var _ OutputStore = &HTTPCache{}
+var _ BatchChecker = &HTTPCache{}
 
 func (c *HTTPCache) httpClient() *http.Client {
 	if c.client != nil {
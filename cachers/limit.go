@@ -0,0 +1,111 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ConcurrencyLimitedRemoteCache is a RemoteCache that allows at most a fixed
+// number of simultaneous operations on the cache it wraps; the others wait
+// for a slot. A get holds its slot until its output is closed; health
+// checks don't wait for one.
+type ConcurrencyLimitedRemoteCache struct {
+	forwarder
+	slots chan struct{}
+}
+
+var _ RemoteCache = &ConcurrencyLimitedRemoteCache{}
+var _ HealthChecker = &ConcurrencyLimitedRemoteCache{}
+var _ OutputStore = &ConcurrencyLimitedRemoteCache{}
+var _ BatchChecker = &ConcurrencyLimitedRemoteCache{}
+
+func NewConcurrencyLimitedRemoteCache(cache RemoteCache, limit int) *ConcurrencyLimitedRemoteCache {
+	return &ConcurrencyLimitedRemoteCache{
+		forwarder: forwarder{cache},
+		slots:     make(chan struct{}, max(limit, 1)),
+	}
+}
+
+func (l *ConcurrencyLimitedRemoteCache) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *ConcurrencyLimitedRemoteCache) release() {
+	<-l.slots
+}
+
+func (l *ConcurrencyLimitedRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	if err := l.acquire(ctx); err != nil {
+		return "", 0, nil, err
+	}
+	outputID, size, output, err = l.cache.Get(ctx, actionID)
+	if err != nil || output == nil {
+		l.release()
+		return outputID, size, output, err
+	}
+	return outputID, size, &releaseOnClose{ReadCloser: output, release: l.release}, nil
+}
+
+func (l *ConcurrencyLimitedRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+	defer l.release()
+	return l.cache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (l *ConcurrencyLimitedRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	store, ok := l.cache.(OutputStore)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	if err := l.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer l.release()
+	return store.HasOutput(ctx, outputID)
+}
+
+func (l *ConcurrencyLimitedRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	bc, ok := l.cache.(BatchChecker)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer l.release()
+	return bc.BatchExists(ctx, actionIDs)
+}
+
+func (l *ConcurrencyLimitedRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	store, ok := l.cache.(OutputStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+	defer l.release()
+	return store.PutAction(ctx, actionID, outputID, size)
+}
+
+// releaseOnClose calls release once, when the first Close returns.
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
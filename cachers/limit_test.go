@@ -0,0 +1,71 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowRemote is a fakeRemote that records how many puts run at once.
+type slowRemote struct {
+	*fakeRemote
+	running, peak atomic.Int32
+}
+
+func (s *slowRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	n := s.running.Add(1)
+	defer s.running.Add(-1)
+	for {
+		p := s.peak.Load()
+		if n <= p || s.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return s.fakeRemote.Put(ctx, actionID, outputID, size, body)
+}
+
+func TestConcurrencyLimitedRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := &slowRemote{fakeRemote: newFakeRemote("slow")}
+	l := NewConcurrencyLimitedRemoteCache(remote, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, l.Put(ctx, "a1", "0123", 0, sbytes.NewBuffer(nil)))
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, remote.peak.Load())
+
+	t.Run("get holds its slot until closed", func(t *testing.T) {
+		remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+		l := NewConcurrencyLimitedRemoteCache(remote, 1)
+		_, _, output, err := l.Get(ctx, "a1")
+		require.NoError(t, err)
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, _, _, err = l.Get(tctx, "a1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NoError(t, output.Close())
+		_, _, output, err = l.Get(ctx, "a1")
+		require.NoError(t, err)
+		require.NoError(t, output.Close())
+	})
+
+	t.Run("output store passthrough", func(t *testing.T) {
+		_, err := l.HasOutput(ctx, "0123")
+		assert.True(t, errors.Is(err, errors.ErrUnsupported))
+	})
+}
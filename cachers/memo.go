@@ -0,0 +1,300 @@
+package cachers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoHeader starts the first line of a memo file, followed by the
+// identity of the remote it is about.
+const memoHeader = "go-cacher remote memo "
+
+// memoCompactRatio is how many times as many lines as live entries a memo
+// file may grow to before it is rewritten.
+const memoCompactRatio = 2
+
+// MemoRemoteCache is a RemoteCache remembering, in a file, which actions
+// the cache it wraps was found to store and which it lacks, so that the
+// next sessions answer from the file rather than asking the remote again.
+// A Get of an action the remote lacked less than missTTL ago is a miss
+// without a round trip, and a BatchExists only asks about the actions not
+// known for less than hitTTL or missTTL. A zero TTL leaves its answers
+// unmemoized.
+//
+// The file is appended to as answers come, and rewritten without the
+// expired entries when it is started. Its first line is the identity of
+// the remote, like a hash of its settings: a file about another remote is
+// discarded. The file may be shared by several processes; an answer one
+// appends while another rewrites it is lost, which only costs a lookup.
+type MemoRemoteCache struct {
+	forwarder
+	file     string
+	identity string
+	hitTTL   time.Duration
+	missTTL  time.Duration
+	now      func() time.Time // for tests
+
+	mu      sync.Mutex
+	entries map[string]memoEntry
+	f       *os.File // the file appended to, or nil
+}
+
+// A memoEntry is what a remote answered about an action, and when.
+type memoEntry struct {
+	at     int64 // Unix time
+	exists bool
+}
+
+var _ RemoteCache = &MemoRemoteCache{}
+var _ HealthChecker = &MemoRemoteCache{}
+var _ StatsReporter = &MemoRemoteCache{}
+var _ OutputStore = &MemoRemoteCache{}
+var _ BatchChecker = &MemoRemoteCache{}
+
+func NewMemoRemoteCache(cache RemoteCache, file, identity string, hitTTL, missTTL time.Duration) *MemoRemoteCache {
+	return &MemoRemoteCache{
+		forwarder: forwarder{cache},
+		file:      file,
+		identity:  identity,
+		hitTTL:    hitTTL,
+		missTTL:   missTTL,
+		now:       time.Now,
+		entries:   map[string]memoEntry{},
+	}
+}
+
+// Start starts the wrapped cache and loads the memo. A memo that can't be
+// read or written is logged, and the session goes without it.
+func (c *MemoRemoteCache) Start(ctx context.Context) error {
+	if err := c.cache.Start(ctx); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		slog.Warn("remote memo unavailable", "file", c.file, "err", err)
+	}
+	return nil
+}
+
+func (c *MemoRemoteCache) Close() error {
+	c.mu.Lock()
+	var err error
+	if c.f != nil {
+		err = c.f.Close()
+		c.f = nil
+	}
+	c.mu.Unlock()
+	return errors.Join(c.cache.Close(), err)
+}
+
+// load reads the fresh entries of the memo file, rewrites it if it is about
+// another remote or has grown too much, and opens it to be appended to.
+// c.mu must be held.
+func (c *MemoRemoteCache) load() error {
+	lines, err := c.read()
+	if err != nil {
+		return err
+	}
+	if lines < 0 || lines > memoCompactRatio*len(c.entries)+100 {
+		if err := c.rewrite(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(c.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	c.f = f
+	return nil
+}
+
+// read reads the fresh entries of the memo file into c.entries, and
+// returns the number of its lines, or -1 if it is missing or about another
+// remote.
+func (c *MemoRemoteCache) read() (int, error) {
+	f, err := os.Open(c.file)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || sc.Text() != memoHeader+c.identity {
+		return -1, sc.Err()
+	}
+	lines := 1
+	for sc.Scan() {
+		lines++
+		at, exists, actionID, ok := parseMemoLine(sc.Text())
+		if !ok {
+			continue
+		}
+		e := memoEntry{at: at, exists: exists}
+		if c.fresh(e) {
+			c.entries[actionID] = e
+		} else {
+			delete(c.entries, actionID)
+		}
+	}
+	return lines, sc.Err()
+}
+
+// rewrite replaces the memo file with one of the entries in c.entries.
+// c.mu must be held.
+func (c *MemoRemoteCache) rewrite() error {
+	if err := os.MkdirAll(filepath.Dir(c.file), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	fmt.Fprintf(bw, "%s%s\n", memoHeader, c.identity)
+	for actionID, e := range c.entries {
+		bw.WriteString(formatMemoLine(actionID, e))
+	}
+	if err := errors.Join(bw.Flush(), f.Close()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.file)
+}
+
+// formatMemoLine returns the line of the memo file recording e about
+// actionID: "<Unix time> +|- <actionID>".
+func formatMemoLine(actionID string, e memoEntry) string {
+	sign := "-"
+	if e.exists {
+		sign = "+"
+	}
+	return strconv.FormatInt(e.at, 10) + " " + sign + " " + actionID + "\n"
+}
+
+func parseMemoLine(line string) (at int64, exists bool, actionID string, ok bool) {
+	f := strings.Fields(line)
+	if len(f) != 3 || (f[1] != "+" && f[1] != "-") {
+		return 0, false, "", false
+	}
+	at, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return 0, false, "", false
+	}
+	return at, f[1] == "+", f[2], true
+}
+
+// fresh reports whether e is still to be trusted.
+func (c *MemoRemoteCache) fresh(e memoEntry) bool {
+	ttl := c.missTTL
+	if e.exists {
+		ttl = c.hitTTL
+	}
+	return ttl > 0 && c.now().Sub(time.Unix(e.at, 0)) < ttl
+}
+
+// lookup returns the fresh entry of actionID, if any.
+func (c *MemoRemoteCache) lookup(actionID string) (exists, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[actionID]
+	if !ok || !c.fresh(e) {
+		return false, false
+	}
+	return e.exists, true
+}
+
+// record memoizes, if its TTL is set, that the remote stores actionID or
+// lacks it.
+func (c *MemoRemoteCache) record(actionID string, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (exists && c.hitTTL <= 0) || (!exists && c.missTTL <= 0) {
+		// Forget a previous answer, which may now be wrong.
+		delete(c.entries, actionID)
+		return
+	}
+	e := memoEntry{at: c.now().Unix(), exists: exists}
+	if old, ok := c.entries[actionID]; ok && old.exists == exists && old.at == e.at {
+		return
+	}
+	c.entries[actionID] = e
+	if c.f == nil {
+		return
+	}
+	// One write of the whole line, which O_APPEND keeps from interleaving
+	// with those of other processes.
+	if _, err := io.WriteString(c.f, formatMemoLine(actionID, e)); err != nil {
+		slog.Warn("writing the remote memo failed", "file", c.file, "err", err)
+		c.f.Close()
+		c.f = nil
+	}
+}
+
+func (c *MemoRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	if exists, ok := c.lookup(actionID); ok && !exists {
+		return "", 0, nil, nil
+	}
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err == nil {
+		c.record(actionID, outputID != "")
+	}
+	return outputID, size, output, err
+}
+
+func (c *MemoRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	err := c.cache.Put(ctx, actionID, outputID, size, body)
+	if err == nil {
+		c.record(actionID, true)
+	}
+	return err
+}
+
+func (c *MemoRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	err := c.forwarder.PutAction(ctx, actionID, outputID, size)
+	if err == nil {
+		c.record(actionID, true)
+	}
+	return err
+}
+
+// BatchExists answers about the actions it knows of, and asks the wrapped
+// cache about the others.
+func (c *MemoRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	exists := make([]bool, len(actionIDs))
+	var unknown []string
+	var at []int // the index in actionIDs of each of unknown
+	for i, id := range actionIDs {
+		e, ok := c.lookup(id)
+		if ok {
+			exists[i] = e
+			continue
+		}
+		unknown = append(unknown, id)
+		at = append(at, i)
+	}
+	if len(unknown) == 0 {
+		return exists, nil
+	}
+	answers, err := c.forwarder.BatchExists(ctx, unknown)
+	if err != nil {
+		return nil, err
+	}
+	for j, e := range answers {
+		exists[at[j]] = e
+		c.record(unknown[j], e)
+	}
+	return exists, nil
+}
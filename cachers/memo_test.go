@@ -0,0 +1,104 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRemote is a batchRemote counting its Gets and recording the
+// actions of its last BatchExists.
+type countingRemote struct {
+	*batchRemote
+	gets  atomic.Int64
+	asked []string
+}
+
+func (c *countingRemote) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	c.gets.Add(1)
+	return c.batchRemote.Get(ctx, actionID)
+}
+
+func (c *countingRemote) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	c.asked = actionIDs
+	return c.batchRemote.BatchExists(ctx, actionIDs)
+}
+
+func TestMemoRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "memo", "remote-memo")
+	remote := &countingRemote{batchRemote: &batchRemote{fakeRemote: newFakeRemote("remote")}}
+	remote.entries["a2"] = fakeEntry{outputID: "o2", body: []byte("hello")}
+	start := func(t *testing.T, identity string, now time.Time) *MemoRemoteCache {
+		c := NewMemoRemoteCache(remote, file, identity, time.Hour, 10*time.Minute)
+		c.now = func() time.Time { return now }
+		require.NoError(t, c.Start(ctx))
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	now := time.Now()
+
+	c := start(t, "id1", now)
+	outputID, _, _, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID)
+	outputID, _, output, err := c.Get(ctx, "a2")
+	require.NoError(t, err)
+	assert.Equal(t, "o2", outputID)
+	output.Close()
+	assert.EqualValues(t, 2, remote.gets.Load())
+	require.NoError(t, c.Close())
+
+	t.Run("next session", func(t *testing.T) {
+		c := start(t, "id1", now.Add(time.Minute))
+		outputID, _, _, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.Empty(t, outputID)
+		assert.EqualValues(t, 2, remote.gets.Load(), "the miss is answered by the memo")
+
+		exists, err := c.BatchExists(ctx, []string{"a1", "a2", "a3"})
+		require.NoError(t, err)
+		assert.Equal(t, []bool{false, true, false}, exists)
+		assert.Equal(t, []string{"a3"}, remote.asked, "only the unknown actions are asked about")
+
+		// A hit is still fetched, and a put replaces a memoized miss.
+		require.NoError(t, c.Put(ctx, "a1", "o1", 5, strings.NewReader("hello")))
+		outputID, _, output, err = c.Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.Equal(t, "o1", outputID)
+		output.Close()
+		assert.EqualValues(t, 3, remote.gets.Load())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		delete(remote.entries, "a1")
+		c := start(t, "id1", now.Add(30*time.Minute))
+		exists, err := c.BatchExists(ctx, []string{"a1", "a2", "a3"})
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true, true, false}, exists, "the hits are trusted for longer")
+		assert.Equal(t, []string{"a3"}, remote.asked)
+
+		c = start(t, "id1", now.Add(2*time.Hour))
+		_, err = c.BatchExists(ctx, []string{"a1", "a2", "a3"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a1", "a2", "a3"}, remote.asked)
+	})
+
+	t.Run("another remote", func(t *testing.T) {
+		c := start(t, "id2", now.Add(2*time.Hour))
+		_, err := c.BatchExists(ctx, []string{"a1", "a2", "a3"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a1", "a2", "a3"}, remote.asked)
+		b, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(b), memoHeader+"id2\n"))
+	})
+}
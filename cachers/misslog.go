@@ -0,0 +1,96 @@
+package cachers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// MissLogCache is a LocalCache that records every miss of the cache it
+// wraps to a writer, one JSON object per line, for analyzing why a hit
+// rate is low. cmd/go only sends the action ID of a get, not the
+// description of the action it hashes, so that is all a miss records; run
+// the build with GODEBUG=gocachehash=1 to see what goes into the IDs.
+type MissLogCache struct {
+	cache LocalCache
+
+	mu  sync.Mutex // guards enc
+	enc *json.Encoder
+}
+
+// Miss is an entry of the log written by a MissLogCache.
+type Miss struct {
+	Time     time.Time
+	ActionID string
+	Request  int64 `json:",omitempty"` // the protocol request ID, if known
+}
+
+var _ LocalCache = &MissLogCache{}
+var _ HealthChecker = &MissLogCache{}
+var _ StatsReporter = &MissLogCache{}
+var _ QueueReporter = &MissLogCache{}
+var _ LocalOutputStore = &MissLogCache{}
+
+func NewMissLogCache(cache LocalCache, w io.Writer) *MissLogCache {
+	return &MissLogCache{cache: cache, enc: json.NewEncoder(w)}
+}
+
+func (m *MissLogCache) Kind() string {
+	return m.cache.Kind()
+}
+
+func (m *MissLogCache) TierStats() []TierStats {
+	return CacheStats(m.cache)
+}
+
+func (m *MissLogCache) QueueStats() QueueStats {
+	return CacheQueues(m.cache)
+}
+
+func (m *MissLogCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, m.cache)
+}
+
+func (m *MissLogCache) Start(ctx context.Context) error {
+	return m.cache.Start(ctx)
+}
+
+func (m *MissLogCache) Close() error {
+	return m.cache.Close()
+}
+
+func (m *MissLogCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	outputID, diskPath, err = m.cache.Get(ctx, actionID)
+	if err == nil && outputID == "" {
+		miss := Miss{Time: time.Now(), ActionID: actionID}
+		miss.Request, _ = RequestID(ctx)
+		m.mu.Lock()
+		werr := m.enc.Encode(miss)
+		m.mu.Unlock()
+		if werr != nil {
+			slog.WarnContext(ctx, "failed to log miss", "action", actionID, "err", werr)
+		}
+	}
+	return outputID, diskPath, err
+}
+
+func (m *MissLogCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	return m.cache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (m *MissLogCache) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := m.cache.(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+func (m *MissLogCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := m.cache.(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return los.PutAction(ctx, actionID, outputID, size)
+}
@@ -0,0 +1,43 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissLogCache(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	c := NewMissLogCache(NewSimpleDiskCache(false, t.TempDir()), &buf)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	_, err := c.Put(ctx, "a1", "0123", 5, sbytes.NewBuffer([]byte("hello")))
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "a1") // hit
+	require.NoError(t, err)
+	_, _, err = c.Get(WithRequestID(ctx, 7), "a2") // miss
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "a3") // miss
+	require.NoError(t, err)
+
+	var misses []Miss
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var m Miss
+		require.NoError(t, dec.Decode(&m))
+		misses = append(misses, m)
+	}
+	require.Len(t, misses, 2)
+	assert.Equal(t, "a2", misses[0].ActionID)
+	assert.Equal(t, int64(7), misses[0].Request)
+	assert.False(t, misses[0].Time.IsZero())
+	assert.Equal(t, "a3", misses[1].ActionID)
+	assert.Zero(t, misses[1].Request)
+}
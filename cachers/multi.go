@@ -0,0 +1,422 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+)
+
+// MultiReadMode controls how MultiRemoteCache looks up entries.
+type MultiReadMode int
+
+const (
+	// ReadOrdered tries the remotes one after another, in order.
+	ReadOrdered MultiReadMode = iota
+	// ReadRace queries all remotes concurrently and uses the first hit.
+	ReadRace
+)
+
+// MultiWriteMode controls where MultiRemoteCache stores entries.
+type MultiWriteMode int
+
+const (
+	// WriteAll stores every entry in all remotes.
+	WriteAll MultiWriteMode = iota
+	// WriteFirst stores every entry in the first remote that accepts it.
+	WriteFirst
+)
+
+// ParseMultiReadMode parses "ordered" or "race". The empty string is ReadOrdered.
+func ParseMultiReadMode(s string) (MultiReadMode, error) {
+	switch strings.ToLower(s) {
+	case "", "ordered":
+		return ReadOrdered, nil
+	case "race":
+		return ReadRace, nil
+	}
+	return 0, fmt.Errorf("unknown read mode %q", s)
+}
+
+// ParseMultiWriteMode parses "all" or "first". The empty string is WriteAll.
+func ParseMultiWriteMode(s string) (MultiWriteMode, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return WriteAll, nil
+	case "first":
+		return WriteFirst, nil
+	}
+	return 0, fmt.Errorf("unknown write mode %q", s)
+}
+
+// MultiRemoteCache is a RemoteCache backed by an ordered list of remotes.
+type MultiRemoteCache struct {
+	remotes   []RemoteCache
+	readMode  MultiReadMode
+	writeMode MultiWriteMode
+	verbose   bool
+	spoolDir  string // for the temporary files of putFirst, or ""
+}
+
+var _ RemoteCache = &MultiRemoteCache{}
+var _ HealthChecker = &MultiRemoteCache{}
+var _ BatchChecker = &MultiRemoteCache{}
+
+func NewMultiRemoteCache(remotes []RemoteCache, readMode MultiReadMode, writeMode MultiWriteMode, verbose bool) *MultiRemoteCache {
+	return &MultiRemoteCache{
+		remotes:   remotes,
+		readMode:  readMode,
+		writeMode: writeMode,
+		verbose:   verbose,
+	}
+}
+
+// SetSpoolDir makes the bodies that WriteFirst may send more than once, and
+// can't read again, be spooled to dir instead of the default directory for
+// temporary files.
+func (m *MultiRemoteCache) SetSpoolDir(dir string) {
+	m.spoolDir = dir
+}
+
+func (m *MultiRemoteCache) Kind() string {
+	kinds := make([]string, len(m.remotes))
+	for i, r := range m.remotes {
+		kinds[i] = r.Kind()
+	}
+	return "multi(" + strings.Join(kinds, ",") + ")"
+}
+
+func (m *MultiRemoteCache) Start(ctx context.Context) error {
+	for i, r := range m.remotes {
+		if err := r.Start(ctx); err != nil {
+			for _, started := range m.remotes[:i] {
+				_ = started.Close()
+			}
+			return fmt.Errorf("%s start failed: %w", r.Kind(), err)
+		}
+	}
+	return nil
+}
+
+// HealthCheck reports whether any remote is healthy. Remotes that do not
+// implement HealthChecker count as healthy.
+func (m *MultiRemoteCache) HealthCheck(ctx context.Context) error {
+	return anyHealthy(ctx, m.remotes)
+}
+
+func (m *MultiRemoteCache) Close() error {
+	var errAll error
+	for _, r := range m.remotes {
+		if err := r.Close(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("%s stop failed: %w", r.Kind(), err))
+		}
+	}
+	return errAll
+}
+
+func (m *MultiRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	if m.readMode == ReadRace {
+		return m.getRace(ctx, actionID)
+	}
+	var errs []error
+	for _, r := range m.remotes {
+		outputID, size, output, err := r.Get(ctx, actionID)
+		if err != nil {
+			if m.verbose {
+				slog.DebugContext(ctx, "get failed", "cache", r.Kind(), "action", actionID, "err", err)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.Kind(), err))
+			continue
+		}
+		if outputID != "" {
+			return outputID, size, output, nil
+		}
+	}
+	if len(errs) == len(m.remotes) {
+		return "", 0, nil, errors.Join(errs...)
+	}
+	return "", 0, nil, nil
+}
+
+// BatchExists asks the remotes, in order, about the actions those before
+// them lack. Like Get, it fails only if all of them do, and a remote that
+// fails is taken to lack the actions it was asked about.
+func (m *MultiRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	exists := make([]bool, len(actionIDs))
+	pending := make([]int, len(actionIDs))
+	for i := range pending {
+		pending[i] = i
+	}
+	var errs []error
+	for _, r := range m.remotes {
+		if len(pending) == 0 {
+			break
+		}
+		ids := make([]string, len(pending))
+		for j, i := range pending {
+			ids[j] = actionIDs[i]
+		}
+		found, err := BatchExists(ctx, r, ids)
+		if err != nil {
+			if m.verbose {
+				slog.DebugContext(ctx, "batch exists failed", "cache", r.Kind(), "actions", len(ids), "err", err)
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.Kind(), err))
+			continue
+		}
+		rest := pending[:0]
+		for j, i := range pending {
+			if found[j] {
+				exists[i] = true
+			} else {
+				rest = append(rest, i)
+			}
+		}
+		pending = rest
+	}
+	if len(errs) == len(m.remotes) {
+		return nil, errors.Join(errs...)
+	}
+	return exists, nil
+}
+
+type getResult struct {
+	outputID string
+	size     int64
+	output   io.ReadCloser
+	err      error
+	cancel   context.CancelFunc
+}
+
+// getRace queries all remotes at once and returns the first hit.
+// Losing requests are canceled; the winner's context lives until its
+// output is closed.
+func (m *MultiRemoteCache) getRace(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	results := make(chan getResult, len(m.remotes))
+	for _, r := range m.remotes {
+		r := r
+		rctx, cancel := context.WithCancel(ctx)
+		go func() {
+			outputID, size, output, err := r.Get(rctx, actionID)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", r.Kind(), err)
+			}
+			results <- getResult{outputID, size, output, err, cancel}
+		}()
+	}
+	var errs []error
+	for i := range m.remotes {
+		res := <-results
+		if res.err != nil || res.outputID == "" {
+			res.cancel()
+			if res.err != nil {
+				errs = append(errs, res.err)
+			}
+			continue
+		}
+		// Drain and cancel the rest in the background.
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				late := <-results
+				if late.output != nil {
+					_ = late.output.Close()
+				}
+				late.cancel()
+			}
+		}(len(m.remotes) - i - 1)
+		return res.outputID, res.size, &cancelOnClose{ReadCloser: res.output, cancel: res.cancel}, nil
+	}
+	if len(errs) == len(m.remotes) {
+		return "", 0, nil, errors.Join(errs...)
+	}
+	return "", 0, nil, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (m *MultiRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if m.writeMode == WriteFirst {
+		return m.putFirst(ctx, actionID, outputID, size, body)
+	}
+	if bb, ok := body.(*sbytes.Buffer); ok || size == 0 {
+		var b []byte
+		if ok {
+			b = bb.Bytes()
+		}
+		errs := make([]error, len(m.remotes))
+		done := make(chan struct{})
+		for i, r := range m.remotes {
+			i, r := i, r
+			go func() {
+				defer func() { done <- struct{}{} }()
+				errs[i] = m.wrapErr(ctx, r, r.Put(ctx, actionID, outputID, size, sbytes.NewBuffer(b)))
+			}()
+		}
+		for range m.remotes {
+			<-done
+		}
+		return errors.Join(errs...)
+	}
+	return m.putStream(ctx, actionID, outputID, size, body)
+}
+
+// putStream fans a non-replayable body out to all remotes through pipes.
+// A remote that fails stops receiving data without affecting the others.
+func (m *MultiRemoteCache) putStream(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	errs := make([]error, len(m.remotes))
+	writers := make([]*io.PipeWriter, len(m.remotes))
+	done := make(chan struct{})
+	for i, r := range m.remotes {
+		i, r := i, r
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		go func() {
+			defer func() { done <- struct{}{} }()
+			errs[i] = m.wrapErr(ctx, r, r.Put(ctx, actionID, outputID, size, pr))
+			// Unblock the copy below if the remote stopped reading early.
+			pr.CloseWithError(io.ErrClosedPipe)
+		}()
+	}
+	_, copyErr := sbytes.Copy(&fanOutWriter{writers: append([]*io.PipeWriter(nil), writers...)}, body)
+	for _, pw := range writers {
+		pw.CloseWithError(copyErr)
+	}
+	for range m.remotes {
+		<-done
+	}
+	if copyErr != nil && !errors.Is(copyErr, errAllRemotesFailed) {
+		return copyErr
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiRemoteCache) putFirst(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	// We may need to send the body more than once: replay returns it from
+	// its start.
+	var replay func() (io.Reader, error)
+	switch b := body.(type) {
+	case *sbytes.Buffer:
+		bytes := b.Bytes()
+		replay = func() (io.Reader, error) { return sbytes.NewBuffer(bytes), nil }
+	case io.ReadSeeker:
+		start, err := b.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		replay = func() (io.Reader, error) {
+			_, err := b.Seek(start, io.SeekStart)
+			return b, err
+		}
+	default:
+		if size == 0 {
+			replay = func() (io.Reader, error) { return sbytes.NewBuffer(nil), nil }
+			break
+		}
+		// Spool it rather than hold it in memory, as large as it may be.
+		f, err := os.CreateTemp(m.spoolDir, "go-cacher-put-*")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+		if _, err := sbytes.Copy(f, body); err != nil {
+			return err
+		}
+		replay = func() (io.Reader, error) {
+			_, err := f.Seek(0, io.SeekStart)
+			return f, err
+		}
+	}
+	var errs []error
+	for _, r := range m.remotes {
+		body, err := replay()
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		err = r.Put(ctx, actionID, outputID, size, body)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, m.wrapErr(ctx, r, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiRemoteCache) wrapErr(ctx context.Context, r RemoteCache, err error) error {
+	if err == nil {
+		return nil
+	}
+	if m.verbose {
+		slog.DebugContext(ctx, "put failed", "cache", r.Kind(), "err", err)
+	}
+	return fmt.Errorf("%s: %w", r.Kind(), err)
+}
+
+// anyHealthy checks remotes concurrently and succeeds if one of them is
+// healthy, or does not implement HealthChecker.
+func anyHealthy(ctx context.Context, remotes []RemoteCache) error {
+	errs := make([]error, len(remotes))
+	done := make(chan struct{})
+	for i, r := range remotes {
+		i, r := i, r
+		go func() {
+			defer func() { done <- struct{}{} }()
+			if hc, ok := r.(HealthChecker); ok {
+				if err := hc.HealthCheck(ctx); err != nil {
+					errs[i] = fmt.Errorf("%s: %w", r.Kind(), err)
+				}
+			}
+		}()
+	}
+	for range remotes {
+		<-done
+	}
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var errAllRemotesFailed = errors.New("all remotes failed")
+
+// fanOutWriter writes to all of its writers, dropping the ones that fail.
+// It only fails once every writer has failed.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for i, w := range f.writers {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.writers[i] = nil
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errAllRemotesFailed
+	}
+	return len(p), nil
+}
@@ -0,0 +1,175 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRemote is an in-memory RemoteCache for tests.
+type fakeRemote struct {
+	kind string
+	err  error // if non-nil, returned by all Gets and Puts
+
+	mu      sync.Mutex
+	entries map[string]fakeEntry // by actionID
+}
+
+type fakeEntry struct {
+	outputID string
+	body     []byte
+}
+
+func newFakeRemote(kind string) *fakeRemote {
+	return &fakeRemote{kind: kind, entries: map[string]fakeEntry{}}
+}
+
+func (f *fakeRemote) Kind() string                    { return f.kind }
+func (f *fakeRemote) Start(ctx context.Context) error { return nil }
+func (f *fakeRemote) Close() error                    { return nil }
+
+func (f *fakeRemote) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	if f.err != nil {
+		return "", 0, nil, f.err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[actionID]
+	if !ok {
+		return "", 0, nil, nil
+	}
+	return e.outputID, int64(len(e.body)), io.NopCloser(bytes.NewReader(e.body)), nil
+}
+
+func (f *fakeRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if f.err != nil {
+		return f.err
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[actionID] = fakeEntry{outputID: outputID, body: b}
+	return nil
+}
+
+func (f *fakeRemote) has(actionID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.entries[actionID]
+	return ok
+}
+
+func TestMultiRemoteCacheGet(t *testing.T) {
+	for _, mode := range []MultiReadMode{ReadOrdered, ReadRace} {
+		first, second := newFakeRemote("first"), newFakeRemote("second")
+		second.entries["a1"] = fakeEntry{outputID: "o1", body: []byte("hello")}
+		m := NewMultiRemoteCache([]RemoteCache{first, second}, mode, WriteAll, false)
+
+		outputID, size, output, err := m.Get(context.Background(), "a1")
+		require.NoError(t, err)
+		assert.Equal(t, "o1", outputID)
+		assert.EqualValues(t, 5, size)
+		b, _ := io.ReadAll(output)
+		assert.NoError(t, output.Close())
+		assert.Equal(t, "hello", string(b))
+
+		outputID, _, _, err = m.Get(context.Background(), "missing")
+		assert.NoError(t, err)
+		assert.Empty(t, outputID)
+	}
+}
+
+func TestMultiRemoteCacheGetErrors(t *testing.T) {
+	broken, empty := newFakeRemote("broken"), newFakeRemote("empty")
+	broken.err = errors.New("boom")
+	m := NewMultiRemoteCache([]RemoteCache{broken, empty}, ReadOrdered, WriteAll, false)
+	outputID, _, _, err := m.Get(context.Background(), "a1")
+	assert.NoError(t, err, "a healthy remote's miss should win over another's error")
+	assert.Empty(t, outputID)
+
+	empty.err = errors.New("also boom")
+	_, _, _, err = m.Get(context.Background(), "a1")
+	assert.Error(t, err)
+}
+
+func TestMultiRemoteCachePut(t *testing.T) {
+	body := strings.Repeat("x", 100<<10)
+	for _, tt := range []struct {
+		name string
+		body func() io.Reader
+	}{
+		{"buffer", func() io.Reader { return sbytes.NewBuffer([]byte(body)) }},
+		{"stream", func() io.Reader { return strings.NewReader(body) }},
+	} {
+		t.Run(tt.name+"/all", func(t *testing.T) {
+			broken, a, b := newFakeRemote("broken"), newFakeRemote("a"), newFakeRemote("b")
+			broken.err = errors.New("boom")
+			m := NewMultiRemoteCache([]RemoteCache{a, broken, b}, ReadOrdered, WriteAll, false)
+			err := m.Put(context.Background(), "a1", "o1", int64(len(body)), tt.body())
+			assert.Error(t, err)
+			assert.True(t, a.has("a1"))
+			assert.True(t, b.has("a1"))
+			assert.Equal(t, body, string(b.entries["a1"].body))
+		})
+		t.Run(tt.name+"/first", func(t *testing.T) {
+			broken, a, b := newFakeRemote("broken"), newFakeRemote("a"), newFakeRemote("b")
+			broken.err = errors.New("boom")
+			m := NewMultiRemoteCache([]RemoteCache{broken, a, b}, ReadOrdered, WriteFirst, false)
+			err := m.Put(context.Background(), "a1", "o1", int64(len(body)), tt.body())
+			assert.NoError(t, err)
+			assert.True(t, a.has("a1"))
+			assert.False(t, b.has("a1"))
+		})
+	}
+}
+
+// halfRemote is a RemoteCache reading half of the bodies it is sent before
+// failing.
+type halfRemote struct {
+	*fakeRemote
+}
+
+func (h halfRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	_, err := io.CopyN(io.Discard, body, size/2)
+	return errors.Join(err, errors.New("half"))
+}
+
+func TestMultiRemoteCachePutFirstReplay(t *testing.T) {
+	body := strings.Repeat("hello ", 1000)
+	for _, tt := range []struct {
+		name string
+		body func() io.Reader
+	}{
+		{"buffer", func() io.Reader { return sbytes.NewBuffer([]byte(body)) }},
+		{"seeker", func() io.Reader {
+			r := strings.NewReader("skipped" + body)
+			_, _ = r.Seek(int64(len("skipped")), io.SeekStart)
+			return r
+		}},
+		{"stream", func() io.Reader { return struct{ io.Reader }{strings.NewReader(body)} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			a := newFakeRemote("a")
+			m := NewMultiRemoteCache([]RemoteCache{halfRemote{newFakeRemote("half")}, a}, ReadOrdered, WriteFirst, false)
+			m.SetSpoolDir(dir)
+			require.NoError(t, m.Put(context.Background(), "a1", "o1", int64(len(body)), tt.body()))
+			assert.Equal(t, body, string(a.entries["a1"].body))
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, entries, "the spooled body is removed")
+		})
+	}
+}
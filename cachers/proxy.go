@@ -0,0 +1,78 @@
+package cachers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NewProxyFunc returns a function for http.Transport.Proxy sending all the
+// requests through proxy, an http://, https://, socks5:// or socks5h://
+// URL, except those to the hosts of noProxy and to the loopback and
+// link-local addresses, like the metadata endpoints of the cloud instances.
+// noProxy is like NO_PROXY: comma-separated hosts, which also match their
+// subdomains, with an optional leading dot and port, IP addresses, CIDR
+// ranges, or "*" for all of them.
+func NewProxyFunc(proxy, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %q: want an http, https, socks5 or socks5h URL", proxy)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q: no host", proxy)
+	}
+	var bypass []string
+	for _, e := range strings.Split(noProxy, ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+			bypass = append(bypass, e)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, bypass) {
+			return nil, nil
+		}
+		return u, nil
+	}, nil
+}
+
+// bypassProxy reports whether the requests to u go around the proxy.
+func bypassProxy(u *url.URL, bypass []string) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+		return true
+	}
+	for _, e := range bypass {
+		if e == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		h, p := e, ""
+		if sh, sp, err := net.SplitHostPort(e); err == nil {
+			h, p = sh, sp
+		}
+		if p != "" && p != port {
+			continue
+		}
+		h = strings.TrimPrefix(h, ".")
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package cachers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProxyFunc(t *testing.T) {
+	proxy, err := NewProxyFunc("socks5h://proxy.corp:1080", "internal.corp, .svc:8080,10.0.0.0/8,192.168.1.7")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		url    string
+		direct bool
+	}{
+		{"https://cache.example.com/", false},
+		{"https://internal.corp/", true},
+		{"https://cache.internal.corp/", true},
+		{"https://notinternal.corp/", false},
+		{"http://a.svc:8080/", true},
+		{"http://a.svc:9090/", false},
+		{"http://10.1.2.3/", true},
+		{"http://192.168.1.7:80/", true},
+		{"http://192.168.1.8/", false},
+		{"http://localhost:3000/", true},
+		{"http://127.0.0.1/", true},
+		{"http://[::1]/", true},
+		{"http://169.254.169.254/latest/meta-data/", true},
+	} {
+		u, err := proxy(&http.Request{URL: mustParse(t, tc.url)})
+		require.NoError(t, err)
+		if tc.direct {
+			assert.Nil(t, u, tc.url)
+		} else {
+			assert.Equal(t, "socks5h://proxy.corp:1080", u.String(), tc.url)
+		}
+	}
+
+	all, err := NewProxyFunc("http://proxy.corp:3128", "*")
+	require.NoError(t, err)
+	u, err := all(&http.Request{URL: mustParse(t, "https://cache.example.com/")})
+	require.NoError(t, err)
+	assert.Nil(t, u)
+
+	for _, bad := range []string{"ftp://proxy.corp", "proxy.corp:3128", "http://"} {
+		_, err := NewProxyFunc(bad, "")
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestNewProxyFuncProxies(t *testing.T) {
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+	}))
+	defer proxy.Close()
+	f, err := NewProxyFunc(proxy.URL, "")
+	require.NoError(t, err)
+	res, err := (&http.Client{Transport: &http.Transport{Proxy: f}}).Get("http://cache.example.com/action/a1")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "http://cache.example.com/action/a1", got)
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	require.NoError(t, err)
+	return u
+}
@@ -0,0 +1,21 @@
+package cachers
+
+// QueueStats are the depths of the background work queues of a cache.
+type QueueStats struct {
+	Uploads int64 // background uploads queued or in flight
+	Retries int64 // failed writes waiting for a retry
+}
+
+// QueueReporter is implemented by caches that do work in the background,
+// including wrappers of caches that do.
+type QueueReporter interface {
+	QueueStats() QueueStats
+}
+
+// CacheQueues returns the queue depths of c, if it has queues.
+func CacheQueues(c Cache) QueueStats {
+	if qr, ok := c.(QueueReporter); ok {
+		return qr.QueueStats()
+	}
+	return QueueStats{}
+}
@@ -0,0 +1,108 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPRangedDownloads(t *testing.T) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	var mu sync.Mutex
+	var ranges []string
+	handler := func(ranged bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/action/") {
+				_ = json.NewEncoder(w).Encode(&ActionValue{OutputID: "0123", Size: int64(len(body))})
+				return
+			}
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			if !ranged {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		}
+	}
+	get := func(t *testing.T, c *HTTPCache) []byte {
+		_, size, output, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.EqualValues(t, len(body), size)
+		got, err := io.ReadAll(output)
+		require.NoError(t, err)
+		require.NoError(t, output.Close())
+		return got
+	}
+
+	t.Run("ranged", func(t *testing.T) {
+		ranges = nil
+		srv := httptest.NewServer(handler(true))
+		defer srv.Close()
+		dir := t.TempDir()
+		c := NewHttpCache(srv.URL, false)
+		c.SetRangedDownloads(RangedDownloads{Threshold: 1000, Parts: 4, Dir: dir})
+		assert.Equal(t, body, get(t, c))
+		assert.ElementsMatch(t, []string{"bytes=0-2499", "bytes=2500-4999", "bytes=5000-7499", "bytes=7500-9999"}, ranges)
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, files, "the download removed once closed")
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		ranges = nil
+		srv := httptest.NewServer(handler(false))
+		defer srv.Close()
+		c := NewHttpCache(srv.URL, false)
+		c.SetRangedDownloads(RangedDownloads{Threshold: 1000, Parts: 2, Dir: t.TempDir()})
+		assert.Equal(t, body, get(t, c))
+		assert.Equal(t, body, get(t, c))
+		assert.Len(t, ranges, 4, "two ranges, then whole gets")
+		assert.Equal(t, []string{"", ""}, ranges[2:])
+	})
+}
+
+func TestS3RangedDownloads(t *testing.T) {
+	ctx := context.Background()
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	client := &fakeS3{objects: map[string]fakeObject{}}
+	c := NewS3Cache(client, "bucket", "prefix", false)
+	c.SetCompression(Compression{Mode: CompressionOff})
+	c.SetRangedDownloads(RangedDownloads{Threshold: 4000, Parts: 3, Dir: t.TempDir()})
+	require.NoError(t, c.Put(ctx, "a1b2c3", "0123", int64(len(body)), sbytes.NewBuffer(bytes.Clone(body))))
+	require.NoError(t, c.Put(ctx, "d4e5f6", "4567", 0, sbytes.NewBuffer(nil)))
+	require.NoError(t, c.Put(ctx, "a7b8c9", "89ab", 5, sbytes.NewBuffer([]byte("hello"))))
+
+	for _, tc := range []struct {
+		actionID string
+		want     []byte
+		gets     []string
+	}{
+		{"a1b2c3", body, []string{"bytes=0-3999", "bytes=4000-6999", "bytes=7000-9999"}},
+		{"d4e5f6", []byte{}, []string{"bytes=0-3999", ""}},
+		{"a7b8c9", []byte("hello"), []string{"bytes=0-3999"}},
+	} {
+		client.gets = nil
+		_, size, output, err := c.Get(ctx, tc.actionID)
+		require.NoError(t, err)
+		assert.EqualValues(t, len(tc.want), size)
+		got, err := io.ReadAll(output)
+		require.NoError(t, err)
+		require.NoError(t, output.Close())
+		assert.Equal(t, tc.want, got, tc.actionID)
+		assert.ElementsMatch(t, tc.gets, client.gets, tc.actionID)
+	}
+}
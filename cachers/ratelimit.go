@@ -0,0 +1,132 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxRateLimitChunk bounds how many bytes a rate-limited reader hands out
+// per Read, so waits stay short and the limit is applied smoothly.
+const maxRateLimitChunk = 32 << 10
+
+// tokenBucket is a byte-rate limiter. Tokens refill continuously at rate
+// per second up to a burst of one second's worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens from the bucket, blocking until they have been
+// refilled or ctx is done. The bucket is allowed to go into debt so that
+// concurrent callers queue up behind each other.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rateLimitedReader is an io.Reader that takes tokens from a bucket for
+// every byte it reads.
+type rateLimitedReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxRateLimitChunk {
+		p = p[:maxRateLimitChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.bucket.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type rateLimitedReadCloser struct {
+	rateLimitedReader
+	io.Closer
+}
+
+// RateLimitedTransport is an http.RoundTripper that limits the rate at which
+// request bodies are sent and response bodies are received.
+// The limits are shared by all requests going through the transport, so a
+// single RateLimitedTransport should be used for the whole remote tier.
+type RateLimitedTransport struct {
+	base     http.RoundTripper
+	upload   *tokenBucket // nil means unlimited
+	download *tokenBucket // nil means unlimited
+}
+
+// NewRateLimitedTransport returns a transport wrapping base (or
+// http.DefaultTransport if nil) that limits uploads and downloads to the
+// given number of bytes per second. A limit <= 0 means unlimited.
+func NewRateLimitedTransport(base http.RoundTripper, uploadBytesPerSecond, downloadBytesPerSecond int64) *RateLimitedTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &RateLimitedTransport{base: base}
+	if uploadBytesPerSecond > 0 {
+		t.upload = newTokenBucket(uploadBytesPerSecond)
+	}
+	if downloadBytesPerSecond > 0 {
+		t.download = newTokenBucket(downloadBytesPerSecond)
+	}
+	return t
+}
+
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if t.upload != nil && req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(ctx)
+		req.Body = &rateLimitedReadCloser{
+			rateLimitedReader: rateLimitedReader{ctx: ctx, r: req.Body, bucket: t.upload},
+			Closer:            req.Body,
+		}
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.download != nil {
+		res.Body = &rateLimitedReadCloser{
+			rateLimitedReader: rateLimitedReader{ctx: ctx, r: res.Body, bucket: t.download},
+			Closer:            res.Body,
+		}
+	}
+	return res, nil
+}
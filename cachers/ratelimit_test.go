@@ -0,0 +1,34 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	const rate = 64 << 10
+	r := &rateLimitedReader{
+		ctx:    context.Background(),
+		r:      bytes.NewReader(make([]byte, 2*rate)),
+		bucket: newTokenBucket(rate),
+	}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2*rate, n)
+	// The first second's worth is the burst; the second must be waited for.
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestTokenBucketContextCanceled(t *testing.T) {
+	b := newTokenBucket(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, b.wait(ctx, 1))
+	assert.ErrorIs(t, b.wait(ctx, 10), context.Canceled)
+}
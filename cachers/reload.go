@@ -0,0 +1,102 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ReloadableRemoteCache is a RemoteCache whose underlying cache can be
+// replaced while it is in use, for example to pick up rotated credentials
+// or new endpoints without restarting the session. Replaced caches are
+// kept open, for the operations still using them, until Close.
+type ReloadableRemoteCache struct {
+	mu      sync.Mutex
+	cache   RemoteCache
+	retired []RemoteCache
+	ctx     context.Context // set by Start, to start the caches swapped in
+}
+
+var _ RemoteCache = &ReloadableRemoteCache{}
+var _ HealthChecker = &ReloadableRemoteCache{}
+var _ OutputStore = &ReloadableRemoteCache{}
+var _ BatchChecker = &ReloadableRemoteCache{}
+
+func NewReloadableRemoteCache(cache RemoteCache) *ReloadableRemoteCache {
+	return &ReloadableRemoteCache{cache: cache}
+}
+
+// current returns the cache operations are sent to.
+func (r *ReloadableRemoteCache) current() RemoteCache {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cache
+}
+
+// Swap makes the operations go to cache from now on. If r is started,
+// cache is started first; r is left unchanged if that fails.
+func (r *ReloadableRemoteCache) Swap(cache RemoteCache) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx != nil {
+		if err := cache.Start(r.ctx); err != nil {
+			return err
+		}
+	}
+	r.retired = append(r.retired, r.cache)
+	r.cache = cache
+	return nil
+}
+
+func (r *ReloadableRemoteCache) Kind() string {
+	return r.current().Kind()
+}
+
+func (r *ReloadableRemoteCache) TierStats() []TierStats {
+	return CacheStats(r.current())
+}
+
+func (r *ReloadableRemoteCache) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctx = context.WithoutCancel(ctx)
+	return r.cache.Start(ctx)
+}
+
+// Close closes the current cache and all the ones it replaced.
+func (r *ReloadableRemoteCache) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var errs []error
+	for _, c := range append(r.retired, r.cache) {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *ReloadableRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	return r.current().Get(ctx, actionID)
+}
+
+func (r *ReloadableRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return r.current().Put(ctx, actionID, outputID, size, body)
+}
+
+// HealthCheck checks the current cache. Caches that do not implement
+// HealthChecker are reported healthy.
+func (r *ReloadableRemoteCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, r.current())
+}
+
+func (r *ReloadableRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	return hasOutput(ctx, r.current(), outputID)
+}
+
+func (r *ReloadableRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	return BatchExists(ctx, r.current(), actionIDs)
+}
+
+func (r *ReloadableRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return putAction(ctx, r.current(), actionID, outputID, size)
+}
@@ -0,0 +1,58 @@
+package cachers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lifecycleRemote is a fakeRemote that records whether it was started and
+// closed.
+type lifecycleRemote struct {
+	*fakeRemote
+	started, closed bool
+}
+
+func (l *lifecycleRemote) Start(ctx context.Context) error {
+	l.started = true
+	return nil
+}
+
+func (l *lifecycleRemote) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestReloadableRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	old := &lifecycleRemote{fakeRemote: newFakeRemote("old")}
+	old.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+	r := NewReloadableRemoteCache(old)
+	require.NoError(t, r.Start(ctx))
+	assert.True(t, old.started)
+
+	outputID, _, body, err := r.Get(ctx, "a1")
+	require.NoError(t, err)
+	body.Close()
+	assert.Equal(t, "0123", outputID)
+
+	cur := &lifecycleRemote{fakeRemote: newFakeRemote("new")}
+	require.NoError(t, r.Swap(cur))
+	assert.True(t, cur.started, "caches swapped in after Start are started")
+	assert.Equal(t, "new", r.Kind())
+
+	outputID, _, _, err = r.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "gets go to the new cache")
+	require.NoError(t, r.Put(ctx, "a2", "4567", 3, strings.NewReader("bye")))
+	assert.Contains(t, cur.entries, "a2")
+	assert.NotContains(t, old.entries, "a2")
+	assert.False(t, old.closed, "the old cache stays open for operations in flight")
+
+	require.NoError(t, r.Close())
+	assert.True(t, old.closed)
+	assert.True(t, cur.closed)
+}
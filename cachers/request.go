@@ -0,0 +1,60 @@
+package cachers
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/bradfitz/go-tool-cache/internal/trace"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the cmd/go request
+// it serves, so what the caches log on its behalf can be correlated with it.
+func WithRequestID(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request ctx serves, if any.
+func RequestID(ctx context.Context) (id int64, ok bool) {
+	id, ok = ctx.Value(requestIDKey{}).(int64)
+	return id, ok
+}
+
+// endGetSpan ends the span of a get, recording whether it hit.
+func endGetSpan(span *trace.Span, outputID string, err error) {
+	if err == nil {
+		span.SetAttrs(trace.Bool("gocacheprog.hit", outputID != ""))
+	}
+	span.End(err)
+}
+
+// requestIDHandler is a slog.Handler that adds the request ID carried by
+// the context of each record.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+// NewRequestIDHandler returns a handler that passes records to h, adding
+// a "request" attribute with the ID of the request their context serves.
+// The caches log with the context of the request whenever they have one,
+// including for the uploads they do in the background.
+func NewRequestIDHandler(h slog.Handler) slog.Handler {
+	return requestIDHandler{h}
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := RequestID(ctx); ok {
+		r = r.Clone()
+		r.AddAttrs(slog.Int64("request", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
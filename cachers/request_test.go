@@ -0,0 +1,35 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewRequestIDHandler(slog.NewTextHandler(&buf, nil))).With("cache", "disk")
+
+	logger.InfoContext(WithRequestID(context.Background(), 42), "put failed")
+	assert.Contains(t, buf.String(), `msg="put failed" cache=disk request=42`)
+
+	buf.Reset()
+	logger.InfoContext(context.Background(), "configured")
+	assert.NotContains(t, buf.String(), "request=")
+}
+
+func TestUploadJobRequestID(t *testing.T) {
+	ctx := WithRequestID(context.Background(), 3)
+	job := newUploadJob(ctx, 1, "a", "o", 5, "/p")
+	assert.Equal(t, uploadJob{Tier: 1, ActionID: "a", OutputID: "o", Size: 5, DiskPath: "/p", RequestID: 3}, job)
+
+	id, ok := RequestID(job.context(context.Background()))
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), id)
+
+	_, ok = RequestID(uploadJob{}.context(context.Background()))
+	assert.False(t, ok)
+}
@@ -0,0 +1,145 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy controls how a TieredCache retries failed writes to the tiers
+// after the first one.
+type RetryPolicy struct {
+	// MaxAttempts is the number of tries per write, including the first.
+	// Values <= 1 disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry; it doubles after each
+	// failure, up to MaxDelay. Delays are jittered.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Spread retries over [d/2, d) so that a remote recovering from an
+	// outage isn't hit by every failed write at once.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// RetryStats counts the outcomes of retried writes.
+type RetryStats struct {
+	Retried   int64 // writes that failed and were scheduled for a retry
+	Succeeded int64 // writes that succeeded on a retry
+	GaveUp    int64 // writes that failed MaxAttempts times
+	Abandoned int64 // writes still waiting for a retry on close
+}
+
+// Pending returns the number of writes waiting for a retry.
+func (s RetryStats) Pending() int64 {
+	return s.Retried - s.Succeeded - s.GaveUp - s.Abandoned
+}
+
+func (s RetryStats) String() string {
+	return fmt.Sprintf("retried %d, succeeded %d, gave up %d, abandoned %d", s.Retried, s.Succeeded, s.GaveUp, s.Abandoned)
+}
+
+// retryQueue retries failed uploads with exponential backoff. Each upload
+// waits for its next attempt in its own goroutine; Close abandons the ones
+// still waiting.
+type retryQueue struct {
+	upload func(ctx context.Context, job uploadJob) error
+	policy RetryPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	retried, succeeded, gaveUp, abandoned atomic.Int64
+
+	mu            sync.Mutex
+	abandonedJobs []uploadJob
+}
+
+func newRetryQueue(upload func(context.Context, uploadJob) error, policy RetryPolicy) *retryQueue {
+	return &retryQueue{upload: upload, policy: policy}
+}
+
+func (q *retryQueue) Start(ctx context.Context) {
+	// Like uploads, retries outlive the request that failed.
+	q.ctx, q.cancel = context.WithCancel(context.WithoutCancel(ctx))
+}
+
+// add schedules a retry of job, whose first attempt failed with err.
+func (q *retryQueue) add(job uploadJob, err error) {
+	if q.policy.MaxAttempts <= 1 {
+		return
+	}
+	q.retried.Add(1)
+	q.wg.Add(1)
+	go q.retry(job, err)
+}
+
+func (q *retryQueue) retry(job uploadJob, err error) {
+	defer q.wg.Done()
+	ctx := job.context(q.ctx)
+	for attempt := 2; attempt <= q.policy.MaxAttempts; attempt++ {
+		t := time.NewTimer(q.policy.backoff(attempt - 1))
+		select {
+		case <-q.ctx.Done():
+			t.Stop()
+			q.abandon(job)
+			return
+		case <-t.C:
+		}
+		if err = q.upload(ctx, job); err == nil {
+			q.succeeded.Add(1)
+			return
+		}
+		if q.ctx.Err() != nil {
+			q.abandon(job)
+			return
+		}
+		if errors.Is(err, errPutsDenied) {
+			return
+		}
+	}
+	q.gaveUp.Add(1)
+	slog.WarnContext(ctx, "upload gave up", "action", job.ActionID, "attempts", q.policy.MaxAttempts, "err", err)
+}
+
+func (q *retryQueue) abandon(job uploadJob) {
+	q.abandoned.Add(1)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.abandonedJobs = append(q.abandonedJobs, job)
+}
+
+func (q *retryQueue) Stats() RetryStats {
+	return RetryStats{
+		Retried:   q.retried.Load(),
+		Succeeded: q.succeeded.Load(),
+		GaveUp:    q.gaveUp.Load(),
+		Abandoned: q.abandoned.Load(),
+	}
+}
+
+// Close stops all pending retries and returns the uploads they were for.
+func (q *retryQueue) Close() []uploadJob {
+	q.cancel()
+	q.wg.Wait()
+	return q.abandonedJobs
+}
@@ -0,0 +1,92 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyRemote is a fakeRemote whose first puts fail.
+type flakyRemote struct {
+	*fakeRemote
+	failures atomic.Int32 // puts left to fail
+}
+
+func (f *flakyRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if f.failures.Add(-1) >= 0 {
+		return errors.New("flaky")
+	}
+	return f.fakeRemote.Put(ctx, actionID, outputID, size, body)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 3 * time.Second}
+	for _, tc := range []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 1500 * time.Millisecond, 3 * time.Second},
+		{10, 1500 * time.Millisecond, 3 * time.Second},
+	} {
+		d := p.backoff(tc.retry)
+		assert.GreaterOrEqual(t, d, tc.min, "retry %d", tc.retry)
+		assert.LessOrEqual(t, d, tc.max, "retry %d", tc.retry)
+	}
+}
+
+func TestTieredCacheRetriesFailedPuts(t *testing.T) {
+	t.Run("succeeds", func(t *testing.T) {
+		ctx := context.Background()
+		remote := &flakyRemote{fakeRemote: newFakeRemote("flaky")}
+		remote.failures.Store(2)
+		c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+		require.NoError(t, err)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+		require.NoError(t, c.Start(ctx))
+
+		_, err = c.Put(ctx, "a1", "0123", 5, sbytes.NewBuffer([]byte("hello")))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool { return remote.has("a1") }, time.Second, time.Millisecond)
+		require.NoError(t, c.Close())
+		assert.Equal(t, RetryStats{Retried: 1, Succeeded: 1}, c.RetryStats())
+	})
+	t.Run("gives up", func(t *testing.T) {
+		ctx := context.Background()
+		remote := &flakyRemote{fakeRemote: newFakeRemote("flaky")}
+		remote.failures.Store(10)
+		c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+		require.NoError(t, err)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+		require.NoError(t, c.Start(ctx))
+
+		_, err = c.Put(ctx, "a1", "0123", 5, sbytes.NewBuffer([]byte("hello")))
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool { return c.RetryStats().GaveUp == 1 }, time.Second, time.Millisecond)
+		require.NoError(t, c.Close())
+		assert.False(t, remote.has("a1"))
+		assert.EqualValues(t, 7, remote.failures.Load())
+	})
+	t.Run("abandoned on close", func(t *testing.T) {
+		ctx := context.Background()
+		remote := &flakyRemote{fakeRemote: newFakeRemote("flaky")}
+		remote.failures.Store(1)
+		c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+		require.NoError(t, err)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour})
+		require.NoError(t, c.Start(ctx))
+
+		_, err = c.Put(ctx, "a1", "0123", 5, sbytes.NewBuffer([]byte("hello")))
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		assert.Equal(t, RetryStats{Retried: 1, Abandoned: 1}, c.RetryStats())
+	})
+}
@@ -5,17 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"os"
+	"log/slog"
 	"path"
-	"runtime"
 	"strconv"
 	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
 	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/bradfitz/go-tool-cache/internal/trace"
 	"github.com/klauspost/compress/s2"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -28,8 +29,21 @@ const (
 type s3Client interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
 }
 
+const (
+	// batchListMin is the number of the actions of a batch under a prefix
+	// of the keys from which BatchExists lists the prefix rather than
+	// heads each of their objects.
+	batchListMin = 8
+	// batchConcurrency is the number of the requests of a BatchExists run
+	// at once.
+	batchConcurrency = 16
+)
+
 // S3Cache is a remote cache that is backed by S3 bucket
 type S3Cache struct {
 	bucket string
@@ -37,34 +51,64 @@ type S3Cache struct {
 	// verbose optionally specifies whether to log verbose messages.
 	verbose  bool
 	s3Client s3Client
+	// compression says how the bodies put are compressed.
+	compression Compression
+	// ranged says which objects are downloaded in ranges.
+	ranged RangedDownloads
 }
 
 var _ RemoteCache = &S3Cache{}
+var _ HealthChecker = &S3Cache{}
+var _ BatchChecker = &S3Cache{}
 
 func (s *S3Cache) Kind() string {
 	return "s3"
 }
 
+// SetCompression sets how the bodies put are compressed. Whatever it is,
+// the objects compressed with s2 and zstd are read.
+func (s *S3Cache) SetCompression(compression Compression) {
+	s.compression = compression
+}
+
+// SetRangedDownloads sets which objects are downloaded in ranges. The size
+// of an object is only known from the response to a first range, of the
+// threshold, so its other ranges split the rest of the object.
+func (s *S3Cache) SetRangedDownloads(ranged RangedDownloads) {
+	s.ranged = ranged
+}
+
 func (s *S3Cache) Start(context.Context) error {
-	log.Printf("[%s]\tconfigured to s3://%s/%s", s.Kind(), s.bucket, s.prefix)
+	slog.Info("configured", "cache", s.Kind(), "url", "s3://"+s.bucket+"/"+s.prefix)
 	return nil
 }
 
 func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	ctx, span := trace.Start(ctx, "s3 get", trace.Client, trace.String("gocacheprog.action_id", actionID))
+	defer func() { endGetSpan(span, outputID, err) }()
 	actionKey := s.actionKey(actionID)
-	outputResult, getOutputErr := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &actionKey,
-	})
+	}
+	if s.ranged.Threshold > 0 {
+		input.Range = aws.String(rangeHeader(0, s.ranged.Threshold))
+	}
+	outputResult, getOutputErr := s.s3Client.GetObject(ctx, input)
+	if input.Range != nil && isInvalidRangeError(getOutputErr) {
+		// An empty object has no range.
+		input.Range = nil
+		outputResult, getOutputErr = s.s3Client.GetObject(ctx, input)
+	}
 	if s.verbose {
-		log.Printf("[%s]\t GetObject: s3://%s/%s", s.Kind(), s.bucket, actionKey)
+		slog.DebugContext(ctx, "GetObject", "cache", s.Kind(), "bucket", s.bucket, "key", actionKey)
 	}
 	if isNotFoundError(getOutputErr) {
 		// handle object not found
 		return "", 0, nil, nil
 	} else if getOutputErr != nil {
 		if s.verbose {
-			log.Printf("error S3 get for %s:  %v", actionKey, getOutputErr)
+			slog.DebugContext(ctx, "GetObject failed", "cache", s.Kind(), "key", actionKey, "err", getOutputErr)
 		}
 		return "", 0, nil, fmt.Errorf("unexpected S3 get for %s:  %v", actionKey, getOutputErr)
 	}
@@ -73,16 +117,50 @@ func (s *S3Cache) Get(ctx context.Context, actionID string) (outputID string, si
 	if !ok || outputID == "" || contentSize == nil {
 		return "", 0, nil, fmt.Errorf("outputId or contentSize not found in metadata")
 	}
-	if outputResult.Metadata[compressedMetadataKey] == "s2" {
+	if total, ok := contentRangeSize(aws.ToString(outputResult.ContentRange)); ok && total > *contentSize {
+		body, err := s.ranged.download(ctx, outputResult.Body, *contentSize, total, func(ctx context.Context, off, n int64) (io.ReadCloser, error) {
+			res, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: &s.bucket,
+				Key:    &actionKey,
+				Range:  aws.String(rangeHeader(off, n)),
+				// Not the ranges of an object put since the first.
+				IfMatch: outputResult.ETag,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return res.Body, nil
+		})
+		if err != nil {
+			return "", 0, nil, fmt.Errorf("ranged S3 get for %s: %w", actionKey, err)
+		}
+		outputResult.Body, contentSize = body, &total
+	}
+	switch codec := outputResult.Metadata[compressedMetadataKey]; codec {
+	case "":
+	case "s2", "zstd":
 		sz, err := strconv.Atoi(outputResult.Metadata[decompSizeMetadataKey])
 		if err != nil {
+			outputResult.Body.Close()
 			return "", 0, nil, err
 		}
 		*contentSize = int64(sz)
+		if codec == "zstd" {
+			zr, err := NewZstdReader(outputResult.Body)
+			if err != nil {
+				outputResult.Body.Close()
+				return "", 0, nil, err
+			}
+			outputResult.Body = zr
+			break
+		}
 		outputResult.Body = struct {
 			io.Reader
 			io.Closer
 		}{Reader: s2.NewReader(outputResult.Body), Closer: outputResult.Body}
+	default:
+		outputResult.Body.Close()
+		return "", 0, nil, fmt.Errorf("unsupported compression %q of %s", codec, actionKey)
 	}
 	return outputID, *contentSize, outputResult.Body, nil
 }
@@ -92,20 +170,39 @@ var s2Encoders = sync.Pool{
 }
 
 func (s *S3Cache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
+	ctx, span := trace.Start(ctx, "s3 put", trace.Client, trace.String("gocacheprog.action_id", actionID), trace.Int("gocacheprog.body_size", size))
+	defer func() { span.End(err) }()
 	if size == 0 {
 		body = sbytes.NewBuffer(nil)
 	}
 
 	actionKey := s.actionKey(actionID)
 	if s.verbose {
-		log.Printf("[%s]\t PutObject: s3://%s/%s", s.Kind(), s.bucket, actionKey)
+		slog.DebugContext(ctx, "PutObject", "cache", s.Kind(), "bucket", s.bucket, "key", actionKey)
 	}
 	metadata := map[string]string{
 		outputIDMetadataKey: outputID,
 	}
+	if tags := encodeTags(ctx); tags != "" {
+		metadata[tagsMetadataKey] = tags
+	}
 
-	if bb, ok := body.(*sbytes.Buffer); size > 8<<10 && ok {
-		dst := sbytes.NewBuffer(make([]byte, 0, size/2))
+	bb, ok := body.(*sbytes.Buffer)
+	switch {
+	case !ok || !s.compression.compresses(size) || incompressibleBody(ctx):
+	case s.compression.Mode == CompressionZstd:
+		b := sbytes.Get(int(size / 2))
+		defer sbytes.Put(b)
+		if dst := zstdEncoder.EncodeAll(bb.Bytes(), b[:0]); int64(len(dst)) < size {
+			metadata[compressedMetadataKey] = "zstd"
+			metadata[decompSizeMetadataKey] = strconv.Itoa(int(size))
+			body = sbytes.NewBuffer(dst)
+			size = int64(len(dst))
+		}
+	default:
+		b := sbytes.Get(int(size / 2))
+		defer sbytes.Put(b)
+		dst := sbytes.NewBuffer(b[:0])
 		enc := s2Encoders.Get().(*s2.Writer)
 		enc.Reset(dst)
 		enc.EncodeBuffer(bb.Bytes())
@@ -118,6 +215,12 @@ func (s *S3Cache) Put(ctx context.Context, actionID, outputID string, size int64
 		size = int64(dst.Len())
 	}
 
+	// The client may still be sending the body after PutObject returns,
+	// when its bytes, or those of a buffer the wrappers read it from, are
+	// reused.
+	fence := sbytes.FenceReader(body)
+	defer fence.Close()
+	body = fence
 	_, err = s.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        &s.bucket,
 		Key:           &actionKey,
@@ -128,46 +231,142 @@ func (s *S3Cache) Put(ctx context.Context, actionID, outputID string, size int64
 		options.RetryMaxAttempts = 1 // We cannot perform seek in Body
 	})
 	if err != nil && s.verbose {
-		log.Printf("error S3 put for %s:  %v", actionKey, err)
+		slog.DebugContext(ctx, "PutObject failed", "cache", s.Kind(), "key", actionKey, "err", err)
 	}
 	return
 }
 
+// HealthCheck verifies that the bucket endpoint answers. Any response other
+// than a server error counts as healthy: credentials that can only read and
+// write objects are commonly denied HeadBucket.
+func (s *S3Cache) HealthCheck(ctx context.Context) error {
+	_, err := s.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &s.bucket})
+	if err == nil {
+		return nil
+	}
+	var re interface{ HTTPStatusCode() int }
+	if errors.As(err, &re) && re.HTTPStatusCode() < 500 {
+		return nil
+	}
+	return err
+}
+
 func (s *S3Cache) Close() error {
 	return nil
 }
 
+// NewS3Cache returns an S3Cache storing its entries under prefix in the
+// bucket. The prefix should include a namespace for the toolchain
+// configuration, so that different toolchains don't share entries.
 func NewS3Cache(client s3Client, bucketName, prefix string, verbose bool) *S3Cache {
-	// get target architecture
-	goarch := os.Getenv("GOARCH")
-	if goarch == "" {
-		goarch = runtime.GOARCH
-	}
-	// get target operating system
-	goos := os.Getenv("GOOS")
-	if goos == "" {
-		goos = runtime.GOOS
-	}
 	cache := &S3Cache{
 		s3Client: client,
 		bucket:   bucketName,
-		prefix:   path.Join(prefix, goarch, goos),
+		prefix:   prefix,
 		verbose:  verbose,
 	}
 	return cache
 }
 
+func isInvalidRangeError(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "InvalidRange"
+}
+
 func isNotFoundError(err error) bool {
 	if err != nil {
 		var ae smithy.APIError
 		if errors.As(err, &ae) {
 			code := ae.ErrorCode()
-			return code == "AccessDenied" || code == "NoSuchKey"
+			// HEAD requests, without a body, have the code of their status.
+			return code == "AccessDenied" || code == "NoSuchKey" || code == "NotFound"
 		}
 	}
 	return false
 }
 
+// BatchExists reports which of the actions the bucket stores. The actions
+// are grouped by the prefixes of their keys: those of the prefixes with
+// batchListMin of them or more are found by listing the prefix, at up to
+// 1000 keys a request, the others with a HEAD of their object.
+func (s *S3Cache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	exists := make([]bool, len(actionIDs))
+	var dirs []string
+	byDir := map[string][]int{}
+	for i, actionID := range actionIDs {
+		dir, _ := path.Split(s.actionKey(actionID))
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], i)
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(batchConcurrency)
+	for _, dir := range dirs {
+		dir, idx := dir, byDir[dir]
+		if dir != "" && len(idx) >= batchListMin {
+			g.Go(func() error {
+				return s.listExists(gctx, dir, actionIDs, idx, exists)
+			})
+			continue
+		}
+		for _, i := range idx {
+			i := i
+			g.Go(func() (err error) {
+				exists[i], err = s.headExists(gctx, s.actionKey(actionIDs[i]))
+				return err
+			})
+		}
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// listExists sets exists[i], for the indexes idx of the actions under the
+// prefix dir, by listing the keys of dir, in order, up to the last of
+// theirs.
+func (s *S3Cache) listExists(ctx context.Context, dir string, actionIDs []string, idx []int, exists []bool) error {
+	keys := make(map[string]int, len(idx))
+	last := ""
+	for _, i := range idx {
+		key := s.actionKey(actionIDs[i])
+		keys[key] = i
+		last = max(last, key)
+	}
+	p := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &dir,
+	})
+	for found := 0; p.HasMorePages() && found < len(keys); {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if key > last {
+				return nil
+			}
+			if i, ok := keys[key]; ok {
+				exists[i] = true
+				found++
+			}
+		}
+	}
+	return nil
+}
+
+// headExists reports whether the object of key exists.
+func (s *S3Cache) headExists(ctx context.Context, key string) (bool, error) {
+	_, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if isNotFoundError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (s *S3Cache) actionKey(actionID string) string {
 	objPre := ""
 	if len(actionID) > 3 {
@@ -0,0 +1,62 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// selfCheckBody is the output stored by SelfCheck. Its action ID, derived
+// from it, is not one cmd/go computes, so the entry never shadows a real
+// one.
+const selfCheckBody = "go-cacher self-check"
+
+// SelfCheck probes remote: that it is reachable, if it implements
+// HealthChecker, that entries can be read and, if write is set, that they
+// can be written and read back. The error says which of these failed.
+func SelfCheck(ctx context.Context, remote RemoteCache, write bool) error {
+	fail := func(what string, err error) error {
+		return fmt.Errorf("%s cache self-check: %s: %w", remote.Kind(), what, err)
+	}
+	if hc, ok := remote.(HealthChecker); ok {
+		if err := hc.HealthCheck(ctx); err != nil {
+			return fail("unreachable", err)
+		}
+	}
+	sum := sha256.Sum256([]byte(selfCheckBody))
+	outputID := hex.EncodeToString(sum[:])
+	actionSum := sha256.Sum256([]byte("action " + selfCheckBody))
+	actionID := hex.EncodeToString(actionSum[:])
+	if _, _, output, err := remote.Get(ctx, actionID); err != nil {
+		return fail("cannot read entries", err)
+	} else if output != nil {
+		output.Close()
+	}
+	if !write {
+		return nil
+	}
+	body := []byte(selfCheckBody)
+	if err := remote.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body)); err != nil {
+		return fail("cannot write entries", err)
+	}
+	gotID, _, output, err := remote.Get(ctx, actionID)
+	if err != nil {
+		return fail("cannot read back a written entry", err)
+	}
+	if output == nil {
+		return fail("cannot read back a written entry", errors.New("not found"))
+	}
+	defer output.Close()
+	got, err := io.ReadAll(output)
+	if err != nil {
+		return fail("cannot read back a written entry", err)
+	}
+	if gotID != outputID || !bytes.Equal(got, body) {
+		return fail("read back a different entry than written", ErrCorruptOutput)
+	}
+	return nil
+}
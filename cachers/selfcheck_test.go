@@ -0,0 +1,35 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readOnlyRemote is a fakeRemote that refuses writes.
+type readOnlyRemote struct {
+	*fakeRemote
+}
+
+func (r readOnlyRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return errors.New("AccessDenied")
+}
+
+func TestSelfCheck(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	require.NoError(t, SelfCheck(ctx, remote, true))
+	assert.Len(t, remote.entries, 1)
+
+	broken := newFakeRemote("fake")
+	broken.err = errors.New("no such host")
+	assert.EqualError(t, SelfCheck(ctx, broken, false), "fake cache self-check: cannot read entries: no such host")
+
+	ro := readOnlyRemote{newFakeRemote("fake")}
+	require.NoError(t, SelfCheck(ctx, ro, false))
+	assert.EqualError(t, SelfCheck(ctx, ro, true), "fake cache self-check: cannot write entries: AccessDenied")
+}
@@ -0,0 +1,148 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+)
+
+// The bodies stored by a SignedRemoteCache are a header of sigMagic, the
+// ID of the signing key and the signature, followed by the body as is.
+const (
+	sigMagic      = "GCS\x01"
+	sigKeyIDSize  = 8
+	sigHeaderSize = len(sigMagic) + sigKeyIDSize + ed25519.SignatureSize
+)
+
+// errNoSigningKey is the error of the puts of a SignedRemoteCache without
+// a signing key.
+var errNoSigningKey = errors.New("no signing key to sign the entry with")
+
+// SignedRemoteCache is a RemoteCache that signs the entries it puts to the
+// cache it wraps with an ed25519 key, and only accepts the entries it gets
+// that are signed by one of the keys it trusts, so that only trusted
+// writers can populate a shared cache. A signature covers the action ID,
+// the output ID and the size, and the output ID is the SHA-256 of the
+// body, which a TieredCache checks. Entries that aren't signed, or whose
+// signature doesn't verify with a trusted key, fail to read with
+// ErrCorruptOutput, which a TieredCache treats as a miss.
+//
+// Its HasOutput and PutAction fail with errors.ErrUnsupported: the
+// outputs of other writers may not be signed.
+type SignedRemoteCache struct {
+	forwarder
+	key     ed25519.PrivateKey // nil if c only verifies
+	trusted map[[sigKeyIDSize]byte]ed25519.PublicKey
+}
+
+var _ RemoteCache = &SignedRemoteCache{}
+var _ HealthChecker = &SignedRemoteCache{}
+var _ StatsReporter = &SignedRemoteCache{}
+var _ BatchChecker = &SignedRemoteCache{}
+
+// NewSignedRemoteCache returns cache wrapped to sign its entries with
+// key, if not nil, and to accept those signed by key or by a key of
+// trusted.
+func NewSignedRemoteCache(cache RemoteCache, key ed25519.PrivateKey, trusted []ed25519.PublicKey) *SignedRemoteCache {
+	c := &SignedRemoteCache{forwarder: forwarder{cache}, key: key, trusted: map[[sigKeyIDSize]byte]ed25519.PublicKey{}}
+	if key != nil {
+		trusted = append(trusted, key.Public().(ed25519.PublicKey))
+	}
+	for _, pub := range trusted {
+		c.trusted[signingKeyID(pub)] = pub
+	}
+	return c
+}
+
+// signingKeyID returns the ID of the public key pub, stored with the
+// signatures to find the key to verify them with.
+func signingKeyID(pub ed25519.PublicKey) [sigKeyIDSize]byte {
+	sum := sha256.Sum256(pub)
+	return [sigKeyIDSize]byte(sum[:sigKeyIDSize])
+}
+
+// signedMessage returns what the signature of an entry signs.
+func signedMessage(actionID, outputID string, size int64) []byte {
+	msg := make([]byte, 0, 32+len(actionID)+len(outputID))
+	msg = append(msg, "go-cacher entry\x00"...)
+	msg = append(msg, actionID...)
+	msg = append(msg, 0)
+	msg = append(msg, outputID...)
+	msg = append(msg, 0)
+	return binary.BigEndian.AppendUint64(msg, uint64(size))
+}
+
+func (c *SignedRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err != nil || outputID == "" || output == nil {
+		return outputID, size, output, err
+	}
+	size -= int64(sigHeaderSize)
+	if err = c.verify(output, actionID, outputID, size); err != nil {
+		output.Close()
+		return outputID, 0, nil, err
+	}
+	return outputID, size, output, nil
+}
+
+// verify reads the header of a signed entry from r and checks its
+// signature.
+func (c *SignedRemoteCache) verify(r io.Reader, actionID, outputID string, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%w: truncated signature header", ErrCorruptOutput)
+	}
+	header := make([]byte, sigHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated signature header", ErrCorruptOutput)
+		}
+		return err
+	}
+	if string(header[:len(sigMagic)]) != sigMagic {
+		return fmt.Errorf("%w: entry is not signed", ErrCorruptOutput)
+	}
+	keyID := [sigKeyIDSize]byte(header[len(sigMagic) : len(sigMagic)+sigKeyIDSize])
+	pub, ok := c.trusted[keyID]
+	if !ok {
+		return fmt.Errorf("%w: entry signed by the untrusted key %x", ErrCorruptOutput, keyID)
+	}
+	if !ed25519.Verify(pub, signedMessage(actionID, outputID, size), header[len(sigMagic)+sigKeyIDSize:]) {
+		return fmt.Errorf("%w: bad signature", ErrCorruptOutput)
+	}
+	return nil
+}
+
+func (c *SignedRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if c.key == nil {
+		return errNoSigningKey
+	}
+	header := make([]byte, 0, sigHeaderSize)
+	header = append(header, sigMagic...)
+	keyID := signingKeyID(c.key.Public().(ed25519.PublicKey))
+	header = append(header, keyID[:]...)
+	header = append(header, ed25519.Sign(c.key, signedMessage(actionID, outputID, size))...)
+	if bb, ok := body.(*sbytes.Buffer); ok && int64(bb.Len()) == size {
+		// Keep the body a buffer, which the caches below, like the
+		// encryption, compress.
+		b := sbytes.Get(sigHeaderSize + bb.Len())
+		defer sbytes.Put(b)
+		copy(b[copy(b, header):], bb.Bytes())
+		return c.cache.Put(ctx, actionID, outputID, int64(len(b)), sbytes.NewBuffer(b))
+	}
+	return c.cache.Put(ctx, actionID, outputID, int64(sigHeaderSize)+size, io.MultiReader(bytes.NewReader(header), body))
+}
+
+func (c *SignedRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func (c *SignedRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,154 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("signed")
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	c := NewSignedRemoteCache(remote, key, nil)
+
+	require.NoError(t, c.Put(ctx, "a1", helloID, 5, strings.NewReader("hello")))
+	assert.Len(t, remote.entries["a1"].body, sigHeaderSize+5)
+	outputID, size, output, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	got, err := io.ReadAll(output)
+	require.NoError(t, err)
+	require.NoError(t, output.Close())
+	assert.Equal(t, helloID, outputID)
+	assert.EqualValues(t, 5, size)
+	assert.Equal(t, "hello", string(got))
+
+	t.Run("trusted writer", func(t *testing.T) {
+		reader := NewSignedRemoteCache(remote, nil, []ed25519.PublicKey{key.Public().(ed25519.PublicKey)})
+		_, _, output, err := reader.Get(ctx, "a1")
+		require.NoError(t, err)
+		require.NoError(t, output.Close())
+
+		err = reader.Put(ctx, "a2", helloID, 5, strings.NewReader("hello"))
+		assert.ErrorIs(t, err, errNoSigningKey)
+	})
+
+	t.Run("untrusted writer", func(t *testing.T) {
+		_, other, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		_, _, _, err = NewSignedRemoteCache(remote, other, nil).Get(ctx, "a1")
+		assert.ErrorIs(t, err, ErrCorruptOutput)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		e := remote.entries["a1"]
+		remote.entries["a3"] = e
+		_, _, _, err := c.Get(ctx, "a3")
+		assert.ErrorIs(t, err, ErrCorruptOutput, "the signature is of another action")
+
+		remote.entries["a4"] = fakeEntry{outputID: sha256Hex("other"), body: e.body}
+		_, _, _, err = c.Get(ctx, "a4")
+		assert.ErrorIs(t, err, ErrCorruptOutput, "the signature is of another output")
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		remote.entries["a5"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+		_, _, _, err := c.Get(ctx, "a5")
+		assert.ErrorIs(t, err, ErrCorruptOutput)
+
+		remote.entries["a6"] = fakeEntry{outputID: helloID, body: []byte(strings.Repeat("x", sigHeaderSize))}
+		_, _, _, err = c.Get(ctx, "a6")
+		assert.ErrorIs(t, err, ErrCorruptOutput)
+	})
+}
+
+// lateReader is a RoundTripper refusing the requests at once, and reading
+// their bodies only once told to, as a transport may.
+type lateReader struct {
+	read chan struct{} // receives when to read a body
+	done chan error    // receives the error of reading it
+}
+
+func (l *lateReader) RoundTrip(req *http.Request) (*http.Response, error) {
+	go func() {
+		<-l.read
+		_, err := io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+		l.done <- err
+	}()
+	return &http.Response{StatusCode: http.StatusForbidden, Status: "403 Forbidden", Body: http.NoBody, Request: req}, nil
+}
+
+// TestWrappedPutEarlyResponse checks that the transport is done with the
+// bodies of the wrappers once a refused put returns, for them to be
+// reused.
+func TestWrappedPutEarlyResponse(t *testing.T) {
+	transport := &lateReader{read: make(chan struct{}), done: make(chan error)}
+	remote := NewHttpCacheWithClient("http://cache", &http.Client{Transport: transport}, false)
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	signed := NewSignedRemoteCache(remote, key, nil)
+	encrypted, err := NewEncryptedRemoteCache(signed, bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+
+	// The encryption reads the bodies it compressed from the pool.
+	compressible := func(b []byte) {
+		for i := range b {
+			b[i] = byte(i / 64)
+		}
+	}
+	random := func(b []byte) {
+		_, err := rand.Read(b)
+		require.NoError(t, err)
+	}
+	for name, tc := range map[string]struct {
+		c    RemoteCache
+		fill func([]byte)
+	}{
+		"signed":    {signed, random},
+		"encrypted": {encrypted, compressible},
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := sbytes.Get(1 << 20)
+			tc.fill(buf)
+			err := tc.c.Put(context.Background(), "a1", "o1", int64(len(buf)), sbytes.NewBuffer(buf))
+			assert.Error(t, err)
+			clear(buf)
+			sbytes.Put(buf)
+			clear(sbytes.Get(512 << 10))
+			transport.read <- struct{}{}
+			assert.ErrorIs(t, <-transport.done, sbytes.ErrFenceClosed)
+		})
+	}
+}
+
+func TestSignedEncryptedCompression(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	encrypted, err := NewEncryptedRemoteCache(remote, bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	c := NewSignedRemoteCache(encrypted, key, nil)
+
+	body := bytes.Repeat([]byte("symbol at 0x1234\n"), 10000)
+	require.NoError(t, c.Put(ctx, "a1", "o1", int64(len(body)), sbytes.NewBuffer(append([]byte(nil), body...))))
+	assert.Less(t, len(remote.entries["a1"].body), len(body)/4, "compressed before encrypted")
+	_, size, output, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	defer output.Close()
+	assert.EqualValues(t, len(body), size)
+	got, err := io.ReadAll(output)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+}
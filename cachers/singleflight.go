@@ -0,0 +1,186 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// SingleflightCache is a LocalCache that collapses concurrent identical
+// operations into one: cmd/go's parallelism often asks for the same
+// actionID many times in a burst. All callers sharing an operation get its
+// result. Since it wraps a whole LocalCache, every client of a shared
+// cache instance benefits from it.
+//
+// A shared operation doesn't fail just because the caller that happened to
+// start it went away: it is only cancelled once all its callers have.
+type SingleflightCache struct {
+	cache LocalCache
+
+	mu   sync.Mutex
+	gets map[string]*flight // by actionID
+	puts map[string]*flight // by actionID/outputID
+}
+
+var _ LocalCache = &SingleflightCache{}
+var _ HealthChecker = &SingleflightCache{}
+var _ LocalOutputStore = &SingleflightCache{}
+var _ BatchChecker = &SingleflightCache{}
+
+func NewSingleflightCache(cache LocalCache) *SingleflightCache {
+	return &SingleflightCache{
+		cache: cache,
+		gets:  make(map[string]*flight),
+		puts:  make(map[string]*flight),
+	}
+}
+
+// A flight is an operation shared by its callers.
+type flight struct {
+	done    chan struct{} // closed once val and err are set
+	val     any
+	err     error
+	callers int                // those still waiting
+	cancel  context.CancelFunc // cancels the operation
+}
+
+type singleflightGet struct {
+	outputID, diskPath string
+	tier               string // that answered the get, for setHitTier
+}
+
+// do runs fn, or joins the flight of key in flights running it already,
+// and returns its result, or the error of ctx if it is done first. The
+// context of fn has the values of the ctx that started it, and is
+// cancelled once all the callers have gone. The flight is run in the
+// goroutine that starts it if inline, for fn to use what that caller lent
+// it, which returns only once fn does.
+func (s *SingleflightCache) do(ctx context.Context, flights map[string]*flight, key string, inline bool, fn func(context.Context) (any, error)) (any, error) {
+	var fctx context.Context
+	s.mu.Lock()
+	f, joined := flights[key]
+	if !joined {
+		f = &flight{done: make(chan struct{})}
+		fctx, f.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		flights[key] = f
+	}
+	f.callers++
+	s.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { s.leave(flights, key, f) })
+	defer stop()
+	if !joined {
+		if inline {
+			s.run(fctx, flights, key, f, fn)
+			return f.val, f.err
+		}
+		go s.run(fctx, flights, key, f, fn)
+	}
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run runs the flight f of key.
+func (s *SingleflightCache) run(ctx context.Context, flights map[string]*flight, key string, f *flight, fn func(context.Context) (any, error)) {
+	f.val, f.err = fn(ctx)
+	s.mu.Lock()
+	if flights[key] == f {
+		delete(flights, key)
+	}
+	s.mu.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+// leave counts off a caller of the flight f of key, gone before it
+// returned, cancelling it if it was the last one.
+func (s *SingleflightCache) leave(flights map[string]*flight, key string, f *flight) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.callers--
+	if f.callers > 0 {
+		return
+	}
+	// Later callers start over rather than share the cancelled flight.
+	if flights[key] == f {
+		delete(flights, key)
+	}
+	f.cancel()
+}
+
+func (s *SingleflightCache) Kind() string {
+	return s.cache.Kind()
+}
+
+func (s *SingleflightCache) TierStats() []TierStats {
+	return CacheStats(s.cache)
+}
+
+func (s *SingleflightCache) QueueStats() QueueStats {
+	return CacheQueues(s.cache)
+}
+
+func (s *SingleflightCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, s.cache)
+}
+
+func (s *SingleflightCache) Start(ctx context.Context) error {
+	return s.cache.Start(ctx)
+}
+
+func (s *SingleflightCache) Close() error {
+	return s.cache.Close()
+}
+
+func (s *SingleflightCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	bc, ok := s.cache.(BatchChecker)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return bc.BatchExists(ctx, actionIDs)
+}
+
+func (s *SingleflightCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	v, err := s.do(ctx, s.gets, actionID, false, func(ctx context.Context) (any, error) {
+		ctx, tier := withHitTier(ctx)
+		outputID, diskPath, err := s.cache.Get(ctx, actionID)
+		return singleflightGet{outputID, diskPath, *tier}, err
+	})
+	res, _ := v.(singleflightGet)
+	setHitTier(ctx, res.tier)
+	return res.outputID, res.diskPath, err
+}
+
+// Put stores the body of the first of several concurrent identical puts;
+// the bodies of the others are left unread. The first one returns only
+// once its body is stored, or the put cancelled.
+func (s *SingleflightCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	v, err := s.do(ctx, s.puts, actionID+"/"+outputID, true, func(ctx context.Context) (any, error) {
+		return s.cache.Put(ctx, actionID, outputID, size, body)
+	})
+	diskPath, _ = v.(string)
+	return diskPath, err
+}
+
+func (s *SingleflightCache) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := s.cache.(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+// PutAction is shared by concurrent identical puts like Put.
+func (s *SingleflightCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := s.cache.(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	v, err := s.do(ctx, s.puts, actionID+"/"+outputID, true, func(ctx context.Context) (any, error) {
+		return los.PutAction(ctx, actionID, outputID, size)
+	})
+	diskPath, _ = v.(string)
+	return diskPath, err
+}
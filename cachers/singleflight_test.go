@@ -0,0 +1,123 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowLocal is a LocalCache whose Gets take a while, counting calls.
+type slowLocal struct {
+	gets atomic.Int32
+}
+
+func (s *slowLocal) Kind() string                    { return "slow" }
+func (s *slowLocal) Start(ctx context.Context) error { return nil }
+func (s *slowLocal) Close() error                    { return nil }
+
+func (s *slowLocal) Get(ctx context.Context, actionID string) (string, string, error) {
+	s.gets.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return "o-" + actionID, "/tmp/" + actionID, nil
+}
+
+func (s *slowLocal) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	return "/tmp/" + outputID, nil
+}
+
+func TestSingleflightCacheGet(t *testing.T) {
+	inner := &slowLocal{}
+	c := NewSingleflightCache(inner)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputID, diskPath, err := c.Get(context.Background(), "a1")
+			assert.NoError(t, err)
+			assert.Equal(t, "o-a1", outputID)
+			assert.Equal(t, "/tmp/a1", diskPath)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, inner.gets.Load())
+}
+
+// blockingLocal is a LocalCache whose Gets, answered by a remote tier,
+// wait to be released or cancelled.
+type blockingLocal struct {
+	slowLocal
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func (b *blockingLocal) Get(ctx context.Context, actionID string) (string, string, error) {
+	b.gets.Add(1)
+	select {
+	case <-b.release:
+		setHitTier(ctx, "remote")
+		return "o-" + actionID, "/tmp/" + actionID, nil
+	case <-ctx.Done():
+		close(b.cancelled)
+		return "", "", ctx.Err()
+	}
+}
+
+func TestSingleflightCacheCancel(t *testing.T) {
+	inner := &blockingLocal{release: make(chan struct{}), cancelled: make(chan struct{})}
+	c := NewSingleflightCache(inner)
+	callers := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if f := c.gets["a1"]; f != nil {
+			return f.callers
+		}
+		return 0
+	}
+
+	// The first caller going away doesn't fail the others.
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, _, err := c.Get(first, "a1")
+		firstErr <- err
+	}()
+	require.Eventually(t, func() bool { return callers() == 1 }, time.Second, time.Millisecond)
+	ctx, tier := withHitTier(context.Background())
+	type result struct {
+		outputID string
+		err      error
+	}
+	second := make(chan result)
+	go func() {
+		outputID, _, err := c.Get(ctx, "a1")
+		second <- result{outputID, err}
+	}()
+	require.Eventually(t, func() bool { return callers() == 2 }, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-firstErr, context.Canceled)
+	close(inner.release)
+	res := <-second
+	require.NoError(t, res.err)
+	assert.Equal(t, "o-a1", res.outputID)
+	assert.Equal(t, "remote", *tier, "the followers get the tier of the shared get")
+	assert.EqualValues(t, 1, inner.gets.Load())
+
+	// Once all the callers have gone, the shared get is cancelled.
+	inner.release = make(chan struct{})
+	tctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := c.Get(tctx, "a2")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	select {
+	case <-inner.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the shared get was not cancelled")
+	}
+}
@@ -0,0 +1,173 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// slowLogger warns of the operations of a backend that take longer than a
+// threshold, naming the backend and the key, so that one misbehaving
+// endpoint stands out in the build logs.
+type slowLogger struct {
+	kind, name string
+	threshold  time.Duration
+}
+
+// done warns if the operation op on key, started at start, was slow.
+func (s slowLogger) done(ctx context.Context, op, key string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if elapsed <= s.threshold {
+		return
+	}
+	attrs := []any{"cache", s.kind, "backend", s.name, "op", op, "key", key,
+		"elapsed", elapsed.Round(time.Millisecond), "threshold", s.threshold}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	slog.WarnContext(ctx, "slow cache operation", attrs...)
+}
+
+// SlowLogRemoteCache is a RemoteCache that warns of the operations of the
+// cache it wraps that are slower than a threshold. The time of a get that
+// hits runs until its output is closed.
+type SlowLogRemoteCache struct {
+	forwarder
+	slow slowLogger
+}
+
+var _ RemoteCache = &SlowLogRemoteCache{}
+var _ HealthChecker = &SlowLogRemoteCache{}
+var _ OutputStore = &SlowLogRemoteCache{}
+var _ BatchChecker = &SlowLogRemoteCache{}
+var _ StatsReporter = &SlowLogRemoteCache{}
+
+// NewSlowLogRemoteCache returns cache, named name in the warnings, like
+// the URL of its server, wrapped to warn of operations slower than
+// threshold.
+func NewSlowLogRemoteCache(cache RemoteCache, name string, threshold time.Duration) *SlowLogRemoteCache {
+	return &SlowLogRemoteCache{forwarder: forwarder{cache}, slow: slowLogger{kind: cache.Kind(), name: name, threshold: threshold}}
+}
+
+func (c *SlowLogRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	start := time.Now()
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err != nil || output == nil {
+		c.slow.done(ctx, "get", actionID, start, err)
+		return outputID, size, output, err
+	}
+	return outputID, size, &releaseOnClose{ReadCloser: output, release: func() {
+		c.slow.done(ctx, "get", actionID, start, nil)
+	}}, nil
+}
+
+func (c *SlowLogRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	start := time.Now()
+	err := c.cache.Put(ctx, actionID, outputID, size, body)
+	c.slow.done(ctx, "put", actionID, start, err)
+	return err
+}
+
+func (c *SlowLogRemoteCache) HealthCheck(ctx context.Context) error {
+	start := time.Now()
+	err := c.forwarder.HealthCheck(ctx)
+	c.slow.done(ctx, "health check", "", start, err)
+	return err
+}
+
+func (c *SlowLogRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	start := time.Now()
+	has, err := c.forwarder.HasOutput(ctx, outputID)
+	c.slow.done(ctx, "has output", outputID, start, err)
+	return has, err
+}
+
+func (c *SlowLogRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	start := time.Now()
+	exists, err := c.forwarder.BatchExists(ctx, actionIDs)
+	c.slow.done(ctx, "batch exists", fmt.Sprintf("%d actions", len(actionIDs)), start, err)
+	return exists, err
+}
+
+func (c *SlowLogRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	start := time.Now()
+	err := c.forwarder.PutAction(ctx, actionID, outputID, size)
+	c.slow.done(ctx, "put action", actionID, start, err)
+	return err
+}
+
+// SlowLogLocalCache is a LocalCache that warns of the operations of the
+// cache it wraps that are slower than a threshold.
+type SlowLogLocalCache struct {
+	cache LocalCache
+	slow  slowLogger
+}
+
+var _ LocalCache = &SlowLogLocalCache{}
+var _ HealthChecker = &SlowLogLocalCache{}
+var _ LocalOutputStore = &SlowLogLocalCache{}
+var _ StatsReporter = &SlowLogLocalCache{}
+var _ QueueReporter = &SlowLogLocalCache{}
+
+// NewSlowLogLocalCache returns cache, named name in the warnings, like its
+// directory, wrapped to warn of operations slower than threshold.
+func NewSlowLogLocalCache(cache LocalCache, name string, threshold time.Duration) *SlowLogLocalCache {
+	return &SlowLogLocalCache{cache: cache, slow: slowLogger{kind: cache.Kind(), name: name, threshold: threshold}}
+}
+
+func (c *SlowLogLocalCache) Kind() string {
+	return c.cache.Kind()
+}
+
+func (c *SlowLogLocalCache) TierStats() []TierStats {
+	return CacheStats(c.cache)
+}
+
+func (c *SlowLogLocalCache) QueueStats() QueueStats {
+	return CacheQueues(c.cache)
+}
+
+func (c *SlowLogLocalCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, c.cache)
+}
+
+func (c *SlowLogLocalCache) Start(ctx context.Context) error {
+	return c.cache.Start(ctx)
+}
+
+func (c *SlowLogLocalCache) Close() error {
+	return c.cache.Close()
+}
+
+func (c *SlowLogLocalCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	start := time.Now()
+	outputID, diskPath, err = c.cache.Get(ctx, actionID)
+	c.slow.done(ctx, "get", actionID, start, err)
+	return outputID, diskPath, err
+}
+
+func (c *SlowLogLocalCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	start := time.Now()
+	diskPath, err = c.cache.Put(ctx, actionID, outputID, size, body)
+	c.slow.done(ctx, "put", actionID, start, err)
+	return diskPath, err
+}
+
+func (c *SlowLogLocalCache) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := c.cache.(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+func (c *SlowLogLocalCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := c.cache.(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	start := time.Now()
+	diskPath, err = los.PutAction(ctx, actionID, outputID, size)
+	c.slow.done(ctx, "put action", actionID, start, err)
+	return diskPath, err
+}
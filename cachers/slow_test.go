@@ -0,0 +1,53 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowLogCache(t *testing.T) {
+	ctx := context.Background()
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	t.Run("remote", func(t *testing.T) {
+		logs.Reset()
+		remote := newFakeRemote("fake")
+		remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+		slow := NewFaultyRemoteCache(remote, FaultConfig{Latency: 20 * time.Millisecond})
+		c := NewSlowLogRemoteCache(slow, "https://cache.example.com", 10*time.Millisecond)
+		_, _, body, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.Empty(t, logs.String(), "a hit is timed until its output is closed")
+		require.NoError(t, body.Close())
+		assert.Contains(t, logs.String(), `msg="slow cache operation" cache=fake backend=https://cache.example.com op=get key=a1`)
+		assert.Contains(t, logs.String(), "threshold=10ms")
+
+		logs.Reset()
+		fast := NewSlowLogRemoteCache(remote, "https://cache.example.com", time.Second)
+		require.NoError(t, fast.Put(ctx, "a2", "4567", 3, strings.NewReader("bye")))
+		_, _, _, err = fast.Get(ctx, "a3")
+		require.NoError(t, err)
+		assert.Empty(t, logs.String())
+	})
+
+	t.Run("local", func(t *testing.T) {
+		logs.Reset()
+		dir := t.TempDir()
+		c := NewSlowLogLocalCache(NewSimpleDiskCache(false, dir), dir, time.Nanosecond)
+		require.NoError(t, c.Start(ctx))
+		defer c.Close()
+		_, err := c.Put(ctx, "a1", "0123", 5, sbytes.NewBuffer([]byte("hello")))
+		require.NoError(t, err)
+		assert.Contains(t, logs.String(), "cache=disk backend="+dir+" op=put key=a1")
+	})
+}
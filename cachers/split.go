@@ -0,0 +1,90 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// SplitRemoteCache is a RemoteCache that reads from one cache and writes
+// to another, typically the same remote accessed with credentials that
+// may only read and with ones that may also write.
+type SplitRemoteCache struct {
+	read, write RemoteCache
+}
+
+var _ RemoteCache = &SplitRemoteCache{}
+var _ HealthChecker = &SplitRemoteCache{}
+var _ OutputStore = &SplitRemoteCache{}
+var _ BatchChecker = &SplitRemoteCache{}
+
+func NewSplitRemoteCache(read, write RemoteCache) *SplitRemoteCache {
+	return &SplitRemoteCache{read: read, write: write}
+}
+
+func (s *SplitRemoteCache) Kind() string {
+	return s.read.Kind()
+}
+
+func (s *SplitRemoteCache) TierStats() []TierStats {
+	return CacheStats(s.read)
+}
+
+func (s *SplitRemoteCache) Start(ctx context.Context) error {
+	if err := s.read.Start(ctx); err != nil {
+		return err
+	}
+	return s.write.Start(ctx)
+}
+
+func (s *SplitRemoteCache) Close() error {
+	return errors.Join(s.read.Close(), s.write.Close())
+}
+
+func (s *SplitRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	return s.read.Get(ctx, actionID)
+}
+
+func (s *SplitRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return s.write.Put(ctx, actionID, outputID, size, body)
+}
+
+// HealthCheck checks the reading cache. Caches that do not implement
+// HealthChecker are reported healthy.
+func (s *SplitRemoteCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, s.read)
+}
+
+func (s *SplitRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	return hasOutput(ctx, s.read, outputID)
+}
+
+func (s *SplitRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	return BatchExists(ctx, s.read, actionIDs)
+}
+
+func (s *SplitRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return putAction(ctx, s.write, actionID, outputID, size)
+}
+
+// NewTokenTransport returns a RoundTripper sending the requests through
+// base, or http.DefaultTransport if it is nil, with token as their bearer
+// token.
+func NewTokenTransport(base http.RoundTripper, token string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tokenTransport{base: base, token: token}
+}
+
+type tokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
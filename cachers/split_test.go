@@ -0,0 +1,50 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	read, write := newFakeRemote("read"), newFakeRemote("write")
+	read.entries["a1"] = fakeEntry{outputID: "o1", body: []byte("hello")}
+	s := NewSplitRemoteCache(read, write)
+	assert.Equal(t, "read", s.Kind())
+
+	outputID, _, body, err := s.Get(ctx, "a1")
+	require.NoError(t, err)
+	body.Close()
+	assert.Equal(t, "o1", outputID, "gets go to the reading cache")
+
+	require.NoError(t, s.Put(ctx, "a2", "o2", 3, strings.NewReader("bye")))
+	assert.True(t, write.has("a2"), "puts go to the writing cache")
+	assert.False(t, read.has("a2"))
+
+	_, err = s.HasOutput(ctx, "o1")
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+}
+
+func TestTokenTransport(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	read := NewHttpCacheWithClient(srv.URL, &http.Client{Transport: NewTokenTransport(nil, "r3ad")}, false)
+	write := NewHttpCacheWithClient(srv.URL, &http.Client{Transport: NewTokenTransport(nil, "wr1te")}, false)
+	s := NewSplitRemoteCache(read, write)
+	_, _, _, err := s.Get(context.Background(), "a1")
+	require.NoError(t, err)
+	assert.Error(t, s.Put(context.Background(), "a1", "o1", 2, strings.NewReader("hi")))
+	assert.Equal(t, []string{"GET Bearer r3ad", "PUT Bearer wr1te"}, got)
+}
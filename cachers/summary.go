@@ -0,0 +1,213 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SummaryCache is a LocalCache that produces an end-of-session report of
+// the statistics of the cache it wraps. To estimate the time remote hits
+// saved, it measures how long cmd/go takes to build what it misses: the
+// time from a miss to the put of the same action.
+type SummaryCache struct {
+	cache LocalCache
+
+	mu        sync.Mutex
+	gets      int64
+	misses    int64
+	puts      int64
+	getErrors int64
+	putErrors int64
+	missedAt  map[string]time.Time // by actionID
+	builds    int64
+	buildTime time.Duration
+}
+
+var _ LocalCache = &SummaryCache{}
+var _ HealthChecker = &SummaryCache{}
+var _ StatsReporter = &SummaryCache{}
+var _ QueueReporter = &SummaryCache{}
+var _ LocalOutputStore = &SummaryCache{}
+
+func NewSummaryCache(cache LocalCache) *SummaryCache {
+	return &SummaryCache{cache: cache, missedAt: map[string]time.Time{}}
+}
+
+func (s *SummaryCache) Kind() string {
+	return s.cache.Kind()
+}
+
+func (s *SummaryCache) TierStats() []TierStats {
+	return CacheStats(s.cache)
+}
+
+func (s *SummaryCache) QueueStats() QueueStats {
+	return CacheQueues(s.cache)
+}
+
+func (s *SummaryCache) HealthCheck(ctx context.Context) error {
+	return CheckHealth(ctx, s.cache)
+}
+
+func (s *SummaryCache) Start(ctx context.Context) error {
+	return s.cache.Start(ctx)
+}
+
+func (s *SummaryCache) Close() error {
+	return s.cache.Close()
+}
+
+func (s *SummaryCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	outputID, diskPath, err = s.cache.Get(ctx, actionID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	switch {
+	case err != nil:
+		s.getErrors++
+	case outputID == "":
+		s.misses++
+		s.missedAt[actionID] = time.Now()
+	}
+	return outputID, diskPath, err
+}
+
+func (s *SummaryCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	s.built(actionID)
+	diskPath, err = s.cache.Put(ctx, actionID, outputID, size, body)
+	s.put(err)
+	return diskPath, err
+}
+
+func (s *SummaryCache) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := s.cache.(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+// PutAction is accounted for like Put.
+func (s *SummaryCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := s.cache.(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	s.built(actionID)
+	diskPath, err = los.PutAction(ctx, actionID, outputID, size)
+	s.put(err)
+	return diskPath, err
+}
+
+// built records the time taken to build actionID, if it was missed.
+func (s *SummaryCache) built(actionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.missedAt[actionID]; ok {
+		delete(s.missedAt, actionID)
+		s.builds++
+		s.buildTime += time.Since(t)
+	}
+}
+
+// put counts a put that returned err.
+func (s *SummaryCache) put(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.puts++
+	if err != nil {
+		s.putErrors++
+	}
+}
+
+// A Summary is the statistics of a session, as reported by Report.
+type Summary struct {
+	Gets, Hits, Misses, Puts, Errors int64
+	// TierHits are the hits of the local and remote tiers, in order.
+	TierHits []TierHits `json:",omitempty"`
+	// Downloaded and Uploaded are the bytes transferred by the remotes.
+	Downloaded, Uploaded int64
+	// BackendErrors are the failed operations of the tiers by the class of
+	// their errors, as in TierStats.Errors.
+	BackendErrors map[string]int64 `json:",omitempty"`
+	// TimeSaved is the build time remote hits saved, estimated from the
+	// average time taken to build a missed action, ActionTime. Both are
+	// zero if nothing was built or no remote hit.
+	TimeSaved, ActionTime time.Duration `json:",omitempty"`
+}
+
+// TierHits is the number of hits of a tier.
+type TierHits struct {
+	Tier string
+	Hits int64
+}
+
+// Summary returns the statistics of the session so far.
+func (s *SummaryCache) Summary() Summary {
+	var (
+		sum        Summary
+		remoteHits int64
+	)
+	for _, ts := range CacheStats(s.cache) {
+		if ts.Tier == "local" || strings.HasPrefix(ts.Tier, "remote") {
+			sum.TierHits = append(sum.TierHits, TierHits{Tier: ts.Tier, Hits: ts.Hits})
+			for class, n := range ts.Errors {
+				if sum.BackendErrors == nil {
+					sum.BackendErrors = map[string]int64{}
+				}
+				sum.BackendErrors[class] += n
+			}
+		}
+		if strings.HasPrefix(ts.Tier, "remote") {
+			remoteHits += ts.Hits
+			sum.Downloaded += ts.HitBytes
+			sum.Uploaded += ts.PutBytes
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum.Gets, sum.Misses, sum.Puts = s.gets, s.misses, s.puts
+	sum.Hits = s.gets - s.misses - s.getErrors
+	sum.Errors = s.getErrors + s.putErrors
+	if remoteHits > 0 && s.builds > 0 {
+		sum.ActionTime = s.buildTime / time.Duration(s.builds)
+		sum.TimeSaved = sum.ActionTime * time.Duration(remoteHits)
+	}
+	return sum
+}
+
+// Report returns a one-paragraph summary of the session: gets, hits by
+// tier, puts, bytes transferred and the estimated time saved by remote hits.
+func (s *SummaryCache) Report() string {
+	sum := s.Summary()
+	var b strings.Builder
+	fmt.Fprintf(&b, "go-cacher summary: %d gets, %d hits", sum.Gets, sum.Hits)
+	if len(sum.TierHits) > 0 {
+		hits := make([]string, len(sum.TierHits))
+		for i, th := range sum.TierHits {
+			hits[i] = fmt.Sprintf("%d %s", th.Hits, th.Tier)
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(hits, ", "))
+	}
+	fmt.Fprintf(&b, ", %d misses; %d puts; %d errors", sum.Misses, sum.Puts, sum.Errors)
+	if len(sum.TierHits) > 1 {
+		fmt.Fprintf(&b, "; %s downloaded, %s uploaded", formatBytes(float64(sum.Downloaded)), formatBytes(float64(sum.Uploaded)))
+	}
+	if len(sum.BackendErrors) > 0 {
+		var errs []string
+		for _, class := range ErrorClasses {
+			if n := sum.BackendErrors[class]; n > 0 {
+				errs = append(errs, fmt.Sprintf("%d %s", n, class))
+			}
+		}
+		fmt.Fprintf(&b, "; backend errors: %s", strings.Join(errs, ", "))
+	}
+	if sum.ActionTime > 0 {
+		fmt.Fprintf(&b, "; remote hits saved an estimated %v of build time (%v per action on average)",
+			sum.TimeSaved.Round(time.Millisecond), sum.ActionTime.Round(time.Millisecond))
+	}
+	b.WriteString(".")
+	return b.String()
+}
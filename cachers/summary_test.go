@@ -0,0 +1,61 @@
+package cachers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummaryCacheReport(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	tiered, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	c := NewSummaryCache(tiered)
+	require.NoError(t, c.Start(ctx))
+
+	_, _, err = c.Get(ctx, "a1") // remote hit
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "a1") // local hit
+	require.NoError(t, err)
+	_, _, err = c.Get(ctx, "a2") // miss, then built
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.Put(ctx, "a2", "4567", 3, sbytes.NewBuffer([]byte("abc")))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	report := c.Report()
+	assert.Contains(t, report, "3 gets, 2 hits (1 local, 1 remote), 1 misses; 1 puts; 0 errors")
+	assert.Contains(t, report, "5.00 B downloaded, 3.00 B uploaded")
+	assert.Contains(t, report, "remote hits saved an estimated")
+
+	sum := c.Summary()
+	assert.Equal(t, int64(3), sum.Gets)
+	assert.Equal(t, int64(2), sum.Hits)
+	assert.Equal(t, []TierHits{{Tier: "local", Hits: 1}, {Tier: "remote", Hits: 1}}, sum.TierHits)
+	assert.Equal(t, int64(5), sum.Downloaded)
+	assert.GreaterOrEqual(t, sum.ActionTime, 10*time.Millisecond)
+	assert.Equal(t, sum.ActionTime, sum.TimeSaved)
+}
+
+func TestSummaryCacheBackendErrors(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.err = &StatusError{StatusCode: 429}
+	tiered, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	c := NewSummaryCache(tiered)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	_, _, err = c.Get(ctx, "a1")
+	require.Error(t, err)
+	assert.Equal(t, map[string]int64{ErrorThrottled: 1}, c.Summary().BackendErrors)
+	assert.Contains(t, c.Report(), "; backend errors: 1 throttled")
+}
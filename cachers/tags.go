@@ -0,0 +1,74 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"net/url"
+)
+
+// tagsMetadataKey is the S3 object metadata, and tagsHeader the header of
+// the puts to a cacher server, with the tags of an upload, encoded as a
+// URL query, like "branch=main&team=build".
+const (
+	tagsMetadataKey = "tags"
+	tagsHeader      = "X-Gocache-Tags"
+)
+
+type uploadTagsKey struct{}
+
+// WithUploadTags returns a copy of ctx whose writes to the remotes carry
+// tags, like the CI pipeline or the team that made them, in their
+// metadata.
+func WithUploadTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, uploadTagsKey{}, tags)
+}
+
+// UploadTags returns the tags of the writes of ctx, or nil.
+func UploadTags(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(uploadTagsKey{}).(map[string]string)
+	return tags
+}
+
+// encodeTags returns the tags of the writes of ctx as a URL query, or "".
+func encodeTags(ctx context.Context) string {
+	tags := UploadTags(ctx)
+	if len(tags) == 0 {
+		return ""
+	}
+	v := url.Values{}
+	for k, t := range tags {
+		v.Set(k, t)
+	}
+	return v.Encode()
+}
+
+// TaggedRemoteCache is a RemoteCache whose writes to the cache it wraps
+// carry tags in their metadata, for the operators of a shared cache to
+// attribute its entries and costs to teams. The backends that store
+// metadata store them, and an AuditRemoteCache records them.
+type TaggedRemoteCache struct {
+	forwarder
+	tags map[string]string
+}
+
+var _ RemoteCache = &TaggedRemoteCache{}
+var _ HealthChecker = &TaggedRemoteCache{}
+var _ StatsReporter = &TaggedRemoteCache{}
+var _ OutputStore = &TaggedRemoteCache{}
+var _ BatchChecker = &TaggedRemoteCache{}
+
+func NewTaggedRemoteCache(cache RemoteCache, tags map[string]string) *TaggedRemoteCache {
+	return &TaggedRemoteCache{forwarder: forwarder{cache}, tags: tags}
+}
+
+func (c *TaggedRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	return c.cache.Get(ctx, actionID)
+}
+
+func (c *TaggedRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return c.cache.Put(WithUploadTags(ctx, c.tags), actionID, outputID, size, body)
+}
+
+func (c *TaggedRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	return c.forwarder.PutAction(WithUploadTags(ctx, c.tags), actionID, outputID, size)
+}
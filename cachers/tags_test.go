@@ -0,0 +1,41 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaggedRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	tags := map[string]string{"team": "build", "branch": "feature/x"}
+
+	t.Run("http", func(t *testing.T) {
+		var got []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = append(got, r.Header.Get(tagsHeader))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+		c := NewTaggedRemoteCache(NewHttpCache(srv.URL, false), tags)
+		require.NoError(t, c.Put(ctx, "a1", helloID, 5, strings.NewReader("hello")))
+		require.NoError(t, c.PutAction(ctx, "a2", helloID, 5))
+		assert.Equal(t, []string{"branch=feature%2Fx&team=build", "branch=feature%2Fx&team=build"}, got)
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		var log bytes.Buffer
+		c := NewTaggedRemoteCache(NewAuditRemoteCache(newFakeRemote("fake"), &log, "", ""), tags)
+		require.NoError(t, c.Put(ctx, "a1", helloID, 5, strings.NewReader("hello")))
+		var rec AuditRecord
+		require.NoError(t, json.Unmarshal(log.Bytes(), &rec))
+		assert.Equal(t, tags, rec.Tags)
+	})
+}
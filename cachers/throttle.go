@@ -0,0 +1,210 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	// throttleCutInterval is how long after cutting its concurrency a
+	// ThrottleRemoteCache ignores further throttling, so that the requests
+	// already in flight when the remote started throttling don't each
+	// halve it again.
+	throttleCutInterval = time.Second
+	// throttleMaxPause bounds the pause of a Retry-After, so that a
+	// misbehaving remote can't hold up the build for long.
+	throttleMaxPause = time.Minute
+)
+
+// ThrottleRemoteCache is a RemoteCache that backs off when the cache it
+// wraps throttles it, with an S3 SlowDown or an HTTP 429 or 503: it halves
+// the number of simultaneous operations it allows, for the rest of the
+// session, and starts no operation before the Retry-After of the response,
+// if any. Until the first throttling, operations are not limited. Health
+// checks never wait.
+type ThrottleRemoteCache struct {
+	forwarder
+
+	mu       sync.Mutex
+	limit    int // of simultaneous operations, 0 until throttled
+	inFlight int
+	until    time.Time     // no operation starts before, after a Retry-After
+	lastCut  time.Time     // when limit was last cut
+	wake     chan struct{} // closed, and replaced, when an operation ends
+}
+
+var _ RemoteCache = &ThrottleRemoteCache{}
+var _ HealthChecker = &ThrottleRemoteCache{}
+var _ OutputStore = &ThrottleRemoteCache{}
+var _ BatchChecker = &ThrottleRemoteCache{}
+
+func NewThrottleRemoteCache(cache RemoteCache) *ThrottleRemoteCache {
+	return &ThrottleRemoteCache{
+		forwarder: forwarder{cache},
+		wake:      make(chan struct{}),
+	}
+}
+
+// acquire waits for the pause of a Retry-After to be over and for a slot
+// under the limit.
+func (c *ThrottleRemoteCache) acquire(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		pause := time.Until(c.until)
+		if pause <= 0 && (c.limit == 0 || c.inFlight < c.limit) {
+			c.inFlight++
+			c.mu.Unlock()
+			return nil
+		}
+		wake := c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if pause > 0 {
+			timer = time.NewTimer(pause)
+			expired = timer.C
+		}
+		select {
+		case <-wake:
+		case <-expired:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// release ends an operation, which failed with err, if any, backing off if
+// err is a throttling.
+func (c *ThrottleRemoteCache) release(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && ClassifyError(err) == ErrorThrottled {
+		c.throttled(err)
+	}
+	c.inFlight--
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// throttled backs off after err, a throttling. c.mu must be held.
+func (c *ThrottleRemoteCache) throttled(err error) {
+	now := time.Now()
+	if d := min(retryAfter(err), throttleMaxPause); d > 0 && now.Add(d).After(c.until) {
+		c.until = now.Add(d)
+	}
+	if now.Sub(c.lastCut) < throttleCutInterval {
+		return
+	}
+	// Halve what actually ran when the remote pushed back, which may be less
+	// than the limit.
+	base := c.inFlight
+	if c.limit > 0 && c.limit < base {
+		base = c.limit
+	}
+	limit := max(base/2, 1)
+	if limit == c.limit {
+		return
+	}
+	c.limit, c.lastCut = limit, now
+	slog.Warn("remote cache is throttling; reducing concurrency for the rest of the session",
+		"remote", c.cache.Kind(), "concurrency", limit, "err", err)
+}
+
+func (c *ThrottleRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	if err := c.acquire(ctx); err != nil {
+		return "", 0, nil, err
+	}
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err != nil || output == nil {
+		c.release(err)
+		return outputID, size, output, err
+	}
+	return outputID, size, &releaseOnClose{ReadCloser: output, release: func() { c.release(nil) }}, nil
+}
+
+func (c *ThrottleRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (err error) {
+	if err := c.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { c.release(err) }()
+	return c.cache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (c *ThrottleRemoteCache) HasOutput(ctx context.Context, outputID string) (_ bool, err error) {
+	store, ok := c.cache.(OutputStore)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	if err := c.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer func() { c.release(err) }()
+	return store.HasOutput(ctx, outputID)
+}
+
+func (c *ThrottleRemoteCache) BatchExists(ctx context.Context, actionIDs []string) (_ []bool, err error) {
+	bc, ok := c.cache.(BatchChecker)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { c.release(err) }()
+	return bc.BatchExists(ctx, actionIDs)
+}
+
+func (c *ThrottleRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (err error) {
+	store, ok := c.cache.(OutputStore)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	if err := c.acquire(ctx); err != nil {
+		return err
+	}
+	defer func() { c.release(err) }()
+	return store.PutAction(ctx, actionID, outputID, size)
+}
+
+// retryAfter returns the Retry-After of the response err is the error of,
+// from the cacher server or S3, or 0.
+func retryAfter(err error) time.Duration {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.RetryAfter
+	}
+	var re *smithyhttp.ResponseError
+	if errors.As(err, &re) && re.Response != nil {
+		return parseRetryAfter(re.Response.Header.Get("Retry-After"), time.Now())
+	}
+	return 0
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either seconds
+// or an HTTP date, into how long after now to retry, or 0.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
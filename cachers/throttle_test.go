@@ -0,0 +1,81 @@
+package cachers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottleRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("throttled")
+	remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+	c := NewThrottleRemoteCache(remote)
+
+	var outputs []io.ReadCloser
+	for i := 0; i < 8; i++ {
+		_, _, output, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		outputs = append(outputs, output)
+	}
+	assert.Zero(t, c.limit, "unlimited until throttled")
+
+	remote.err = &StatusError{Method: "PUT", Path: "/cache/a1/0123", Status: "429 Too Many Requests", StatusCode: http.StatusTooManyRequests, RetryAfter: 100 * time.Millisecond}
+	err := c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello"))
+	require.Error(t, err)
+	start := time.Now()
+	assert.Equal(t, 4, c.limit, "halved from the 9 operations in flight")
+
+	// The 8 gets still hold their slots, over the limit.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err = c.Get(tctx, "a1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	for _, output := range outputs[:5] {
+		require.NoError(t, output.Close())
+	}
+
+	err = c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello"))
+	require.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond, "waited for the Retry-After")
+	assert.Equal(t, 4, c.limit, "cut once for a burst of throttling")
+
+	remote.err = nil
+	_, _, output, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	require.NoError(t, output.Close())
+	for _, output := range outputs[5:] {
+		require.NoError(t, output.Close())
+	}
+	assert.Zero(t, c.inFlight)
+
+	t.Run("other errors", func(t *testing.T) {
+		c := NewThrottleRemoteCache(remote)
+		remote.err = &StatusError{Method: "PUT", Path: "/cache/a1/0123", Status: "500 Internal Server Error", StatusCode: http.StatusInternalServerError}
+		require.Error(t, c.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+		assert.Zero(t, c.limit)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{"Wed, 14 Oct 2026 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 14 Oct 2026 11:00:00 GMT", 0},
+		{"soon", 0},
+	} {
+		assert.Equal(t, tc.want, parseRetryAfter(tc.v, now), tc.v)
+	}
+}
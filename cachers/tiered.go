@@ -0,0 +1,782 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+)
+
+// TierPolicy controls how a TieredCache uses one of its tiers.
+type TierPolicy struct {
+	// ReadOnly tiers are only read from: neither puts nor hits from
+	// lower tiers are written to them.
+	ReadOnly bool
+
+	// NoPopulate tiers are written by puts, but not filled with hits
+	// found in lower tiers. For the first tier, this means hits from the
+	// other tiers are streamed through a scratch directory that is removed
+	// on Close, instead of being persisted.
+	NoPopulate bool
+
+	// MinPutSize and MaxPutSize bound the sizes of bodies written to the
+	// tier. MaxPutSize <= 0 means there is no upper bound.
+	MinPutSize int64
+	MaxPutSize int64
+}
+
+// allowsSize reports whether the policy allows writing a body of the given size.
+func (p TierPolicy) allowsSize(size int64) bool {
+	return size >= p.MinPutSize && (p.MaxPutSize <= 0 || size <= p.MaxPutSize)
+}
+
+type policyTier struct {
+	Cache
+	policy TierPolicy
+}
+
+// WithTierPolicy returns c annotated with the policy a TieredCache should
+// apply to it. The result is only meant to be passed to NewTieredCache.
+func WithTierPolicy(c Cache, policy TierPolicy) Cache {
+	return &policyTier{Cache: c, policy: policy}
+}
+
+// tier is one level of a TieredCache. Exactly one of local and remote is set.
+type tier struct {
+	local  LocalCache
+	remote RemoteCache
+	// policy is set with SetTierPolicy, which may race with the requests.
+	policy atomic.Pointer[TierPolicy]
+
+	// outputs is set if the remote can record actions whose output it
+	// already has, without the body being uploaded again.
+	outputs OutputStore
+	// health is set if the remote can probe whether it is reachable.
+	health HealthChecker
+	// batch is set if the remote can tell which of many actions it stores
+	// at once.
+	batch BatchChecker
+	// noDedup is set once the remote failed a lookup, like old servers
+	// without the endpoint do, so later puts don't pay for it again.
+	noDedup atomic.Bool
+	// denied is set once the remote denied a write, as with read-only
+	// credentials, so the session stops writing to it but keeps reading.
+	denied atomic.Bool
+
+	// putsMetrics and getsMetrics time transfers to and from the tier.
+	putsMetrics *timeKeeper
+	getsMetrics *timeKeeper
+}
+
+func (t *tier) cache() Cache {
+	if t.local != nil {
+		return t.local
+	}
+	return t.remote
+}
+
+func (t *tier) get(ctx context.Context, actionID string) (outputID string, size int64, body io.ReadCloser, err error) {
+	if t.remote != nil {
+		return t.remote.Get(ctx, actionID)
+	}
+	outputID, diskPath, err := t.local.Get(ctx, actionID)
+	if err != nil || outputID == "" {
+		return "", 0, nil, err
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, nil, nil
+		}
+		return "", 0, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return "", 0, nil, err
+	}
+	return outputID, fi.Size(), f, nil
+}
+
+// dedupMinSize is the smallest body for which a remote tier is asked
+// whether it has the output before uploading it; smaller bodies cost less
+// to send than the extra round trip.
+const dedupMinSize = 16 << 10
+
+// errPutsDenied is returned by the writes to a tier that denied one
+// before. They are neither logged nor retried.
+var errPutsDenied = errors.New("writes denied")
+
+func (t *tier) put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	if t.denied.Load() {
+		return errPutsDenied
+	}
+	if t.outputs != nil && size >= dedupMinSize && !t.noDedup.Load() {
+		ok, err := t.outputs.HasOutput(ctx, outputID)
+		if err != nil && ctx.Err() == nil {
+			t.noDedup.Store(true)
+		}
+		// If recording the action fails, upload the body after all.
+		if ok && t.outputs.PutAction(ctx, actionID, outputID, size) == nil {
+			return nil
+		}
+	}
+	_, err := t.putsMetrics.DoWithMeasure(size, func() (string, error) {
+		if t.remote != nil {
+			return "", t.remote.Put(ctx, actionID, outputID, size, body)
+		}
+		return t.local.Put(ctx, actionID, outputID, size, body)
+	})
+	if t.remote != nil && isWriteDenied(err) {
+		if !t.denied.Swap(true) {
+			slog.WarnContext(ctx, "remote cache denied a write; not writing to it for the rest of the session", "cache", t.remote.Kind(), "err", err)
+		}
+		return fmt.Errorf("%w: %w", errPutsDenied, err)
+	}
+	return err
+}
+
+// TieredCache is a LocalCache built from a chain of caches, ordered from
+// fastest to slowest, like memory→disk→LAN server→cloud.
+//
+// Gets try each tier in order and copy hits into the faster tiers.
+// Puts are written to every tier their policies allow. The first tier
+// must be a LocalCache, since cmd/go needs a path on disk for every
+// entry; the others may be LocalCaches or RemoteCaches.
+type TieredCache struct {
+	tiers   []*tier
+	verbose bool
+
+	// uploads, if non-nil, writes entries to the tiers after the first one
+	// in the background.
+	uploads *uploadQueue
+
+	// retries retries failed writes to the tiers after the first one.
+	retries *retryQueue
+
+	// scratchDir holds the hits that aren't persisted because the first
+	// tier has NoPopulate set. It is created on Start.
+	scratchDir    string
+	scratchParent string // where scratchDir is created; "" is os.TempDir
+	scratchMu     sync.Mutex
+	scratch       map[string]scratchEntry // by actionID
+}
+
+type scratchEntry struct {
+	outputID, diskPath string
+	size               int64
+}
+
+var _ LocalCache = &TieredCache{}
+var _ StatsReporter = &TieredCache{}
+var _ QueueReporter = &TieredCache{}
+var _ HealthChecker = &TieredCache{}
+var _ LocalOutputStore = &TieredCache{}
+var _ BatchChecker = &TieredCache{}
+
+// NewTieredCache returns a TieredCache of the given tiers. Use
+// WithTierPolicy to set the policy of a tier.
+func NewTieredCache(tiers ...Cache) (*TieredCache, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("no cache tiers")
+	}
+	c := &TieredCache{}
+	for i, cache := range tiers {
+		t := &tier{
+			putsMetrics: newTimeKeeper(),
+			getsMetrics: newTimeKeeper(),
+		}
+		if pt, ok := cache.(*policyTier); ok {
+			cache = pt.Cache
+			t.policy.Store(&pt.policy)
+		} else {
+			t.policy.Store(&TierPolicy{})
+		}
+		name := tierName(i, len(tiers))
+		switch cache := cache.(type) {
+		case LocalCache:
+			t.local = NewLocalCacheWithCounts(cache, name, false)
+		case RemoteCache:
+			if i == 0 {
+				return nil, fmt.Errorf("first tier %s is not a local cache", cache.Kind())
+			}
+			t.remote = NewRemoteCacheWithCounts(cache, name, false)
+			t.outputs, _ = cache.(OutputStore)
+			t.health, _ = cache.(HealthChecker)
+			t.batch, _ = cache.(BatchChecker)
+		default:
+			return nil, fmt.Errorf("tier %d (%s) is neither a local nor a remote cache", i, cache.Kind())
+		}
+		c.tiers = append(c.tiers, t)
+	}
+	c.retries = newRetryQueue(c.putFromDisk, RetryPolicy{})
+	return c, nil
+}
+
+// tierName names the tier at index i of n in statistics.
+func tierName(i, n int) string {
+	switch {
+	case i == 0:
+		return "local"
+	case n == 2:
+		return "remote"
+	}
+	return fmt.Sprintf("remote%d", i)
+}
+
+// SetVerbose makes the cache log per-tier summaries on Close.
+// It must be called before Start.
+func (c *TieredCache) SetVerbose(verbose bool) {
+	c.verbose = verbose
+	for _, t := range c.tiers {
+		switch cache := t.cache().(type) {
+		case *LocalCacheWithCounts:
+			cache.verbose = verbose
+		case *RemoteCacheWithCounts:
+			cache.verbose = verbose
+		}
+	}
+}
+
+// SetAsyncUploads makes Put return as soon as the entry is stored in the
+// first tier, writing it to the others from the given number of background
+// workers. On Close, the cache waits up to drainTimeout for queued uploads
+// and saves the rest to pendingFile (if not empty) to be uploaded by the
+// next session. It must be called before Start.
+func (c *TieredCache) SetAsyncUploads(workers int, drainTimeout time.Duration, pendingFile string) {
+	c.uploads = newUploadQueue(c.upload, workers, drainTimeout, pendingFile)
+}
+
+// SetRetryPolicy makes the cache retry failed writes to the tiers after
+// the first one, reading the body back from the first tier. Writes still
+// waiting for a retry on Close are saved along with unfinished background
+// uploads, if those are enabled. It must be called before Start.
+func (c *TieredCache) SetRetryPolicy(policy RetryPolicy) {
+	c.retries.policy = policy
+}
+
+// SetScratchDir makes the scratch directory, used when the first tier
+// isn't populated, be created in dir instead of the default directory for
+// temporary files. It must be called before Start.
+func (c *TieredCache) SetScratchDir(dir string) {
+	c.scratchParent = dir
+}
+
+// SetTierPolicy replaces the policy of the tier at index i, for example
+// after a configuration reload. It may be called at any time, but the
+// NoPopulate setting of the first tier only takes effect at Start.
+func (c *TieredCache) SetTierPolicy(i int, policy TierPolicy) error {
+	if i < 0 || i >= len(c.tiers) {
+		return fmt.Errorf("no cache tier %d", i)
+	}
+	c.tiers[i].policy.Store(&policy)
+	return nil
+}
+
+// QueueStats returns the number of background uploads and of writes
+// waiting for a retry.
+func (c *TieredCache) QueueStats() QueueStats {
+	qs := QueueStats{Retries: c.retries.Stats().Pending()}
+	if c.uploads != nil {
+		qs.Uploads = c.uploads.Len()
+	}
+	return qs
+}
+
+// HealthCheck checks the tiers after the first one that can probe whether
+// they are reachable, returning the errors of those that aren't.
+func (c *TieredCache) HealthCheck(ctx context.Context) error {
+	var errs []error
+	for i, t := range c.tiers {
+		if t.health == nil {
+			continue
+		}
+		if err := t.health.HealthCheck(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %w", tierName(i, len(c.tiers)), t.remote.Kind(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RetryStats returns the outcomes of retried writes so far.
+func (c *TieredCache) RetryStats() RetryStats {
+	return c.retries.Stats()
+}
+
+func (c *TieredCache) Kind() string {
+	return "tiered"
+}
+
+// TierStats returns the stats of each tier, fastest first.
+func (c *TieredCache) TierStats() []TierStats {
+	var stats []TierStats
+	for _, t := range c.tiers {
+		stats = append(stats, CacheStats(t.cache())...)
+	}
+	return stats
+}
+
+func (c *TieredCache) Start(ctx context.Context) error {
+	for i, t := range c.tiers {
+		if err := t.cache().Start(ctx); err != nil {
+			for _, started := range c.tiers[:i] {
+				_ = started.cache().Close()
+			}
+			return fmt.Errorf("%s cache start failed: %w", t.cache().Kind(), err)
+		}
+		t.putsMetrics.Start(ctx)
+		t.getsMetrics.Start(ctx)
+	}
+	c.retries.Start(ctx)
+	if c.uploads != nil {
+		c.uploads.Start(ctx)
+	}
+	if c.tiers[0].policy.Load().NoPopulate {
+		dir, err := os.MkdirTemp(c.scratchParent, "go-cacher-")
+		if err != nil {
+			return err
+		}
+		c.scratchDir = dir
+		c.scratch = map[string]scratchEntry{}
+	}
+	return nil
+}
+
+func (c *TieredCache) local() LocalCache {
+	return c.tiers[0].local
+}
+
+func (c *TieredCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	if !c.verbose {
+		var source string
+		outputID, diskPath, source, _, err = c.get(ctx, actionID)
+		setHitTier(ctx, source)
+		return outputID, diskPath, err
+	}
+	start := time.Now()
+	outputID, diskPath, source, size, err := c.get(ctx, actionID)
+	setHitTier(ctx, source)
+	elapsed := time.Since(start).Round(time.Microsecond)
+	switch {
+	case err != nil:
+		slog.DebugContext(ctx, "get failed", "cache", c.Kind(), "action", actionID, "elapsed", elapsed, "err", err)
+	case outputID == "":
+		slog.DebugContext(ctx, "get miss", "cache", c.Kind(), "action", actionID, "elapsed", elapsed)
+	default:
+		slog.DebugContext(ctx, "get hit", "cache", c.Kind(), "action", actionID, "tier", source, "size", size, "elapsed", elapsed)
+	}
+	return outputID, diskPath, err
+}
+
+// get is Get, also returning which tier answered and the size of the
+// body, for logging. The size of local hits is only known when verbose.
+func (c *TieredCache) get(ctx context.Context, actionID string) (outputID, diskPath, source string, size int64, err error) {
+	outputID, diskPath, err = c.local().Get(ctx, actionID)
+	if err == nil && outputID != "" {
+		if c.verbose {
+			if fi, err := os.Stat(diskPath); err == nil {
+				size = fi.Size()
+			}
+		}
+		return outputID, diskPath, tierName(0, len(c.tiers)), size, nil
+	}
+	if err != nil && c.verbose {
+		slog.DebugContext(ctx, "get failed", "cache", c.local().Kind(), "action", actionID, "err", err)
+	}
+	if e, ok := c.scratchHit(actionID); ok {
+		return e.outputID, e.diskPath, "scratch", e.size, nil
+	}
+	var errs []error
+	for i := 1; i < len(c.tiers); i++ {
+		t := c.tiers[i]
+		outputID, size, body, err := t.get(ctx, actionID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if outputID == "" {
+			continue
+		}
+		diskPath, err = c.promote(ctx, i, actionID, outputID, size, body)
+		if errors.Is(err, ErrCorruptOutput) {
+			// Treat it as a miss, so the action is rebuilt and put again.
+			slog.WarnContext(ctx, "corrupt output", "cache", t.cache().Kind(), "action", actionID, "err", err)
+			if rc, ok := t.remote.(*RemoteCacheWithCounts); ok {
+				rc.countError(err)
+			}
+			continue
+		}
+		if err != nil {
+			return "", "", "", 0, err
+		}
+		return outputID, diskPath, tierName(i, len(c.tiers)), size, nil
+	}
+	return "", "", "", 0, errors.Join(errs...)
+}
+
+// promote stores a hit from tier i in the first tier, and from there in
+// the tiers in between that accept it. The body is verified against the
+// OutputID on the way, which must be a SHA-256, so a corrupted or tampered
+// remote object is never recorded nor served.
+func (c *TieredCache) promote(ctx context.Context, i int, actionID, outputID string, size int64, body io.ReadCloser) (string, error) {
+	diskPath, err := c.tiers[i].getsMetrics.DoWithMeasure(size, func() (string, error) {
+		defer body.Close()
+		r := newStrictVerifyingReader(body, outputID)
+		if c.scratchDir != "" {
+			return c.putScratch(actionID, outputID, size, r)
+		}
+		return c.local().Put(ctx, actionID, outputID, size, r)
+	})
+	if err != nil {
+		return "", err
+	}
+	for j := 1; j < i; j++ {
+		if p := c.tiers[j].policy.Load(); !p.ReadOnly && !p.NoPopulate && p.allowsSize(size) && !c.tiers[j].denied.Load() {
+			c.putLater(ctx, newUploadJob(ctx, j, actionID, outputID, size, diskPath))
+		}
+	}
+	return diskPath, nil
+}
+
+func (c *TieredCache) scratchHit(actionID string) (scratchEntry, bool) {
+	if c.scratchDir == "" {
+		return scratchEntry{}, false
+	}
+	c.scratchMu.Lock()
+	defer c.scratchMu.Unlock()
+	e, ok := c.scratch[actionID]
+	return e, ok
+}
+
+// putScratch writes a body to the scratch directory, where it stays until
+// Close, and remembers it for the rest of the session.
+func (c *TieredCache) putScratch(actionID, outputID string, size int64, body io.Reader) (string, error) {
+	diskPath := filepath.Join(c.scratchDir, "o-"+outputID)
+	wrote, err := writeAtomic(diskPath, body)
+	if err != nil {
+		return "", err
+	}
+	if wrote != size {
+		return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+	}
+	c.scratchMu.Lock()
+	defer c.scratchMu.Unlock()
+	c.scratch[actionID] = scratchEntry{outputID: outputID, diskPath: diskPath, size: size}
+	return diskPath, nil
+}
+
+// putTargets returns the tiers after the first that a put of size bytes
+// should be written to.
+func (c *TieredCache) putTargets(size int64) []int {
+	var targets []int
+	for i := 1; i < len(c.tiers); i++ {
+		if p := c.tiers[i].policy.Load(); !p.ReadOnly && p.allowsSize(size) && !c.tiers[i].denied.Load() {
+			targets = append(targets, i)
+		}
+	}
+	return targets
+}
+
+func (c *TieredCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	if !c.verbose {
+		return c.put(ctx, actionID, outputID, size, body)
+	}
+	start := time.Now()
+	diskPath, err = c.put(ctx, actionID, outputID, size, body)
+	elapsed := time.Since(start).Round(time.Microsecond)
+	if err != nil {
+		slog.DebugContext(ctx, "put failed", "cache", c.Kind(), "action", actionID, "size", size, "elapsed", elapsed, "err", err)
+	} else {
+		slog.DebugContext(ctx, "put", "cache", c.Kind(), "action", actionID, "size", size, "elapsed", elapsed)
+	}
+	return diskPath, err
+}
+
+func (c *TieredCache) put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	targets := c.putTargets(size)
+	if bb, ok := body.(*sbytes.Buffer); (ok || size == 0) && len(targets) > 0 && c.uploads == nil {
+		var b []byte
+		if ok {
+			b = bb.Bytes()
+		}
+		return c.putBytes(ctx, targets, actionID, outputID, size, b)
+	}
+	diskPath, err = c.local().Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		slog.WarnContext(ctx, "put failed", "cache", c.local().Kind(), "action", actionID, "err", err)
+		return "", err
+	}
+	c.putFromFirst(ctx, targets, actionID, outputID, size, diskPath)
+	return diskPath, nil
+}
+
+// BatchExists reports which of the actions a tier stores. The local tiers
+// are looked up one action after another, without a round trip; each
+// remote tier is asked, at once, about the actions the tiers before it
+// lack. It fails with errors.ErrUnsupported if a remote tier can't tell.
+func (c *TieredCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	exists := make([]bool, len(actionIDs))
+	pending := make([]int, len(actionIDs))
+	for i := range pending {
+		pending[i] = i
+	}
+	for _, t := range c.tiers {
+		if len(pending) == 0 {
+			break
+		}
+		found := make([]bool, len(pending))
+		if t.local != nil {
+			for j, i := range pending {
+				outputID, _, err := t.local.Get(ctx, actionIDs[i])
+				if err != nil {
+					return nil, err
+				}
+				found[j] = outputID != ""
+			}
+		} else {
+			if t.batch == nil {
+				return nil, errors.ErrUnsupported
+			}
+			ids := make([]string, len(pending))
+			for j, i := range pending {
+				ids[j] = actionIDs[i]
+			}
+			var err error
+			if found, err = t.batch.BatchExists(ctx, ids); err != nil {
+				return nil, err
+			}
+		}
+		rest := pending[:0]
+		for j, i := range pending {
+			if found[j] {
+				exists[i] = true
+			} else {
+				rest = append(rest, i)
+			}
+		}
+		pending = rest
+	}
+	return exists, nil
+}
+
+// HasOutput reports whether the first tier stores the output.
+func (c *TieredCache) HasOutput(ctx context.Context, outputID string, size int64) bool {
+	los, ok := c.local().(LocalOutputStore)
+	return ok && los.HasOutput(ctx, outputID, size)
+}
+
+// PutAction records the action in the first tier, which stores its
+// output, and writes it from there to the other tiers like Put.
+func (c *TieredCache) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	los, ok := c.local().(LocalOutputStore)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	diskPath, err = los.PutAction(ctx, actionID, outputID, size)
+	if err != nil {
+		slog.WarnContext(ctx, "put failed", "cache", c.local().Kind(), "action", actionID, "err", err)
+		return "", err
+	}
+	slog.DebugContext(ctx, "put action", "cache", c.Kind(), "action", actionID, "output", outputID, "size", size)
+	c.putFromFirst(ctx, c.putTargets(size), actionID, outputID, size, diskPath)
+	return diskPath, nil
+}
+
+// putFromFirst writes an entry stored at diskPath in the first tier to the
+// targets, in the background if uploads are asynchronous.
+func (c *TieredCache) putFromFirst(ctx context.Context, targets []int, actionID, outputID string, size int64, diskPath string) {
+	if c.uploads != nil {
+		for _, i := range targets {
+			c.uploads.enqueue(newUploadJob(ctx, i, actionID, outputID, size, diskPath))
+		}
+		return
+	}
+	// The other tiers read the body back from disk.
+	var wg sync.WaitGroup
+	for _, i := range targets {
+		job := newUploadJob(ctx, i, actionID, outputID, size, diskPath)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.putFromDisk(ctx, job); err != nil {
+				c.putFailed(job, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// putBytes writes an in-memory body to the first tier and the targets
+// concurrently.
+func (c *TieredCache) putBytes(ctx context.Context, targets []int, actionID, outputID string, size int64, body []byte) (diskPath string, err error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for j, i := range targets {
+		j, i := j, i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// tolerate errors writing to other tiers
+			errs[j] = c.tiers[i].put(ctx, actionID, outputID, size, sbytes.NewBuffer(body))
+		}()
+	}
+	diskPath, err = c.local().Put(ctx, actionID, outputID, size, sbytes.NewBuffer(body))
+	wg.Wait()
+	if err != nil {
+		slog.WarnContext(ctx, "put failed", "cache", c.local().Kind(), "action", actionID, "err", err)
+		return "", err
+	}
+	for j, i := range targets {
+		if errs[j] != nil {
+			c.putFailed(newUploadJob(ctx, i, actionID, outputID, size, diskPath), errs[j])
+		}
+	}
+	return diskPath, nil
+}
+
+// putLater writes job in the background if uploads are asynchronous,
+// and right away otherwise.
+func (c *TieredCache) putLater(ctx context.Context, job uploadJob) {
+	if c.uploads != nil {
+		c.uploads.enqueue(job)
+		return
+	}
+	if err := c.putFromDisk(ctx, job); err != nil {
+		c.putFailed(job, err)
+	}
+}
+
+// upload is putFromDisk for the background upload queue, which leaves
+// failures to the retry queue if retries are enabled.
+func (c *TieredCache) upload(ctx context.Context, job uploadJob) error {
+	err := c.putFromDisk(ctx, job)
+	if errors.Is(err, errPutsDenied) {
+		return nil
+	}
+	if err != nil && ctx.Err() == nil && c.retries.policy.MaxAttempts > 1 {
+		c.putFailed(job, err)
+		return nil
+	}
+	return err
+}
+
+// putFailed logs a failed write and schedules a retry, unless the tier
+// denies writes.
+func (c *TieredCache) putFailed(job uploadJob, err error) {
+	if errors.Is(err, errPutsDenied) {
+		return
+	}
+	c.logPutError(job.context(context.Background()), job.Tier, err)
+	c.retries.add(job, err)
+}
+
+// putFromDisk writes an entry to job.Tier, reading its body from the first tier.
+func (c *TieredCache) putFromDisk(ctx context.Context, job uploadJob) error {
+	if job.Tier <= 0 || job.Tier >= len(c.tiers) {
+		return fmt.Errorf("no cache tier %d", job.Tier)
+	}
+	if job.Size == 0 {
+		return c.tiers[job.Tier].put(ctx, job.ActionID, job.OutputID, 0, sbytes.NewBuffer(nil))
+	}
+	f, err := os.Open(job.DiskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.tiers[job.Tier].put(ctx, job.ActionID, job.OutputID, job.Size, f)
+}
+
+func (c *TieredCache) logPutError(ctx context.Context, i int, err error) {
+	if err != nil && c.verbose {
+		slog.DebugContext(ctx, "put failed", "cache", c.tiers[i].cache().Kind(), "err", err)
+	}
+}
+
+func (c *TieredCache) Close() error {
+	var errAll error
+	if c.uploads != nil {
+		if err := c.uploads.Close(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("upload queue stop failed: %w", err))
+		}
+	}
+	if abandoned := c.retries.Close(); len(abandoned) > 0 {
+		if c.uploads != nil && c.uploads.pendingFile != "" {
+			slog.Info("saving unfinished retries for the next session", "count", len(abandoned))
+			if err := c.uploads.savePending(abandoned); err != nil {
+				errAll = errors.Join(errAll, fmt.Errorf("saving retries failed: %w", err))
+			}
+		} else {
+			slog.Warn("dropping unfinished retries", "count", len(abandoned))
+		}
+	}
+	for _, t := range c.tiers {
+		if err := t.cache().Close(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("%s cache stop failed: %w", t.cache().Kind(), err))
+		}
+		if err := t.putsMetrics.Stop(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("puts metrics stop failed: %w", err))
+		}
+		if err := t.getsMetrics.Stop(); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("gets metrics stop failed: %w", err))
+		}
+	}
+	if c.scratchDir != "" {
+		if err := os.RemoveAll(c.scratchDir); err != nil {
+			errAll = errors.Join(errAll, fmt.Errorf("removing scratch dir failed: %w", err))
+		}
+	}
+	if c.verbose {
+		for _, t := range c.tiers[1:] {
+			slog.Info("transfers", "cache", t.cache().Kind(), "downloads", t.getsMetrics.Summary(), "uploads", t.putsMetrics.Summary())
+		}
+		if stats := c.retries.Stats(); stats.Retried > 0 {
+			slog.Info("retries", "stats", stats.String())
+		}
+	}
+	return errAll
+}
+
+// CombinedOption configures the cache returned by NewCombinedCache.
+type CombinedOption func(*TieredCache)
+
+// WithUploadSizeLimits makes the cache only upload bodies of at least min
+// and at most max bytes to the remote cache; other entries are stored
+// locally only. A max <= 0 means there is no upper bound.
+func WithUploadSizeLimits(min, max int64) CombinedOption {
+	return func(c *TieredCache) {
+		for _, t := range c.tiers[1:] {
+			p := *t.policy.Load()
+			p.MinPutSize, p.MaxPutSize = min, max
+			t.policy.Store(&p)
+		}
+	}
+}
+
+// WithAsyncUploads makes the cache upload entries in the background.
+// See TieredCache.SetAsyncUploads.
+func WithAsyncUploads(workers int, drainTimeout time.Duration, pendingFile string) CombinedOption {
+	return func(c *TieredCache) {
+		c.SetAsyncUploads(workers, drainTimeout, pendingFile)
+	}
+}
+
+// NewCombinedCache returns a two-tier TieredCache of localCache and remoteCache.
+func NewCombinedCache(localCache LocalCache, remoteCache RemoteCache, verbose bool, opts ...CombinedOption) LocalCache {
+	cache, _ := NewTieredCache(localCache, remoteCache) // can't fail for these types
+	cache.SetVerbose(verbose)
+	for _, opt := range opts {
+		opt(cache)
+	}
+	if verbose {
+		return NewLocalCacheStates(cache)
+	}
+	return cache
+}
@@ -0,0 +1,324 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helloID is the OutputID of "hello", which remote hits must match.
+var helloID = sha256Hex("hello")
+
+func TestTieredCacheTierStats(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	c := NewCombinedCache(NewSimpleDiskCache(false, t.TempDir()), remote, false)
+	require.NoError(t, c.Start(ctx))
+
+	outputID, _, err := c.Get(ctx, "a1") // local miss, remote hit
+	require.NoError(t, err)
+	assert.Equal(t, helloID, outputID)
+	outputID, _, err = c.Get(ctx, "a1") // local hit
+	require.NoError(t, err)
+	assert.Equal(t, helloID, outputID)
+	_, err = c.Put(ctx, "a2", "4567", 3, sbytes.NewBuffer([]byte("abc")))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	stats := CacheStats(c)
+	require.Len(t, stats, 2)
+	local, rem := stats[0], stats[1]
+	assert.Equal(t, "local", local.Tier)
+	assert.Equal(t, "disk", local.Kind)
+	assert.Equal(t, Stats{Gets: 2, Hits: 1, Misses: 1, Puts: 2, PutBytes: 8}, local.Stats)
+	assert.Equal(t, "remote", rem.Tier)
+	assert.Equal(t, "fake", rem.Kind)
+	assert.Equal(t, Stats{Gets: 1, Hits: 1, HitBytes: 5, Puts: 1, PutBytes: 3}, rem.Stats)
+}
+
+func TestTieredCacheChain(t *testing.T) {
+	ctx := context.Background()
+	lan, cloud, sealed := newFakeRemote("lan"), newFakeRemote("cloud"), newFakeRemote("sealed")
+	cloud.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	c, err := NewTieredCache(
+		NewSimpleDiskCache(false, t.TempDir()),
+		lan,
+		WithTierPolicy(sealed, TierPolicy{ReadOnly: true}),
+		cloud,
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	outputID, diskPath, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Equal(t, helloID, outputID)
+	b, err := os.ReadFile(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	assert.True(t, lan.has("a1"), "hit should populate the tiers in between")
+	assert.False(t, sealed.has("a1"), "read-only tiers are never written")
+
+	_, err = c.Put(ctx, "a2", "4567", 3, sbytes.NewBuffer([]byte("abc")))
+	require.NoError(t, err)
+	assert.True(t, lan.has("a2"))
+	assert.True(t, cloud.has("a2"))
+	assert.False(t, sealed.has("a2"))
+}
+
+func TestNewTieredCacheFirstTierMustBeLocal(t *testing.T) {
+	_, err := NewTieredCache(newFakeRemote("fake"))
+	assert.Error(t, err)
+}
+
+func TestTieredCacheNoPopulate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	disk := NewSimpleDiskCache(false, dir)
+	c, err := NewTieredCache(WithTierPolicy(disk, TierPolicy{NoPopulate: true}), remote)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+
+	outputID, diskPath, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Equal(t, helloID, outputID)
+	b, err := os.ReadFile(diskPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	remote.entries = map[string]fakeEntry{}
+	outputID, _, err = c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Equal(t, helloID, outputID, "hits are remembered for the session")
+
+	outputID, _, err = disk.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "hit must not be persisted locally")
+
+	require.NoError(t, c.Close())
+	assert.NoFileExists(t, diskPath)
+}
+
+func TestTieredCacheScratchDir(t *testing.T) {
+	ctx := context.Background()
+	scratch := t.TempDir()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	c, err := NewTieredCache(WithTierPolicy(NewSimpleDiskCache(false, t.TempDir()), TierPolicy{NoPopulate: true}), remote)
+	require.NoError(t, err)
+	c.SetScratchDir(scratch)
+	require.NoError(t, c.Start(ctx))
+
+	_, diskPath, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	rel, err := filepath.Rel(scratch, diskPath)
+	require.NoError(t, err)
+	assert.False(t, strings.HasPrefix(rel, ".."), "hit %s is in the scratch dir %s", diskPath, scratch)
+	require.NoError(t, c.Close())
+	entries, err := os.ReadDir(scratch)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the scratch dir is removed on Close")
+}
+
+func TestTieredCacheVerboseTiming(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	remote.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	c.SetVerbose(true)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	for _, id := range []string{"a1", "a1", "a2"} {
+		_, _, err := c.Get(ctx, id)
+		require.NoError(t, err)
+	}
+	out := logs.String()
+	assert.Contains(t, out, `msg="get hit" cache=tiered action=a1 tier=remote size=5 elapsed=`)
+	assert.Contains(t, out, `msg="get hit" cache=tiered action=a1 tier=local size=5 elapsed=`)
+	assert.Contains(t, out, `msg="get miss" cache=tiered action=a2 elapsed=`)
+}
+
+// dedupRemote is a fakeRemote that can record actions for stored outputs.
+type dedupRemote struct {
+	*fakeRemote
+	uploads atomic.Int32
+}
+
+func (d *dedupRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	d.uploads.Add(1)
+	return d.fakeRemote.Put(ctx, actionID, outputID, size, body)
+}
+
+func (d *dedupRemote) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		if e.outputID == outputID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *dedupRemote) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		if e.outputID == outputID {
+			d.entries[actionID] = e
+			return nil
+		}
+	}
+	return errors.New("no such output")
+}
+
+func TestTieredCacheDedupsOutputs(t *testing.T) {
+	ctx := context.Background()
+	remote := &dedupRemote{fakeRemote: newFakeRemote("dedup")}
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("x"), dedupMinSize)
+	for _, id := range []string{"a1", "a2"} {
+		_, err := c.Put(ctx, id, "0123", int64(len(body)), sbytes.NewBuffer(body))
+		require.NoError(t, err)
+	}
+	assert.True(t, remote.has("a2"))
+	assert.EqualValues(t, 1, remote.uploads.Load(), "same output should only be uploaded once")
+
+	_, err = c.Put(ctx, "a3", "0123", 3, sbytes.NewBuffer([]byte("abc")))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, remote.uploads.Load(), "small bodies are always uploaded")
+}
+
+func TestTieredCacheSetTierPolicy(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	_, err = c.Put(ctx, "a1", sha256Hex("hello"), 5, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Contains(t, remote.entries, "a1")
+
+	require.NoError(t, c.SetTierPolicy(1, TierPolicy{ReadOnly: true}))
+	_, err = c.Put(ctx, "a2", sha256Hex("bye"), 3, strings.NewReader("bye"))
+	require.NoError(t, err)
+	assert.NotContains(t, remote.entries, "a2")
+
+	assert.Error(t, c.SetTierPolicy(2, TierPolicy{}))
+}
+
+func TestTieredCachePutAction(t *testing.T) {
+	ctx := context.Background()
+	remote := newFakeRemote("fake")
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	assert.False(t, c.HasOutput(ctx, sha256Hex("hello"), 5))
+	_, err = c.Put(ctx, "a1", sha256Hex("hello"), 5, strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.True(t, c.HasOutput(ctx, sha256Hex("hello"), 5))
+	assert.False(t, c.HasOutput(ctx, sha256Hex("hello"), 4))
+
+	// The other tiers get the body from the first one.
+	_, err = c.PutAction(ctx, "a2", sha256Hex("hello"), 5)
+	require.NoError(t, err)
+	require.Contains(t, remote.entries, "a2")
+	assert.Equal(t, "hello", string(remote.entries["a2"].body))
+	outputID, _, err := c.Get(ctx, "a2")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Hex("hello"), outputID)
+
+	_, err = c.PutAction(ctx, "a3", sha256Hex("bye"), 3)
+	assert.Error(t, err)
+}
+
+// forbiddenRemote is a fakeRemote denying writes with a 403, like a server
+// with read-only credentials.
+type forbiddenRemote struct {
+	*fakeRemote
+	puts atomic.Int32
+}
+
+func (r *forbiddenRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	r.puts.Add(1)
+	return &StatusError{Method: "PUT", Path: "/cache/" + actionID, Status: "403 Forbidden", StatusCode: 403}
+}
+
+func TestTieredCacheStopsWritingWhenDenied(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	ctx := context.Background()
+	remote := &forbiddenRemote{fakeRemote: newFakeRemote("forbidden")}
+	remote.entries["a1"] = fakeEntry{outputID: helloID, body: []byte("hello")}
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond})
+	c.SetAsyncUploads(1, time.Second, "")
+	require.NoError(t, c.Start(ctx))
+
+	for _, id := range []string{"a2", "a3", "a4"} {
+		_, err := c.Put(ctx, id, sha256Hex(id), int64(len(id)), strings.NewReader(id))
+		require.NoError(t, err)
+	}
+	outputID, _, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Equal(t, helloID, outputID, "reads go on")
+	require.NoError(t, c.Close())
+
+	assert.EqualValues(t, 1, remote.puts.Load())
+	assert.Equal(t, RetryStats{}, c.RetryStats())
+	assert.Equal(t, 1, strings.Count(logs.String(), "level=WARN"), logs.String())
+	assert.Contains(t, logs.String(), "not writing to it for the rest of the session")
+}
+
+// unhealthyRemote is a fakeRemote whose health checks fail with err.
+type unhealthyRemote struct {
+	*fakeRemote
+	err error
+}
+
+func (u *unhealthyRemote) HealthCheck(ctx context.Context) error { return u.err }
+
+func TestTieredCacheHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	remote := &unhealthyRemote{fakeRemote: newFakeRemote("down")}
+	c, err := NewTieredCache(NewSimpleDiskCache(false, t.TempDir()), remote)
+	require.NoError(t, err)
+	cache := NewSingleflightCache(NewLocalCacheWithCounts(c, "tiered", false))
+	require.NoError(t, CheckHealth(ctx, cache))
+
+	remote.err = errors.New("connection refused")
+	err = CheckHealth(ctx, cache)
+	assert.ErrorContains(t, err, "remote (down): connection refused")
+}
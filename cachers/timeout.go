@@ -0,0 +1,208 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrStalled is the error of the requests of a transport from
+// NewTimeoutTransport that go without progress for too long.
+var ErrStalled = errors.New("stalled")
+
+// Timeouts bound the steps of the requests to a remote. Zero durations
+// are unlimited.
+type Timeouts struct {
+	// Connect bounds establishing a connection, including the TLS handshake.
+	Connect time.Duration
+	// Read bounds the wait for the response, and for each part of its body.
+	Read time.Duration
+	// Write bounds the wait for each part of the request body to be sent.
+	Write time.Duration
+}
+
+// NewTimeoutTransport returns a RoundTripper like http.DefaultTransport
+// that applies t to its requests.
+func NewTimeoutTransport(t Timeouts) http.RoundTripper {
+	return NewTimeoutTransportFrom(http.DefaultTransport.(*http.Transport).Clone(), t)
+}
+
+// NewTimeoutTransportFrom is NewTimeoutTransport with the base transport
+// tr, like one with a custom TLS configuration, which it modifies.
+func NewTimeoutTransportFrom(tr *http.Transport, t Timeouts) http.RoundTripper {
+	if t.Connect > 0 {
+		dialer := &net.Dialer{Timeout: t.Connect, KeepAlive: 30 * time.Second}
+		tr.DialContext = dialer.DialContext
+		tr.TLSHandshakeTimeout = t.Connect
+	}
+	if t.Read <= 0 && t.Write <= 0 {
+		return tr
+	}
+	return &stallTransport{base: tr, read: t.Read, write: t.Write}
+}
+
+// stallTransport cancels the requests that make no progress, sending their
+// body or receiving the response, for longer than write or read.
+type stallTransport struct {
+	base        http.RoundTripper
+	read, write time.Duration
+}
+
+func (t *stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	s := &stallTimer{cancel: cancel}
+	if req.Body != nil && req.Body != http.NoBody {
+		s.arm(t.write)
+		req = req.Clone(ctx)
+		req.Body = &progressReader{ReadCloser: req.Body, progress: func(eof bool) {
+			if eof {
+				s.arm(t.read)
+			} else {
+				s.arm(t.write)
+			}
+		}}
+	} else {
+		s.arm(t.read)
+		req = req.WithContext(ctx)
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		s.stop()
+		if cause := context.Cause(ctx); errors.Is(cause, ErrStalled) {
+			return nil, cause
+		}
+		return nil, err
+	}
+	s.arm(t.read)
+	res.Body = &progressReader{ReadCloser: res.Body, progress: func(bool) { s.arm(t.read) }, ctx: ctx, done: s.stop}
+	return res, nil
+}
+
+// stallTimer cancels a request when it fires.
+type stallTimer struct {
+	mu      sync.Mutex
+	t       *time.Timer
+	stopped bool
+	cancel  context.CancelCauseFunc
+}
+
+// arm restarts the timer for d, or stops it if d is 0.
+func (s *stallTimer) arm(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	if s.t != nil {
+		s.t.Stop()
+	}
+	s.t = nil
+	if d > 0 {
+		s.t = time.AfterFunc(d, func() {
+			s.cancel(fmt.Errorf("%w: no progress for %v", ErrStalled, d))
+		})
+	}
+}
+
+// stop stops the timer for good and releases the request's context.
+func (s *stallTimer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.t != nil {
+		s.t.Stop()
+	}
+	s.stopped = true
+	s.cancel(nil)
+}
+
+// progressReader calls progress after each read that returns data, or
+// the end of the stream, and done, if set, once on Close.
+type progressReader struct {
+	io.ReadCloser
+	progress func(eof bool)
+	ctx      context.Context // reported as the cause of read errors, if set
+	done     func()
+	once     sync.Once
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 || err == io.EOF {
+		r.progress(err == io.EOF)
+	}
+	if err != nil && err != io.EOF && r.ctx != nil {
+		if cause := context.Cause(r.ctx); errors.Is(cause, ErrStalled) {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.done != nil {
+		r.once.Do(r.done)
+	}
+	return err
+}
+
+// TimeoutRemoteCache is a RemoteCache that bounds the time of each
+// operation on the cache it wraps, including reading the output of a get.
+type TimeoutRemoteCache struct {
+	forwarder
+	timeout time.Duration
+}
+
+var _ RemoteCache = &TimeoutRemoteCache{}
+var _ HealthChecker = &TimeoutRemoteCache{}
+var _ OutputStore = &TimeoutRemoteCache{}
+var _ BatchChecker = &TimeoutRemoteCache{}
+
+func NewTimeoutRemoteCache(cache RemoteCache, timeout time.Duration) *TimeoutRemoteCache {
+	return &TimeoutRemoteCache{forwarder: forwarder{cache}, timeout: timeout}
+}
+
+func (c *TimeoutRemoteCache) Get(ctx context.Context, actionID string) (outputID string, size int64, output io.ReadCloser, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	outputID, size, output, err = c.cache.Get(ctx, actionID)
+	if err != nil || output == nil {
+		cancel()
+		return outputID, size, output, err
+	}
+	return outputID, size, &releaseOnClose{ReadCloser: output, release: cancel}, nil
+}
+
+func (c *TimeoutRemoteCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.cache.Put(ctx, actionID, outputID, size, body)
+}
+
+func (c *TimeoutRemoteCache) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.forwarder.HealthCheck(ctx)
+}
+
+func (c *TimeoutRemoteCache) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.forwarder.HasOutput(ctx, outputID)
+}
+
+func (c *TimeoutRemoteCache) BatchExists(ctx context.Context, actionIDs []string) ([]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.forwarder.BatchExists(ctx, actionIDs)
+}
+
+func (c *TimeoutRemoteCache) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	return c.forwarder.PutAction(ctx, actionID, outputID, size)
+}
@@ -0,0 +1,79 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/sbytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingRemote is a fakeRemote whose puts wait for their context to end.
+type blockingRemote struct {
+	*fakeRemote
+}
+
+func (b *blockingRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestTimeoutRemoteCache(t *testing.T) {
+	ctx := context.Background()
+	remote := &blockingRemote{fakeRemote: newFakeRemote("slow")}
+	c := NewTimeoutRemoteCache(remote, 10*time.Millisecond)
+
+	err := c.Put(ctx, "a1", "0123", 0, sbytes.NewBuffer(nil))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	t.Run("get lasts until the output is closed", func(t *testing.T) {
+		remote.entries["a1"] = fakeEntry{outputID: "0123", body: []byte("hello")}
+		c := NewTimeoutRemoteCache(remote, time.Minute)
+		_, _, output, err := c.Get(ctx, "a1")
+		require.NoError(t, err)
+		body, err := io.ReadAll(output)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(body))
+		require.NoError(t, output.Close())
+	})
+
+	t.Run("output store passthrough", func(t *testing.T) {
+		_, err := c.HasOutput(ctx, "0123")
+		assert.True(t, errors.Is(err, errors.ErrUnsupported))
+	})
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: NewTimeoutTransport(Timeouts{Connect: time.Second, Read: 50 * time.Millisecond, Write: time.Second})}
+
+	res, err := client.Post(srv.URL+"/fast", "text/plain", strings.NewReader("body"))
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	require.NoError(t, res.Body.Close())
+
+	t.Run("stalled response body", func(t *testing.T) {
+		res, err := client.Get(srv.URL + "/slow")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		_, err = io.ReadAll(res.Body)
+		assert.ErrorIs(t, err, ErrStalled)
+	})
+}
@@ -0,0 +1,65 @@
+package cachers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrPinMismatch is the error of the TLS connections of a configuration
+// from NewTLSConfig whose certificates have none of the pins.
+var ErrPinMismatch = errors.New("no certificate matches the pinned public keys")
+
+// NewTLSConfig returns a TLS client configuration trusting, besides the
+// system roots, the CAs of the PEM bundle caFile if it is set, as for a
+// private CA or a TLS-intercepting proxy. If pins are set, it only accepts
+// the verified chains with a certificate whose public key is one of them:
+// "sha256/" and the base64 of the SHA-256 of its SubjectPublicKeyInfo, as
+// for curl's --pinnedpubkey.
+func NewTLSConfig(caFile string, pins []string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(pins) > 0 {
+		hashes := make([][]byte, len(pins))
+		for i, pin := range pins {
+			h, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q: want sha256/ and the base64 of a SHA-256", pin)
+			}
+			hashes[i] = h
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, h := range hashes {
+						if bytes.Equal(sum[:], h) {
+							return nil
+						}
+					}
+				}
+			}
+			return fmt.Errorf("%w of %s", ErrPinMismatch, cs.ServerName)
+		}
+	}
+	return cfg, nil
+}
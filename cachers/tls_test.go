@@ -0,0 +1,54 @@
+package cachers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTLSServer returns a TLS server, the path of a PEM bundle of its
+// certificate and the pin of its public key.
+func newTLSServer(t *testing.T) (srv *httptest.Server, caFile, pin string) {
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	cert := srv.Certificate()
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644))
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return srv, caFile, "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	srv, caFile, pin := newTLSServer(t)
+	get := func(caFile string, pins ...string) error {
+		cfg, err := NewTLSConfig(caFile, pins)
+		require.NoError(t, err)
+		res, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}).Get(srv.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	assert.Error(t, get(""), "untrusted without the CA")
+	assert.NoError(t, get(caFile))
+	assert.NoError(t, get(caFile, "sha256/"+base64.StdEncoding.EncodeToString(make([]byte, 32)), pin))
+	assert.ErrorIs(t, get(caFile, "sha256/"+base64.StdEncoding.EncodeToString(make([]byte, 32))), ErrPinMismatch)
+
+	_, err := NewTLSConfig("", []string{"sha256/short"})
+	assert.ErrorContains(t, err, "invalid pin")
+	_, err = NewTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), nil)
+	assert.Error(t, err)
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	require.NoError(t, os.WriteFile(empty, nil, 0644))
+	_, err = NewTLSConfig(empty, nil)
+	assert.ErrorContains(t, err, "no PEM certificates")
+}
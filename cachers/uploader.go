@@ -0,0 +1,205 @@
+package cachers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// uploadJob is an entry waiting to be written to a tier of a TieredCache.
+// The body is read back from DiskPath in the first tier.
+type uploadJob struct {
+	Tier     int    `json:"t"`
+	ActionID string `json:"a"`
+	OutputID string `json:"o"`
+	Size     int64  `json:"n"`
+	DiskPath string `json:"p"`
+
+	// RequestID is the ID of the request that produced the entry, for
+	// logging; it means nothing to the next session.
+	RequestID int64 `json:"-"`
+}
+
+// newUploadJob returns the job writing an entry to the given tier on
+// behalf of the request ctx serves.
+func newUploadJob(ctx context.Context, tier int, actionID, outputID string, size int64, diskPath string) uploadJob {
+	id, _ := RequestID(ctx)
+	return uploadJob{Tier: tier, ActionID: actionID, OutputID: outputID, Size: size, DiskPath: diskPath, RequestID: id}
+}
+
+// context returns ctx, carrying the ID of the request of the job if known.
+func (job uploadJob) context(ctx context.Context) context.Context {
+	if job.RequestID == 0 {
+		return ctx
+	}
+	return WithRequestID(ctx, job.RequestID)
+}
+
+// UploadQueueSize is how many background uploads can be queued; puts
+// block while the queue is full.
+const UploadQueueSize = 4096
+
+// uploadQueue uploads entries to a remote cache in the background.
+// On close it waits up to drainTimeout for the queue to empty and saves
+// whatever is left to pendingFile, from where the next session picks it up.
+type uploadQueue struct {
+	upload       func(ctx context.Context, job uploadJob) error
+	workers      int
+	drainTimeout time.Duration
+	pendingFile  string // or empty to drop unfinished uploads
+
+	jobs    chan uploadJob
+	pending atomic.Int64 // queued or in flight
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex
+	leftover []uploadJob // interrupted by the drain deadline
+}
+
+func newUploadQueue(upload func(context.Context, uploadJob) error, workers int, drainTimeout time.Duration, pendingFile string) *uploadQueue {
+	return &uploadQueue{
+		upload:       upload,
+		workers:      max(workers, 1),
+		drainTimeout: drainTimeout,
+		pendingFile:  pendingFile,
+	}
+}
+
+func (q *uploadQueue) Start(ctx context.Context) {
+	// Uploads outlive the request that queued them, and are stopped by Close.
+	ctx, q.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	pending := q.loadPending()
+	q.jobs = make(chan uploadJob, UploadQueueSize+len(pending))
+	for _, job := range pending {
+		q.enqueue(job)
+	}
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+}
+
+// enqueue adds job to the queue, blocking while it is full.
+func (q *uploadQueue) enqueue(job uploadJob) {
+	q.pending.Add(1)
+	q.jobs <- job
+}
+
+// Len returns the number of uploads queued or in flight.
+func (q *uploadQueue) Len() int64 {
+	return q.pending.Load()
+}
+
+func (q *uploadQueue) work(ctx context.Context) {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		jctx := job.context(ctx)
+		var err error
+		if err = ctx.Err(); err == nil {
+			err = q.upload(jctx, job)
+		}
+		if err != nil && ctx.Err() != nil {
+			q.keep(job)
+		} else if err != nil {
+			slog.WarnContext(jctx, "upload failed", "action", job.ActionID, "err", err)
+		}
+		q.pending.Add(-1)
+	}
+}
+
+func (q *uploadQueue) keep(job uploadJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.leftover = append(q.leftover, job)
+}
+
+// Close stops accepting uploads and drains the queue, bounded by the drain
+// timeout. Uploads that didn't make it are saved for the next session.
+func (q *uploadQueue) Close() error {
+	close(q.jobs)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	deadline := time.NewTimer(q.drainTimeout)
+	defer deadline.Stop()
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+	if n := q.Len(); n > 0 {
+		slog.Info("waiting for uploads", "count", n, "timeout", q.drainTimeout)
+	}
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-progress.C:
+			slog.Info("waiting for uploads", "count", q.Len())
+		case <-deadline.C:
+			q.cancel()
+			<-done
+			break wait
+		}
+	}
+	q.cancel()
+	if len(q.leftover) == 0 {
+		return nil
+	}
+	if q.pendingFile == "" {
+		slog.Warn("dropping unfinished uploads", "count", len(q.leftover))
+		return nil
+	}
+	slog.Info("saving unfinished uploads for the next session", "count", len(q.leftover))
+	return q.savePending(q.leftover)
+}
+
+func (q *uploadQueue) savePending(jobs []uploadJob) error {
+	f, err := os.OpenFile(q.pendingFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, job := range jobs {
+		if err := enc.Encode(job); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return errors.Join(bw.Flush(), f.Close())
+}
+
+// loadPending returns the uploads saved by a previous session and forgets
+// them; they are saved again if this session doesn't finish them either.
+func (q *uploadQueue) loadPending() []uploadJob {
+	if q.pendingFile == "" {
+		return nil
+	}
+	f, err := os.Open(q.pendingFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("reading pending uploads failed", "err", err)
+		}
+		return nil
+	}
+	var jobs []uploadJob
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var job uploadJob
+		if err := dec.Decode(&job); err != nil {
+			break
+		}
+		jobs = append(jobs, job)
+	}
+	_ = f.Close()
+	_ = os.Remove(q.pendingFile)
+	return jobs
+}
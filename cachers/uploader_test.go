@@ -0,0 +1,51 @@
+package cachers
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadQueueDrain(t *testing.T) {
+	var uploaded atomic.Int32
+	q := newUploadQueue(func(ctx context.Context, job uploadJob) error {
+		uploaded.Add(1)
+		return nil
+	}, 2, time.Minute, "")
+	q.Start(context.Background())
+	for i := 0; i < 10; i++ {
+		q.enqueue(uploadJob{ActionID: "a"})
+	}
+	require.NoError(t, q.Close())
+	assert.EqualValues(t, 10, uploaded.Load())
+	assert.EqualValues(t, 0, q.Len())
+}
+
+func TestUploadQueueSavesUnfinished(t *testing.T) {
+	pendingFile := filepath.Join(t.TempDir(), "pending.jsonl")
+	stuck := func(ctx context.Context, job uploadJob) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	q := newUploadQueue(stuck, 1, 50*time.Millisecond, pendingFile)
+	q.Start(context.Background())
+	for _, id := range []string{"a1", "a2", "a3"} {
+		q.enqueue(uploadJob{ActionID: id, OutputID: "o", DiskPath: "/p/" + id})
+	}
+	require.NoError(t, q.Close())
+
+	var got []string
+	q = newUploadQueue(func(ctx context.Context, job uploadJob) error {
+		got = append(got, job.ActionID)
+		return nil
+	}, 1, time.Minute, pendingFile)
+	q.Start(context.Background())
+	require.NoError(t, q.Close())
+	assert.ElementsMatch(t, []string{"a1", "a2", "a3"}, got)
+	assert.NoFileExists(t, pendingFile)
+}
@@ -0,0 +1,91 @@
+package cachers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrCorruptOutput is returned when a body doesn't match its OutputID.
+var ErrCorruptOutput = errors.New("output does not match its ID")
+
+// verifyingReader hashes a body as it is read and, at EOF, fails with
+// ErrCorruptOutput instead if the hash isn't the expected OutputID. Since
+// the error comes before EOF, a cache writing the body never records it.
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	outputID string
+}
+
+// NewVerifyingReader returns r, checked against outputID. cmd/go uses the
+// SHA-256 of the content as the OutputID; other IDs can't be verified and
+// r is returned as is.
+func NewVerifyingReader(r io.Reader, outputID string) io.Reader {
+	if len(outputID) != 2*sha256.Size {
+		return r
+	}
+	return &verifyingReader{r: r, h: sha256.New(), outputID: outputID}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if err := VerifyOutputHash(v.h, v.outputID); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// newStrictVerifyingReader is like NewVerifyingReader, for bodies that
+// can't be trusted, like those of remote hits: an OutputID that isn't a
+// SHA-256 fails with ErrCorruptOutput, rather than being taken on faith.
+func newStrictVerifyingReader(r io.Reader, outputID string) io.Reader {
+	if !isSHA256Hex(outputID) {
+		return &errReader{fmt.Errorf("%w: %q is not a SHA-256", ErrCorruptOutput, outputID)}
+	}
+	return NewVerifyingReader(r, outputID)
+}
+
+// isSHA256Hex reports whether id is a SHA-256 in lowercase hex, like the
+// OutputIDs of cmd/go.
+func isSHA256Hex(id string) bool {
+	if len(id) != 2*sha256.Size {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// VerifyOutput returns ErrCorruptOutput if b doesn't match outputID. Like
+// NewVerifyingReader, it only checks SHA-256 IDs.
+func VerifyOutput(b []byte, outputID string) error {
+	h := sha256.New()
+	h.Write(b)
+	return VerifyOutputHash(h, outputID)
+}
+
+// VerifyOutputHash is like VerifyOutput, for a body already hashed with
+// SHA-256 into h.
+func VerifyOutputHash(h hash.Hash, outputID string) error {
+	if len(outputID) != 2*sha256.Size {
+		return nil
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != outputID {
+		return fmt.Errorf("%w: got sha256 %s", ErrCorruptOutput, got)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package cachers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyingReader(t *testing.T) {
+	t.Run("match", func(t *testing.T) {
+		b, err := io.ReadAll(NewVerifyingReader(strings.NewReader("hello"), sha256Hex("hello")))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		_, err := io.ReadAll(NewVerifyingReader(strings.NewReader("hellO"), sha256Hex("hello")))
+		assert.ErrorIs(t, err, ErrCorruptOutput)
+	})
+	t.Run("not a hash", func(t *testing.T) {
+		r := strings.NewReader("hello")
+		assert.Same(t, r, NewVerifyingReader(r, "0123"))
+	})
+}
+
+func TestVerifyOutput(t *testing.T) {
+	assert.NoError(t, VerifyOutput([]byte("hello"), sha256Hex("hello")))
+	assert.ErrorIs(t, VerifyOutput([]byte("hellO"), sha256Hex("hello")), ErrCorruptOutput)
+	assert.NoError(t, VerifyOutput([]byte("hello"), "0123"))
+}
+
+func TestTieredCacheRejectsCorruptRemoteOutput(t *testing.T) {
+	ctx := context.Background()
+	disk := NewSimpleDiskCache(false, t.TempDir())
+	corrupt, good := newFakeRemote("corrupt"), newFakeRemote("good")
+	corrupt.entries["a1"] = fakeEntry{outputID: sha256Hex("hello"), body: []byte("hellO")}
+	c, err := NewTieredCache(disk, corrupt)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	outputID, _, err := c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "corrupt output should be a miss")
+	outputID, _, err = disk.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Empty(t, outputID, "corrupt output must not be recorded locally")
+
+	good.entries["a1"] = fakeEntry{outputID: sha256Hex("hello"), body: []byte("hello")}
+	c, err = NewTieredCache(disk, corrupt, good)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+	outputID, _, err = c.Get(ctx, "a1")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Hex("hello"), outputID, "later tiers are tried after a corrupt hit")
+}
+
+func TestTieredCacheRejectsUnverifiableRemoteOutput(t *testing.T) {
+	ctx := context.Background()
+	disk := NewSimpleDiskCache(false, t.TempDir())
+	remote := newFakeRemote("tampered")
+	for actionID, outputID := range map[string]string{
+		"a1": "0123",
+		"a2": strings.ToUpper(sha256Hex("hello")),
+		"a3": sha256Hex("hello")[:63] + "g",
+	} {
+		remote.entries[actionID] = fakeEntry{outputID: outputID, body: []byte("hello")}
+	}
+	c, err := NewTieredCache(disk, remote)
+	require.NoError(t, err)
+	require.NoError(t, c.Start(ctx))
+	defer c.Close()
+
+	for _, actionID := range []string{"a1", "a2", "a3"} {
+		outputID, _, err := c.Get(ctx, actionID)
+		require.NoError(t, err)
+		assert.Empty(t, outputID, "%s: an OutputID that isn't a SHA-256 can't be verified, so is a miss", actionID)
+	}
+}
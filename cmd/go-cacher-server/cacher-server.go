@@ -13,15 +13,56 @@ GET /action/<actionID-hex>
 GET /output/<outputID-hex>
 200 of those bytes with Content-Length or 404
 
+HEAD /output/<outputID-hex>
+200 or 404, to check whether an output is stored
+
+PUT /action/<actionID-hex>
+{"outputID":"$outputID-hex","size":1234}
+204, recording an action whose output is already stored, or 404 if it isn't
+
 PUT /<actionID>/<outputID>
 Content-Length: 1234
 <bytes>
 
+POST /exists
+{"actionIDs":["$actionID-hex",...]}
+{"exists":[true,...]}, whether each action is stored, for up to 1000 of them
+
+Every response has "Accept-Encoding: zstd", telling the clients that the
+bodies of the puts may instead be compressed with zstd:
+
+PUT /<actionID>/<outputID>
+Content-Encoding: zstd
+X-Gocache-Decoded-Size: 1234
+<zstd bytes, chunked>
+
+and a get of an output with "Accept-Encoding: zstd" is answered, for
+outputs of 8 KiB or more, with "Content-Encoding: zstd" and the compressed
+bytes, chunked.
+
+GET /healthz
+200 while the server runs
+
+GET /readyz
+200 if the cache directory can be written, or 503
+
+With -hmac-secret-file, every request must be signed with the secret in the
+file, or is refused with a 401:
+
+X-Gocache-Timestamp: <Unix time>
+X-Gocache-Content-Sha256: <SHA-256 of the body in hex>
+X-Gocache-Signature: <hex HMAC-SHA256 of "GOCACHE-HMAC-SHA256\n" + timestamp + "\n" + method + "\n" + path + "\n" + body hash>
+
+followed, for each of the Content-Encoding and X-Gocache-Decoded-Size headers
+the request has, by "\n" + the lowercase name + ":" + the value.
+
 */
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -29,6 +70,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,6 +82,7 @@ var (
 	verbose = flag.Bool("verbose", false, "be verbose")
 	listen  = flag.String("listen", ":31364", "listen address")
 	latency = flag.Duration("inject-latency", 0, "the additional latency to add to all requests (for testing)")
+	hmacKey = flag.String("hmac-secret-file", "", "if set, the file with the secret shared with the clients, with which they must sign their requests")
 )
 
 func main() {
@@ -64,6 +107,16 @@ func main() {
 		verbose: *verbose,
 		latency: *latency,
 	}
+	if *hmacKey != "" {
+		secret, err := os.ReadFile(*hmacKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.hmacSecret = bytes.TrimRight(secret, "\r\n")
+		if len(srv.hmacSecret) == 0 {
+			log.Fatalf("empty HMAC secret in %s", *hmacKey)
+		}
+	}
 
 	log.Fatal(http.ListenAndServe(*listen, srv))
 }
@@ -72,6 +125,9 @@ type server struct {
 	cache   *cachers.SimpleDiskCache // TODO: add interface for things other than disk cache? when needed.
 	verbose bool
 	latency time.Duration
+
+	// hmacSecret, if set, is the secret the requests must be signed with.
+	hmacSecret []byte
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -81,10 +137,44 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if s.verbose {
 		log.Printf("%s %s", r.Method, r.RequestURI)
 	}
+	// Clients may compress their puts, as RFC 7694 says.
+	w.Header().Set("Accept-Encoding", "zstd")
+	// The probes of orchestrators aren't signed.
+	if r.Method == "GET" {
+		switch r.URL.Path {
+		case "/healthz":
+			_, _ = io.WriteString(w, "ok")
+			return
+		case "/readyz":
+			s.handleReady(w, r)
+			return
+		}
+	}
+	if s.hmacSecret != nil {
+		if err := cachers.VerifyHMAC(r, s.hmacSecret, time.Now()); err != nil {
+			if s.verbose {
+				log.Printf("%s %s: %v", r.Method, r.RequestURI, err)
+			}
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
 	if r.Method == "PUT" {
+		if strings.HasPrefix(r.URL.Path, "/action/") {
+			s.handlePutAction(w, r)
+			return
+		}
 		s.handlePut(w, r)
 		return
 	}
+	if r.Method == "POST" && r.URL.Path == "/exists" {
+		s.handleExists(w, r)
+		return
+	}
+	if r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/output/") {
+		s.handleGetOutput(w, r)
+		return
+	}
 	if r.Method != "GET" {
 		http.Error(w, "bad method", http.StatusBadRequest)
 		return
@@ -101,6 +191,21 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleReady answers whether the server can store entries, writing a
+// file to the cache directory.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	f, err := os.CreateTemp(*dir, ".readyz-*")
+	if err == nil {
+		err = f.Close()
+		os.Remove(f.Name())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = io.WriteString(w, "ok")
+}
+
 func getHexSuffix(r *http.Request, prefix string) (hexSuffix string, ok bool) {
 	hexSuffix, _ = strings.CutPrefix(r.RequestURI, prefix)
 	if !validHex(hexSuffix) {
@@ -156,6 +261,66 @@ func (s *server) handleGetAction(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// errBodyTooLarge is the error of readBody for the bodies over its limit.
+var errBodyTooLarge = errors.New("body too large")
+
+// readBody reads the body of r to its end, where a signed body is checked,
+// unless it is over limit bytes.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err == nil && int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, err
+}
+
+// writeBodyError writes the error of readBody.
+func writeBodyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cachers.ErrBadSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}
+}
+
+func (s *server) handleExists(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r, 1<<20)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	var req cachers.BatchExistsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req.ActionIDs) > cachers.MaxBatchExists {
+		http.Error(w, "too many actions", http.StatusRequestEntityTooLarge)
+		return
+	}
+	res := cachers.BatchExistsResponse{Exists: make([]bool, len(req.ActionIDs))}
+	for i, actionID := range req.ActionIDs {
+		if !validHex(actionID) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		outputID, diskPath, err := s.cache.Get(r.Context(), actionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if outputID != "" {
+			_, err := os.Stat(diskPath)
+			res.Exists[i] = err == nil
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&res)
+}
+
 func (s *server) handleGetOutput(w http.ResponseWriter, r *http.Request) {
 	outputID, ok := getHexSuffix(r, "/output/")
 	if !ok {
@@ -163,7 +328,23 @@ func (s *server) handleGetOutput(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, OutputFilename(*dir, outputID))
+	w.Header().Add("Vary", "Accept-Encoding")
+	path := OutputFilename(*dir, outputID)
+	if r.Method == "GET" && cachers.AcceptsZstd(r.Header) {
+		if f, err := os.Open(path); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() >= cachers.DefaultCompressionMinSize {
+				w.Header().Set("Content-Encoding", "zstd")
+				zw := cachers.NewZstdWriter(w)
+				if _, err := io.Copy(zw, f); err != nil && s.verbose {
+					log.Printf("%s %s: %v", r.Method, r.RequestURI, err)
+				}
+				zw.Close()
+				return
+			}
+		}
+	}
+	http.ServeFile(w, r, path)
 }
 
 func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
@@ -177,11 +358,36 @@ func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad URI", http.StatusBadRequest)
 		return
 	}
-	if r.ContentLength == -1 {
-		http.Error(w, "missing Content-Length", http.StatusBadRequest)
+	size, body := r.ContentLength, io.Reader(r.Body)
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "":
+		if size == -1 {
+			http.Error(w, "missing Content-Length", http.StatusBadRequest)
+			return
+		}
+	case "zstd":
+		n, err := strconv.ParseInt(r.Header.Get("X-Gocache-Decoded-Size"), 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "missing X-Gocache-Decoded-Size", http.StatusBadRequest)
+			return
+		}
+		zr, err := cachers.NewZstdReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		// The decoded size is the client's word: don't decompress more.
+		size, body = n, io.LimitReader(zr, n+1)
+	default:
+		http.Error(w, "unsupported Content-Encoding "+enc, http.StatusUnsupportedMediaType)
+		return
+	}
+	_, err := s.cache.Put(ctx, actionID, outputID, size, body)
+	if errors.Is(err, cachers.ErrBadSignature) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	_, err := s.cache.Put(ctx, actionID, outputID, r.ContentLength, r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -189,6 +395,33 @@ func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *server) handlePutAction(w http.ResponseWriter, r *http.Request) {
+	actionID, ok := getHexSuffix(r, "/action/")
+	if !ok {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	body, err := readBody(r, 4<<10)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	var av cachers.ActionValue
+	if json.Unmarshal(body, &av) != nil || !validHex(av.OutputID) {
+		http.Error(w, "bad action value", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.cache.PutAction(r.Context(), actionID, av.OutputID, av.Size); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "output not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func OutputFilename(dir, outputID string) string {
 	if len(outputID) < 4 || len(outputID) > 1000 {
 		return ""
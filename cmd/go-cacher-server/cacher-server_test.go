@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestSignedBodies(t *testing.T) {
+	secret := []byte("s3cret")
+	s := &server{cache: cachers.NewSimpleDiskCache(false, t.TempDir()), hmacSecret: secret}
+	for _, outputID := range []string{"0011", "0022"} {
+		_, err := s.cache.Put(context.Background(), "aa"+outputID, outputID, 2, strings.NewReader("hi"))
+		require.NoError(t, err)
+	}
+	// sign returns the headers of a request signed by a client.
+	sign := func(method, path, body string) http.Header {
+		var header http.Header
+		rt := cachers.NewHMACTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			header = r.Header.Clone()
+			return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: r}, nil
+		}), secret, "")
+		req, err := http.NewRequest(method, "http://cache"+path, struct{ io.Reader }{strings.NewReader(body)})
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		return header
+	}
+	serve := func(method, path string, header http.Header, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header = header
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	put := `{"OutputID":"0011","Size":2}`
+	header := sign("PUT", "/action/aa11", put)
+	assert.Equal(t, http.StatusNoContent, serve("PUT", "/action/aa11", header, put))
+
+	// A replay binding the action to another output.
+	tampered := `{"OutputID":"0022","Size":2}`
+	assert.Equal(t, http.StatusUnauthorized, serve("PUT", "/action/aa11", header, tampered))
+	padded := tampered + strings.Repeat(" ", 8<<10)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("PUT", "/action/aa11", header, padded))
+	outputID, _, err := s.cache.Get(context.Background(), "aa11")
+	require.NoError(t, err)
+	assert.Equal(t, "0011", outputID)
+
+	exists := `{"ActionIDs":["aa11"]}`
+	header = sign("POST", "/exists", exists)
+	assert.Equal(t, http.StatusOK, serve("POST", "/exists", header, exists))
+	assert.Equal(t, http.StatusUnauthorized, serve("POST", "/exists", header, `{"ActionIDs":["aa22"]}`+" "))
+	big := `{"ActionIDs":["aa22"]}` + string(bytes.Repeat([]byte(" "), 2<<20))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve("POST", "/exists", header, big))
+}
+
+func TestCompressedPutSize(t *testing.T) {
+	dir := t.TempDir()
+	s := &server{cache: cachers.NewSimpleDiskCache(false, dir)}
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	put := func(outputID string, body []byte, decodedSize int) int {
+		r := httptest.NewRequest("PUT", "/aa11/"+outputID, bytes.NewReader(enc.EncodeAll(body, nil)))
+		r.Header.Set("Content-Encoding", "zstd")
+		r.Header.Set("X-Gocache-Decoded-Size", strconv.Itoa(decodedSize))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	body := bytes.Repeat([]byte("hello "), 1000)
+	assert.Equal(t, http.StatusNoContent, put("0011", body, len(body)))
+	got, err := os.ReadFile(filepath.Join(dir, "o-0011"))
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+
+	// A bomb claiming to be small, and a body claiming to be larger.
+	bomb := make([]byte, 64<<20)
+	assert.NotEqual(t, http.StatusNoContent, put("0022", bomb, 10))
+	assert.NotEqual(t, http.StatusNoContent, put("0033", body, len(body)+1))
+	for _, outputID := range []string{"0022", "0033"} {
+		_, err := os.Stat(filepath.Join(dir, "o-"+outputID))
+		assert.ErrorIs(t, err, os.ErrNotExist, "no output of the wrong size is left behind")
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		fi, err := e.Info()
+		require.NoError(t, err)
+		assert.Less(t, fi.Size(), int64(1<<20), e.Name())
+	}
+}
@@ -0,0 +1,39 @@
+// The go-cacher-stub is a GOCACHEPROG that connects cmd/go to a shared
+// daemon, "go-cacher serve", relaying the protocol between its stdin and stdout
+// and the daemon's Unix socket, or named pipe on Windows.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/bradfitz/go-tool-cache/internal/daemon"
+)
+
+func main() {
+	log.SetPrefix("go-cacher-stub: ")
+	log.SetFlags(0)
+	defaultAddr, err := daemon.Addr()
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := flag.String("socket", defaultAddr, "connect to the daemon on the Unix socket, or named pipe on Windows, at `path`")
+	flag.Parse()
+
+	conn, err := daemon.Dial(*addr)
+	if err != nil {
+		log.Fatalf("is go-cacher daemon running? %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		// cmd/go closes stdin when it is done; pass that on, so that the
+		// daemon ends the session.
+		_, _ = io.Copy(conn, os.Stdin)
+		_ = daemon.CloseWrite(conn)
+	}()
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const (
+	// auditFlushInterval is how often the records of an audit endpoint are
+	// posted.
+	auditFlushInterval = 5 * time.Second
+	// auditFlushSize is the size of the records above which they are posted
+	// right away.
+	auditFlushSize = 256 << 10
+	// auditPostTimeout bounds each post of records.
+	auditPostTimeout = 30 * time.Second
+)
+
+// withAuditLog returns remote wrapped to record its writes to the audit
+// log of GOCACHE_AUDIT_LOG, if set: a file the records are appended to,
+// or an http:// or https:// URL they are posted to.
+func withAuditLog(env Env, remote cachers.RemoteCache) (cachers.RemoteCache, error) {
+	v := env.Get(envVarAuditLog)
+	if v == "" {
+		return remote, nil
+	}
+	var w io.WriteCloser
+	if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+		client, err := proxyClient(env)
+		if err != nil {
+			return nil, err
+		}
+		w = newAuditPoster(v, client)
+	} else {
+		f, err := os.OpenFile(v, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarAuditLog, err)
+		}
+		w = f
+	}
+	return cachers.NewAuditRemoteCache(remote, w, auditIdentity(env), ciJob(env)), nil
+}
+
+// auditIdentity returns who writes to the remotes: GOCACHE_AUDIT_IDENTITY,
+// or else the actor of the CI job, or else user@host.
+func auditIdentity(env Env) string {
+	for _, key := range []string{envVarAuditIdentity, "GITHUB_ACTOR", "GITLAB_USER_LOGIN", "BUILDKITE_BUILD_CREATOR_EMAIL", "CIRCLE_USERNAME"} {
+		if v := env.Get(key); v != "" {
+			return v
+		}
+	}
+	var name string
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
+
+// ciJob returns the URL of the CI job go-cacher runs in, or its ID, or ""
+// outside of CI.
+func ciJob(env Env) string {
+	if id := env.Get("GITHUB_RUN_ID"); id != "" {
+		job := env.Get("GITHUB_SERVER_URL") + "/" + env.Get("GITHUB_REPOSITORY") + "/actions/runs/" + id
+		if attempt := env.Get("GITHUB_RUN_ATTEMPT"); attempt != "" {
+			job += "/attempts/" + attempt
+		}
+		return job
+	}
+	if u := env.Get("BUILDKITE_BUILD_URL"); u != "" {
+		return u + "#" + env.Get("BUILDKITE_JOB_ID")
+	}
+	for _, key := range []string{"CI_JOB_URL", "CIRCLE_BUILD_URL", "BUILD_URL", "CI_JOB_ID"} {
+		if v := env.Get(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// An auditPoster posts the audit records written to it to an endpoint, as
+// application/x-ndjson, in batches. Failed posts are logged and dropped,
+// so that an unavailable endpoint doesn't fail the builds.
+type auditPoster struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	flush  chan struct{}
+	done   chan struct{}
+	exited chan struct{}
+	stop   sync.Once
+}
+
+func newAuditPoster(url string, client *http.Client) *auditPoster {
+	p := &auditPoster{
+		url:    url,
+		client: client,
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Write buffers a record. The JSON encoder writes each in a single call.
+func (p *auditPoster) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf.Write(b)
+	if p.buf.Len() >= auditFlushSize {
+		select {
+		case p.flush <- struct{}{}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (p *auditPoster) run() {
+	defer close(p.exited)
+	t := time.NewTicker(auditFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.flush:
+		case <-p.done:
+			return
+		}
+		p.post()
+	}
+}
+
+// post posts the records buffered so far.
+func (p *auditPoster) post() {
+	p.mu.Lock()
+	body := bytes.Clone(p.buf.Bytes())
+	p.buf.Reset()
+	p.mu.Unlock()
+	if len(body) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditPostTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		var res *http.Response
+		res, err = p.client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				err = fmt.Errorf("unexpected status %s", res.Status)
+			}
+		}
+	}
+	if err != nil {
+		slog.Warn("failed to post audit records", "records", bytes.Count(body, []byte("\n")), "err", err)
+	}
+}
+
+// Close posts the records left.
+func (p *auditPoster) Close() error {
+	p.stop.Do(func() { close(p.done) })
+	<-p.exited
+	p.post()
+	return nil
+}
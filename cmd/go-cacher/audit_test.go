@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nopRemote is a RemoteCache storing nothing.
+type nopRemote struct{}
+
+func (nopRemote) Kind() string                    { return "nop" }
+func (nopRemote) Start(ctx context.Context) error { return nil }
+func (nopRemote) Close() error                    { return nil }
+func (nopRemote) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	return "", 0, nil, nil
+}
+func (nopRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return nil
+}
+
+func TestWithAuditLog(t *testing.T) {
+	ctx := context.Background()
+	githubEnv := map[string]string{
+		"GITHUB_ACTOR":       "octocat",
+		"GITHUB_SERVER_URL":  "https://github.com",
+		"GITHUB_REPOSITORY":  "o/r",
+		"GITHUB_RUN_ID":      "42",
+		"GITHUB_RUN_ATTEMPT": "2",
+	}
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		m := map[string]string{envVarAuditLog: path}
+		for k, v := range githubEnv {
+			m[k] = v
+		}
+		remote, err := withAuditLog(&mapEnv{m: m}, nopRemote{})
+		require.NoError(t, err)
+		require.NoError(t, remote.Put(ctx, "a1", "0123", 5, strings.NewReader("hello")))
+		require.NoError(t, remote.Close())
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var rec cachers.AuditRecord
+		require.NoError(t, json.Unmarshal(b, &rec))
+		assert.Equal(t, "a1", rec.ActionID)
+		assert.Equal(t, "octocat", rec.Identity)
+		assert.Equal(t, "https://github.com/o/r/actions/runs/42/attempts/2", rec.Job)
+	})
+
+	t.Run("endpoint", func(t *testing.T) {
+		var mu sync.Mutex
+		var got []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+			b, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			got = append(got, strings.Split(strings.TrimSpace(string(b)), "\n")...)
+			mu.Unlock()
+		}))
+		defer srv.Close()
+		remote, err := withAuditLog(&mapEnv{m: map[string]string{envVarAuditLog: srv.URL, envVarAuditIdentity: "deploy-bot"}}, nopRemote{})
+		require.NoError(t, err)
+		for _, id := range []string{"a1", "a2"} {
+			require.NoError(t, remote.Put(ctx, id, "0123", 5, strings.NewReader("hello")))
+		}
+		require.NoError(t, remote.Close())
+		require.Len(t, got, 2, "the records are posted on close")
+		assert.Contains(t, got[1], `"ActionID":"a2"`)
+		assert.Contains(t, got[1], `"Identity":"deploy-bot"`)
+	})
+
+	t.Run("off", func(t *testing.T) {
+		remote, err := withAuditLog(&mapEnv{m: map[string]string{}}, nopRemote{})
+		require.NoError(t, err)
+		assert.Equal(t, nopRemote{}, remote)
+	})
+}
+
+func TestCIJob(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"CI_JOB_URL": "https://gitlab.com/o/r/-/jobs/7", "CI_JOB_ID": "7"}, "https://gitlab.com/o/r/-/jobs/7"},
+		{map[string]string{"BUILDKITE_BUILD_URL": "https://buildkite.com/o/p/builds/3", "BUILDKITE_JOB_ID": "j1"}, "https://buildkite.com/o/p/builds/3#j1"},
+		{map[string]string{"BUILD_URL": "https://jenkins.example.com/job/go/5/"}, "https://jenkins.example.com/job/go/5/"},
+		{map[string]string{}, ""},
+	} {
+		assert.Equal(t, tc.want, ciJob(&mapEnv{m: tc.env}))
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"golang.org/x/sync/errgroup"
+)
+
+const benchUsage = `usage: go-cacher [flags] bench [-n count] [-size bytes] [-p parallelism]
+
+Bench measures the backends of the configuration: a local disk cache in a
+temporary directory next to the configured one, and each remote. It puts
+objects of random content under random action IDs, then gets them back,
+and reports for each backend and operation the throughput, the latency
+percentiles and the errors.
+
+The objects put in the remotes stay there, under action IDs no build will
+look up. In read-only mode, the remotes are only sent gets, which miss.
+
+`
+
+func runBench(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("bench", benchUsage)
+	n := fs.Int("n", 100, "number of puts, and of gets, for each backend")
+	sizearg := fs.String("size", "64KB", "size of the objects, like 512B or 1MB")
+	parallel := fs.Int("p", 8, "number of operations run at once")
+	_ = fs.Parse(args)
+	size, err := parseByteSize(*sizearg)
+	if err != nil {
+		return fmt.Errorf("-size: %w", err)
+	}
+	if *n <= 0 || *parallel <= 0 {
+		return errors.New("-n and -p must be positive")
+	}
+
+	dir := getDir(env)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dir, "bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	targets := []benchTarget{diskBenchTarget(cachers.NewSimpleDiskCache(false, tmp))}
+
+	remotes, err := benchRemotes(ctx, env)
+	if err != nil {
+		return err
+	}
+	ro, err := readOnly(env)
+	if err != nil {
+		return err
+	}
+	if !ro {
+		if ro, err = remotesReadOnly(env); err != nil {
+			return err
+		}
+	}
+	for _, r := range remotes {
+		if err := r.Start(ctx); err != nil {
+			return err
+		}
+		defer r.Close()
+		targets = append(targets, remoteBenchTarget(r, !ro))
+	}
+
+	for _, t := range targets {
+		for _, res := range bench(ctx, t, *n, size, *parallel) {
+			fmt.Println(res)
+		}
+	}
+	return nil
+}
+
+// benchRemotes returns each remote the configuration selects, without the
+// wrappers combining them.
+func benchRemotes(ctx context.Context, env Env) ([]cachers.RemoteCache, error) {
+	selected, err := backends(env)
+	if err != nil {
+		return nil, err
+	}
+	var remotes []cachers.RemoteCache
+	for _, b := range selected {
+		switch b {
+		case "http":
+			httpRemotes, err := httpCaches(env)
+			if err != nil {
+				return nil, err
+			}
+			remotes = append(remotes, httpRemotes...)
+		case "s3":
+			s3Cache, err := maybeS3Cache(ctx, env)
+			if err != nil {
+				return nil, err
+			}
+			if s3Cache != nil {
+				remotes = append(remotes, s3Cache)
+			}
+		}
+	}
+	return remotes, nil
+}
+
+// errBenchMiss is returned by the gets of a benchTarget that miss.
+var errBenchMiss = errors.New("miss")
+
+// A benchTarget is a backend measured by go-cacher bench.
+type benchTarget struct {
+	name string
+	// put stores body, or is nil for the backends that are only read.
+	put func(ctx context.Context, actionID, outputID string, body []byte) error
+	// get reads the body stored for actionID, returning its size.
+	get func(ctx context.Context, actionID string) (int64, error)
+}
+
+func diskBenchTarget(dc *cachers.SimpleDiskCache) benchTarget {
+	return benchTarget{
+		name: dc.Kind(),
+		put: func(ctx context.Context, actionID, outputID string, body []byte) error {
+			_, err := dc.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body))
+			return err
+		},
+		get: func(ctx context.Context, actionID string) (int64, error) {
+			outputID, path, err := dc.Get(ctx, actionID)
+			if err != nil {
+				return 0, err
+			}
+			if outputID == "" {
+				return 0, errBenchMiss
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return 0, err
+			}
+			defer f.Close()
+			return io.Copy(io.Discard, f)
+		},
+	}
+}
+
+func remoteBenchTarget(rc cachers.RemoteCache, write bool) benchTarget {
+	t := benchTarget{
+		name: rc.Kind(),
+		get: func(ctx context.Context, actionID string) (int64, error) {
+			outputID, _, output, err := rc.Get(ctx, actionID)
+			if err != nil {
+				return 0, err
+			}
+			if outputID == "" || output == nil {
+				return 0, errBenchMiss
+			}
+			defer output.Close()
+			return io.Copy(io.Discard, output)
+		},
+	}
+	if write {
+		t.put = func(ctx context.Context, actionID, outputID string, body []byte) error {
+			return rc.Put(ctx, actionID, outputID, int64(len(body)), bytes.NewReader(body))
+		}
+	}
+	return t
+}
+
+// A benchResult is the measure of one operation of a backend.
+type benchResult struct {
+	target, op     string
+	errors, misses int64
+	bytes          int64
+	elapsed        time.Duration
+	latencies      cacheproc.Latencies
+}
+
+func (r benchResult) String() string {
+	secs := r.elapsed.Seconds()
+	return fmt.Sprintf("%-6s %-3s %d ops, %.1f ops/s, %.2f MB/s, %v, %d errors, %d misses",
+		r.target, r.op, r.latencies.Count, float64(r.latencies.Count)/secs,
+		float64(r.bytes)/(1<<20)/secs, r.latencies, r.errors, r.misses)
+}
+
+// bench puts n objects of size bytes to t, unless it is read-only, then
+// gets them, running parallel operations at once.
+func bench(ctx context.Context, t benchTarget, n int, size int64, parallel int) []benchResult {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = randomHex(32)
+	}
+	var results []benchResult
+	if t.put != nil {
+		results = append(results, benchPhase(t.name, "put", n, parallel, func(i int) (int64, error) {
+			body := make([]byte, size)
+			_, _ = rand.Read(body)
+			sum := sha256.Sum256(body)
+			return size, t.put(ctx, keys[i], hex.EncodeToString(sum[:]), body)
+		}))
+	}
+	results = append(results, benchPhase(t.name, "get", n, parallel, func(i int) (int64, error) {
+		return t.get(ctx, keys[i])
+	}))
+	return results
+}
+
+// benchPhase runs do for 0 to n-1, parallel at once, and measures it.
+func benchPhase(target, op string, n, parallel int, do func(i int) (int64, error)) benchResult {
+	res := benchResult{target: target, op: op}
+	lat := make([]time.Duration, n)
+	var transferred, failed, missed atomic.Int64
+	var g errgroup.Group
+	g.SetLimit(parallel)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		i := i
+		g.Go(func() error {
+			t0 := time.Now()
+			size, err := do(i)
+			lat[i] = time.Since(t0)
+			switch {
+			case errors.Is(err, errBenchMiss):
+				missed.Add(1)
+			case err != nil:
+				failed.Add(1)
+			default:
+				transferred.Add(size)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	res.elapsed = time.Since(start)
+	res.bytes, res.errors, res.misses = transferred.Load(), failed.Load(), missed.Load()
+	res.latencies = percentiles(lat)
+	return res
+}
+
+// percentiles returns the percentiles of lat, which it sorts.
+func percentiles(lat []time.Duration) cacheproc.Latencies {
+	if len(lat) == 0 {
+		return cacheproc.Latencies{}
+	}
+	slices.Sort(lat)
+	q := func(q float64) time.Duration {
+		return lat[int(math.Ceil(q*float64(len(lat))))-1].Round(time.Microsecond)
+	}
+	return cacheproc.Latencies{Count: int64(len(lat)), P50: q(0.50), P95: q(0.95), P99: q(0.99)}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBench(t *testing.T) {
+	ctx := context.Background()
+	target := diskBenchTarget(cachers.NewSimpleDiskCache(false, t.TempDir()))
+	results := bench(ctx, target, 20, 1024, 4)
+	require.Len(t, results, 2)
+	for _, r := range results {
+		assert.EqualValues(t, 20, r.latencies.Count, r.op)
+		assert.Zero(t, r.errors, r.op)
+		assert.Zero(t, r.misses, r.op)
+		assert.EqualValues(t, 20*1024, r.bytes, r.op)
+	}
+	assert.True(t, strings.HasPrefix(results[0].String(), "disk   put 20 ops, "), results[0].String())
+
+	t.Run("read-only", func(t *testing.T) {
+		target.put = nil
+		results := bench(ctx, target, 5, 1024, 2)
+		require.Len(t, results, 1)
+		assert.Equal(t, "get", results[0].op)
+		assert.EqualValues(t, 5, results[0].misses)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		r := benchPhase("fake", "get", 4, 2, func(i int) (int64, error) {
+			if i%2 == 0 {
+				return 0, errors.New("boom")
+			}
+			return 10, nil
+		})
+		assert.EqualValues(t, 2, r.errors)
+		assert.EqualValues(t, 20, r.bytes)
+	})
+}
+
+func TestPercentiles(t *testing.T) {
+	var lat []time.Duration
+	for i := 100; i > 0; i-- {
+		lat = append(lat, time.Duration(i)*time.Millisecond)
+	}
+	l := percentiles(lat)
+	assert.EqualValues(t, 100, l.Count)
+	assert.Equal(t, 50*time.Millisecond, l.P50)
+	assert.Equal(t, 95*time.Millisecond, l.P95)
+	assert.Equal(t, 99*time.Millisecond, l.P99)
+	assert.Zero(t, percentiles(nil))
+}
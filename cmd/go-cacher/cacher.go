@@ -6,13 +6,28 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -20,6 +35,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bradfitz/go-tool-cache/cacheproc"
 	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
 )
 
 const (
@@ -31,6 +47,79 @@ const (
 	// path to local disk directory. defaults to os.UserCacheDir()/go-cacher
 	envVarDiskCacheDir = "GOCACHE_DISK_DIR"
 
+	// Maximum number of requests from cmd/go handled at once.
+	// Unset or 0 means unlimited.
+	envVarMaxConcurrency = "GOCACHE_MAX_CONCURRENCY"
+
+	// Put bodies larger than this (default 8MB) are spooled to temporary
+	// files in the disk cache directory instead of being held in memory.
+	// Same syntax as the bandwidth limits below.
+	envVarSpoolThreshold = "GOCACHE_SPOOL_THRESHOLD"
+
+	// Directory for the temporary files of put bodies being received, of
+	// the signed uploads and those written to the first remote that
+	// accepts them, and of the remote hits not stored in the local cache,
+	// instead of the disk cache directory, so that they can go to a tmpfs. Entries are still
+	// written in place through temporary files in the disk cache directory,
+	// to be renamed atomically.
+	envVarTempDir = "GOCACHE_TEMP_DIR"
+
+	// Minimum free space of the disk cache's file system, like "1GB",
+	// below which puts are refused so the build doesn't fill the disk.
+	// Unset means no minimum; puts are still refused for a while after
+	// one fails for lack of space.
+	envVarMinFreeSpace = "GOCACHE_MIN_FREE_SPACE"
+
+	// Longest time to handle each get, put and close request, like "30s".
+	// Requests that take longer fail, and cmd/go carries on without the
+	// cache entry. Unset means unlimited.
+	envVarGetTimeout   = "GOCACHE_GET_TIMEOUT"
+	envVarPutTimeout   = "GOCACHE_PUT_TIMEOUT"
+	envVarCloseTimeout = "GOCACHE_CLOSE_TIMEOUT"
+
+	// What to do when a get or put fails: "report" (default) answers it
+	// with the error, which cmd/go quietly ignores; "strict" ends the
+	// session, failing the build; "degrade" answers failed gets as misses.
+	envVarErrorMode = "GOCACHE_ERROR_MODE"
+
+	// How go-cacher reports the error it exits with: "text" (default), or
+	// "json", as an object with the error, its kind and the exit code.
+	envVarErrorFormat = "GOCACHE_ERROR_FORMAT"
+
+	// The DSN of a Sentry project, like "https://KEY@o1.ingest.sentry.io/42",
+	// to which the crashes and fatal errors of go-cacher, and the remotes
+	// failing GOCACHE_ERROR_REPORT_THRESHOLD times in a row, are reported
+	// as events. Like the credentials, it may be a reference to the secret.
+	envVarSentryDSN = "GOCACHE_SENTRY_DSN"
+	// An http:// or https:// endpoint to which the same reports are posted
+	// as JSON. Like the credentials, it may be a reference to the secret.
+	envVarErrorWebhook = "GOCACHE_ERROR_WEBHOOK"
+	// The number of failures in a row of a remote that are reported, once
+	// until it succeeds again (default 10).
+	envVarErrorReportThreshold = "GOCACHE_ERROR_REPORT_THRESHOLD"
+
+	// Set to 1 to answer every get as a miss and store no puts, only
+	// logging them and what they would have transferred.
+	envVarDryRun = "GOCACHE_DRY_RUN"
+
+	// Set to 1 to only read from the caches: cmd/go is told not to send
+	// puts, and nothing is written to the remotes.
+	envVarReadOnly = "GOCACHE_READONLY"
+
+	// The profile of the configuration files to use, whose settings
+	// override their others, like "work" for the "profiles: work:" map.
+	envVarProfile = "GOCACHE_PROFILE"
+
+	// A file of KEY=VALUE lines overriding these variables. It is read
+	// again, and the remote settings reloaded, on SIGHUP.
+	envVarEnvFile = "GOCACHE_ENV_FILE"
+
+	// The backends to use, in order, comma-separated: "disk", which always
+	// comes first, then any of "http" and "s3", each of which must be
+	// configured. Unset uses disk and the configured remote, S3 if both
+	// are: using both is to be asked for.
+	envVarBackends = "GOCACHE_BACKENDS"
+
 	// S3 cache
 	envVarS3CacheRegion        = "GOCACHE_AWS_REGION"
 	envVarS3CacheURL           = "GOCACHE_AWS_URL"
@@ -41,12 +130,287 @@ const (
 	envVarS3BucketName         = "GOCACHE_S3_BUCKET"
 	envVarS3Prefix             = "GOCACHE_S3_PREFIX"
 
+	// The ARN of a role to assume with the OIDC token of the CI job, like
+	// one GitHub Actions issues, so that no static secret is needed.
+	// GOCACHE_OIDC_TOKEN is the token, if not requested from GitHub
+	// Actions, and GOCACHE_OIDC_AUDIENCE the audience requested (default
+	// sts.amazonaws.com).
+	envVarS3AwsRoleArn = "GOCACHE_AWS_ROLE_ARN"
+	envVarOIDCToken    = "GOCACHE_OIDC_TOKEN"
+	envVarOIDCAudience = "GOCACHE_OIDC_AUDIENCE"
+
+	// Appended to the namespace of the remote keys, which is otherwise built
+	// from the Go version, GOOS/GOARCH and GOEXPERIMENT.
+	envVarKeySuffix = "GOCACHE_KEY_SUFFIX"
+
 	// HTTP cache - optional cache server HTTP prefix (scheme and authority only);
+	// several comma-separated servers may be given.
 	envVarHttpCacheServerBase = "GOCACHE_HTTP_SERVER_BASE"
+	// Bearer token sent to the HTTP cache servers.
+	envVarHttpToken = "GOCACHE_HTTP_TOKEN"
+	// Command run to get the credentials of each remote without a static
+	// token or keys, again when they expire, as described on
+	// credentialHelper.
+	envVarCredentialHelper = "GOCACHE_CREDENTIAL_HELPER"
+	// Secret shared with the HTTP cache servers, with which every request is
+	// signed, as go-cacher-server -hmac-secret-file checks.
+	envVarHttpHMACSecret = "GOCACHE_HTTP_HMAC_SECRET"
+
+	// Set to 1 to read the remotes with the usual credentials, or none for
+	// public caches, and to write them with separate ones: the token
+	// GOCACHE_HTTP_WRITE_TOKEN, and the static S3 credentials
+	// GOCACHE_AWS_WRITE_*. Without write credentials, like in CI jobs for
+	// pull requests from forks, nothing is written to the remotes.
+	envVarSplitCredentials       = "GOCACHE_SPLIT_CREDENTIALS"
+	envVarHttpWriteToken         = "GOCACHE_HTTP_WRITE_TOKEN"
+	envVarS3AwsWriteAccessKey    = "GOCACHE_AWS_WRITE_ACCESS_KEY"
+	envVarS3AwsWriteSecretKey    = "GOCACHE_AWS_WRITE_SECRET_ACCESS_KEY"
+	envVarS3AwsWriteSessionToken = "GOCACHE_AWS_WRITE_SESSION_TOKEN"
+
+	// How multiple remotes are used: reads are "ordered" (default) or "race",
+	// writes go to "all" (default) or the "first" one accepting them.
+	envVarRemoteReadMode  = "GOCACHE_REMOTE_READ_MODE"
+	envVarRemoteWriteMode = "GOCACHE_REMOTE_WRITE_MODE"
+
+	// Instead of using all remotes, send everything to the first healthy one,
+	// probing them every GOCACHE_REMOTE_HEALTH_INTERVAL (default 30s).
+	envVarRemoteFailover       = "GOCACHE_REMOTE_FAILOVER"
+	envVarRemoteHealthInterval = "GOCACHE_REMOTE_HEALTH_INTERVAL"
+
+	// Maximum number of simultaneous remote operations, shared by all
+	// remotes. Unset or 0 means unlimited. "auto" tunes it to what the
+	// remotes and the network take, from their latency and errors; "auto:64"
+	// does so up to 64.
+	envVarRemoteConcurrency = "GOCACHE_REMOTE_CONCURRENCY"
+
+	// How long the answers of the remotes are remembered across sessions, in
+	// the "remote-memo" file of the cache directory, as durations like "1h":
+	// an action they lacked is a miss without asking them again for
+	// GOCACHE_REMOTE_MEMO_MISSES, and the warming only asks about the actions
+	// not known to be stored for GOCACHE_REMOTE_MEMO_HITS. Unset means not
+	// remembered.
+	envVarRemoteMemoMisses = "GOCACHE_REMOTE_MEMO_MISSES"
+	envVarRemoteMemoHits   = "GOCACHE_REMOTE_MEMO_HITS"
+
+	// Faults to inject into the remote tier, for testing, as comma-separated
+	// settings: "latency=100ms,jitter=50ms,errors=0.1,corrupt=0.01,seed=1".
+	// errors and corrupt are the fractions of operations that fail and of
+	// hits whose body is corrupted.
+	envVarFaults = "GOCACHE_FAULTS"
+
+	// Bandwidth limits for the remote tier, in bytes per second.
+	// Accepts suffixes like "512KB" or "10MB". Unset or 0 means unlimited.
+	envVarRemoteUploadLimit   = "GOCACHE_REMOTE_UPLOAD_LIMIT"
+	envVarRemoteDownloadLimit = "GOCACHE_REMOTE_DOWNLOAD_LIMIT"
+
+	// Timeouts of the requests to the remotes, as durations like "10s":
+	// establishing a connection, waiting for each part of a response or for
+	// each part of a request body to be sent, and each remote operation as
+	// a whole, including reading the output of a hit. Unset means unlimited.
+	envVarTimeoutConnect = "GOCACHE_TIMEOUT_CONNECT"
+	envVarTimeoutRead    = "GOCACHE_TIMEOUT_READ"
+	envVarTimeoutWrite   = "GOCACHE_TIMEOUT_WRITE"
+	envVarTimeoutTotal   = "GOCACHE_TIMEOUT_TOTAL"
+
+	// The connection pool of the HTTP transport of the remotes. net/http
+	// keeps only 2 idle connections per host, so that beyond that every
+	// burst of cmd/go's parallel requests opens new ones: the maximum of
+	// connections per host (unlimited by default), of those kept idle (by
+	// default, the maximum of connections if set), and how long they are
+	// kept, like "90s" (default).
+	envVarHTTPMaxConns     = "GOCACHE_HTTP_MAX_CONNS_PER_HOST"
+	envVarHTTPMaxIdleConns = "GOCACHE_HTTP_MAX_IDLE_CONNS_PER_HOST"
+	envVarHTTPIdleTimeout  = "GOCACHE_HTTP_IDLE_TIMEOUT"
+	// Set to 0 to speak only HTTP/1.1 to the remotes, over the connections
+	// of the pool, rather than to multiplex the requests over one HTTP/2
+	// connection to the TLS servers that speak it, which is the default.
+	envVarHTTP2 = "GOCACHE_HTTP2"
+
+	// Only entries with bodies within these bounds are uploaded to the remote
+	// tier; all entries are still stored locally. Same syntax as the limits above.
+	envVarRemoteMinUploadSize = "GOCACHE_REMOTE_MIN_UPLOAD_SIZE"
+	envVarRemoteMaxUploadSize = "GOCACHE_REMOTE_MAX_UPLOAD_SIZE"
+
+	// Upload to the remote tier in the background with this many workers,
+	// instead of while cmd/go waits for each put.
+	envVarAsyncUploads = "GOCACHE_ASYNC_UPLOADS"
+	// Set to 0 to not persist remote hits in the local disk cache; they are
+	// kept in a temporary directory until the end of the session instead.
+	envVarPopulateLocal = "GOCACHE_POPULATE_LOCAL"
+	// Number of attempts for each remote upload, including the first
+	// (default 3). Set to 1 to not retry failed uploads.
+	envVarUploadMaxAttempts = "GOCACHE_UPLOAD_MAX_ATTEMPTS"
+	// Delay before the first retry of a failed upload (default 1s). It
+	// doubles with every further attempt, up to 30s.
+	envVarUploadRetryDelay = "GOCACHE_UPLOAD_RETRY_DELAY"
+	// How long to wait for queued background uploads on exit (default 30s).
+	// Unfinished ones are uploaded by the next session.
+	envVarUploadDrainTimeout = "GOCACHE_UPLOAD_DRAIN_TIMEOUT"
+
+	// Set to 1 to use only the local cache for the session, or to "auto" to
+	// do so when the remote can't be reached at startup.
+	envVarOffline = "GOCACHE_OFFLINE"
+
+	// Set to "fail" to probe the remote at startup, checking that it can be
+	// reached and entries read and written, and exit with the reason if it
+	// can't; or to "warn" to log it and use only the local cache instead.
+	envVarSelfCheck = "GOCACHE_SELF_CHECK"
+
+	// Logs are written to stderr as "text" (default) or "json", from the
+	// level "info" (default; "debug" with -verbose), "debug", "warn" or "error".
+	envVarLogFormat = "GOCACHE_LOG_FORMAT"
+	envVarLogLevel  = "GOCACHE_LOG_LEVEL"
+	// Set to 1, as --quiet does, to log only errors, so that a cache that
+	// works leaves nothing in the build logs.
+	envVarQuiet = "GOCACHE_QUIET"
+
+	// File to write the logs to instead of stderr, for a long-lived daemon.
+	// It is rotated when it would grow past GOCACHE_LOG_MAX_SIZE (default
+	// 10MB), or after GOCACHE_LOG_MAX_AGE, like "24h", if set, keeping the
+	// GOCACHE_LOG_BACKUPS (default 5) newest previous files.
+	envVarLogFile    = "GOCACHE_LOG_FILE"
+	envVarLogMaxSize = "GOCACHE_LOG_MAX_SIZE"
+	envVarLogMaxAge  = "GOCACHE_LOG_MAX_AGE"
+	envVarLogBackups = "GOCACHE_LOG_BACKUPS"
+
+	// Address, like "localhost:6060", to serve expvar counters and pprof on
+	// while the session runs.
+	envVarDebugAddr = "GOCACHE_DEBUG_ADDR"
+
+	// Address, like "localhost:8086", to serve the /healthz and /readyz
+	// probes of go-cacher serve on, and how many uploads and retries may be
+	// queued (default 4096, the size of the upload queue) before the daemon
+	// isn't ready.
+	envVarHealthAddr     = "GOCACHE_HEALTH_ADDR"
+	envVarHealthMaxQueue = "GOCACHE_HEALTH_MAX_QUEUE"
+
+	// Address, like "localhost:9090", to serve Prometheus metrics at
+	// /metrics on while the session runs, and the URL of a Pushgateway to
+	// push them to, for sessions too short to be scraped.
+	envVarMetricsAddr    = "GOCACHE_METRICS_ADDR"
+	envVarMetricsPushURL = "GOCACHE_METRICS_PUSH_URL"
+	// How often, like "30s", the metrics are sent to the Pushgateway and
+	// StatsD (default 10s); they are sent a last time when the session
+	// ends.
+	envVarMetricsInterval = "GOCACHE_METRICS_INTERVAL"
+	// The comma-separated labels of the metrics to keep, among cmd, tier,
+	// kind, op and class (the default), and namespace, the namespace of the
+	// remote keys, which is off by default. The samples of the labels left
+	// out are aggregated.
+	envVarMetricsLabels = "GOCACHE_METRICS_LABELS"
+	// How many series of labels each metric has at most (default 100); the
+	// samples of the others are aggregated into a series whose labels are
+	// "other".
+	envVarMetricsMaxSeries = "GOCACHE_METRICS_MAX_SERIES"
+
+	// Address of a StatsD server, like "localhost:8125", to send the metrics
+	// to over UDP, with GOCACHE_STATSD_PREFIX (default "gocacher.") before
+	// their names. GOCACHE_STATSD_FORMAT "dogstatsd" sends the labels and
+	// the comma-separated GOCACHE_STATSD_TAGS, like "env:ci", as DogStatsD
+	// tags, instead of the default "statsd", which folds the labels into
+	// the names.
+	envVarStatsdAddr   = "GOCACHE_STATSD_ADDR"
+	envVarStatsdPrefix = "GOCACHE_STATSD_PREFIX"
+	envVarStatsdFormat = "GOCACHE_STATSD_FORMAT"
+	envVarStatsdTags   = "GOCACHE_STATSD_TAGS"
+
+	// Where to report the summary of the session on exit: "stderr", which
+	// --summary alone sets, or the path of a file to write it to as JSON,
+	// for CI jobs to record how effective the cache was.
+	envVarSummary = "GOCACHE_SUMMARY"
+
+	// How often, like "30s", to log a line of the stats of the session so
+	// far during long builds: the hits, the misses, the requests in flight,
+	// the background queues and the bytes transferred. Off by default.
+	envVarProgressInterval = "GOCACHE_PROGRESS_INTERVAL"
+
+	// File to append a record of every get and put to, one JSON object per
+	// line with its action ID, result, tier, size and duration, for the
+	// offline analysis of hit patterns and of the size a cache needs.
+	envVarEventLog = "GOCACHE_EVENT_LOG"
+
+	// Duration, like "2s", above which any single operation of a backend is
+	// logged as a warning, with the backend and the key, so that a
+	// misbehaving endpoint stands out in the build logs. Off by default.
+	envVarSlowThreshold = "GOCACHE_SLOW_THRESHOLD"
+
+	// How the bodies sent to the remotes are compressed: "auto" (default),
+	// with zstd for the cacher servers that accept it and s2 for S3; "zstd",
+	// with zstd for S3 too, whose objects older versions of go-cacher then
+	// can't read; or "off".
+	envVarCompression = "GOCACHE_COMPRESSION"
+	// The size, like "8KB" (default), under which bodies are sent as they
+	// are.
+	envVarCompressionMinSize = "GOCACHE_COMPRESSION_MIN_SIZE"
+
+	// The size, like "64MB" (default), above which the remote objects are
+	// downloaded in ranges fetched concurrently, to a preallocated file in
+	// GOCACHE_TEMP_DIR or the disk cache directory. "0" turns it off.
+	envVarRangedThreshold = "GOCACHE_RANGED_DOWNLOAD_THRESHOLD"
+	// The number of ranges of a ranged download (default 4).
+	envVarRangedParts = "GOCACHE_RANGED_DOWNLOAD_PARTS"
+
+	// A 256-bit key, in base64 or hex, with which the bodies put to the
+	// remotes are encrypted, and those got decrypted, so that the storage
+	// provider can't read them. Like the credentials, it may be a
+	// reference to the secret, like "exec:" a command decrypting it with
+	// a KMS.
+	envVarEncryptionKey = "GOCACHE_ENCRYPTION_KEY"
+
+	// The ID, ARN or alias of an AWS KMS key with which the bodies put to
+	// the remotes are envelope-encrypted: each is encrypted with a data key
+	// KMS generates, stored wrapped with it, so that the clients only need
+	// the right to use the key, which can be rotated or revoked. Exclusive
+	// with GOCACHE_ENCRYPTION_KEY.
+	envVarKMSKeyID = "GOCACHE_KMS_KEY_ID"
+
+	// An ed25519 private key, as PEM or its 32-byte seed in base64 or hex,
+	// with which the entries put to the remotes are signed. Like the
+	// credentials, it may be a reference to the secret.
+	envVarSigningKey = "GOCACHE_SIGNING_KEY"
+	// The ed25519 public keys, comma-separated, in base64 or hex, or as PEM,
+	// whose signatures are accepted on the entries got from the remotes,
+	// besides that of GOCACHE_SIGNING_KEY. Setting them makes every entry not
+	// signed by one of them a miss, and without GOCACHE_SIGNING_KEY the
+	// remotes are only read.
+	envVarSigningTrustedKeys = "GOCACHE_SIGNING_TRUSTED_KEYS"
+
+	// A file, or an http:// or https:// endpoint, to which every write to
+	// the remotes is recorded as a line of JSON, with its key, size, time,
+	// identity and CI job, so that the operators of a shared cache can
+	// trace where its entries came from.
+	envVarAuditLog = "GOCACHE_AUDIT_LOG"
+	// Who writes to the remotes, for the audit log. By default, the actor of
+	// the CI job, or user@host.
+	envVarAuditIdentity = "GOCACHE_AUDIT_IDENTITY"
+
+	// Comma-separated key=value tags, like "team=build,pipeline=$CI_PIPELINE_ID",
+	// attached to the metadata of every write to the remotes and to every
+	// metric as labels, to attribute the costs and hit rates of a shared
+	// cache. $VAR and ${VAR} in the values are replaced with the settings
+	// or environment variables they name.
+	envVarTags = "GOCACHE_TAGS"
+
+	// A PEM bundle of CAs the remotes are trusted with, besides the system
+	// roots, for private CAs and TLS-intercepting proxies.
+	envVarTLSCAFile = "GOCACHE_TLS_CA_FILE"
+	// Comma-separated pins, "sha256/" and the base64 of the SHA-256 of a
+	// SubjectPublicKeyInfo, one of which a certificate of the chain of the
+	// remotes must have.
+	envVarTLSPins = "GOCACHE_TLS_PINS"
+
+	// The URL of a proxy, http://, https://, socks5:// or socks5h://, for
+	// all the requests of go-cacher, besides those to the hosts of NO_PROXY.
+	// Without it, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored.
+	envVarProxy = "GOCACHE_PROXY"
 )
 
 var (
-	verbose = flag.Bool("verbose", false, "be verbose")
+	verbose    = flag.Bool("verbose", false, "be verbose")
+	missLog    = flag.String("miss-log", "", "append every cache miss to this file, one JSON object per line")
+	record     = flag.String("record", "", "record the session to this file, for go-cacher replay")
+	version    = flag.Bool("version", false, "print the version and build metadata, like go-cacher version")
+	configFile = flag.String("config", "", "read settings from this YAML file (default $XDG_CONFIG_HOME/go-cacher/config.yaml); the environment overrides them")
 )
 
 type Env interface {
@@ -65,24 +429,53 @@ func getAwsConfigFromEnv(ctx context.Context, env Env) (*aws.Config, error) {
 	if awsRegion == "" {
 		awsRegion = "us-east-1"
 	}
+	opts := []func(*config.LoadOptions) error{config.WithRegion(awsRegion)}
+	if env.Get(envVarProxy) != "" {
+		client, err := proxyClient(env)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, config.WithHTTPClient(client))
+	}
 	accessKey := env.Get(envVarS3AwsAccessKey)
 	secretAccessKey := env.Get(envVarS3AwsSecretAccessKey)
 	sessionToken := env.Get(envVarS3AwsSessionToken)
 	if accessKey != "" && secretAccessKey != "" || sessionToken != "" {
-		cfg, err := config.LoadDefaultConfig(ctx,
-			config.WithRegion(awsRegion),
+		cfg, err := config.LoadDefaultConfig(ctx, append(opts,
 			config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
 				Value: aws.Credentials{
 					AccessKeyID:     accessKey,
 					SecretAccessKey: secretAccessKey,
 					SessionToken:    sessionToken,
 				},
-			}))
+			}))...)
+		return &cfg, err
+	}
+	if h, err := newCredentialHelper(env, "s3://"+env.Get(envVarS3BucketName)); err != nil {
+		return nil, err
+	} else if h != nil {
+		provider := aws.NewCredentialsCache(h, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = credentialRefreshMargin
+		})
+		cfg, err := config.LoadDefaultConfig(ctx, append(opts, config.WithCredentialsProvider(provider))...)
 		return &cfg, err
 	}
+	if env.Get(envVarS3AwsRoleArn) != "" {
+		cfg, err := config.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Credentials = oidcCredentials(env, cfg)
+		return &cfg, nil
+	}
 	credsProfile := env.Get(envVarS3AwsCredsProfile)
 	if credsProfile != "" {
-		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(awsRegion), config.WithSharedConfigProfile(credsProfile))
+		cfg, err := config.LoadDefaultConfig(ctx, append(opts, config.WithSharedConfigProfile(credsProfile))...)
+		return &cfg, err
+	}
+	if split, _ := splitCredentials(env); split {
+		// Public caches are read anonymously.
+		cfg, err := config.LoadDefaultConfig(ctx, append(opts, config.WithCredentialsProvider(aws.AnonymousCredentials{}))...)
 		return &cfg, err
 	}
 	return nil, errors.New("no s3 credentials found")
@@ -103,49 +496,936 @@ func maybeS3Cache(ctx context.Context, env Env) (cachers.RemoteCache, error) {
 	if prefix == "" {
 		prefix = defaultPrefix
 	}
+	prefix = path.Join(prefix, namespace(currentToolchain(ctx, env), env.Get(envVarKeySuffix)))
 
-	s3Client := s3.NewFromConfig(*awsConfig, func(o *s3.Options) {
-		if u := env.Get(envVarS3CacheURL); u != "" {
-			// Custom URL, use path style.
-			o.UsePathStyle = true
-			o.BaseEndpoint = &u
-		}
-	},
-	)
-	s3Cache := cachers.NewS3Cache(s3Client, bucket, prefix, *verbose)
-	return s3Cache, nil
+	httpClient, err := remoteHTTPClient(env)
+	if err != nil {
+		return nil, err
+	}
+	newClient := func(cfg *aws.Config) *s3.Client {
+		return s3.NewFromConfig(*cfg, func(o *s3.Options) {
+			if u := env.Get(envVarS3CacheURL); u != "" {
+				// Custom URL, use path style.
+				o.UsePathStyle = true
+				o.BaseEndpoint = &u
+			}
+			if httpClient != nil {
+				o.HTTPClient = httpClient
+			}
+		})
+	}
+	// The remotes can't compress ciphertext: the encryption compresses the
+	// bodies before encrypting them.
+	compression, err := remoteCompression(env)
+	if err != nil {
+		return nil, err
+	}
+	ranged, err := rangedDownloads(env)
+	if err != nil {
+		return nil, err
+	}
+	s3Cache := cachers.NewS3Cache(newClient(awsConfig), bucket, prefix, *verbose)
+	s3Cache.SetCompression(compression)
+	s3Cache.SetRangedDownloads(ranged)
+	if split, err := splitCredentials(env); err != nil || !split {
+		return s3Cache, err
+	}
+	writeConfig, err := s3WriteConfig(ctx, env, awsConfig.Region)
+	if err != nil || writeConfig == nil {
+		return s3Cache, err
+	}
+	writeCache := cachers.NewS3Cache(newClient(writeConfig), bucket, prefix, *verbose)
+	writeCache.SetCompression(compression)
+	return cachers.NewSplitRemoteCache(s3Cache, writeCache), nil
+}
+
+// reloadFunc applies the remote settings of env to a running cache.
+type reloadFunc func(ctx context.Context, env Env) error
+
+func getCache(ctx context.Context, env Env, verbose bool) (cachers.LocalCache, reloadFunc) {
+	cache, reload := getBaseCache(ctx, env, verbose)
+	return cachers.NewSingleflightCache(cache), reload
 }
 
-func getCache(ctx context.Context, env Env, verbose bool) cachers.LocalCache {
+// getBaseCache returns the cache configured in env and, if it has a remote
+// tier, the function reloading the remote settings.
+func getBaseCache(ctx context.Context, env Env, verbose bool) (cachers.LocalCache, reloadFunc) {
+	if dir := env.Get(envVarTempDir); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fatal(fmt.Errorf("%s: %w", envVarTempDir, err))
+		}
+	}
+	if dry, err := dryRun(env); err != nil {
+		fatal(configErr(err))
+	} else if dry {
+		return cachers.NewDryRunCache(), nil
+	}
 	dir := getDir(env)
 	var local cachers.LocalCache = cachers.NewSimpleDiskCache(verbose, dir)
+	if slow, err := slowThreshold(env); err != nil {
+		fatal(configErr(err))
+	} else if slow > 0 {
+		local = cachers.NewSlowLogLocalCache(local, dir, slow)
+	}
 
-	remote, err := maybeS3Cache(ctx, env)
+	remote, err := maybeRemoteCache(ctx, env)
 	if err != nil {
-		log.Fatal(err)
+		fatal(configErr(err))
+	}
+	if remote, err = maybeOffline(ctx, env, remote); err != nil {
+		fatal(configErr(err))
+	}
+	if remote, err = maybeSelfCheck(ctx, env, remote); err != nil {
+		fatal(err)
 	}
 	if remote == nil {
-		remote, err = maybeHttpCache(env)
+		return cachers.NewLocalCacheWithCounts(local, "local", verbose), nil
+	}
+	reloadable := cachers.NewReloadableRemoteCache(remote)
+	cache, err := newTieredCache(env, dir, local, reloadable, verbose)
+	if err != nil {
+		fatal(configErr(err))
+	}
+	reload := func(ctx context.Context, env Env) error {
+		policy, err := remoteTierPolicy(env)
+		if err != nil {
+			return err
+		}
+		remote, err := maybeRemoteCache(ctx, env)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		if remote == nil {
+			return errors.New("no remote cache configured")
 		}
+		if err := reloadable.Swap(remote); err != nil {
+			return err
+		}
+		return cache.SetTierPolicy(1, policy)
+	}
+	if verbose {
+		return cachers.NewLocalCacheStates(cache), reload
 	}
+	return cache, reload
+}
 
-	if remote != nil {
-		return cachers.NewCombinedCache(local, remote, verbose)
+// backends returns the backends env selects, in order: those listed in
+// GOCACHE_BACKENDS, or disk and the configured remote, S3 rather than HTTP
+// if both are (see httpIgnored).
+func backends(env Env) ([]string, error) {
+	v := env.Get(envVarBackends)
+	if v == "" {
+		backends := []string{"disk"}
+		switch {
+		case env.Get(envVarS3BucketName) != "":
+			backends = append(backends, "s3")
+		case env.Get(envVarHttpCacheServerBase) != "":
+			backends = append(backends, "http")
+		}
+		return backends, nil
 	}
-	if verbose {
-		return cachers.NewLocalCacheStates(local)
+	var backends []string
+	seen := map[string]bool{}
+	for _, b := range strings.Split(v, ",") {
+		b = strings.ToLower(strings.TrimSpace(b))
+		switch b {
+		case "disk", "http", "s3":
+		default:
+			return nil, fmt.Errorf("%s: unknown backend %q; want disk, http or s3", envVarBackends, b)
+		}
+		if seen[b] {
+			return nil, fmt.Errorf("%s: %s listed twice", envVarBackends, b)
+		}
+		seen[b] = true
+		backends = append(backends, b)
+	}
+	if backends[0] != "disk" {
+		return nil, fmt.Errorf("%s: must start with disk, which is always in front of the remotes", envVarBackends)
+	}
+	if seen["http"] && env.Get(envVarHttpCacheServerBase) == "" {
+		return nil, fmt.Errorf("%s: http selected but %s is not set", envVarBackends, envVarHttpCacheServerBase)
+	}
+	if seen["s3"] && env.Get(envVarS3BucketName) == "" {
+		return nil, fmt.Errorf("%s: s3 selected but %s is not set", envVarBackends, envVarS3BucketName)
 	}
-	return local
+	return backends, nil
+}
+
+// httpIgnored reports whether the configured HTTP servers are left out by
+// default, S3 being configured too.
+func httpIgnored(env Env) bool {
+	return env.Get(envVarBackends) == "" && env.Get(envVarS3BucketName) != "" && env.Get(envVarHttpCacheServerBase) != ""
+}
+
+// maybeRemoteCache returns the selected remotes combined into one, in the
+// order of backends, or nil if there are none. HTTP servers are used in the
+// order given.
+func maybeRemoteCache(ctx context.Context, env Env) (cachers.RemoteCache, error) {
+	selected, err := backends(env)
+	if err != nil {
+		return nil, err
+	}
+	if httpIgnored(env) {
+		slog.Warn("both S3 and HTTP are configured; ignoring HTTP unless both are listed in "+envVarBackends, "servers", env.Get(envVarHttpCacheServerBase))
+	}
+	var remotes []cachers.RemoteCache
+	for _, b := range selected {
+		switch b {
+		case "http":
+			httpRemotes, err := httpCaches(env)
+			if err != nil {
+				return nil, err
+			}
+			remotes = append(remotes, httpRemotes...)
+		case "s3":
+			s3Cache, err := maybeS3Cache(ctx, env)
+			if err != nil {
+				return nil, err
+			}
+			if s3Cache != nil {
+				if slow, err := slowThreshold(env); err != nil {
+					return nil, err
+				} else if slow > 0 {
+					s3Cache = cachers.NewSlowLogRemoteCache(s3Cache, "s3://"+env.Get(envVarS3BucketName), slow)
+				}
+				remotes = append(remotes, s3Cache)
+			}
+		}
+	}
+	// Each remote backs off on its own when it throttles, and is reported
+	// on its own when it keeps failing.
+	for i, r := range remotes {
+		remotes[i] = cachers.NewThrottleRemoteCache(r)
+	}
+	reporter, err := newErrorReporter(env)
+	if err != nil {
+		return nil, err
+	}
+	remotes = reporter.withFailureReports(remotes)
+	remote, err := combineRemotes(env, remotes)
+	if err != nil || remote == nil {
+		return nil, err
+	}
+	if env.Get(envVarEncryptionKey) != "" && env.Get(envVarKMSKeyID) != "" {
+		return nil, fmt.Errorf("%s and %s are exclusive", envVarEncryptionKey, envVarKMSKeyID)
+	}
+	compression, err := remoteCompression(env)
+	if err != nil {
+		return nil, err
+	}
+	if v := env.Get(envVarKMSKeyID); v != "" {
+		kms, err := newAWSKMS(ctx, env, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarKMSKeyID, err)
+		}
+		envelope := cachers.NewEnvelopeRemoteCache(remote, kms)
+		envelope.SetCompression(compression)
+		remote = envelope
+	}
+	if v := env.Get(envVarEncryptionKey); v != "" {
+		key, err := parseEncryptionKey(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarEncryptionKey, err)
+		}
+		encrypted, err := cachers.NewEncryptedRemoteCache(remote, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarEncryptionKey, err)
+		}
+		encrypted.SetCompression(compression)
+		remote = encrypted
+	}
+	if remote, err = withSigning(env, remote); err != nil {
+		return nil, err
+	}
+	if remote, err = withAuditLog(env, remote); err != nil {
+		return nil, err
+	}
+	if tags, err := parseTags(env); err != nil {
+		return nil, err
+	} else if len(tags) > 0 {
+		remote = cachers.NewTaggedRemoteCache(remote, tags)
+	}
+	if v := env.Get(envVarFaults); v != "" {
+		cfg, err := parseFaults(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarFaults, err)
+		}
+		slog.Warn("injecting faults into the remote cache", "faults", v)
+		remote = cachers.NewFaultyRemoteCache(remote, cfg)
+	}
+	if v := env.Get(envVarTimeoutTotal); v != "" {
+		d, err := parseDuration(v, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarTimeoutTotal, err)
+		}
+		remote = cachers.NewTimeoutRemoteCache(remote, d)
+	}
+	if remote, err = withConcurrencyLimit(env, remote); err != nil {
+		return nil, err
+	}
+	return withMemo(env, remote)
+}
+
+// withConcurrencyLimit returns remote wrapped to limit its simultaneous
+// operations to GOCACHE_REMOTE_CONCURRENCY, if set: a number, or "auto" or
+// "auto:<max>" for a limit tuned as the session goes.
+func withConcurrencyLimit(env Env, remote cachers.RemoteCache) (cachers.RemoteCache, error) {
+	v := env.Get(envVarRemoteConcurrency)
+	if v == "" {
+		return remote, nil
+	}
+	invalid := fmt.Errorf("%s: invalid limit %q", envVarRemoteConcurrency, v)
+	if auto, ok := strings.CutPrefix(v, "auto"); ok {
+		var limits cachers.AdaptiveLimits
+		if auto != "" {
+			n, ok := strings.CutPrefix(auto, ":")
+			var err error
+			if limits.Max, err = strconv.Atoi(n); !ok || err != nil || limits.Max <= 0 {
+				return nil, invalid
+			}
+		}
+		return cachers.NewAdaptiveRemoteCache(remote, limits), nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return nil, invalid
+	}
+	if limit == 0 {
+		return remote, nil
+	}
+	return cachers.NewConcurrencyLimitedRemoteCache(remote, limit), nil
+}
+
+// parseEncryptionKey parses the GOCACHE_ENCRYPTION_KEY setting, 32 bytes
+// in hex or in standard or URL base64, with or without padding.
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 64 {
+		if key, err := hex.DecodeString(s); err == nil {
+			return key, nil
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil {
+			if len(key) != 32 {
+				return nil, fmt.Errorf("key of %d bytes; want 32", len(key))
+			}
+			return key, nil
+		}
+	}
+	return nil, errors.New("want 32 bytes in hex or base64")
+}
+
+// parseFaults parses the GOCACHE_FAULTS settings.
+func parseFaults(s string) (cachers.FaultConfig, error) {
+	var cfg cachers.FaultConfig
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return cfg, fmt.Errorf("want key=value, got %q", kv)
+		}
+		var err error
+		switch k {
+		case "latency":
+			cfg.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			cfg.Jitter, err = time.ParseDuration(v)
+		case "errors":
+			cfg.ErrorRate, err = parseRate(v)
+		case "corrupt":
+			cfg.CorruptRate, err = parseRate(v)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(v, 10, 64)
+		default:
+			return cfg, fmt.Errorf("unknown fault %q", k)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return cfg, nil
+}
+
+// parseRate parses a fraction between 0 and 1.
+func parseRate(s string) (float64, error) {
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if r < 0 || r > 1 {
+		return 0, fmt.Errorf("rate %v not between 0 and 1", r)
+	}
+	return r, nil
+}
+
+// offlineProbeTimeout bounds the reachability check of GOCACHE_OFFLINE=auto.
+const offlineProbeTimeout = 3 * time.Second
+
+// maybeOffline returns nil instead of remote if GOCACHE_OFFLINE says to
+// work offline, so that a session without network doesn't wait for a
+// timeout on every action.
+func maybeOffline(ctx context.Context, env Env, remote cachers.RemoteCache) (cachers.RemoteCache, error) {
+	v := env.Get(envVarOffline)
+	if remote == nil || v == "" {
+		return remote, nil
+	}
+	if strings.EqualFold(v, "auto") {
+		hc, ok := remote.(cachers.HealthChecker)
+		if !ok {
+			return remote, nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, offlineProbeTimeout)
+		defer cancel()
+		if err := hc.HealthCheck(ctx); err != nil {
+			slog.Warn("remote cache unreachable, working offline", "cache", remote.Kind(), "err", err)
+			return nil, nil
+		}
+		return remote, nil
+	}
+	offline, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: want a boolean or \"auto\", got %q", envVarOffline, v)
+	}
+	if offline {
+		return nil, nil
+	}
+	return remote, nil
+}
+
+// selfCheckTimeout bounds the startup self-check of GOCACHE_SELF_CHECK.
+const selfCheckTimeout = 10 * time.Second
+
+// maybeSelfCheck probes remote if GOCACHE_SELF_CHECK says to. It returns
+// the reason the remote doesn't work, or nil instead of remote to only use
+// the local cache, depending on the setting.
+func maybeSelfCheck(ctx context.Context, env Env, remote cachers.RemoteCache) (cachers.RemoteCache, error) {
+	v := strings.ToLower(env.Get(envVarSelfCheck))
+	if remote == nil || v == "" {
+		return remote, nil
+	}
+	if v != "fail" && v != "warn" {
+		return nil, configErr(fmt.Errorf("%s: want \"fail\" or \"warn\", got %q", envVarSelfCheck, v))
+	}
+	ro, err := readOnly(env)
+	if err == nil && !ro {
+		ro, err = remotesReadOnly(env)
+	}
+	if err != nil {
+		return nil, configErr(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	if err := cachers.SelfCheck(ctx, remote, !ro); err != nil {
+		if v == "fail" {
+			return nil, err
+		}
+		slog.Warn("remote cache failed its self-check, using only the local cache", "cache", remote.Kind(), "err", err)
+		return nil, nil
+	}
+	return remote, nil
+}
+
+// remoteTierPolicy returns the policy of the remote tier configured in env.
+func remoteTierPolicy(env Env) (cachers.TierPolicy, error) {
+	var p cachers.TierPolicy
+	var err error
+	if p.MinPutSize, err = parseByteSize(env.Get(envVarRemoteMinUploadSize)); err != nil {
+		return p, fmt.Errorf("%s: %w", envVarRemoteMinUploadSize, err)
+	}
+	if p.MaxPutSize, err = parseByteSize(env.Get(envVarRemoteMaxUploadSize)); err != nil {
+		return p, fmt.Errorf("%s: %w", envVarRemoteMaxUploadSize, err)
+	}
+	if p.ReadOnly, err = readOnly(env); err != nil {
+		return p, err
+	}
+	if !p.ReadOnly {
+		if p.ReadOnly, err = remotesReadOnly(env); err != nil {
+			return p, err
+		}
+	}
+	if !p.ReadOnly {
+		p.ReadOnly = verifyOnly(env)
+	}
+	return p, nil
+}
+
+// newTieredCache chains the local and remote caches with the policies
+// configured in env.
+func newTieredCache(env Env, dir string, local cachers.LocalCache, remote cachers.RemoteCache, verbose bool) (*cachers.TieredCache, error) {
+	remotePolicy, err := remoteTierPolicy(env)
+	if err != nil {
+		return nil, err
+	}
+	if ro, _ := remotesReadOnly(env); ro {
+		slog.Info("no write credentials; only reading the remotes", "cache", remote.Kind())
+	}
+	if verifyOnly(env) {
+		slog.Info("no signing key; only reading the remotes", "cache", remote.Kind())
+	}
+	var localPolicy cachers.TierPolicy
+	if v := env.Get(envVarPopulateLocal); v != "" {
+		populate, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarPopulateLocal, err)
+		}
+		localPolicy.NoPopulate = !populate
+	}
+	cache, err := cachers.NewTieredCache(
+		cachers.WithTierPolicy(local, localPolicy),
+		cachers.WithTierPolicy(remote, remotePolicy),
+	)
+	if err != nil {
+		return nil, err
+	}
+	cache.SetVerbose(verbose)
+	cache.SetScratchDir(env.Get(envVarTempDir))
+	retry := cachers.RetryPolicy{MaxAttempts: 3, MaxDelay: 30 * time.Second}
+	if v := env.Get(envVarUploadMaxAttempts); v != "" {
+		if retry.MaxAttempts, err = strconv.Atoi(v); err != nil || retry.MaxAttempts < 1 {
+			return nil, fmt.Errorf("%s: invalid number of attempts %q", envVarUploadMaxAttempts, v)
+		}
+	}
+	if retry.BaseDelay, err = parseDuration(env.Get(envVarUploadRetryDelay), time.Second); err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarUploadRetryDelay, err)
+	}
+	cache.SetRetryPolicy(retry)
+	if v := env.Get(envVarAsyncUploads); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil || workers < 0 {
+			return nil, fmt.Errorf("%s: invalid number of workers %q", envVarAsyncUploads, v)
+		}
+		drain, err := parseDuration(env.Get(envVarUploadDrainTimeout), 30*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarUploadDrainTimeout, err)
+		}
+		if workers > 0 {
+			cache.SetAsyncUploads(workers, drain, filepath.Join(dir, "pending-uploads.jsonl"))
+		}
+	}
+	return cache, nil
 }
 
 func maybeHttpCache(env Env) (cachers.RemoteCache, error) {
+	remotes, err := httpCaches(env)
+	if err != nil {
+		return nil, err
+	}
+	return combineRemotes(env, remotes)
+}
+
+func httpCaches(env Env) ([]cachers.RemoteCache, error) {
 	serverBase := env.Get(envVarHttpCacheServerBase)
 	if serverBase == "" {
 		return nil, nil
 	}
-	return cachers.NewHttpCache(serverBase, *verbose), nil
+	httpClient, err := remoteHTTPClient(env)
+	if err != nil {
+		return nil, err
+	}
+	split, err := splitCredentials(env)
+	if err != nil {
+		return nil, err
+	}
+	slow, err := slowThreshold(env)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := remoteCompression(env)
+	if err != nil {
+		return nil, err
+	}
+	ranged, err := rangedDownloads(env)
+	if err != nil {
+		return nil, err
+	}
+	httpClient = withHMAC(httpClient, env.Get(envVarHttpHMACSecret), ranged.Dir)
+	readClient := withToken(httpClient, env.Get(envVarHttpToken))
+	writeToken := env.Get(envVarHttpWriteToken)
+	var remotes []cachers.RemoteCache
+	for _, base := range strings.Split(serverBase, ",") {
+		if base = strings.TrimSpace(base); base == "" {
+			continue
+		}
+		client := readClient
+		if env.Get(envVarHttpToken) == "" {
+			h, err := newCredentialHelper(env, base)
+			if err != nil {
+				return nil, err
+			}
+			if h != nil {
+				client = withCredentialHelper(httpClient, h)
+			}
+		}
+		hc := cachers.NewHttpCacheWithClient(base, client, *verbose)
+		hc.SetCompression(compression)
+		hc.SetRangedDownloads(ranged)
+		var remote cachers.RemoteCache = hc
+		if split && writeToken != "" {
+			wc := cachers.NewHttpCacheWithClient(base, withToken(httpClient, writeToken), *verbose)
+			wc.SetCompression(compression)
+			remote = cachers.NewSplitRemoteCache(remote, wc)
+		}
+		if slow > 0 {
+			remote = cachers.NewSlowLogRemoteCache(remote, base, slow)
+		}
+		remotes = append(remotes, remote)
+	}
+	return remotes, nil
+}
+
+// slowThreshold returns the GOCACHE_SLOW_THRESHOLD setting, or 0 if it is
+// unset.
+func slowThreshold(env Env) (time.Duration, error) {
+	d, err := parseDuration(env.Get(envVarSlowThreshold), 0)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", envVarSlowThreshold, err)
+	}
+	return d, nil
+}
+
+// remoteCompression returns how the bodies sent to the remotes are
+// compressed, from GOCACHE_COMPRESSION and GOCACHE_COMPRESSION_MIN_SIZE.
+func remoteCompression(env Env) (cachers.Compression, error) {
+	c := cachers.Compression{Mode: strings.ToLower(env.Get(envVarCompression))}
+	switch c.Mode {
+	case "":
+		c.Mode = cachers.CompressionAuto
+	case cachers.CompressionAuto, cachers.CompressionZstd, cachers.CompressionOff:
+	default:
+		return c, fmt.Errorf("%s: unknown compression %q", envVarCompression, c.Mode)
+	}
+	c.MinSize = cachers.DefaultCompressionMinSize
+	if v := env.Get(envVarCompressionMinSize); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", envVarCompressionMinSize, err)
+		}
+		c.MinSize = max(n, 1) // 0 compresses every body
+
+	}
+	return c, nil
+}
+
+// rangedDownloads returns which remote objects are downloaded in ranges,
+// from GOCACHE_RANGED_DOWNLOAD_THRESHOLD and GOCACHE_RANGED_DOWNLOAD_PARTS.
+func rangedDownloads(env Env) (cachers.RangedDownloads, error) {
+	r := cachers.RangedDownloads{Threshold: cachers.DefaultRangedThreshold, Parts: 4, Dir: getDir(env)}
+	if v := env.Get(envVarRangedThreshold); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", envVarRangedThreshold, err)
+		}
+		r.Threshold = n
+	}
+	if v := env.Get(envVarRangedParts); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 {
+			return r, fmt.Errorf("%s: invalid number of parts %q", envVarRangedParts, v)
+		}
+		r.Parts = n
+	}
+	if dir := env.Get(envVarTempDir); dir != "" {
+		r.Dir = dir
+	}
+	return r, nil
+}
+
+// combineRemotes returns nil for no remotes, the remote itself for one,
+// and a MultiRemoteCache otherwise.
+func combineRemotes(env Env, remotes []cachers.RemoteCache) (cachers.RemoteCache, error) {
+	switch len(remotes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return remotes[0], nil
+	}
+	if failover, _ := strconv.ParseBool(env.Get(envVarRemoteFailover)); failover {
+		interval, err := parseDuration(env.Get(envVarRemoteHealthInterval), 30*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarRemoteHealthInterval, err)
+		}
+		return cachers.NewFailoverRemoteCache(remotes, interval, *verbose), nil
+	}
+	readMode, err := cachers.ParseMultiReadMode(env.Get(envVarRemoteReadMode))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarRemoteReadMode, err)
+	}
+	writeMode, err := cachers.ParseMultiWriteMode(env.Get(envVarRemoteWriteMode))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarRemoteWriteMode, err)
+	}
+	multi := cachers.NewMultiRemoteCache(remotes, readMode, writeMode, *verbose)
+	multi.SetSpoolDir(env.Get(envVarTempDir))
+	return multi, nil
+}
+
+// remoteProxy returns the proxy function of GOCACHE_PROXY, with the
+// exceptions of NO_PROXY, or nil if it is unset, leaving the transports to
+// honor HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func remoteProxy(env Env) (func(*http.Request) (*url.URL, error), error) {
+	v := env.Get(envVarProxy)
+	if v == "" {
+		return nil, nil
+	}
+	noProxy := env.Get("NO_PROXY")
+	if noProxy == "" {
+		noProxy = env.Get("no_proxy")
+	}
+	proxy, err := cachers.NewProxyFunc(v, noProxy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarProxy, err)
+	}
+	return proxy, nil
+}
+
+// proxyClient returns the client of the requests of go-cacher other than
+// to the remotes, like those for credentials, to KMS or of the audit log:
+// http.DefaultClient, or one using GOCACHE_PROXY if it is set.
+func proxyClient(env Env) (*http.Client, error) {
+	proxy, err := remoteProxy(env)
+	if err != nil || proxy == nil {
+		return http.DefaultClient, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = proxy
+	return &http.Client{Transport: tr}, nil
+}
+
+// remoteTLSConfig returns the TLS configuration of GOCACHE_TLS_CA_FILE and
+// GOCACHE_TLS_PINS, or nil if they are unset.
+func remoteTLSConfig(env Env) (*tls.Config, error) {
+	caFile := env.Get(envVarTLSCAFile)
+	var pins []string
+	for _, pin := range strings.Split(env.Get(envVarTLSPins), ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	if caFile == "" && len(pins) == 0 {
+		return nil, nil
+	}
+	cfg, err := cachers.NewTLSConfig(caFile, pins)
+	if err != nil {
+		return nil, fmt.Errorf("TLS configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// remoteHTTPSettings are the settings of the client of remoteHTTPClient.
+var remoteHTTPSettings = []string{
+	envVarRemoteUploadLimit,
+	envVarRemoteDownloadLimit,
+	envVarTimeoutConnect,
+	envVarTimeoutRead,
+	envVarTimeoutWrite,
+	envVarTLSCAFile,
+	envVarTLSPins,
+	envVarProxy,
+	envVarHTTPMaxConns,
+	envVarHTTPMaxIdleConns,
+	envVarHTTPIdleTimeout,
+	envVarHTTP2,
+}
+
+// remoteHTTPClients are the clients of remoteHTTPClient, by their settings.
+var remoteHTTPClients struct {
+	sync.Mutex
+	m map[string]*http.Client
+}
+
+// remoteHTTPClient returns the http.Client that remote caches should use,
+// or nil if the defaults are fine. The remotes of the same settings share
+// it, for its rate limits to hold for the whole remote tier, and its
+// connections to be reused.
+func remoteHTTPClient(env Env) (*http.Client, error) {
+	var key strings.Builder
+	for _, k := range remoteHTTPSettings {
+		fmt.Fprintf(&key, "%s=%s\n", k, env.Get(k))
+	}
+	remoteHTTPClients.Lock()
+	defer remoteHTTPClients.Unlock()
+	if c, ok := remoteHTTPClients.m[key.String()]; ok {
+		return c, nil
+	}
+	c, err := newRemoteHTTPClient(env)
+	if err != nil {
+		return nil, err
+	}
+	if remoteHTTPClients.m == nil {
+		remoteHTTPClients.m = map[string]*http.Client{}
+	}
+	remoteHTTPClients.m[key.String()] = c
+	return c, nil
+}
+
+// newRemoteHTTPClient returns a new client of remoteHTTPClient.
+func newRemoteHTTPClient(env Env) (*http.Client, error) {
+	upload, err := parseByteSize(env.Get(envVarRemoteUploadLimit))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarRemoteUploadLimit, err)
+	}
+	download, err := parseByteSize(env.Get(envVarRemoteDownloadLimit))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarRemoteDownloadLimit, err)
+	}
+	var timeouts cachers.Timeouts
+	for _, t := range []struct {
+		key string
+		d   *time.Duration
+	}{
+		{envVarTimeoutConnect, &timeouts.Connect},
+		{envVarTimeoutRead, &timeouts.Read},
+		{envVarTimeoutWrite, &timeouts.Write},
+	} {
+		if *t.d, err = parseDuration(env.Get(t.key), 0); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.key, err)
+		}
+	}
+	tlsConfig, err := remoteTLSConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := remoteProxy(env)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := connPool(env)
+	if err != nil {
+		return nil, err
+	}
+	if upload <= 0 && download <= 0 && timeouts == (cachers.Timeouts{}) && tlsConfig == nil && proxy == nil && pool == nil {
+		return nil, nil
+	}
+	transport := http.DefaultTransport
+	if tlsConfig != nil || proxy != nil || pool != nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		if tlsConfig != nil {
+			tr.TLSClientConfig = tlsConfig
+		}
+		if proxy != nil {
+			tr.Proxy = proxy
+		}
+		if pool != nil {
+			pool(tr)
+		}
+		transport = tr
+	}
+	if timeouts != (cachers.Timeouts{}) {
+		transport = cachers.NewTimeoutTransportFrom(transport.(*http.Transport), timeouts)
+	}
+	if upload > 0 || download > 0 {
+		transport = cachers.NewRateLimitedTransport(transport, upload, download)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// connPool returns a function applying the tuning of the connection pool of
+// GOCACHE_HTTP_MAX_CONNS_PER_HOST, GOCACHE_HTTP_MAX_IDLE_CONNS_PER_HOST,
+// GOCACHE_HTTP_IDLE_TIMEOUT and GOCACHE_HTTP2 to a transport, or nil if
+// they are unset.
+func connPool(env Env) (func(*http.Transport), error) {
+	var maxConns, maxIdle int
+	for _, l := range []struct {
+		key string
+		n   *int
+	}{
+		{envVarHTTPMaxConns, &maxConns},
+		{envVarHTTPMaxIdleConns, &maxIdle},
+	} {
+		if v := env.Get(l.key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: invalid limit %q", l.key, v)
+			}
+			*l.n = n
+		}
+	}
+	idleTimeout, err := parseDuration(env.Get(envVarHTTPIdleTimeout), 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarHTTPIdleTimeout, err)
+	}
+	var http2 *bool
+	if v := env.Get(envVarHTTP2); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarHTTP2, err)
+		}
+		http2 = &b
+	}
+	if maxConns == 0 && maxIdle == 0 && idleTimeout == 0 && http2 == nil {
+		return nil, nil
+	}
+	if maxIdle == 0 {
+		// Keep the connections a burst opened for the next one.
+		maxIdle = maxConns
+	}
+	return func(tr *http.Transport) {
+		tr.MaxConnsPerHost = maxConns
+		if maxIdle > 0 {
+			tr.MaxIdleConnsPerHost = maxIdle
+			tr.MaxIdleConns = max(tr.MaxIdleConns, maxIdle)
+		}
+		if idleTimeout > 0 {
+			tr.IdleConnTimeout = idleTimeout
+		}
+		if http2 != nil {
+			tr.ForceAttemptHTTP2 = *http2
+			if !*http2 {
+				// A non-nil empty map turns HTTP/2 off.
+				tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			}
+		}
+	}, nil
+}
+
+// parseDuration parses a positive time.Duration, returning def for the empty string.
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive, got %v", d)
+	}
+	return d, nil
+}
+
+// parseByteSize parses a byte count like "1024", "512KB" or "10MB".
+// Suffixes are powers of 1024. The empty string is 0.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for _, suf := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KB", 1 << 10},
+		{"MB", 1 << 20},
+		{"GB", 1 << 30},
+		{"K", 1 << 10},
+		{"M", 1 << 20},
+		{"G", 1 << 30},
+		{"B", 1},
+	} {
+		if v, ok := strings.CutSuffix(s, suf.suffix); ok {
+			s, mult = strings.TrimSpace(v), suf.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative byte size %q", s)
+	}
+	return n * mult, nil
 }
 
 func getDir(env Env) string {
@@ -153,7 +1433,7 @@ func getDir(env Env) string {
 	if dir == "" {
 		d, err := os.UserCacheDir()
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		d = filepath.Join(d, "go-cacher")
 		dir = d
@@ -161,16 +1441,371 @@ func getDir(env Env) string {
 	return dir
 }
 
+// dryRun reports whether env configures a dry run, which leaves the disk
+// cache directory alone.
+func dryRun(env Env) (bool, error) {
+	v := env.Get(envVarDryRun)
+	if v == "" {
+		return false, nil
+	}
+	dry, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", envVarDryRun, err)
+	}
+	return dry, nil
+}
+
+// readOnly reports whether env configures a read-only session.
+func readOnly(env Env) (bool, error) {
+	v := env.Get(envVarReadOnly)
+	if v == "" {
+		return false, nil
+	}
+	ro, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", envVarReadOnly, err)
+	}
+	return ro, nil
+}
+
+// latencyReport describes the latencies of the requests of a session, or
+// returns "" if none were answered.
+func latencyReport(lat map[wire.Cmd]cacheproc.Latencies) string {
+	var parts []string
+	for _, cmd := range []wire.Cmd{wire.CmdGet, wire.CmdPut} {
+		if l, ok := lat[cmd]; ok {
+			parts = append(parts, fmt.Sprintf("%ss %s", cmd, l))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "Request latencies: " + strings.Join(parts, "; ") + "."
+}
+
+// A sessionSummary is the summary of a session written to the
+// GOCACHE_SUMMARY file.
+type sessionSummary struct {
+	cachers.Summary
+	Latencies map[wire.Cmd]cacheproc.Latencies `json:",omitempty"`
+}
+
+// logSummary logs sum and the latencies lat of a session as one event, for
+// JSON logs, in which a free-form report would stand out.
+func logSummary(sum cachers.Summary, lat map[wire.Cmd]cacheproc.Latencies) {
+	attrs := []any{"gets", sum.Gets, "hits", sum.Hits, "misses", sum.Misses, "puts", sum.Puts, "errors", sum.Errors,
+		"downloaded", sum.Downloaded, "uploaded", sum.Uploaded}
+	for _, th := range sum.TierHits {
+		attrs = append(attrs, th.Tier+"_hits", th.Hits)
+	}
+	for _, class := range cachers.ErrorClasses {
+		if n := sum.BackendErrors[class]; n > 0 {
+			attrs = append(attrs, class+"_errors", n)
+		}
+	}
+	if sum.TimeSaved > 0 {
+		attrs = append(attrs, "time_saved", sum.TimeSaved)
+	}
+	for _, cmd := range []wire.Cmd{wire.CmdGet, wire.CmdPut} {
+		if l, ok := lat[cmd]; ok {
+			attrs = append(attrs, slog.Group(string(cmd)+"_latency", "p50", l.P50, "p95", l.P95, "p99", l.P99))
+		}
+	}
+	slog.Info("summary", attrs...)
+}
+
+// writeSummary writes sum and the latencies lat of a session to the file
+// at path as JSON.
+func writeSummary(path string, sum cachers.Summary, lat map[wire.Cmd]cacheproc.Latencies) error {
+	b, err := json.MarshalIndent(sessionSummary{Summary: sum, Latencies: lat}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// procOptions returns the options of the protocol process configured in env.
+func procOptions(env Env) ([]cacheproc.Option, error) {
+	var opts []cacheproc.Option
+	if v := env.Get(envVarMaxConcurrency); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: invalid limit %q", envVarMaxConcurrency, v)
+		}
+		opts = append(opts, cacheproc.WithMaxConcurrency(n))
+	}
+	spoolThreshold := int64(cacheproc.DefaultSpoolThreshold)
+	if v := env.Get(envVarSpoolThreshold); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarSpoolThreshold, err)
+		}
+		spoolThreshold = n
+	}
+	spoolDir := getDir(env)
+	if dry, err := dryRun(env); err != nil {
+		return nil, err
+	} else if dry {
+		spoolDir = "" // the default directory for temporary files
+	}
+	if dir := env.Get(envVarTempDir); dir != "" {
+		spoolDir = dir
+	}
+	opts = append(opts, cacheproc.WithSpool(spoolDir, spoolThreshold))
+	if v := env.Get(envVarMinFreeSpace); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarMinFreeSpace, err)
+		}
+		opts = append(opts, cacheproc.WithMinFreeSpace(getDir(env), n))
+	}
+	for cmd, key := range map[wire.Cmd]string{
+		wire.CmdGet:   envVarGetTimeout,
+		wire.CmdPut:   envVarPutTimeout,
+		wire.CmdClose: envVarCloseTimeout,
+	} {
+		d, err := parseDuration(env.Get(key), 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		opts = append(opts, cacheproc.WithTimeout(cmd, d))
+	}
+	mode, err := cacheproc.ParseErrorMode(env.Get(envVarErrorMode))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarErrorMode, err)
+	}
+	opts = append(opts, cacheproc.WithErrorMode(mode))
+	ro, err := readOnly(env)
+	if err != nil {
+		return nil, err
+	}
+	if ro {
+		// cmd/go doesn't send puts to a cache that doesn't advertise them.
+		opts = append(opts, cacheproc.WithCommands(wire.CmdGet, wire.CmdClose))
+	}
+	if reporter, err := newErrorReporter(env); err != nil {
+		return nil, err
+	} else if reporter != nil {
+		opts = append(opts, reporter.panicHandler())
+	}
+	return opts, nil
+}
+
+// loadEnv returns the environment of the process, over the settings of
+// the configuration file and overridden by those of GOCACHE_ENV_FILE if it
+// is set, then by those of the flags, with the secrets referred to by the
+// credential settings resolved.
+func loadEnv() (Env, error) {
+	wd, _ := os.Getwd()
+	profile := (&fileEnv{vars: flagSettings, base: osEnv{}}).Get(envVarProfile)
+	env, err := loadConfigEnv(*configFile, wd, profile)
+	if err != nil {
+		return nil, err
+	}
+	if path := (&fileEnv{vars: flagSettings, base: env, origin: "flags"}).Get(envVarEnvFile); path != "" {
+		if env, err = loadEnvFile(path, env); err != nil {
+			return nil, err
+		}
+	}
+	if env, err = resolveSecrets(&fileEnv{vars: flagSettings, base: env, origin: "flags"}); err != nil {
+		return nil, err
+	}
+	logRedactor.addSettings(env)
+	return env, nil
+}
+
+// reloadOnHangup reloads the remote settings on every SIGHUP, until ctx is
+// done, so that rotated credentials don't require a new session.
+func reloadOnHangup(ctx context.Context, reload reloadFunc) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		env, err := loadEnv()
+		if err == nil {
+			err = reload(ctx, env)
+		}
+		if err != nil {
+			slog.Error("reloading the configuration failed; keeping the current one", "err", err)
+			continue
+		}
+		slog.Info("reloaded the configuration")
+	}
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	env := &osEnv{}
+	// Until the configuration is loaded, only the flags and the environment
+	// tell how to report its errors.
+	_ = setErrorFormat(&fileEnv{vars: flagSettings, base: osEnv{}})
+	env, err := loadEnv()
+	if err != nil {
+		if c := lookupCommand(flag.Arg(0)); c == nil || !c.writesConfig {
+			fatal(configErr(err))
+		}
+		env = &fileEnv{vars: flagSettings, base: osEnv{}, origin: "flags"}
+	}
+	if err := setErrorFormat(env); err != nil {
+		fatal(err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cache := getCache(ctx, env, *verbose)
-	proc := cacheproc.NewCacheProc(cache)
-	if err := proc.Run(ctx); err != nil {
-		log.Fatal(err)
+	logTo, err := logOutput(env)
+	if err != nil {
+		fatal(configErr(err))
+	}
+	h, err := newLogHandler(env, logTo, *verbose)
+	if err != nil {
+		fatal(configErr(err))
+	}
+	logger := slog.New(cachers.NewRequestIDHandler(newRedactingHandler(h, logRedactor)))
+	slog.SetDefault(logger)
+	// The errors go-cacher exits with, from fatal, are logged as errors
+	// rather than information, so that even quiet mode reports them.
+	log.SetOutput(slog.NewLogLogger(logger.Handler(), slog.LevelError).Writer())
+	// The caches only produce their debug logs when verbose.
+	*verbose = h.Enabled(ctx, slog.LevelDebug)
+	if errorReports, err = newErrorReporter(env); err != nil {
+		fatal(configErr(err))
+	}
+	defer reportPanic()
+
+	// Without a subcommand, go-cacher speaks the protocol, as GOCACHEPROG.
+	cmd, args := lookupCommand("run"), flag.Args()
+	if c := lookupCommand(flag.Arg(0)); c != nil {
+		cmd, args = c, args[1:]
+	}
+	if *version {
+		cmd, args = lookupCommand("version"), nil
+	}
+	if cmd.stoppable {
+		// On SIGINT or SIGTERM, stop reading requests, finish the ones in
+		// flight and drain the uploads. A second signal kills the process.
+		sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigCtx.Done()
+			stop()
+		}()
+		ctx = sigCtx
+	}
+	if err := cmd.run(ctx, env, args); err != nil {
+		fatal(err)
+	}
+	waitReports()
+}
+
+// runProc serves the protocol over stdin and stdout until stdin is closed
+// or ctx is done, when it finishes the requests in flight.
+func runProc(ctx context.Context, env Env, args []string) error {
+	ctx, stopTracing, err := startTracing(ctx, env)
+	if err != nil {
+		return configErr(err)
+	}
+	defer stopTracing()
+	sigCtx := ctx
+	// The cache outlives ctx, to drain its uploads.
+	ctx = context.WithoutCancel(ctx)
+	cache, reload := getCache(ctx, env, *verbose)
+	if reload != nil {
+		go reloadOnHangup(sigCtx, reload)
+	}
+	if *missLog != "" {
+		f, err := os.OpenFile(*missLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cache = cachers.NewMissLogCache(cache, f)
+	}
+	if path := env.Get(envVarEventLog); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cache = cachers.NewEventLogCache(cache, f)
+	}
+	summaryTo := env.Get(envVarSummary)
+	var sc *cachers.SummaryCache
+	if summaryTo != "" {
+		sc = cachers.NewSummaryCache(cache)
+		cache = sc
+	}
+	opts, err := procOptions(env)
+	if err != nil {
+		return configErr(err)
+	}
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		defer bw.Flush()
+		opts = append(opts, cacheproc.WithRecording(bw))
+	}
+	proc := cacheproc.NewCacheProc(cache, opts...)
+	if addr := env.Get(envVarDebugAddr); addr != "" {
+		if err := serveDebug(addr, proc, cache); err != nil {
+			return err
+		}
+	}
+	metricsCfg, err := newMetricsConfig(sigCtx, env)
+	if err != nil {
+		return configErr(err)
+	}
+	if addr := env.Get(envVarMetricsAddr); addr != "" {
+		if err := serveMetrics(addr, metricsCfg, proc, cache); err != nil {
+			return err
+		}
+	}
+	stopMetrics, err := startMetricsSinks(env, metricsCfg, proc, cache)
+	if err != nil {
+		return configErr(err)
+	}
+	progressEvery, err := parseDuration(env.Get(envVarProgressInterval), 0)
+	if err != nil {
+		return configErr(fmt.Errorf("%s: %w", envVarProgressInterval, err))
+	}
+	progressCtx, stopProgress := context.WithCancel(sigCtx)
+	if progressEvery > 0 {
+		go logProgress(progressCtx, progressEvery, proc, cache)
+	}
+	err = proc.Run(sigCtx)
+	stopProgress()
+	stopMetrics()
+	if err != nil {
+		return err
+	}
+	switch summaryTo {
+	case "":
+	case "stderr":
+		if strings.EqualFold(env.Get(envVarLogFormat), "json") {
+			logSummary(sc.Summary(), proc.Latencies())
+			break
+		}
+		fmt.Fprintln(os.Stderr, sc.Report())
+		if lat := latencyReport(proc.Latencies()); lat != "" {
+			fmt.Fprintln(os.Stderr, lat)
+		}
+	default:
+		if err := writeSummary(summaryTo, sc.Summary(), proc.Latencies()); err != nil {
+			slog.Warn("failed to write the summary", "err", err)
+		}
+	}
+	if sigCtx.Err() != nil {
+		st := proc.Stats()
+		slog.Info("shut down by signal", "gets", st.Gets, "hits", st.Hits, "misses", st.Misses, "get_errors", st.GetErrors,
+			"puts", st.Puts, "put_errors", st.PutErrors)
 	}
+	return nil
 }
@@ -1,11 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
 	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mapEnv struct {
@@ -65,4 +82,519 @@ func TestMaybeHttpCache(t *testing.T) {
 		assert.NoError(t, err)
 		assert.NotNil(t, client)
 	})
+
+	t.Run("should warn of slow operations if "+envVarSlowThreshold+" is set", func(t *testing.T) {
+		env := &mapEnv{
+			m: map[string]string{
+				envVarHttpCacheServerBase: "http://localhost:8080",
+				envVarSlowThreshold:       "2s",
+			},
+		}
+		remotes, err := httpCaches(env)
+		require.NoError(t, err)
+		require.Len(t, remotes, 1)
+		assert.IsType(t, &cachers.SlowLogRemoteCache{}, remotes[0])
+
+		env.m[envVarSlowThreshold] = "slow"
+		_, err = httpCaches(env)
+		assert.ErrorContains(t, err, envVarSlowThreshold)
+	})
+}
+
+func TestBackends(t *testing.T) {
+	configured := map[string]string{
+		envVarHttpCacheServerBase: "http://localhost:8080",
+		envVarS3BucketName:        "bucket",
+	}
+	withBackends := func(v string) *mapEnv {
+		m := map[string]string{envVarBackends: v}
+		for k, v := range configured {
+			m[k] = v
+		}
+		return &mapEnv{m: m}
+	}
+
+	t.Run("should use the configured remote if "+envVarBackends+" is missing", func(t *testing.T) {
+		got, err := backends(&mapEnv{m: map[string]string{envVarHttpCacheServerBase: "http://localhost:8080"}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"disk", "http"}, got)
+		got, err = backends(&mapEnv{m: map[string]string{envVarS3BucketName: "bucket"}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"disk", "s3"}, got)
+		got, err = backends(&mapEnv{m: map[string]string{}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"disk"}, got)
+	})
+
+	t.Run("should prefer S3 to HTTP if "+envVarBackends+" is missing", func(t *testing.T) {
+		got, err := backends(&mapEnv{m: configured})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"disk", "s3"}, got)
+		assert.True(t, httpIgnored(&mapEnv{m: configured}))
+		assert.False(t, httpIgnored(withBackends("disk,http,s3")))
+	})
+
+	t.Run("should use the listed backends in order", func(t *testing.T) {
+		got, err := backends(withBackends("disk, s3,HTTP"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"disk", "s3", "http"}, got)
+	})
+
+	t.Run("should reject invalid lists", func(t *testing.T) {
+		for _, v := range []string{"disk,gcs", "disk,s3,s3", "s3,disk", "disk,"} {
+			_, err := backends(withBackends(v))
+			assert.ErrorContains(t, err, envVarBackends, v)
+		}
+	})
+
+	t.Run("should reject unconfigured backends", func(t *testing.T) {
+		_, err := backends(&mapEnv{m: map[string]string{envVarBackends: "disk,s3"}})
+		assert.ErrorContains(t, err, envVarS3BucketName)
+		_, err = backends(&mapEnv{m: map[string]string{envVarBackends: "disk,http"}})
+		assert.ErrorContains(t, err, envVarHttpCacheServerBase)
+	})
+
+	t.Run("should ignore configured remotes not listed", func(t *testing.T) {
+		remote, err := maybeRemoteCache(context.Background(), withBackends("disk"))
+		require.NoError(t, err)
+		assert.Nil(t, remote)
+	})
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "1024", want: 1024},
+		{in: "512KB", want: 512 << 10},
+		{in: "10mb", want: 10 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "7 B", want: 7},
+		{in: "fast", wantErr: true},
+		{in: "-1", wantErr: true},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseByteSize(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRemoteCompression(t *testing.T) {
+	c, err := remoteCompression(&mapEnv{m: map[string]string{}})
+	require.NoError(t, err)
+	assert.Equal(t, cachers.Compression{Mode: cachers.CompressionAuto, MinSize: cachers.DefaultCompressionMinSize}, c)
+
+	c, err = remoteCompression(&mapEnv{m: map[string]string{envVarCompression: "ZSTD", envVarCompressionMinSize: "64KB"}})
+	require.NoError(t, err)
+	assert.Equal(t, cachers.Compression{Mode: cachers.CompressionZstd, MinSize: 64 << 10}, c)
+
+	_, err = remoteCompression(&mapEnv{m: map[string]string{envVarCompression: "gzip"}})
+	assert.ErrorContains(t, err, envVarCompression)
+	_, err = remoteCompression(&mapEnv{m: map[string]string{envVarCompressionMinSize: "big"}})
+	assert.ErrorContains(t, err, envVarCompressionMinSize)
+}
+
+func TestRangedDownloads(t *testing.T) {
+	r, err := rangedDownloads(&mapEnv{m: map[string]string{envVarDiskCacheDir: "/cache"}})
+	require.NoError(t, err)
+	assert.Equal(t, cachers.RangedDownloads{Threshold: cachers.DefaultRangedThreshold, Parts: 4, Dir: "/cache"}, r)
+
+	r, err = rangedDownloads(&mapEnv{m: map[string]string{envVarDiskCacheDir: "/cache", envVarTempDir: "/tmp/go", envVarRangedThreshold: "0", envVarRangedParts: "8"}})
+	require.NoError(t, err)
+	assert.Equal(t, cachers.RangedDownloads{Parts: 8, Dir: "/tmp/go"}, r)
+
+	_, err = rangedDownloads(&mapEnv{m: map[string]string{envVarRangedParts: "1"}})
+	assert.ErrorContains(t, err, envVarRangedParts)
+}
+
+func TestMaybeOffline(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	down := httptest.NewServer(nil)
+	down.Close()
+
+	for _, tc := range []struct {
+		offline string
+		url     string
+		online  bool
+	}{
+		{"", down.URL, true},
+		{"0", down.URL, true},
+		{"1", srv.URL, false},
+		{"auto", srv.URL, true},
+		{"auto", down.URL, false},
+	} {
+		t.Run(tc.offline+" "+tc.url, func(t *testing.T) {
+			env := &mapEnv{m: map[string]string{envVarOffline: tc.offline}}
+			remote, err := maybeOffline(ctx, env, cachers.NewHttpCache(tc.url, false))
+			require.NoError(t, err)
+			assert.Equal(t, tc.online, remote != nil)
+		})
+	}
+
+	_, err := maybeOffline(ctx, &mapEnv{m: map[string]string{envVarOffline: "plane"}}, cachers.NewHttpCache(srv.URL, false))
+	assert.Error(t, err)
+}
+
+func TestMaybeSelfCheck(t *testing.T) {
+	ctx := context.Background()
+	down := httptest.NewServer(nil)
+	down.Close()
+	remote := cachers.NewHttpCache(down.URL, false)
+
+	got, err := maybeSelfCheck(ctx, &mapEnv{m: map[string]string{}}, remote)
+	require.NoError(t, err)
+	assert.NotNil(t, got)
+	got, err = maybeSelfCheck(ctx, &mapEnv{m: map[string]string{envVarSelfCheck: "warn"}}, remote)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	_, err = maybeSelfCheck(ctx, &mapEnv{m: map[string]string{envVarSelfCheck: "fail"}}, remote)
+	assert.ErrorContains(t, err, "http cache self-check: unreachable")
+	_, err = maybeSelfCheck(ctx, &mapEnv{m: map[string]string{envVarSelfCheck: "always"}}, remote)
+	assert.ErrorContains(t, err, envVarSelfCheck)
+}
+
+func TestProcOptionsReadOnly(t *testing.T) {
+	cache := cachers.NewSimpleDiskCache(false, t.TempDir())
+	for _, tc := range []struct {
+		readOnly string
+		want     []wire.Cmd
+	}{
+		{"", []wire.Cmd{wire.CmdGet, wire.CmdPut, wire.CmdClose}},
+		{"0", []wire.Cmd{wire.CmdGet, wire.CmdPut, wire.CmdClose}},
+		{"1", []wire.Cmd{wire.CmdGet, wire.CmdClose}},
+	} {
+		t.Run(tc.readOnly, func(t *testing.T) {
+			env := &mapEnv{m: map[string]string{envVarDiskCacheDir: t.TempDir(), envVarReadOnly: tc.readOnly}}
+			opts, err := procOptions(env)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, cacheproc.NewCacheProc(cache, opts...).KnownCommands())
+		})
+	}
+
+	_, err := procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: t.TempDir(), envVarReadOnly: "sealed"}})
+	assert.Error(t, err)
+}
+
+// spoolSpy is a local cache that records the files in dir while it stores
+// a put.
+type spoolSpy struct {
+	cachers.LocalCache
+	dir   string
+	files []string
+}
+
+func (s *spoolSpy) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
+	entries, _ := os.ReadDir(s.dir)
+	for _, e := range entries {
+		s.files = append(s.files, e.Name())
+	}
+	return s.LocalCache.Put(ctx, actionID, outputID, size, body)
+}
+
+func TestProcOptionsTempDir(t *testing.T) {
+	tmp := filepath.Join(t.TempDir(), "tmpfs")
+	require.NoError(t, os.Mkdir(tmp, 0755))
+	opts, err := procOptions(&mapEnv{m: map[string]string{
+		envVarDiskCacheDir:   t.TempDir(),
+		envVarTempDir:        tmp,
+		envVarSpoolThreshold: "1",
+	}})
+	require.NoError(t, err)
+	spy := &spoolSpy{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir()), dir: tmp}
+	body := []byte("spooled")
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	require.NoError(t, enc.Encode(&wire.Request{ID: 1, Command: wire.CmdPut, ActionID: []byte{1}, OutputID: []byte{2}, BodySize: int64(len(body))}))
+	require.NoError(t, enc.Encode(body))
+	require.NoError(t, cacheproc.NewCacheProc(spy, opts...).Serve(context.Background(), &in, io.Discard))
+	require.Len(t, spy.files, 1)
+	assert.Contains(t, spy.files[0], "go-cacher-put-")
+}
+
+func TestProcOptionsTimeouts(t *testing.T) {
+	dir := t.TempDir()
+	_, err := procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarGetTimeout: "10s", envVarCloseTimeout: "1m"}})
+	require.NoError(t, err)
+	_, err = procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarPutTimeout: "soon"}})
+	assert.ErrorContains(t, err, envVarPutTimeout)
+	_, err = procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarPutTimeout: "-1s"}})
+	assert.ErrorContains(t, err, envVarPutTimeout)
+}
+
+func TestRemoteHTTPClientShared(t *testing.T) {
+	limited := map[string]string{envVarRemoteUploadLimit: "1MB", envVarRemoteDownloadLimit: "2MB"}
+	c, err := remoteHTTPClient(&mapEnv{m: limited})
+	require.NoError(t, err)
+	require.IsType(t, &cachers.RateLimitedTransport{}, c.Transport)
+	other, err := remoteHTTPClient(&mapEnv{m: map[string]string{envVarRemoteUploadLimit: "1MB", envVarRemoteDownloadLimit: "2MB", envVarS3BucketName: "b"}})
+	require.NoError(t, err)
+	assert.Same(t, c, other, "the remotes share the limits")
+	other, err = remoteHTTPClient(&mapEnv{m: map[string]string{envVarRemoteUploadLimit: "3MB"}})
+	require.NoError(t, err)
+	assert.NotSame(t, c, other)
+}
+
+func TestRemoteHTTPClientTimeouts(t *testing.T) {
+	c, err := remoteHTTPClient(&mapEnv{m: map[string]string{}})
+	require.NoError(t, err)
+	assert.Nil(t, c)
+	c, err = remoteHTTPClient(&mapEnv{m: map[string]string{envVarTimeoutConnect: "5s", envVarTimeoutRead: "30s"}})
+	require.NoError(t, err)
+	assert.NotNil(t, c)
+	_, err = remoteHTTPClient(&mapEnv{m: map[string]string{envVarTimeoutWrite: "0s"}})
+	assert.ErrorContains(t, err, envVarTimeoutWrite)
+
+	remote, err := maybeRemoteCache(context.Background(), &mapEnv{m: map[string]string{
+		envVarHttpCacheServerBase: "http://127.0.0.1:1",
+		envVarTimeoutTotal:        "1m",
+	}})
+	require.NoError(t, err)
+	assert.IsType(t, &cachers.TimeoutRemoteCache{}, remote)
+	_, err = maybeRemoteCache(context.Background(), &mapEnv{m: map[string]string{
+		envVarHttpCacheServerBase: "http://127.0.0.1:1",
+		envVarTimeoutTotal:        "forever",
+	}})
+	assert.ErrorContains(t, err, envVarTimeoutTotal)
+}
+
+func TestWithConcurrencyLimit(t *testing.T) {
+	remote := cachers.NewHttpCache("http://127.0.0.1:1", false)
+	for v, want := range map[string]cachers.RemoteCache{
+		"":        remote,
+		"0":       remote,
+		"8":       &cachers.ConcurrencyLimitedRemoteCache{},
+		"auto":    &cachers.AdaptiveRemoteCache{},
+		"auto:64": &cachers.AdaptiveRemoteCache{},
+	} {
+		got, err := withConcurrencyLimit(&mapEnv{m: map[string]string{envVarRemoteConcurrency: v}}, remote)
+		require.NoError(t, err, v)
+		assert.IsType(t, want, got, v)
+	}
+	for _, v := range []string{"-1", "many", "auto:0", "autox", "auto:"} {
+		_, err := withConcurrencyLimit(&mapEnv{m: map[string]string{envVarRemoteConcurrency: v}}, remote)
+		assert.ErrorContains(t, err, envVarRemoteConcurrency, v)
+	}
+}
+
+func TestRemoteHTTPClientPool(t *testing.T) {
+	transport := func(t *testing.T, m map[string]string) *http.Transport {
+		c, err := remoteHTTPClient(&mapEnv{m: m})
+		require.NoError(t, err)
+		require.NotNil(t, c)
+		tr, ok := c.Transport.(*http.Transport)
+		require.True(t, ok)
+		return tr
+	}
+
+	tr := transport(t, map[string]string{envVarHTTPMaxConns: "64", envVarHTTPIdleTimeout: "5m"})
+	assert.Equal(t, 64, tr.MaxConnsPerHost)
+	assert.Equal(t, 64, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 100, tr.MaxIdleConns)
+	assert.Equal(t, 5*time.Minute, tr.IdleConnTimeout)
+	assert.True(t, tr.ForceAttemptHTTP2)
+
+	tr = transport(t, map[string]string{envVarHTTPMaxIdleConns: "256", envVarHTTP2: "0"})
+	assert.Zero(t, tr.MaxConnsPerHost)
+	assert.Equal(t, 256, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 256, tr.MaxIdleConns)
+	assert.False(t, tr.ForceAttemptHTTP2)
+	assert.NotNil(t, tr.TLSNextProto)
+	assert.Empty(t, tr.TLSNextProto)
+	assert.Zero(t, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost, "not modified")
+
+	for k, v := range map[string]string{
+		envVarHTTPMaxConns:     "-1",
+		envVarHTTPMaxIdleConns: "many",
+		envVarHTTPIdleTimeout:  "0s",
+		envVarHTTP2:            "maybe",
+	} {
+		_, err := remoteHTTPClient(&mapEnv{m: map[string]string{k: v}})
+		assert.ErrorContains(t, err, k)
+	}
+}
+
+func TestRemoteHTTPClientTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644))
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, m := range []map[string]string{
+		{envVarTLSCAFile: caFile},
+		{envVarTLSCAFile: caFile, envVarTLSPins: " sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ", " + pin},
+		{envVarTLSCAFile: caFile, envVarTimeoutConnect: "5s", envVarTimeoutRead: "30s"},
+	} {
+		c, err := remoteHTTPClient(&mapEnv{m: m})
+		require.NoError(t, err)
+		res, err := c.Get(srv.URL)
+		require.NoError(t, err, m)
+		res.Body.Close()
+	}
+
+	c, err := remoteHTTPClient(&mapEnv{m: map[string]string{envVarTLSCAFile: caFile, envVarTLSPins: "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))}})
+	require.NoError(t, err)
+	_, err = c.Get(srv.URL)
+	assert.ErrorIs(t, err, cachers.ErrPinMismatch)
+
+	_, err = remoteHTTPClient(&mapEnv{m: map[string]string{envVarTLSPins: "pin"}})
+	assert.ErrorContains(t, err, "invalid pin")
+}
+
+func TestRemoteHTTPClientProxy(t *testing.T) {
+	var got []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.String())
+	}))
+	defer proxy.Close()
+	env := &mapEnv{m: map[string]string{envVarProxy: proxy.URL, "NO_PROXY": "internal.corp"}}
+	c, err := remoteHTTPClient(env)
+	require.NoError(t, err)
+	res, err := c.Get("http://cache.example.com/action/a1")
+	require.NoError(t, err)
+	res.Body.Close()
+	_, err = c.Get("http://cache.internal.corp:1/")
+	assert.Error(t, err, "not proxied")
+	pc, err := proxyClient(env)
+	require.NoError(t, err)
+	res, err = pc.Get("http://kms.example.com/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, []string{"http://cache.example.com/action/a1", "http://kms.example.com/"}, got)
+
+	_, err = remoteHTTPClient(&mapEnv{m: map[string]string{envVarProxy: "ftp://proxy"}})
+	assert.ErrorContains(t, err, envVarProxy)
+	pc, err = proxyClient(&mapEnv{m: map[string]string{}})
+	require.NoError(t, err)
+	assert.Same(t, http.DefaultClient, pc)
+}
+
+func TestProcOptionsMinFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	_, err := procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarMinFreeSpace: "1GB"}})
+	require.NoError(t, err)
+	_, err = procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarMinFreeSpace: "lots"}})
+	assert.ErrorContains(t, err, envVarMinFreeSpace)
+}
+
+func TestProcOptionsErrorMode(t *testing.T) {
+	dir := t.TempDir()
+	_, err := procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarErrorMode: "strict"}})
+	require.NoError(t, err)
+	_, err = procOptions(&mapEnv{m: map[string]string{envVarDiskCacheDir: dir, envVarErrorMode: "lenient"}})
+	assert.ErrorContains(t, err, envVarErrorMode)
+}
+
+func TestDryRun(t *testing.T) {
+	dry, err := dryRun(&mapEnv{})
+	require.NoError(t, err)
+	assert.False(t, dry)
+	dry, err = dryRun(&mapEnv{m: map[string]string{envVarDryRun: "1"}})
+	require.NoError(t, err)
+	assert.True(t, dry)
+	_, err = dryRun(&mapEnv{m: map[string]string{envVarDryRun: "maybe"}})
+	assert.ErrorContains(t, err, envVarDryRun)
+	_, err = procOptions(&mapEnv{m: map[string]string{envVarDryRun: "maybe"}})
+	assert.ErrorContains(t, err, envVarDryRun)
+}
+
+func TestLatencyReport(t *testing.T) {
+	assert.Empty(t, latencyReport(nil))
+	assert.Equal(t, "Request latencies: gets p50 1ms, p95 2ms, p99 4ms.", latencyReport(map[wire.Cmd]cacheproc.Latencies{
+		wire.CmdGet:   {Count: 3, P50: time.Millisecond, P95: 2 * time.Millisecond, P99: 4 * time.Millisecond},
+		wire.CmdClose: {Count: 1, P50: time.Millisecond},
+	}))
+}
+
+func TestWriteSummary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.json")
+	sum := cachers.Summary{Gets: 3, Hits: 2, Misses: 1, TierHits: []cachers.TierHits{{Tier: "local", Hits: 2}}}
+	lat := map[wire.Cmd]cacheproc.Latencies{wire.CmdGet: {Count: 3, P50: time.Millisecond}}
+	require.NoError(t, writeSummary(path, sum, lat))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var got sessionSummary
+	require.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, sessionSummary{Summary: sum, Latencies: lat}, got)
+}
+
+func TestLogSummary(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	logSummary(cachers.Summary{Gets: 3, Hits: 2, Misses: 1, TierHits: []cachers.TierHits{{Tier: "local", Hits: 2}}},
+		map[wire.Cmd]cacheproc.Latencies{wire.CmdGet: {Count: 3, P50: time.Millisecond}})
+	var ev map[string]any
+	require.NoError(t, json.Unmarshal(logs.Bytes(), &ev))
+	assert.Equal(t, "summary", ev["msg"])
+	assert.Equal(t, float64(3), ev["gets"])
+	assert.Equal(t, float64(2), ev["local_hits"])
+	assert.Equal(t, map[string]any{"p50": float64(time.Millisecond), "p95": float64(0), "p99": float64(0)}, ev["get_latency"])
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	want := make([]byte, 32)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	for _, s := range []string{
+		hex.EncodeToString(want),
+		base64.StdEncoding.EncodeToString(want),
+		base64.RawURLEncoding.EncodeToString(want),
+		" " + base64.StdEncoding.EncodeToString(want) + "\n",
+	} {
+		key, err := parseEncryptionKey(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, key, s)
+	}
+
+	_, err := parseEncryptionKey(base64.StdEncoding.EncodeToString(want[:16]))
+	assert.ErrorContains(t, err, "key of 16 bytes")
+	_, err = parseEncryptionKey("not a key!")
+	assert.Error(t, err)
+}
+
+func TestMaybeRemoteCacheEncryption(t *testing.T) {
+	env := &mapEnv{m: map[string]string{
+		envVarHttpCacheServerBase: "http://localhost:8080",
+		envVarEncryptionKey:       hex.EncodeToString(make([]byte, 32)),
+	}}
+	remote, err := maybeRemoteCache(context.Background(), env)
+	require.NoError(t, err)
+	assert.IsType(t, &cachers.EncryptedRemoteCache{}, remote)
+
+	env.m[envVarEncryptionKey] = "secret"
+	_, err = maybeRemoteCache(context.Background(), env)
+	assert.ErrorContains(t, err, envVarEncryptionKey)
+}
+
+func TestParseFaults(t *testing.T) {
+	cfg, err := parseFaults("latency=100ms, jitter=50ms,errors=0.1,corrupt=0.01,seed=7")
+	require.NoError(t, err)
+	assert.Equal(t, cachers.FaultConfig{
+		Latency:     100 * time.Millisecond,
+		Jitter:      50 * time.Millisecond,
+		ErrorRate:   0.1,
+		CorruptRate: 0.01,
+		Seed:        7,
+	}, cfg)
+
+	for _, bad := range []string{"latency", "errors=2", "corrupt=-0.5", "latency=soon", "chaos=1"} {
+		_, err := parseFaults(bad)
+		assert.Error(t, err, bad)
+	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+// A command is a subcommand of go-cacher.
+type command struct {
+	name    string
+	aliases []string
+	summary string
+	// stoppable commands get a context that is done on SIGINT or SIGTERM.
+	stoppable bool
+	// writesConfig commands run without the configuration file when it
+	// cannot be loaded, as they write it.
+	writesConfig bool
+	run          func(ctx context.Context, env Env, args []string) error
+}
+
+var commands = []*command{
+	{name: "run", summary: "serve the GOCACHEPROG protocol over stdin and stdout (the default)", stoppable: true, run: runProc},
+	{name: "serve", aliases: []string{"daemon"}, summary: "serve the cache to many go commands through go-cacher-stub", stoppable: true, run: runDaemon},
+	{name: "stats", summary: "print the size of the local disk cache", run: runStats},
+	{name: "clean", summary: "remove entries from the local disk cache", run: runClean},
+	{name: "verify", summary: "check the entries of the local disk cache", run: runVerify},
+	{name: "warm", summary: "download the entries a build will need", run: runWarm},
+	{name: "export", summary: "write the local disk cache to an archive", run: runExport},
+	{name: "import", summary: "add the entries of an archive to the local disk cache", run: runImport},
+	{name: "doctor", summary: "check the configuration, the local disk cache and the remotes", run: runDoctor},
+	{name: "env", summary: "print the resolved configuration and the backends it selects", run: runEnv},
+	{name: "bench", summary: "measure the throughput and latency of the backends", run: runBench},
+	{name: "replay", summary: "replay a session recorded with --record", run: runReplay},
+	{name: "init", summary: "ask for the settings of a first configuration file and check them", writesConfig: true, run: runInit},
+	{name: "install", summary: "set GOCACHEPROG to go-cacher after checking it works", run: runInstall},
+	{name: "version", summary: "print the version and build metadata of go-cacher", run: runVersion},
+}
+
+func init() {
+	// Added here, as it lists the commands.
+	commands = append(commands, &command{name: "completion", summary: "print the shell completion script for bash, zsh or fish", run: runCompletion})
+}
+
+// lookupCommand returns the command named name, or nil.
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, a := range c.aliases {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprint(w, "usage: go-cacher [flags] [command] [arguments]\n\nThe commands are:\n\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t%-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprint(w, "\nRun \"go-cacher command -h\" for the flags of a command. The flags of\ngo-cacher itself are:\n\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupCommand(t *testing.T) {
+	require.NotNil(t, lookupCommand("serve"))
+	assert.Same(t, lookupCommand("serve"), lookupCommand("daemon"))
+	assert.Equal(t, "warm", lookupCommand("warm").name)
+	assert.Nil(t, lookupCommand("./..."), "other arguments are left to the protocol mode")
+	assert.Nil(t, lookupCommand(""))
+}
+
+func TestDoctor(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "cache")
+	var out bytes.Buffer
+	assert.Zero(t, doctor(ctx, &out, &mapEnv{m: map[string]string{envVarDiskCacheDir: dir}}), out.String())
+	assert.Contains(t, out.String(), "ok    local disk cache "+dir+" is writable")
+	assert.Contains(t, out.String(), "ok    no remote configured")
+
+	down := httptest.NewServer(nil)
+	down.Close()
+	out.Reset()
+	n := doctor(ctx, &out, &mapEnv{m: map[string]string{
+		envVarDiskCacheDir:        dir,
+		envVarHttpCacheServerBase: down.URL,
+		envVarErrorMode:           "lenient",
+	}})
+	assert.Equal(t, 2, n, out.String())
+	assert.Contains(t, out.String(), "FAIL  protocol settings: GOCACHE_ERROR_MODE")
+	assert.Contains(t, out.String(), "FAIL  remote http cache can be read and written: http cache self-check: unreachable")
+	assert.Contains(t, out.String(), "      fix: correct the setting named above")
+
+	t.Run("clock skew", func(t *testing.T) {
+		late := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer late.Close()
+		skew, err := clockSkew(ctx, late.URL+"/")
+		require.NoError(t, err)
+		assert.InDelta(t, time.Hour, skew, float64(time.Minute))
+
+		var out bytes.Buffer
+		doctor(ctx, &out, &mapEnv{m: map[string]string{
+			envVarDiskCacheDir:        dir,
+			envVarHttpCacheServerBase: late.URL,
+		}})
+		assert.Contains(t, out.String(), "FAIL  clock agrees with "+late.URL+"/: off by 1h0m")
+	})
+
+	t.Run("S3 credentials", func(t *testing.T) {
+		assert.NoError(t, checkS3Credentials(&mapEnv{m: map[string]string{}}))
+		assert.NoError(t, checkS3Credentials(&mapEnv{m: map[string]string{
+			envVarS3AwsAccessKey:       "AKIA",
+			envVarS3AwsSecretAccessKey: "secret",
+		}}))
+		assert.ErrorContains(t, checkS3Credentials(&mapEnv{m: map[string]string{
+			envVarS3AwsAccessKey: "AKIA",
+		}}), envVarS3AwsAccessKey+" is set without "+envVarS3AwsSecretAccessKey)
+	})
+
+	t.Run("free space", func(t *testing.T) {
+		_, err := checkFreeSpace(&mapEnv{m: map[string]string{envVarMinFreeSpace: "100000000GB"}}, dir)
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip(err)
+		}
+		assert.ErrorContains(t, err, "below the minimum")
+		_, err = checkFreeSpace(&mapEnv{m: map[string]string{envVarMinFreeSpace: "1"}}, dir)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const completionUsage = `usage: go-cacher completion bash|zsh|fish
+
+Completion writes the script completing the commands and flags of go-cacher
+in the given shell, to be sourced from its configuration, as in
+
+	source <(go-cacher completion bash)
+
+or installed where the shell looks for completions, like
+~/.config/fish/completions/go-cacher.fish for fish.
+
+`
+
+func runCompletion(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("completion", completionUsage)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("want a shell: bash, zsh or fish")
+	}
+	return writeCompletion(os.Stdout, fs.Arg(0), flag.CommandLine)
+}
+
+// A completionFlag is a flag of go-cacher, as completed by the shells.
+type completionFlag struct {
+	name, usage string
+	boolean     bool // takes no value
+}
+
+// completionFlags returns the flags defined in fs.
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+		usage, _, _ := strings.Cut(f.Usage, "\n")
+		flags = append(flags, completionFlag{name: f.Name, usage: usage, boolean: ok && bf.IsBoolFlag()})
+	})
+	return flags
+}
+
+// writeCompletion writes the completion script for shell of the commands
+// and of the flags in fs to w.
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	flags := completionFlags(fs)
+	var b strings.Builder
+	switch shell {
+	case "bash":
+		var names, flagNames []string
+		for _, c := range commands {
+			names = append(names, c.name)
+			names = append(names, c.aliases...)
+		}
+		for _, f := range flags {
+			flagNames = append(flagNames, "--"+f.name)
+		}
+		fmt.Fprintf(&b, `# bash completion for go-cacher.
+_go_cacher() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 || ${COMP_WORDS[COMP_CWORD-1]} == -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+	fi
+}
+complete -o default -F _go_cacher go-cacher
+`, strings.Join(flagNames, " "), strings.Join(names, " "))
+	case "zsh":
+		b.WriteString("#compdef go-cacher\n\n_go_cacher() {\n\tlocal -a commands\n\tcommands=(\n")
+		for _, c := range commands {
+			for _, name := range append([]string{c.name}, c.aliases...) {
+				fmt.Fprintf(&b, "\t\t%s\n", shellQuote(name+":"+c.summary))
+			}
+		}
+		b.WriteString("\t)\n\t_arguments \\\n")
+		for _, f := range flags {
+			desc := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(f.usage)
+			if f.boolean {
+				fmt.Fprintf(&b, "\t\t%s \\\n", shellQuote("--"+f.name+"["+desc+"]"))
+			} else {
+				fmt.Fprintf(&b, "\t\t%s \\\n", shellQuote("--"+f.name+"=["+desc+"]:value:"))
+			}
+		}
+		b.WriteString("\t\t'1: :->command' \\\n\t\t'*:: :_files'\n")
+		b.WriteString("\tcase $state in\n\tcommand) _describe command commands ;;\n\tesac\n}\n\n_go_cacher \"$@\"\n")
+	case "fish":
+		b.WriteString("# fish completion for go-cacher.\ncomplete -c go-cacher -f\n")
+		for _, c := range commands {
+			for _, name := range append([]string{c.name}, c.aliases...) {
+				fmt.Fprintf(&b, "complete -c go-cacher -n __fish_use_subcommand -a %s -d %s\n", name, fishQuote(c.summary))
+			}
+		}
+		for _, f := range flags {
+			fmt.Fprintf(&b, "complete -c go-cacher -l %s", f.name)
+			if !f.boolean {
+				b.WriteString(" -r")
+			}
+			fmt.Fprintf(&b, " -d %s\n", fishQuote(f.usage))
+		}
+	default:
+		return fmt.Errorf("unknown shell %q; want bash, zsh or fish", shell)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fishQuote quotes s for fish, in which backslashes escape single quotes.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	fs := flag.NewFlagSet("go-cacher", flag.ContinueOnError)
+	fs.Bool("verbose", false, "be verbose")
+	fs.String("miss-log", "", "append every cache miss to this file [one per line]")
+	registerSettingFlags(fs, map[string]string{})
+
+	for shell, want := range map[string][]string{
+		"bash": {"complete -o default -F _go_cacher go-cacher", "--miss-log", "--s3-bucket", "warm"},
+		"zsh":  {"#compdef go-cacher", `'--verbose[be verbose]'`, `'--miss-log=[append every cache miss to this file \[one per line\]]:value:'`, `'daemon:serve the cache`},
+		"fish": {"complete -c go-cacher -l verbose -d 'be verbose'", "complete -c go-cacher -l s3-bucket -r", "-a doctor -d"},
+	} {
+		t.Run(shell, func(t *testing.T) {
+			var out bytes.Buffer
+			require.NoError(t, writeCompletion(&out, shell, fs))
+			for _, w := range want {
+				assert.Contains(t, out.String(), w)
+			}
+			if path, err := exec.LookPath(shell); err == nil {
+				script := filepath.Join(t.TempDir(), "completion")
+				require.NoError(t, os.WriteFile(script, out.Bytes(), 0644))
+				check := exec.Command(path, "-n", script)
+				if shell == "fish" {
+					check = exec.Command(path, "--no-execute", script)
+				}
+				outb, err := check.CombinedOutput()
+				assert.NoError(t, err, "%s", outb)
+			}
+		})
+	}
+
+	assert.Error(t, writeCompletion(&bytes.Buffer{}, "tcsh", fs))
+}
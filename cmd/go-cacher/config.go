@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnv is the environment of the process, falling back to the
+// settings of the configuration files for the variables it doesn't set.
+type configEnv struct {
+	vars    map[string]string
+	origins map[string]string // the path of the file setting each of vars
+}
+
+func (e *configEnv) Get(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return e.vars[key]
+}
+
+// defaultConfigFile returns the path of the configuration file read when
+// --config isn't given, in the user's configuration directory, like
+// $XDG_CONFIG_HOME/go-cacher/config.yaml.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-cacher", "config.yaml")
+}
+
+// A configDoc is the settings of a YAML configuration file, by the
+// environment variable they stand for, and of its named profiles.
+type configDoc struct {
+	vars     map[string]string
+	profiles map[string]map[string]string
+}
+
+// loadConfigFile reads the YAML file at path. Keys are the names of the
+// variables without their GOCACHE_ prefix, in any case, and may be nested:
+//
+//	s3:
+//	  bucket: my-cache
+//	remote_read_mode: race
+//	profiles:
+//	  work:
+//	    s3_bucket: work-cache
+//
+// sets GOCACHE_S3_BUCKET and GOCACHE_REMOTE_READ_MODE, and overrides the
+// bucket in the profile "work". Lists are joined with commas, for the
+// settings that take several values.
+func loadConfigFile(path string) (*configDoc, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	f := &configDoc{vars: map[string]string{}, profiles: map[string]map[string]string{}}
+	for k, v := range doc {
+		if !strings.EqualFold(k, "profiles") {
+			continue
+		}
+		delete(doc, k)
+		profiles, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: profiles: want a map of profiles by name", path)
+		}
+		for name, v := range profiles {
+			settings, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: profile %s: want a map of settings", path, name)
+			}
+			vars := map[string]string{}
+			if err := flattenConfig(vars, "", settings); err != nil {
+				return nil, fmt.Errorf("%s: profile %s: %w", path, name, err)
+			}
+			f.profiles[name] = vars
+		}
+	}
+	if err := flattenConfig(f.vars, "", doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func flattenConfig(vars map[string]string, prefix string, m map[string]any) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := prefix + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if prefix == "" && !strings.HasPrefix(key, "GOCACHE_") {
+			key = "GOCACHE_" + key
+		}
+		switch v := m[k].(type) {
+		case map[string]any:
+			if err := flattenConfig(vars, key+"_", v); err != nil {
+				return err
+			}
+		case []any:
+			var parts []string
+			for _, e := range v {
+				s, err := configScalar(key, e)
+				if err != nil {
+					return err
+				}
+				parts = append(parts, s)
+			}
+			vars[key] = strings.Join(parts, ",")
+		default:
+			s, err := configScalar(key, v)
+			if err != nil {
+				return err
+			}
+			vars[key] = s
+		}
+	}
+	return nil
+}
+
+func configScalar(key string, v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string, bool, int, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("%s: unsupported value %v", key, v)
+}
+
+// projectConfigName is the name of the configuration file of a project,
+// looked for in the working directory and its parents.
+const projectConfigName = ".go-cacher.yaml"
+
+// projectSettings are the settings a project configuration file may set:
+// where and how the entries are cached, but no credential, command, path,
+// endpoint or URL, lest a cloned repository run commands on the next
+// build, or read the files of the developer and send them to a server of
+// its choosing.
+var projectSettings = []string{
+	envVarBackends,
+	envVarS3BucketName,
+	envVarS3Prefix,
+	envVarS3CacheRegion,
+	envVarKeySuffix,
+	envVarRemoteReadMode,
+	envVarRemoteWriteMode,
+	envVarRemoteMinUploadSize,
+	envVarRemoteMaxUploadSize,
+	envVarAsyncUploads,
+	envVarPopulateLocal,
+	envVarCompression,
+	envVarCompressionMinSize,
+	envVarTags,
+}
+
+// checkProjectConfig returns an error if the project configuration file at
+// path sets vars it may not, or refers to secrets, as with "exec:".
+func checkProjectConfig(path string, vars map[string]string) error {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !slices.Contains(projectSettings, k) {
+			return fmt.Errorf("%s: %s can't be set by a project configuration file", path, k)
+		}
+		switch kind, _, _ := strings.Cut(vars[k], ":"); kind {
+		case "file", "env", "exec":
+			return fmt.Errorf("%s: %s: a project configuration file can't refer to %s: secrets", path, k, kind)
+		}
+	}
+	return nil
+}
+
+// findProjectConfig returns the path of the nearest project configuration
+// file in dir or its parents, or "" if there is none.
+func findProjectConfig(dir string) string {
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadConfigEnv returns the environment of the process over the settings
+// of the configuration file at path, or the default one if path is empty,
+// which may not exist, over those of the project configuration file found
+// from dir, if dir isn't empty. The project's settings come last, so that
+// a repository cannot override what a user configured, and may only be
+// projectSettings. The settings of
+// the profile named profile, or else by GOCACHE_PROFILE in the files,
+// override the others of the files.
+func loadConfigEnv(path, dir, profile string) (Env, error) {
+	type file struct {
+		path string
+		*configDoc
+	}
+	var files []file
+	if dir != "" {
+		if project := findProjectConfig(dir); project != "" {
+			f, err := loadConfigFile(project)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkProjectConfig(project, f.vars); err != nil {
+				return nil, err
+			}
+			for name, vars := range f.profiles {
+				if err := checkProjectConfig(project+" (profile "+name+")", vars); err != nil {
+					return nil, err
+				}
+			}
+			files = append(files, file{project, f})
+		}
+	}
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile()
+	}
+	if path != "" {
+		f, err := loadConfigFile(path)
+		switch {
+		case err == nil:
+			files = append(files, file{path, f})
+		case explicit || !errors.Is(err, fs.ErrNotExist):
+			return nil, err
+		}
+	}
+
+	e := &configEnv{vars: map[string]string{}, origins: map[string]string{}}
+	add := func(path string, vars map[string]string) {
+		for k, v := range vars {
+			e.vars[k] = v
+			e.origins[k] = path
+		}
+	}
+	for _, f := range files {
+		add(f.path, f.vars)
+	}
+	if profile == "" {
+		profile = e.vars[envVarProfile]
+	}
+	if profile != "" {
+		found := false
+		for _, f := range files {
+			if vars, ok := f.profiles[profile]; ok {
+				add(f.path+" (profile "+profile+")", vars)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: no profile %q in the configuration files", envVarProfile, profile)
+		}
+	}
+	if len(e.vars) == 0 {
+		return osEnv{}, nil
+	}
+	return e, nil
+}
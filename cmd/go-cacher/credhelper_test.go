@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCredentialHelper writes a credential helper script printing out,
+// which logs its arguments and input to the returned file.
+func writeCredentialHelper(t *testing.T, out string) (helper, log string) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	helper, log = filepath.Join(dir, "helper"), filepath.Join(dir, "log")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\ncat >> " + log + "\necho '" + out + "'\n"
+	require.NoError(t, os.WriteFile(helper, []byte(script), 0755))
+	return helper, log
+}
+
+func TestCredentialHelper(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("runs the helper again when the credentials expire", func(t *testing.T) {
+		expires := time.Now().Add(credentialRefreshMargin / 2).UTC().Format(time.RFC3339)
+		helper, log := writeCredentialHelper(t, `{"token": "t0ken", "expires": "`+expires+`"}`)
+		h, err := newCredentialHelper(&mapEnv{m: map[string]string{envVarCredentialHelper: helper + " --flag"}}, "https://cache.example.com")
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			creds, err := h.get(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "t0ken", creds.Token)
+		}
+		b, err := os.ReadFile(log)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("--flag get\n{\"uri\":\"https://cache.example.com\"}\n", 2), string(b))
+	})
+
+	t.Run("keeps the credentials that don't expire", func(t *testing.T) {
+		helper, log := writeCredentialHelper(t, `{"accessKeyId": "AKID", "secretAccessKey": "SECRET"}`)
+		h, err := newCredentialHelper(&mapEnv{m: map[string]string{envVarCredentialHelper: helper}}, "s3://bucket")
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			creds, err := h.Retrieve(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "AKID", creds.AccessKeyID)
+			assert.False(t, creds.CanExpire)
+		}
+		b, err := os.ReadFile(log)
+		require.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(string(b), "get\n"))
+
+		_, err = withCredentialHelper(nil, h).Get("http://127.0.0.1:1/")
+		assert.ErrorContains(t, err, "no token")
+	})
+
+	t.Run("sends the token", func(t *testing.T) {
+		helper, _ := writeCredentialHelper(t, `{"token": "t0ken"}`)
+		var got string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+		remotes, err := httpCaches(&mapEnv{m: map[string]string{
+			envVarHttpCacheServerBase: srv.URL,
+			envVarCredentialHelper:    helper,
+		}})
+		require.NoError(t, err)
+		require.Len(t, remotes, 1)
+		_, _, _, err = remotes[0].Get(ctx, "a1")
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer t0ken", got)
+	})
+
+	t.Run("fails with the helper", func(t *testing.T) {
+		h, err := newCredentialHelper(&mapEnv{m: map[string]string{envVarCredentialHelper: "false"}}, "s3://bucket")
+		require.NoError(t, err)
+		_, err = h.Retrieve(ctx)
+		assert.ErrorContains(t, err, "credential helper for s3://bucket")
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/internal/daemon"
+)
+
+const daemonUsage = `usage: go-cacher serve [flags]
+
+Serve, or daemon, serves the cache to many go commands at once, so that they share its
+remote connections, credentials and in-memory state instead of setting them
+up for every build. Set GOCACHEPROG to go-cacher-stub, which connects each go
+command to the daemon. The daemon listens on a Unix socket, or a named pipe
+on Windows, which defaults to $GOCACHE_DAEMON_SOCKET, or daemon.sock in the
+default cache directory (\\.\pipe\go-cacher-<SID> on Windows).
+
+`
+
+func runDaemon(ctx context.Context, env Env, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), daemonUsage)
+		fs.PrintDefaults()
+	}
+	defaultAddr, err := daemon.Addr()
+	if err != nil {
+		return err
+	}
+	addr := fs.String("socket", defaultAddr, "listen on the Unix socket, or named pipe on Windows, at `path`")
+	_ = fs.Parse(args)
+
+	opts, err := procOptions(env)
+	if err != nil {
+		return configErr(err)
+	}
+	ctx, stopTracing, err := startTracing(ctx, env)
+	if err != nil {
+		return configErr(err)
+	}
+	defer stopTracing()
+	cache, reload := getCache(ctx, env, *verbose)
+	if reload != nil {
+		go reloadOnHangup(ctx, reload)
+	}
+	ln, err := daemon.Listen(*addr)
+	if err != nil {
+		return err
+	}
+	if err := cache.Start(ctx); err != nil {
+		ln.Close()
+		return err
+	}
+	if addr := env.Get(envVarDebugAddr); addr != "" {
+		if err := serveDebug(addr, nil, cache); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	if addr := env.Get(envVarHealthAddr); addr != "" {
+		h, err := newHealthServer(env, cache)
+		if err != nil {
+			ln.Close()
+			return configErr(err)
+		}
+		if err := serveHealth(addr, h); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	metricsCfg, err := newMetricsConfig(ctx, env)
+	if err != nil {
+		ln.Close()
+		return configErr(err)
+	}
+	if addr := env.Get(envVarMetricsAddr); addr != "" {
+		if err := serveMetrics(addr, metricsCfg, nil, cache); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+	stopMetrics, err := startMetricsSinks(env, metricsCfg, nil, cache)
+	if err != nil {
+		ln.Close()
+		return configErr(err)
+	}
+	slog.Info("daemon listening", "socket", *addr)
+	err = serveDaemon(ctx, ln, cache, opts)
+	stopMetrics()
+	if cerr := cache.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// serveDaemon serves the protocol to each connection accepted on ln, all
+// sharing cache, until ctx is done, and waits for the sessions to end.
+// Sessions stop reading requests when ctx is done.
+func serveDaemon(ctx context.Context, ln net.Listener, cache cachers.LocalCache, opts []cacheproc.Option) error {
+	opts = append(opts[:len(opts):len(opts)], cacheproc.WithSharedCache())
+	defer ln.Close()
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if err := cacheproc.NewCacheProc(cache, opts...).Serve(ctx, conn, conn); err != nil {
+				slog.Warn("session failed", "err", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/internal/daemon"
+	"github.com/bradfitz/go-tool-cache/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// daemonSession sends the requests, given as JSON lines, to the daemon at
+// addr and returns its responses by ID.
+func daemonSession(t *testing.T, addr string, lines ...string) map[int64]*wire.Response {
+	t.Helper()
+	conn, err := daemon.Dial(addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, line := range lines {
+		_, err := fmt.Fprintln(conn, line)
+		require.NoError(t, err)
+	}
+	require.NoError(t, daemon.CloseWrite(conn))
+	responses := map[int64]*wire.Response{}
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		res := new(wire.Response)
+		require.NoError(t, json.Unmarshal(sc.Bytes(), res))
+		responses[res.ID] = res
+	}
+	return responses
+}
+
+func TestServeDaemon(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := filepath.Join(t.TempDir(), "d.sock")
+	ln, err := daemon.Listen(addr)
+	require.NoError(t, err)
+	cache := cachers.NewLocalCacheWithCounts(cachers.NewSimpleDiskCache(false, t.TempDir()), "local", false)
+	require.NoError(t, cache.Start(ctx))
+	done := make(chan error)
+	go func() {
+		done <- serveDaemon(ctx, ln, cache, nil)
+	}()
+
+	// The entry put by one session is a hit for the next one.
+	res := daemonSession(t, addr,
+		`{"ID":1,"Command":"put","ActionID":"qg==","OutputID":"uw==","BodySize":5}`,
+		`"aGVsbG8="`,
+		`{"ID":2,"Command":"close"}`,
+	)
+	assert.Empty(t, res[1].Err)
+	assert.Empty(t, res[2].Err)
+	res = daemonSession(t, addr,
+		`{"ID":1,"Command":"get","ActionID":"qg=="}`,
+		`{"ID":2,"Command":"close"}`,
+	)
+	assert.False(t, res[1].Miss)
+	assert.Equal(t, int64(5), res[1].Size)
+	assert.Equal(t, &wire.Stats{Gets: 1, Hits: 1}, res[2].Stats)
+
+	cancel()
+	require.NoError(t, <-done)
+	_, err = net.Dial("unix", addr)
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+)
+
+// debugVars is the state of the session published as the "go-cacher"
+// expvar.
+type debugVars struct {
+	Requests  wire.Stats
+	Latencies map[wire.Cmd]cacheproc.Latencies
+	InFlight  int64
+	Queues    cachers.QueueStats
+	Tiers     []cachers.TierStats
+}
+
+// currentDebugVars returns the state of cache and of the session proc, if
+// any: a daemon serves many sessions.
+func currentDebugVars(proc *cacheproc.Process, cache cachers.Cache) debugVars {
+	vars := debugVars{
+		Queues: cachers.CacheQueues(cache),
+		Tiers:  cachers.CacheStats(cache),
+	}
+	if proc != nil {
+		vars.Requests = proc.Stats()
+		vars.Latencies = proc.Latencies()
+		vars.InFlight = proc.InFlight()
+	}
+	return vars
+}
+
+// debugHandler serves the expvars at /debug/vars and pprof at /debug/pprof/.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serveDebug publishes the state of the session proc, which may be nil,
+// and serves debugHandler on addr in the background, so that a stuck or
+// slow session can be inspected and profiled. An addr without a host, like
+// ":6060", listens on localhost only.
+func serveDebug(addr string, proc *cacheproc.Process, cache cachers.Cache) error {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	expvar.Publish("go-cacher", expvar.Func(func() any {
+		return currentDebugVars(proc, cache)
+	}))
+	slog.Info("debug server listening", "addr", ln.Addr().String())
+	go func() {
+		if err := http.Serve(ln, debugHandler()); err != nil {
+			slog.Error("debug server failed", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugVars(t *testing.T) {
+	ctx := context.Background()
+	cache := cachers.NewLocalCacheWithCounts(cachers.NewSimpleDiskCache(false, t.TempDir()), "local", false)
+	require.NoError(t, cache.Start(ctx))
+	_, _, err := cache.Get(ctx, "a1")
+	require.NoError(t, err)
+
+	vars := currentDebugVars(cacheproc.NewCacheProc(cache), cache)
+	assert.Zero(t, vars.InFlight)
+	require.Len(t, vars.Tiers, 1)
+	assert.Equal(t, int64(1), vars.Tiers[0].Misses)
+
+	vars = currentDebugVars(nil, cache)
+	assert.Zero(t, vars.Requests)
+	require.Len(t, vars.Tiers, 1)
+}
+
+func TestDebugHandler(t *testing.T) {
+	srv := httptest.NewServer(debugHandler())
+	defer srv.Close()
+	for _, path := range []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/goroutine?debug=1"} {
+		res, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, path)
+	}
+}
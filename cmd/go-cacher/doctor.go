@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const doctorUsage = `usage: go-cacher doctor
+
+Doctor checks that the go command supports GOCACHEPROG, the configuration,
+that the local disk cache is writable and has space left, the credentials,
+the clocks of the remotes, and that the remotes can be reached, read and,
+unless in read-only mode, written. It reports what is wrong, with how to
+fix it, to diagnose a cache that doesn't work before running a build with
+it.
+
+`
+
+const (
+	// doctorMinFreeSpace is the free space below which doctor reports the
+	// disk of the local cache as full, unless GOCACHE_MIN_FREE_SPACE is set.
+	doctorMinFreeSpace = 1 << 30
+	// maxClockSkew is the clock difference with a remote above which
+	// doctor reports it. S3 rejects requests more than 15 minutes off.
+	maxClockSkew = 5 * time.Minute
+)
+
+func runDoctor(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("doctor", doctorUsage)
+	_ = fs.Parse(args)
+	if n := doctor(ctx, os.Stdout, env); n > 0 {
+		return fmt.Errorf("found %d problems", n)
+	}
+	return nil
+}
+
+// doctor runs the checks of go-cacher doctor, reporting them to w, and
+// returns the number that failed.
+func doctor(ctx context.Context, w io.Writer, env Env) (failed int) {
+	check := func(what string, err error, fix string) bool {
+		if err != nil {
+			fmt.Fprintf(w, "FAIL  %s: %v\n", what, err)
+			fmt.Fprintf(w, "      fix: %s\n", fix)
+			failed++
+			return false
+		}
+		fmt.Fprintf(w, "ok    %s\n", what)
+		return true
+	}
+	const fixSetting = "correct the setting named above; go-cacher env shows where it comes from"
+
+	tc := currentToolchain(ctx, env)
+	check("go command "+tc.GoVersion+" supports GOCACHEPROG", checkCacheProg(tc),
+		"install go1.24 or later, or set GOEXPERIMENT=cacheprog for go1.21 to go1.23")
+
+	_, err := procOptions(env)
+	check("protocol settings", err, fixSetting)
+	_, err = remoteTierPolicy(env)
+	check("remote tier settings", err, fixSetting)
+	ro, err := readOnly(env)
+	check("read-only setting", err, fixSetting)
+	if !ro {
+		ro, _ = remotesReadOnly(env)
+	}
+
+	dir := getDir(env)
+	dc := cachers.NewSimpleDiskCache(false, dir)
+	if check("local disk cache "+dir+" is writable", checkWritable(dir),
+		"fix the permissions of the directory, or set "+envVarDiskCacheDir+" to a writable one") {
+		u, err := dc.Usage()
+		check("local disk cache holds "+u.String(), err,
+			"run go-cacher verify -fix to remove the broken entries")
+		if free, err := checkFreeSpace(env, dir); !errors.Is(err, errors.ErrUnsupported) {
+			check(fmt.Sprintf("local disk cache has %.2f GB free", float64(free)/(1<<30)), err,
+				"free up space, remove old entries with go-cacher clean -older-than=720h, or set "+envVarDiskCacheDir+" to a larger disk")
+		}
+	}
+
+	if s3Configured(env) {
+		check("S3 credentials", checkS3Credentials(env),
+			"set both "+envVarS3AwsAccessKey+" and "+envVarS3AwsSecretAccessKey+", or "+envVarS3AwsCredsProfile+" instead")
+	}
+
+	remote, err := maybeRemoteCache(ctx, env)
+	switch {
+	case err != nil:
+		check("remote settings", err, fixSetting)
+	case remote == nil:
+		fmt.Fprintf(w, "ok    no remote configured\n")
+	default:
+		ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+		defer cancel()
+		for _, u := range clockURLs(env) {
+			skew, err := clockSkew(ctx, u)
+			if err != nil {
+				continue // an unreachable remote fails the self-check below
+			}
+			if skew > maxClockSkew || skew < -maxClockSkew {
+				err = fmt.Errorf("off by %v", skew.Round(time.Second))
+			}
+			check("clock agrees with "+u, err,
+				"synchronize the clock, with NTP: remotes reject or misdate requests from a clock that is off")
+		}
+		what := "remote " + remote.Kind() + " cache can be read and written"
+		fix := "check that the remote is reachable from here, and that the credentials may read and write it; set " + envVarReadOnly + "=1 if they may only read"
+		if ro {
+			what = "remote " + remote.Kind() + " cache can be read"
+			fix = "check that the remote is reachable from here, and that the credentials may read it"
+		}
+		check(what, cachers.SelfCheck(ctx, remote, !ro), fix)
+	}
+	return failed
+}
+
+// checkWritable checks that files can be created in dir, creating it if
+// needed.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "go-cacher-doctor-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkFreeSpace returns the free space of the file system of dir, and an
+// error if it is below GOCACHE_MIN_FREE_SPACE, or doctorMinFreeSpace if
+// that isn't set.
+func checkFreeSpace(env Env, dir string) (int64, error) {
+	free, err := cacheproc.FreeSpace(dir)
+	if err != nil {
+		return 0, err
+	}
+	minFree := int64(doctorMinFreeSpace)
+	if v := env.Get(envVarMinFreeSpace); v != "" {
+		if minFree, err = parseByteSize(v); err != nil {
+			return free, fmt.Errorf("%s: %w", envVarMinFreeSpace, err)
+		}
+	}
+	if free < minFree {
+		return free, fmt.Errorf("below the minimum of %.2f GB", float64(minFree)/(1<<30))
+	}
+	return free, nil
+}
+
+// s3Configured reports whether env selects the S3 backend.
+func s3Configured(env Env) bool {
+	selected, err := backends(env)
+	if err != nil {
+		return false
+	}
+	for _, b := range selected {
+		if b == "s3" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkS3Credentials returns an error if only half of the static
+// credentials are set, which getAwsConfigFromEnv would silently ignore.
+func checkS3Credentials(env Env) error {
+	accessKey, secretKey := env.Get(envVarS3AwsAccessKey), env.Get(envVarS3AwsSecretAccessKey)
+	switch {
+	case accessKey != "" && secretKey == "":
+		return fmt.Errorf("%s is set without %s, so both are ignored", envVarS3AwsAccessKey, envVarS3AwsSecretAccessKey)
+	case accessKey == "" && secretKey != "":
+		return fmt.Errorf("%s is set without %s, so both are ignored", envVarS3AwsSecretAccessKey, envVarS3AwsAccessKey)
+	}
+	return nil
+}
+
+// clockURLs returns the URLs of the selected remotes whose clocks doctor
+// compares with the local one.
+func clockURLs(env Env) []string {
+	selected, err := backends(env)
+	if err != nil {
+		return nil
+	}
+	var urls []string
+	for _, b := range selected {
+		switch b {
+		case "http":
+			for _, base := range strings.Split(env.Get(envVarHttpCacheServerBase), ",") {
+				if base = strings.TrimSpace(base); base != "" {
+					urls = append(urls, base+"/")
+				}
+			}
+		case "s3":
+			u := env.Get(envVarS3CacheURL)
+			if u == "" {
+				region := env.Get(envVarS3CacheRegion)
+				if region == "" {
+					region = "us-east-1"
+				}
+				u = "https://s3." + region + ".amazonaws.com"
+			}
+			urls = append(urls, strings.TrimSuffix(u, "/")+"/")
+		}
+	}
+	return urls
+}
+
+// clockSkew returns how far ahead the local clock is of the one of the
+// server at url, from the Date header of its answer to a HEAD request.
+func clockSkew(ctx context.Context, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	before := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	local := before.Add(time.Since(before) / 2)
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("%s: no Date header", url)
+	}
+	return local.Sub(date), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+const envUsage = `usage: go-cacher env [-a]
+
+Env prints the settings go-cacher resolves from its flags, environment
+variables, env file and configuration file, with where each comes from and
+secrets masked, followed by the backends they select and why, to diagnose
+a misconfiguration without running a build.
+
+`
+
+func runEnv(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("env", envUsage)
+	all := fs.Bool("a", false, "also list the settings that aren't set")
+	_ = fs.Parse(args)
+	writeEnv(os.Stdout, env, *all)
+	return nil
+}
+
+// writeEnv writes the settings of env to w, one KEY=VALUE line each, with
+// their source, followed by the backends it selects. Unset settings are
+// only written if all is set.
+func writeEnv(w io.Writer, env Env, all bool) {
+	for _, key := range settings {
+		v := env.Get(key)
+		if v == "" && !all {
+			continue
+		}
+		line := key + "=" + maskSetting(key, v)
+		if src := settingSource(env, key); src != "" {
+			line = fmt.Sprintf("%-50s # %s", line, src)
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w)
+	for _, line := range explainBackends(env) {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// A sourcedEnv can tell where the value of a setting comes from.
+type sourcedEnv interface {
+	source(key string) string
+}
+
+func (osEnv) source(key string) string {
+	if _, ok := os.LookupEnv(key); ok {
+		return "environment"
+	}
+	return ""
+}
+
+func (e *configEnv) source(key string) string {
+	if _, ok := os.LookupEnv(key); ok {
+		return "environment"
+	}
+	return e.origins[key]
+}
+
+func (e *fileEnv) source(key string) string {
+	if _, ok := e.vars[key]; ok {
+		return e.origin
+	}
+	return settingSource(e.base, key)
+}
+
+// settingSource returns where the value of the setting key in env comes
+// from, or "" if it isn't set or env can't tell.
+func settingSource(env Env, key string) string {
+	if se, ok := env.(sourcedEnv); ok {
+		return se.source(key)
+	}
+	return ""
+}
+
+// maskSetting returns the value v of the setting key with any secret in it
+// masked: credentials entirely, and the passwords of URLs.
+func maskSetting(key, v string) string {
+	if v == "" {
+		return ""
+	}
+	if slices.Contains(secretSettings, key) {
+		return "********"
+	}
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		if u, err := url.Parse(strings.TrimSpace(p)); err == nil && u.User != nil {
+			parts[i] = u.Redacted()
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// explainBackends describes the backends env selects and, for those it
+// doesn't, why not.
+func explainBackends(env Env) []string {
+	if dry, _ := dryRun(env); dry {
+		return []string{"backends: none, a dry run (" + envVarDryRun + ") stores nothing"}
+	}
+	selected, err := backends(env)
+	if err != nil {
+		return []string{"backends: " + err.Error()}
+	}
+	why := "default"
+	switch {
+	case env.Get(envVarBackends) != "":
+		why = "listed in " + envVarBackends
+	case httpIgnored(env):
+		why = "S3 rather than HTTP, as both are configured"
+	}
+	lines := []string{"backends: " + strings.Join(selected, ", ") + " (" + why + ")"}
+	if ro, _ := readOnly(env); ro {
+		lines = append(lines, "  read-only ("+envVarReadOnly+"): nothing is written to the remotes")
+	} else if ro, _ := remotesReadOnly(env); ro {
+		lines = append(lines, "  split credentials ("+envVarSplitCredentials+") without write credentials: nothing is written to the remotes")
+	} else if verifyOnly(env) {
+		lines = append(lines, "  trusted keys ("+envVarSigningTrustedKeys+") without a signing key: nothing is written to the remotes")
+	}
+	isSelected := map[string]bool{}
+	for _, b := range selected {
+		isSelected[b] = true
+	}
+
+	lines = append(lines, "  disk: "+getDir(env))
+
+	switch base := env.Get(envVarHttpCacheServerBase); {
+	case isSelected["http"]:
+		lines = append(lines, "  http: "+maskSetting(envVarHttpCacheServerBase, base))
+	case base == "":
+		lines = append(lines, "  http: not used, "+envVarHttpCacheServerBase+" is not set")
+	case httpIgnored(env):
+		lines = append(lines, "  http: not used, ignored for S3 unless both are listed in "+envVarBackends)
+	default:
+		lines = append(lines, "  http: not used, not listed in "+envVarBackends)
+	}
+
+	switch bucket := env.Get(envVarS3BucketName); {
+	case isSelected["s3"]:
+		region := env.Get(envVarS3CacheRegion)
+		if region == "" {
+			region = "us-east-1 (default)"
+		}
+		lines = append(lines, fmt.Sprintf("  s3: bucket %s in %s, %s", bucket, region, s3Credentials(env)))
+	case bucket == "":
+		lines = append(lines, "  s3: not used, "+envVarS3BucketName+" is not set")
+	default:
+		lines = append(lines, "  s3: not used, not listed in "+envVarBackends)
+	}
+	return lines
+}
+
+// s3Credentials describes which credentials the S3 cache uses, following
+// getAwsConfigFromEnv.
+func s3Credentials(env Env) string {
+	accessKey, secretKey := env.Get(envVarS3AwsAccessKey), env.Get(envVarS3AwsSecretAccessKey)
+	switch {
+	case accessKey != "" && secretKey != "" || env.Get(envVarS3AwsSessionToken) != "":
+		return "static credentials"
+	case env.Get(envVarCredentialHelper) != "":
+		return "credentials of " + envVarCredentialHelper
+	case env.Get(envVarS3AwsRoleArn) != "":
+		return "role " + env.Get(envVarS3AwsRoleArn) + " assumed with the OIDC token of the job"
+	case env.Get(envVarS3AwsCredsProfile) != "":
+		return "credentials of profile " + env.Get(envVarS3AwsCredsProfile)
+	case accessKey != "" || secretKey != "":
+		return fmt.Sprintf("default AWS credentials (%s and %s must both be set to be used)", envVarS3AwsAccessKey, envVarS3AwsSecretAccessKey)
+	default:
+		return "default AWS credentials"
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileEnv is an Env of settings read from a file, falling back to base for
+// the ones the file doesn't set.
+type fileEnv struct {
+	vars   map[string]string
+	base   Env
+	origin string // where vars come from, like the path of the file
+}
+
+func (e *fileEnv) Get(key string) string {
+	if v, ok := e.vars[key]; ok {
+		return v
+	}
+	return e.base.Get(key)
+}
+
+// loadEnvFile returns the settings of the file at path, one KEY=VALUE per
+// line, over base. Blank lines and lines starting with # are ignored, and
+// values may be quoted.
+func loadEnvFile(path string, base Env) (Env, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		vars[strings.TrimSpace(k)] = v
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return &fileEnv{vars: vars, base: base, origin: path}, nil
+}
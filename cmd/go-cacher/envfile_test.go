@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-cacher.env")
+	require.NoError(t, os.WriteFile(path, []byte(`
+# rotated by the credentials helper
+GOCACHE_AWS_ACCESS_KEY=AKIA123
+export GOCACHE_AWS_SECRET_ACCESS_KEY="s3cr=t"
+GOCACHE_S3_PREFIX = 'team'
+`), 0644))
+	base := &mapEnv{m: map[string]string{
+		envVarS3AwsAccessKey: "old",
+		envVarS3BucketName:   "bucket",
+	}}
+	env, err := loadEnvFile(path, base)
+	require.NoError(t, err)
+	assert.Equal(t, "AKIA123", env.Get(envVarS3AwsAccessKey))
+	assert.Equal(t, "s3cr=t", env.Get(envVarS3AwsSecretAccessKey))
+	assert.Equal(t, "team", env.Get(envVarS3Prefix))
+	assert.Equal(t, "bucket", env.Get(envVarS3BucketName), "unset keys fall back to the base")
+
+	require.NoError(t, os.WriteFile(path, []byte("GOCACHE_S3_BUCKET\n"), 0644))
+	_, err = loadEnvFile(path, base)
+	assert.ErrorContains(t, err, ":1: want KEY=VALUE")
+
+	_, err = loadEnvFile(filepath.Join(t.TempDir(), "missing"), base)
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+)
+
+// The exit codes of go-cacher, for wrapper scripts and CI to tell why it
+// failed. Usage errors exit with 2, like those of the flag package.
+const (
+	exitError    = 1 // any other error
+	exitConfig   = 3 // invalid settings or configuration files
+	exitAuth     = 4 // a remote rejected the credentials
+	exitProtocol = 5 // cmd/go sent what isn't the GOCACHEPROG protocol
+)
+
+// A configError is an error in the settings.
+type configError struct{ err error }
+
+func (e configError) Error() string { return e.err.Error() }
+func (e configError) Unwrap() error { return e.err }
+
+// configErr marks err, if not nil, as an error in the settings.
+func configErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return configError{err}
+}
+
+// exitStatus returns the exit code for err, with the name of its kind.
+func exitStatus(err error) (code int, kind string) {
+	var ce configError
+	var se interface{ HTTPStatusCode() int }
+	switch {
+	case errors.As(err, &ce):
+		return exitConfig, "config"
+	case errors.As(err, &se) && (se.HTTPStatusCode() == http.StatusUnauthorized || se.HTTPStatusCode() == http.StatusForbidden):
+		return exitAuth, "auth"
+	case errors.Is(err, cacheproc.ErrProtocol):
+		return exitProtocol, "protocol"
+	default:
+		return exitError, "error"
+	}
+}
+
+// jsonErrors is whether fatal errors are reported as JSON, as set by
+// GOCACHE_ERROR_FORMAT.
+var jsonErrors bool
+
+// setErrorFormat sets how fatal errors are reported from env.
+func setErrorFormat(env Env) error {
+	switch format := strings.ToLower(env.Get(envVarErrorFormat)); format {
+	case "", "text":
+		jsonErrors = false
+	case "json":
+		jsonErrors = true
+	default:
+		return configErr(fmt.Errorf("%s: unknown format %q", envVarErrorFormat, format))
+	}
+	return nil
+}
+
+// An errorEnvelope is the JSON report of a fatal error.
+type errorEnvelope struct {
+	Error    string `json:"error"`
+	Kind     string `json:"kind"` // "config", "auth", "protocol" or "error"
+	ExitCode int    `json:"exit_code"`
+}
+
+// fatal reports err and exits with its exit code.
+func fatal(err error) {
+	code, kind := exitStatus(err)
+	msg := logRedactor.redact(err.Error())
+	if jsonErrors {
+		json.NewEncoder(os.Stderr).Encode(&errorEnvelope{Error: msg, Kind: kind, ExitCode: code})
+	} else {
+		log.Print(msg)
+	}
+	errorReports.fatal(err, kind)
+	waitReports()
+	os.Exit(code)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+		kind string
+	}{
+		{errors.New("boom"), exitError, "error"},
+		{configErr(errors.New("GOCACHE_BACKENDS: unknown backend")), exitConfig, "config"},
+		{fmt.Errorf("loading: %w", configErr(errors.New("bad"))), exitConfig, "config"},
+		{fmt.Errorf("http cache self-check: cannot write entries: %w", &cachers.StatusError{StatusCode: http.StatusForbidden}), exitAuth, "auth"},
+		{&cachers.StatusError{StatusCode: http.StatusUnauthorized}, exitAuth, "auth"},
+		{&cachers.StatusError{StatusCode: http.StatusBadGateway}, exitError, "error"},
+		{fmt.Errorf("reading: %w", cacheproc.ErrProtocol), exitProtocol, "protocol"},
+	} {
+		code, kind := exitStatus(tc.err)
+		assert.Equal(t, tc.code, code, tc.err)
+		assert.Equal(t, tc.kind, kind, tc.err)
+	}
+	assert.NoError(t, configErr(nil))
+}
+
+func TestSetErrorFormat(t *testing.T) {
+	defer func() { jsonErrors = false }()
+	assert.NoError(t, setErrorFormat(&mapEnv{m: map[string]string{envVarErrorFormat: "JSON"}}))
+	assert.True(t, jsonErrors)
+	assert.NoError(t, setErrorFormat(&mapEnv{}))
+	assert.False(t, jsonErrors)
+	err := setErrorFormat(&mapEnv{m: map[string]string{envVarErrorFormat: "xml"}})
+	assert.Error(t, err)
+	code, _ := exitStatus(err)
+	assert.Equal(t, exitConfig, code)
+}
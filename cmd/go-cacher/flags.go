@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// settings lists the environment variables configuring go-cacher. Each can
+// also be set by a flag named after it, like --s3-bucket for
+// GOCACHE_S3_BUCKET, so that the whole configuration fits in GOCACHEPROG.
+var settings = []string{
+	envVarDiskCacheDir,
+	envVarMaxConcurrency,
+	envVarSpoolThreshold,
+	envVarTempDir,
+	envVarMinFreeSpace,
+	envVarGetTimeout,
+	envVarPutTimeout,
+	envVarCloseTimeout,
+	envVarErrorMode,
+	envVarErrorFormat,
+	envVarSentryDSN,
+	envVarErrorWebhook,
+	envVarErrorReportThreshold,
+	envVarDryRun,
+	envVarReadOnly,
+	envVarProfile,
+	envVarEnvFile,
+	envVarBackends,
+	envVarS3CacheRegion,
+	envVarS3CacheURL,
+	envVarS3AwsAccessKey,
+	envVarS3AwsSecretAccessKey,
+	envVarS3AwsSessionToken,
+	envVarS3AwsCredsProfile,
+	envVarS3BucketName,
+	envVarS3Prefix,
+	envVarS3AwsRoleArn,
+	envVarOIDCToken,
+	envVarOIDCAudience,
+	envVarKeySuffix,
+	envVarHttpCacheServerBase,
+	envVarHttpToken,
+	envVarCredentialHelper,
+	envVarHttpHMACSecret,
+	envVarSplitCredentials,
+	envVarHttpWriteToken,
+	envVarS3AwsWriteAccessKey,
+	envVarS3AwsWriteSecretKey,
+	envVarS3AwsWriteSessionToken,
+	envVarRemoteReadMode,
+	envVarRemoteWriteMode,
+	envVarRemoteFailover,
+	envVarRemoteHealthInterval,
+	envVarRemoteConcurrency,
+	envVarRemoteMemoMisses,
+	envVarRemoteMemoHits,
+	envVarFaults,
+	envVarRemoteUploadLimit,
+	envVarRemoteDownloadLimit,
+	envVarTimeoutConnect,
+	envVarTimeoutRead,
+	envVarTimeoutWrite,
+	envVarTimeoutTotal,
+	envVarHTTPMaxConns,
+	envVarHTTPMaxIdleConns,
+	envVarHTTPIdleTimeout,
+	envVarHTTP2,
+	envVarRemoteMinUploadSize,
+	envVarRemoteMaxUploadSize,
+	envVarAsyncUploads,
+	envVarPopulateLocal,
+	envVarUploadMaxAttempts,
+	envVarUploadRetryDelay,
+	envVarUploadDrainTimeout,
+	envVarOffline,
+	envVarSelfCheck,
+	envVarLogFormat,
+	envVarLogLevel,
+	envVarQuiet,
+	envVarLogFile,
+	envVarLogMaxSize,
+	envVarLogMaxAge,
+	envVarLogBackups,
+	envVarDebugAddr,
+	envVarHealthAddr,
+	envVarHealthMaxQueue,
+	envVarMetricsAddr,
+	envVarMetricsPushURL,
+	envVarMetricsInterval,
+	envVarMetricsLabels,
+	envVarMetricsMaxSeries,
+	envVarStatsdAddr,
+	envVarStatsdPrefix,
+	envVarStatsdFormat,
+	envVarStatsdTags,
+	envVarSummary,
+	envVarProgressInterval,
+	envVarEventLog,
+	envVarSlowThreshold,
+	envVarCompression,
+	envVarCompressionMinSize,
+	envVarRangedThreshold,
+	envVarRangedParts,
+	envVarEncryptionKey,
+	envVarKMSKeyID,
+	envVarSigningKey,
+	envVarSigningTrustedKeys,
+	envVarAuditLog,
+	envVarAuditIdentity,
+	envVarTags,
+	envVarTLSCAFile,
+	envVarTLSPins,
+	envVarProxy,
+}
+
+// settingAliases are shorter flags for the most common settings.
+var settingAliases = map[string]string{
+	"bucket": envVarS3BucketName,
+	"region": envVarS3CacheRegion,
+	"pprof":  envVarDebugAddr,
+}
+
+// flagSettings are the settings given by flags, which take precedence
+// over the environment and the configuration files.
+var flagSettings = map[string]string{}
+
+func init() {
+	registerSettingFlags(flag.CommandLine, flagSettings)
+}
+
+// settingFlag returns the name of the flag setting the environment
+// variable key.
+func settingFlag(key string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(key, "GOCACHE_")), "_", "-")
+}
+
+// registerSettingFlags defines a flag in fs for each setting, storing the
+// values given in vars.
+func registerSettingFlags(fs *flag.FlagSet, vars map[string]string) {
+	set := func(key string) func(string) error {
+		return func(v string) error {
+			vars[key] = v
+			return nil
+		}
+	}
+	for _, key := range settings {
+		if key == envVarSummary {
+			fs.Var(summaryFlag(vars), settingFlag(key), "sets $"+key+"; alone, to stderr, printing a summary of the session on exit")
+			continue
+		}
+		if key == envVarQuiet {
+			fs.Var(boolSettingFlag{vars, key}, settingFlag(key), "sets $"+key+"; alone, only logging errors")
+			continue
+		}
+		fs.Func(settingFlag(key), "sets $"+key, set(key))
+	}
+	for name, key := range settingAliases {
+		fs.Func(name, "sets $"+key, set(key))
+	}
+}
+
+// summaryFlag is the --summary flag, which may be given alone, like a
+// boolean flag, to print the summary on stderr.
+type summaryFlag map[string]string
+
+func (f summaryFlag) String() string   { return "" }
+func (f summaryFlag) IsBoolFlag() bool { return true }
+
+func (f summaryFlag) Set(v string) error {
+	switch v {
+	case "true":
+		v = "stderr"
+	case "false":
+		v = ""
+	}
+	f[envVarSummary] = v
+	return nil
+}
+
+// boolSettingFlag is the flag of a boolean setting, which may be given
+// alone, like --quiet, to set it.
+type boolSettingFlag struct {
+	vars map[string]string
+	key  string
+}
+
+func (f boolSettingFlag) String() string   { return "" }
+func (f boolSettingFlag) IsBoolFlag() bool { return true }
+
+func (f boolSettingFlag) Set(v string) error {
+	f.vars[f.key] = v
+	return nil
+}
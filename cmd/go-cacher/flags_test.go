@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettingsComplete(t *testing.T) {
+	// Every envVar constant must be listed, to get its flag.
+	f, err := parser.ParseFile(token.NewFileSet(), "cacher.go", nil, 0)
+	require.NoError(t, err)
+	var consts []string
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.CONST {
+			for _, spec := range d.Specs {
+				spec := spec.(*ast.ValueSpec)
+				for i, name := range spec.Names {
+					if strings.HasPrefix(name.Name, "envVar") {
+						consts = append(consts, strings.Trim(spec.Values[i].(*ast.BasicLit).Value, `"`))
+					}
+				}
+			}
+		}
+	}
+	assert.ElementsMatch(t, consts, settings)
+}
+
+func TestSettingFlags(t *testing.T) {
+	assert.Equal(t, "s3-bucket", settingFlag(envVarS3BucketName))
+	assert.Equal(t, "remote-max-upload-size", settingFlag(envVarRemoteMaxUploadSize))
+
+	fs := flag.NewFlagSet("go-cacher", flag.ContinueOnError)
+	vars := map[string]string{}
+	registerSettingFlags(fs, vars)
+	require.NoError(t, fs.Parse([]string{"--bucket=my-cache", "--region=eu-west-1", "--async-uploads", "4", "--pprof=:6060", "warm"}))
+	assert.Equal(t, map[string]string{
+		envVarS3BucketName:  "my-cache",
+		envVarS3CacheRegion: "eu-west-1",
+		envVarAsyncUploads:  "4",
+		envVarDebugAddr:     ":6060",
+	}, vars)
+	assert.Equal(t, []string{"warm"}, fs.Args())
+
+	env := &fileEnv{vars: vars, base: &mapEnv{m: map[string]string{envVarS3BucketName: "from-env", envVarS3Prefix: "team"}}}
+	assert.Equal(t, "my-cache", env.Get(envVarS3BucketName), "flags take precedence")
+	assert.Equal(t, "team", env.Get(envVarS3Prefix))
+}
+
+func TestSummaryFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--summary"}, "stderr"},
+		{[]string{"--summary=summary.json"}, "summary.json"},
+		{[]string{"--summary=false"}, ""},
+	} {
+		fs := flag.NewFlagSet("go-cacher", flag.ContinueOnError)
+		vars := map[string]string{}
+		registerSettingFlags(fs, vars)
+		require.NoError(t, fs.Parse(append(tc.args, "run")))
+		assert.Equal(t, tc.want, vars[envVarSummary], tc.args)
+		assert.Equal(t, []string{"run"}, fs.Args())
+	}
+}
+
+func TestQuietFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"--quiet"}, true},
+		{[]string{"--quiet=false"}, false},
+		{nil, false},
+	} {
+		fs := flag.NewFlagSet("go-cacher", flag.ContinueOnError)
+		vars := map[string]string{}
+		registerSettingFlags(fs, vars)
+		require.NoError(t, fs.Parse(append(tc.args, "run")))
+		q, err := quiet(&mapEnv{m: vars})
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, q, tc.args)
+		assert.Equal(t, []string{"run"}, fs.Args())
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const (
+	// healthCheckTimeout bounds the checks of the backends of /readyz.
+	healthCheckTimeout = 5 * time.Second
+	// healthWedgedAfter is how long the upload queue stays saturated before
+	// /healthz reports the daemon wedged.
+	healthWedgedAfter = time.Minute
+)
+
+// A healthServer answers the probes of orchestrators and service managers
+// about a daemon serving cache.
+type healthServer struct {
+	cache    cachers.LocalCache
+	maxQueue int64 // uploads and retries past which the queue is saturated
+	now      func() time.Time
+
+	mu        sync.Mutex
+	saturated time.Time // since when the queue is saturated, or zero
+}
+
+// healthStatus is the JSON body of the answers of a healthServer.
+type healthStatus struct {
+	Status  string `json:"status"` // "ok", or what is wrong
+	Backend string `json:"backend,omitempty"`
+	Uploads int64  `json:"uploads"`
+	Retries int64  `json:"retries"`
+}
+
+// newHealthServer returns the healthServer of cache with the settings of
+// env.
+func newHealthServer(env Env, cache cachers.LocalCache) (*healthServer, error) {
+	h := &healthServer{cache: cache, maxQueue: cachers.UploadQueueSize, now: time.Now}
+	if v := env.Get(envVarHealthMaxQueue); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%s: invalid limit %q", envVarHealthMaxQueue, v)
+		}
+		h.maxQueue = n
+	}
+	return h, nil
+}
+
+// queue returns the queues of the cache, whether they are saturated, and
+// for how long.
+func (h *healthServer) queue() (qs cachers.QueueStats, saturated bool, d time.Duration) {
+	qs = cachers.CacheQueues(h.cache)
+	saturated = qs.Uploads+qs.Retries >= h.maxQueue
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	switch {
+	case !saturated:
+		h.saturated = time.Time{}
+	case h.saturated.IsZero():
+		h.saturated = now
+	}
+	if saturated {
+		d = now.Sub(h.saturated)
+	}
+	return qs, saturated, d
+}
+
+// healthz reports whether the daemon is alive: it is wedged once its
+// upload queue has been saturated for healthWedgedAfter, with the puts of
+// the builds blocked on it, and is better restarted.
+func (h *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	qs, _, d := h.queue()
+	st := healthStatus{Status: "ok", Uploads: qs.Uploads, Retries: qs.Retries}
+	if d >= healthWedgedAfter {
+		st.Status = fmt.Sprintf("upload queue saturated for %v", d.Round(time.Second))
+	}
+	writeHealth(w, st)
+}
+
+// readyz reports whether the daemon is ready to serve builds: its
+// backends are reachable and its upload queue isn't saturated.
+func (h *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	qs, saturated, _ := h.queue()
+	st := healthStatus{Status: "ok", Backend: "ok", Uploads: qs.Uploads, Retries: qs.Retries}
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := cachers.CheckHealth(ctx, h.cache); err != nil {
+		st.Status, st.Backend = "backend unreachable", err.Error()
+	} else if saturated {
+		st.Status = "upload queue saturated"
+	}
+	writeHealth(w, st)
+}
+
+func writeHealth(w http.ResponseWriter, st healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if st.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// serveHealth serves the /healthz and /readyz probes of h on addr in the
+// background. An addr without a host, like ":8086", listens on localhost
+// only.
+func serveHealth(addr string, h *healthServer) error {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	slog.Info("health server listening", "addr", ln.Addr().String())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("health server failed", "err", err)
+		}
+	}()
+	return nil
+}
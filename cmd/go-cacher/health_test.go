@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// healthCache is a LocalCache with the queues and the health it is given.
+type healthCache struct {
+	cachers.LocalCache
+	qs  cachers.QueueStats
+	err error
+}
+
+func (c *healthCache) QueueStats() cachers.QueueStats        { return c.qs }
+func (c *healthCache) HealthCheck(ctx context.Context) error { return c.err }
+
+func TestHealthServer(t *testing.T) {
+	cache := &healthCache{LocalCache: cachers.NewSimpleDiskCache(false, t.TempDir())}
+	h, err := newHealthServer(&mapEnv{m: map[string]string{envVarHealthMaxQueue: "10"}}, cache)
+	require.NoError(t, err)
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	probe := func(handler http.HandlerFunc) (int, healthStatus) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+		var st healthStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &st))
+		return rec.Code, st
+	}
+
+	code, st := probe(h.readyz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", st.Status)
+
+	cache.err = errors.New("dial tcp: connection refused")
+	code, st = probe(h.readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "dial tcp: connection refused", st.Backend)
+	code, _ = probe(h.healthz)
+	assert.Equal(t, http.StatusOK, code, "an unreachable backend doesn't need a restart")
+
+	cache.err = nil
+	cache.qs = cachers.QueueStats{Uploads: 8, Retries: 2}
+	code, st = probe(h.readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "upload queue saturated", st.Status)
+	assert.EqualValues(t, 8, st.Uploads)
+	code, _ = probe(h.healthz)
+	assert.Equal(t, http.StatusOK, code)
+
+	now = now.Add(healthWedgedAfter)
+	code, st = probe(h.healthz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "upload queue saturated for 1m0s", st.Status)
+
+	cache.qs = cachers.QueueStats{Uploads: 3}
+	code, _ = probe(h.healthz)
+	assert.Equal(t, http.StatusOK, code)
+	now = now.Add(healthWedgedAfter)
+	cache.qs = cachers.QueueStats{Uploads: 10}
+	code, _ = probe(h.healthz)
+	assert.Equal(t, http.StatusOK, code, "saturated again only now")
+
+	_, err = newHealthServer(&mapEnv{m: map[string]string{envVarHealthMaxQueue: "0"}}, cache)
+	assert.ErrorContains(t, err, envVarHealthMaxQueue)
+}
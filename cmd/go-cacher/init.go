@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"gopkg.in/yaml.v3"
+)
+
+const initUsage = `usage: go-cacher [flags] init [-force]
+
+Init sets up go-cacher for the first time. It asks which remote to use and
+its settings, writes them to the configuration file, the one of --config or
+else the default one, and checks that an entry can be written to the cache
+and read back with them.
+
+`
+
+func runInit(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("init", initUsage)
+	force := fs.Bool("force", false, "overwrite an existing configuration file")
+	_ = fs.Parse(args)
+
+	path := *configFile
+	if path == "" {
+		if path = defaultConfigFile(); path == "" {
+			return errors.New("no configuration directory; use --config to choose the file to write")
+		}
+	}
+	if _, err := os.Stat(path); err == nil && !*force {
+		return fmt.Errorf("%s already exists; use -force to overwrite it", path)
+	}
+	vars, err := setupWizard(&prompter{r: bufio.NewReader(os.Stdin), w: os.Stdout}, getDir(env))
+	if err != nil {
+		return err
+	}
+	if err := writeConfigFile(path, vars); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s.\n", path)
+
+	// Check the settings the way go-cacher will read them, under the
+	// environment.
+	env, err = loadConfigEnv(path, "", "")
+	if err != nil {
+		return err
+	}
+	if err := roundTrip(ctx, os.Stdout, env); err != nil {
+		return fmt.Errorf("%w; fix it and run go-cacher init -force again, or go-cacher doctor for more checks", err)
+	}
+	fmt.Println("Run go-cacher install to make it the cache of the go command.")
+	return nil
+}
+
+// A prompter asks the questions of the setup wizard on w and reads the
+// answers from r.
+type prompter struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// ask asks question and returns the answer, or def for an empty one.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.w, "%s: ", question)
+	}
+	line, err := p.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", fmt.Errorf("reading the answer: %w", err)
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// require asks question until the answer isn't empty.
+func (p *prompter) require(question, def string) (string, error) {
+	for {
+		v, err := p.ask(question, def)
+		if err != nil || v != "" {
+			return v, err
+		}
+		fmt.Fprintln(p.w, "An answer is required.")
+	}
+}
+
+// choose asks question until the answer is one of choices.
+func (p *prompter) choose(question string, choices []string, def string) (string, error) {
+	question = fmt.Sprintf("%s (%s)", question, strings.Join(choices, ", "))
+	for {
+		v, err := p.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if v = strings.ToLower(v); slices.Contains(choices, v) {
+			return v, nil
+		}
+		fmt.Fprintf(p.w, "Answer one of %s.\n", strings.Join(choices, ", "))
+	}
+}
+
+// setupWizard asks for the settings of go-cacher init and returns them,
+// offering defaultDir for the local disk cache.
+func setupWizard(p *prompter, defaultDir string) (map[string]string, error) {
+	vars := map[string]string{}
+	// need sets key to the answer to question, which is required if
+	// required is set.
+	need := func(key, question, def string, required bool) error {
+		ask := p.ask
+		if required {
+			ask = p.require
+		}
+		v, err := ask(question, def)
+		if err == nil && v != "" {
+			vars[key] = v
+		}
+		return err
+	}
+	const secretHint = "; may be file:PATH, env:VAR or exec:COMMAND"
+
+	if err := need(envVarDiskCacheDir, "Local disk cache directory", defaultDir, true); err != nil {
+		return nil, err
+	}
+	remote, err := p.choose("Remote cache", []string{"none", "http", "s3"}, "none")
+	if err != nil {
+		return nil, err
+	}
+	switch remote {
+	case "http":
+		vars[envVarBackends] = "disk,http"
+		if err := need(envVarHttpCacheServerBase, "URL of the cache server", "", true); err != nil {
+			return nil, err
+		}
+		if err := need(envVarHttpToken, "Bearer token, empty for none"+secretHint, "", false); err != nil {
+			return nil, err
+		}
+	case "s3":
+		vars[envVarBackends] = "disk,s3"
+		if err := need(envVarS3BucketName, "Bucket", "", true); err != nil {
+			return nil, err
+		}
+		if err := need(envVarS3CacheRegion, "Region", "us-east-1", true); err != nil {
+			return nil, err
+		}
+		if err := need(envVarS3AwsAccessKey, "Access key ID, empty to use a profile of the AWS configuration"+secretHint, "", false); err != nil {
+			return nil, err
+		}
+		if vars[envVarS3AwsAccessKey] != "" {
+			err = need(envVarS3AwsSecretAccessKey, "Secret access key"+secretHint, "", true)
+		} else {
+			err = need(envVarS3AwsCredsProfile, "AWS profile", "default", true)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+// writeConfigFile writes vars to the configuration file at path, by their
+// names without the GOCACHE_ prefix. It is only readable by the user, as
+// it may hold credentials.
+func writeConfigFile(path string, vars map[string]string) error {
+	doc := make(map[string]string, len(vars))
+	for k, v := range vars {
+		doc[strings.ToLower(strings.TrimPrefix(k, "GOCACHE_"))] = v
+	}
+	b, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	b = append([]byte("# Written by go-cacher init. The environment overrides these settings.\n"), b...)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// roundTrip checks that the caches of env can be written and read back,
+// reporting the checks to w.
+func roundTrip(ctx context.Context, w io.Writer, env Env) error {
+	dir := getDir(env)
+	if err := checkWritable(dir); err != nil {
+		return fmt.Errorf("local disk cache %s: %w", dir, err)
+	}
+	fmt.Fprintf(w, "ok    local disk cache %s is writable\n", dir)
+	remote, err := maybeRemoteCache(ctx, env)
+	if err != nil || remote == nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+	defer cancel()
+	if err := cachers.SelfCheck(ctx, remote, true); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "ok    remote %s cache can be written and read back\n", remote.Kind())
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupWizard(t *testing.T) {
+	answers := func(lines ...string) *prompter {
+		return &prompter{r: bufio.NewReader(strings.NewReader(strings.Join(lines, "\n") + "\n")), w: &bytes.Buffer{}}
+	}
+
+	vars, err := setupWizard(answers("", "ftp", "s3", "", "my-cache", "", "AKIA", "", "env:AWS_SECRET"), "/cache")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		envVarDiskCacheDir:         "/cache",
+		envVarBackends:             "disk,s3",
+		envVarS3BucketName:         "my-cache",
+		envVarS3CacheRegion:        "us-east-1",
+		envVarS3AwsAccessKey:       "AKIA",
+		envVarS3AwsSecretAccessKey: "env:AWS_SECRET",
+	}, vars)
+
+	vars, err = setupWizard(answers("/tmp/c", "HTTP", "https://cache.example.com", ""), "/cache")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		envVarDiskCacheDir:        "/tmp/c",
+		envVarBackends:            "disk,http",
+		envVarHttpCacheServerBase: "https://cache.example.com",
+	}, vars)
+
+	_, err = setupWizard(answers("", "s3"), "/cache")
+	assert.ErrorContains(t, err, "reading the answer")
+}
+
+func TestWriteConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-cacher", "config.yaml")
+	dir := filepath.Join(t.TempDir(), "cache")
+	vars := map[string]string{envVarDiskCacheDir: dir, envVarS3BucketName: "my-cache"}
+	require.NoError(t, writeConfigFile(path, vars))
+	doc, err := loadConfigFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, vars, doc.vars)
+
+	var out bytes.Buffer
+	require.NoError(t, roundTrip(context.Background(), &out, &mapEnv{m: map[string]string{envVarDiskCacheDir: dir}}))
+	assert.Contains(t, out.String(), "ok    local disk cache "+dir+" is writable")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const installUsage = `usage: go-cacher [flags] install [-print]
+
+Install makes go-cacher the cache of the go command. It checks that the go
+command supports GOCACHEPROG, builds a tiny package with go-cacher as its
+cache, and then sets GOCACHEPROG with go env -w. The flags given to
+go-cacher itself, like --s3-bucket, are kept in GOCACHEPROG.
+
+`
+
+func runInstall(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("install", installUsage)
+	printOnly := fs.Bool("print", false, "print a shell snippet setting GOCACHEPROG instead of running go env -w")
+	_ = fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	prog := cacheProg(exe, *configFile, flagSettings)
+	if err := checkCacheProg(currentToolchain(ctx, env)); err != nil {
+		return err
+	}
+	if err := smokeTest(ctx, prog); err != nil {
+		return fmt.Errorf("smoke test build failed: %w", err)
+	}
+	if *printOnly {
+		fmt.Printf("export GOCACHEPROG=%s\n", shellQuote(prog))
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "go", "env", "-w", "GOCACHEPROG="+prog)
+	cmd.Env = append(os.Environ(), "GOCACHEPROG=")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go env -w: %w", err)
+	}
+	fmt.Printf("GOCACHEPROG=%s\n", prog)
+	return nil
+}
+
+// cacheProg returns the GOCACHEPROG command running the go-cacher at exe
+// with the configuration file config, if any, and the settings vars as
+// flags.
+func cacheProg(exe, config string, vars map[string]string) string {
+	args := []string{quoteArg(exe)}
+	if config != "" {
+		args = append(args, quoteArg("--config="+config))
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, quoteArg("--"+settingFlag(key)+"="+vars[key]))
+	}
+	return strings.Join(args, " ")
+}
+
+// quoteArg quotes arg, if needed, the way the go command splits
+// GOCACHEPROG into arguments.
+func quoteArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t\n'\"") {
+		return arg
+	}
+	if !strings.Contains(arg, "'") {
+		return "'" + arg + "'"
+	}
+	return `"` + arg + `"`
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// checkCacheProg returns an error if the go command of tc doesn't support
+// GOCACHEPROG, which is experimental before Go 1.24.
+func checkCacheProg(tc toolchain) error {
+	minor, ok := goMinorVersion(tc.GoVersion)
+	switch {
+	case !ok:
+		return nil // a development version
+	case minor >= 24:
+		return nil
+	case minor >= 21:
+		for _, exp := range strings.Split(tc.GOEXPERIMENT, ",") {
+			if exp == "cacheprog" {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s only supports GOCACHEPROG with GOEXPERIMENT=cacheprog; set it, or use go1.24 or later", tc.GoVersion)
+	default:
+		return fmt.Errorf("%s doesn't support GOCACHEPROG; go1.24 or later is needed", tc.GoVersion)
+	}
+}
+
+// goMinorVersion returns the minor version of a Go 1 release like
+// "go1.24.2", or false for other versions.
+func goMinorVersion(v string) (int, bool) {
+	rest, ok := strings.CutPrefix(v, "go1.")
+	if !ok {
+		return 0, false
+	}
+	if i := strings.IndexAny(rest, ".-+ "); i >= 0 {
+		rest = rest[:i]
+	}
+	// Prereleases, like go1.24rc1, support what the release will.
+	if i := strings.IndexAny(rest, "abcdefghijklmnopqrstuvwxyz"); i >= 0 {
+		rest = rest[:i]
+	}
+	minor, err := strconv.Atoi(rest)
+	return minor, err == nil
+}
+
+// smokeTest builds a tiny package with prog as GOCACHEPROG.
+func smokeTest(ctx context.Context, prog string) error {
+	dir, err := os.MkdirTemp("", "go-cacher-install-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go.mod":   "module smoke\n\ngo 1.21\n",
+		"smoke.go": "package smoke\n\nfunc Answer() int { return 42 }\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	cmd := exec.CommandContext(ctx, "go", "build", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOCACHEPROG="+prog, "GOFLAGS=", "GOWORK=off")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w\n%s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheProg(t *testing.T) {
+	assert.Equal(t, "/usr/bin/go-cacher", cacheProg("/usr/bin/go-cacher", "", nil))
+	assert.Equal(t, `'/opt/my tools/go-cacher' --config=/etc/go-cacher.yaml --readonly=1 '--s3-bucket=my cache' "--s3-prefix=it's"`,
+		cacheProg("/opt/my tools/go-cacher", "/etc/go-cacher.yaml", map[string]string{
+			envVarS3BucketName: "my cache",
+			envVarReadOnly:     "1",
+			envVarS3Prefix:     "it's",
+		}))
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'go-cacher --s3-bucket=b'`, shellQuote("go-cacher --s3-bucket=b"))
+	assert.Equal(t, `'go-cacher '\''--s3-bucket=my b'\'''`, shellQuote("go-cacher '--s3-bucket=my b'"))
+}
+
+func TestCheckCacheProg(t *testing.T) {
+	for _, tc := range []struct {
+		tc toolchain
+		ok bool
+	}{
+		{toolchain{GoVersion: "go1.24.2"}, true},
+		{toolchain{GoVersion: "go1.25rc1"}, true},
+		{toolchain{GoVersion: "devel go1.26-abcdef"}, true},
+		{toolchain{GoVersion: "go1.23.4"}, false},
+		{toolchain{GoVersion: "go1.23.4", GOEXPERIMENT: "loopvar,cacheprog"}, true},
+		{toolchain{GoVersion: "go1.20", GOEXPERIMENT: "cacheprog"}, false},
+	} {
+		err := checkCacheProg(tc.tc)
+		if tc.ok {
+			assert.NoError(t, err, tc.tc.GoVersion)
+		} else {
+			assert.Error(t, err, tc.tc.GoVersion)
+		}
+	}
+}
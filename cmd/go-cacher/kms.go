@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go"
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// kmsTimeout bounds each call to AWS KMS.
+const kmsTimeout = 30 * time.Second
+
+// kmsEncryptionContext is bound to the data keys, so that those of
+// go-cacher can't be unwrapped by, or for, other uses of the key.
+var kmsEncryptionContext = map[string]string{"purpose": "go-cacher"}
+
+// An awsKMS wraps the data keys of an EnvelopeRemoteCache with a key of
+// AWS KMS, calling its JSON API. Data keys are unwrapped with whichever key
+// wrapped them, so that objects written before the key of
+// GOCACHE_KMS_KEY_ID is changed still read, as long as the caller may use
+// the key that wrapped them.
+type awsKMS struct {
+	cfg      aws.Config
+	keyID    string
+	region   string
+	endpoint string
+	client   *http.Client
+}
+
+var _ cachers.KeyWrapper = &awsKMS{}
+
+// newAWSKMS returns the awsKMS of the key keyID, a key ID, ARN or alias,
+// with the AWS credentials of the S3 settings, or the default ones.
+func newAWSKMS(ctx context.Context, env Env, keyID string) (*awsKMS, error) {
+	cfg, err := getAwsConfigFromEnv(ctx, env)
+	if err != nil {
+		region := env.Get(envVarS3CacheRegion)
+		if region == "" {
+			region = "us-east-1"
+		}
+		c, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+		if err != nil {
+			return nil, err
+		}
+		cfg = &c
+	}
+	client, err := proxyClient(env)
+	if err != nil {
+		return nil, err
+	}
+	k := &awsKMS{cfg: *cfg, keyID: keyID, region: cfg.Region, client: client}
+	// The region of a key ARN wins: arn:aws:kms:REGION:ACCOUNT:key/ID.
+	if parts := strings.Split(keyID, ":"); len(parts) >= 6 && parts[0] == "arn" && parts[3] != "" {
+		k.region = parts[3]
+	}
+	k.endpoint = env.Get("AWS_ENDPOINT_URL_KMS")
+	if k.endpoint == "" {
+		k.endpoint = "https://kms." + k.region + ".amazonaws.com"
+	}
+	return k, nil
+}
+
+func (k *awsKMS) GenerateDataKey(ctx context.Context) (key, wrapped []byte, err error) {
+	var out struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	err = k.call(ctx, "GenerateDataKey", map[string]any{
+		"KeyId":             k.keyID,
+		"KeySpec":           "AES_256",
+		"EncryptionContext": kmsEncryptionContext,
+	}, &out)
+	return out.Plaintext, out.CiphertextBlob, err
+}
+
+func (k *awsKMS) UnwrapDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	err := k.call(ctx, "Decrypt", map[string]any{
+		"CiphertextBlob":    wrapped,
+		"EncryptionContext": kmsEncryptionContext,
+	}, &out)
+	return out.Plaintext, err
+}
+
+// call calls the operation op of KMS with the input in, decoding its
+// output into out. The errors of KMS are smithy.APIErrors, which
+// cachers.ClassifyError knows.
+func (k *awsKMS) call(ctx context.Context, op string, in, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, kmsTimeout)
+	defer cancel()
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", k.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+op)
+	creds, err := k.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	sum := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "kms", k.region, time.Now()); err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	res, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(b, &e)
+		// The type may be qualified, like "com.amazon.coral.service#AccessDeniedException".
+		if i := strings.LastIndexByte(e.Type, '#'); i >= 0 {
+			e.Type = e.Type[i+1:]
+		}
+		if e.Type == "" {
+			e.Type = res.Status
+		}
+		return fmt.Errorf("kms %s: %w", op, &smithy.GenericAPIError{Code: e.Type, Message: e.Message})
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("kms %s: %w", op, err)
+	}
+	return nil
+}
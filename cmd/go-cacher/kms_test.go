@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeKMS returns a server acting as KMS for the key "k1", "wrapping"
+// data keys by prefixing them with the key ID, and the settings using it.
+func newFakeKMS(t *testing.T) map[string]string {
+	dataKey := bytes.Repeat([]byte{9}, 32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, `{"__type":"UnrecognizedClientException"}`, http.StatusBadRequest)
+			return
+		}
+		var in struct {
+			KeyId             string
+			CiphertextBlob    []byte
+			EncryptionContext map[string]string
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+		assert.Equal(t, kmsEncryptionContext, in.EncryptionContext)
+		var out any
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			if in.KeyId != "k1" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"__type":"com.amazonaws.kms#NotFoundException","message":"no key"}`))
+				return
+			}
+			out = map[string]any{"CiphertextBlob": append([]byte("k1:"), dataKey...), "Plaintext": dataKey, "KeyId": "k1"}
+		case "TrentService.Decrypt":
+			keyID, key, _ := bytes.Cut(in.CiphertextBlob, []byte(":"))
+			if string(keyID) != "k1" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"__type":"AccessDeniedException","message":"denied"}`))
+				return
+			}
+			out = map[string]any{"Plaintext": key, "KeyId": "k1"}
+		default:
+			http.Error(w, "unknown target", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(srv.Close)
+	return map[string]string{
+		"AWS_ENDPOINT_URL_KMS":     srv.URL,
+		envVarS3AwsAccessKey:       "AKID",
+		envVarS3AwsSecretAccessKey: "SECRET",
+	}
+}
+
+func TestAWSKMS(t *testing.T) {
+	ctx := context.Background()
+	env := &mapEnv{m: newFakeKMS(t)}
+
+	kms, err := newAWSKMS(ctx, env, "k1")
+	require.NoError(t, err)
+	key, wrapped, err := kms.GenerateDataKey(ctx)
+	require.NoError(t, err)
+	assert.Len(t, key, 32)
+	got, err := kms.UnwrapDataKey(ctx, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	_, err = kms.UnwrapDataKey(ctx, []byte("k2:revoked"))
+	var ae smithy.APIError
+	require.ErrorAs(t, err, &ae)
+	assert.Equal(t, "AccessDeniedException", ae.ErrorCode())
+	assert.Equal(t, cachers.ErrorAuth, cachers.ClassifyError(err))
+
+	other, err := newAWSKMS(ctx, env, "k2")
+	require.NoError(t, err)
+	_, _, err = other.GenerateDataKey(ctx)
+	assert.ErrorContains(t, err, "NotFoundException")
+
+	arn, err := newAWSKMS(ctx, &mapEnv{m: map[string]string{}}, "arn:aws:kms:eu-west-3:123456789012:key/k1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://kms.eu-west-3.amazonaws.com", arn.endpoint)
+}
+
+func TestMaybeRemoteCacheKMS(t *testing.T) {
+	m := newFakeKMS(t)
+	m[envVarHttpCacheServerBase] = "http://localhost:8080"
+	m[envVarKMSKeyID] = "k1"
+	env := &mapEnv{m: m}
+	remote, err := maybeRemoteCache(context.Background(), env)
+	require.NoError(t, err)
+	assert.IsType(t, &cachers.EnvelopeRemoteCache{}, remote)
+
+	env.m[envVarEncryptionKey] = strings.Repeat("00", 32)
+	_, err = maybeRemoteCache(context.Background(), env)
+	assert.ErrorContains(t, err, "exclusive")
+}
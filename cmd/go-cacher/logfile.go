@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxSize = 10 << 20
+	defaultLogBackups = 5
+)
+
+// logOutput returns where the logs go: the file GOCACHE_LOG_FILE, rotated
+// as configured, or stderr if that isn't set.
+func logOutput(env Env) (io.Writer, error) {
+	path := env.Get(envVarLogFile)
+	if path == "" {
+		return os.Stderr, nil
+	}
+	r := &rotatingFile{path: path, maxSize: defaultLogMaxSize, backups: defaultLogBackups}
+	if v := env.Get(envVarLogMaxSize); v != "" {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarLogMaxSize, err)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("%s: size must be positive, got %q", envVarLogMaxSize, v)
+		}
+		r.maxSize = n
+	}
+	maxAge, err := parseDuration(env.Get(envVarLogMaxAge), 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarLogMaxAge, err)
+	}
+	r.maxAge = maxAge
+	if v := env.Get(envVarLogBackups); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: invalid count %q", envVarLogBackups, v)
+		}
+		r.backups = n
+	}
+	if err := r.open(); err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarLogFile, err)
+	}
+	return r, nil
+}
+
+// A rotatingFile is a log file that is rotated when it would grow past
+// maxSize, or once it has been written to for maxAge: it is renamed to
+// path.1, the previous path.1 to path.2 and so on, keeping the newest
+// backups, and a new file is started.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration // 0 is no limit
+	backups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+// open opens the file at r.path, appending to it.
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.started = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || r.maxAge > 0 && time.Since(r.started) >= r.maxAge) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to the first backup and opens a new one.
+// If another process sharing the file rotated it already, it only opens
+// the new one.
+func (r *rotatingFile) rotate() error {
+	cur, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	r.f.Close()
+	if fi, err := os.Stat(r.path); err == nil && os.SameFile(cur, fi) {
+		for i := r.backups; i > 1; i-- {
+			if err := os.Rename(r.backup(i-1), r.backup(i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if r.backups > 0 {
+			err = os.Rename(r.path, r.backup(1))
+		} else {
+			err = os.Remove(r.path)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.open()
+}
+
+// backup returns the path of the i-th newest backup.
+func (r *rotatingFile) backup(i int) string {
+	return r.path + "." + strconv.Itoa(i)
+}
+
+// Close closes the current file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
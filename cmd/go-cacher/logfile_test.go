@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogOutput(t *testing.T) {
+	w, err := logOutput(&mapEnv{})
+	require.NoError(t, err)
+	assert.Same(t, os.Stderr, w)
+
+	for _, m := range []map[string]string{
+		{envVarLogMaxSize: "0"},
+		{envVarLogMaxSize: "lots"},
+		{envVarLogMaxAge: "-1h"},
+		{envVarLogBackups: "-1"},
+	} {
+		m[envVarLogFile] = filepath.Join(t.TempDir(), "go-cacher.log")
+		_, err := logOutput(&mapEnv{m: m})
+		assert.Error(t, err, m)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	read := func(path string) string {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	t.Run("size", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "logs", "go-cacher.log")
+		w, err := logOutput(&mapEnv{m: map[string]string{
+			envVarLogFile:    path,
+			envVarLogMaxSize: "10",
+			envVarLogBackups: "1",
+		}})
+		require.NoError(t, err)
+		r := w.(*rotatingFile)
+		defer r.Close()
+		for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+			_, err := r.Write([]byte(line))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, "four\nfive\n", read(path))
+		assert.Equal(t, "three\n", read(path+".1"))
+		assert.Equal(t, "", read(path+".2"), "only the newest backups are kept")
+	})
+
+	t.Run("appends", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "go-cacher.log")
+		require.NoError(t, os.WriteFile(path, []byte("before\n"), 0644))
+		w, err := logOutput(&mapEnv{m: map[string]string{envVarLogFile: path}})
+		require.NoError(t, err)
+		r := w.(*rotatingFile)
+		defer r.Close()
+		_, err = r.Write([]byte("after\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "before\nafter\n", read(path))
+	})
+
+	t.Run("age", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "go-cacher.log")
+		r := &rotatingFile{path: path, maxSize: 1 << 20, maxAge: time.Hour, backups: 1}
+		require.NoError(t, r.open())
+		defer r.Close()
+		_, err := r.Write([]byte("old\n"))
+		require.NoError(t, err)
+		r.started = r.started.Add(-2 * time.Hour)
+		_, err = r.Write([]byte("new\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "new\n", read(path))
+		assert.Equal(t, "old\n", read(path+".1"))
+	})
+
+	t.Run("rotated by another process", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "go-cacher.log")
+		a := &rotatingFile{path: path, maxSize: 8, backups: 3}
+		b := &rotatingFile{path: path, maxSize: 8, backups: 3}
+		require.NoError(t, a.open())
+		defer a.Close()
+		require.NoError(t, b.open())
+		defer b.Close()
+		for _, w := range []*rotatingFile{a, b, a, b} {
+			_, err := w.Write([]byte("line\n"))
+			require.NoError(t, err)
+		}
+		all := read(path) + read(path+".1") + read(path+".2") + read(path+".3")
+		assert.Equal(t, 4, strings.Count(all, "line\n"), "no line is lost")
+	})
+}
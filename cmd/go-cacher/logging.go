@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// newLogHandler returns the handler for the logs of the process, written
+// to w. GOCACHE_LOG_FORMAT selects "text" (the default) or "json" output,
+// and GOCACHE_LOG_LEVEL the minimum level: "debug", "info", "warn" or
+// "error". The level defaults to debug if verbose, to error if
+// GOCACHE_QUIET is set, and to info otherwise.
+func newLogHandler(env Env, w io.Writer, verbose bool) (slog.Handler, error) {
+	quiet, err := quiet(env)
+	if err != nil {
+		return nil, err
+	}
+	level := slog.LevelInfo
+	switch {
+	case verbose && quiet:
+		return nil, fmt.Errorf("%s conflicts with --verbose", envVarQuiet)
+	case verbose:
+		level = slog.LevelDebug
+	case quiet:
+		level = slog.LevelError
+	}
+	if v := env.Get(envVarLogLevel); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarLogLevel, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := strings.ToLower(env.Get(envVarLogFormat)); format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("%s: unknown format %q", envVarLogFormat, format)
+	}
+}
+
+// quiet reports whether env configures quiet mode, which only logs errors.
+func quiet(env Env) (bool, error) {
+	v := env.Get(envVarQuiet)
+	if v == "" {
+		return false, nil
+	}
+	q, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", envVarQuiet, err)
+	}
+	return q, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("default", func(t *testing.T) {
+		var buf bytes.Buffer
+		h, err := newLogHandler(&mapEnv{}, &buf, false)
+		require.NoError(t, err)
+		assert.False(t, h.Enabled(ctx, slog.LevelDebug))
+		slog.New(h).Info("configured", "cache", "disk")
+		assert.Contains(t, buf.String(), `level=INFO msg=configured cache=disk`)
+	})
+
+	t.Run("verbose", func(t *testing.T) {
+		h, err := newLogHandler(&mapEnv{}, &bytes.Buffer{}, true)
+		require.NoError(t, err)
+		assert.True(t, h.Enabled(ctx, slog.LevelDebug))
+	})
+
+	t.Run("level overrides verbose", func(t *testing.T) {
+		h, err := newLogHandler(&mapEnv{m: map[string]string{envVarLogLevel: "WARN"}}, &bytes.Buffer{}, true)
+		require.NoError(t, err)
+		assert.False(t, h.Enabled(ctx, slog.LevelInfo))
+		assert.True(t, h.Enabled(ctx, slog.LevelWarn))
+	})
+
+	t.Run("quiet", func(t *testing.T) {
+		h, err := newLogHandler(&mapEnv{m: map[string]string{envVarQuiet: "1"}}, &bytes.Buffer{}, false)
+		require.NoError(t, err)
+		assert.False(t, h.Enabled(ctx, slog.LevelWarn))
+		assert.True(t, h.Enabled(ctx, slog.LevelError))
+		_, err = newLogHandler(&mapEnv{m: map[string]string{envVarQuiet: "1"}}, &bytes.Buffer{}, true)
+		assert.ErrorContains(t, err, "conflicts with --verbose")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		h, err := newLogHandler(&mapEnv{m: map[string]string{envVarLogFormat: "json"}}, &buf, false)
+		require.NoError(t, err)
+		slog.New(h).Warn("put failed", "action", "a1")
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+		assert.Equal(t, "WARN", rec["level"])
+		assert.Equal(t, "put failed", rec["msg"])
+		assert.Equal(t, "a1", rec["action"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newLogHandler(&mapEnv{m: map[string]string{envVarLogFormat: "xml"}}, &bytes.Buffer{}, false)
+		assert.Error(t, err)
+		_, err = newLogHandler(&mapEnv{m: map[string]string{envVarLogLevel: "loud"}}, &bytes.Buffer{}, false)
+		assert.Error(t, err)
+		_, err = newLogHandler(&mapEnv{m: map[string]string{envVarQuiet: "hush"}}, &bytes.Buffer{}, false)
+		assert.Error(t, err)
+	})
+}
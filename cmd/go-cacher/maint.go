@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+const statsUsage = `usage: go-cacher stats
+
+Stats prints the number and size of the entries of the local disk cache.
+
+`
+
+const cleanUsage = `usage: go-cacher clean [flags]
+
+Clean removes entries from the local disk cache: all of them, or with
+-older-than those written longer ago than the given duration.
+
+`
+
+const verifyUsage = `usage: go-cacher verify [flags]
+
+Verify checks every entry of the local disk cache: that outputs match their
+IDs, and that actions refer to an output of the right size. It lists the
+broken entries, and with -fix removes them.
+
+`
+
+// newFlagSet returns the flag set of the subcommand name, whose usage is
+// the doc followed by the flags.
+func newFlagSet(name, doc string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), doc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runStats(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("stats", statsUsage)
+	_ = fs.Parse(args)
+	dir := getDir(env)
+	u, err := cachers.NewSimpleDiskCache(*verbose, dir).Usage()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", dir, u)
+	return nil
+}
+
+func runClean(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("clean", cleanUsage)
+	olderThan := fs.Duration("older-than", 0, "only remove the entries written longer ago than `duration`")
+	_ = fs.Parse(args)
+	var before time.Time
+	if *olderThan > 0 {
+		before = time.Now().Add(-*olderThan)
+	}
+	removed, err := cachers.NewSimpleDiskCache(*verbose, getDir(env)).Clean(before)
+	fmt.Printf("removed %s\n", removed)
+	return err
+}
+
+func runVerify(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("verify", verifyUsage)
+	fix := fs.Bool("fix", false, "remove the broken entries")
+	_ = fs.Parse(args)
+	checked, problems, err := cachers.NewSimpleDiskCache(*verbose, getDir(env)).Verify(*fix)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("checked %s: %d broken\n", checked, len(problems))
+	if len(problems) > 0 && !*fix {
+		return errors.New("the local disk cache has broken entries; run go-cacher verify -fix to remove them")
+	}
+	return nil
+}
+
+const exportUsage = `usage: go-cacher export [flags]
+
+Export writes the entries of the local disk cache as a tar archive to
+standard output, or the file given with -o, to seed another machine's cache
+with go-cacher import.
+
+`
+
+const importUsage = `usage: go-cacher import [file]
+
+Import adds the entries of an archive written by go-cacher export, read from
+file or standard input, to the local disk cache. Outputs that don't match
+their IDs are refused.
+
+`
+
+func runExport(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("export", exportUsage)
+	out := fs.String("o", "", "write the archive to `file` instead of standard output")
+	_ = fs.Parse(args)
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	exported, err := cachers.NewSimpleDiskCache(*verbose, getDir(env)).Export(w)
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %s\n", exported)
+	return nil
+}
+
+func runImport(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("import", importUsage)
+	_ = fs.Parse(args)
+	r := os.Stdin
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	imported, err := cachers.NewSimpleDiskCache(*verbose, getDir(env)).Import(r)
+	fmt.Fprintf(os.Stderr, "imported %s\n", imported)
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// memoFile is the file of the cache directory remembering the answers of
+// the remotes.
+const memoFile = "remote-memo"
+
+// withMemo returns remote wrapped to remember its answers for
+// GOCACHE_REMOTE_MEMO_MISSES and GOCACHE_REMOTE_MEMO_HITS, if either is
+// set.
+func withMemo(env Env, remote cachers.RemoteCache) (cachers.RemoteCache, error) {
+	missesVal, hitsVal := env.Get(envVarRemoteMemoMisses), env.Get(envVarRemoteMemoHits)
+	if missesVal == "" && hitsVal == "" {
+		return remote, nil
+	}
+	misses, err := parseDuration(missesVal, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarRemoteMemoMisses, err)
+	}
+	hits, err := parseDuration(hitsVal, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarRemoteMemoHits, err)
+	}
+	file := filepath.Join(getDir(env), memoFile)
+	return cachers.NewMemoRemoteCache(remote, file, memoIdentity(env), hits, misses), nil
+}
+
+// memoIdentity returns a hash of the settings that choose the entries the
+// remotes are asked about, for the memo of other settings to be discarded
+// rather than trusted. The toolchain is left out, as it is part of the
+// actionIDs.
+func memoIdentity(env Env) string {
+	h := sha256.New()
+	for _, key := range []string{
+		envVarBackends,
+		envVarHttpCacheServerBase,
+		envVarS3BucketName,
+		envVarS3Prefix,
+		envVarS3CacheURL,
+		envVarKeySuffix,
+		envVarEncryptionKey,
+		envVarKMSKeyID,
+		envVarSigningTrustedKeys,
+	} {
+		fmt.Fprintf(h, "%s=%s\n", key, env.Get(key))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMemo(t *testing.T) {
+	remote := cachers.NewHttpCache("http://127.0.0.1:1", false)
+	env := func(m map[string]string) Env {
+		m[envVarDiskCacheDir] = t.TempDir()
+		return &mapEnv{m: m}
+	}
+
+	got, err := withMemo(env(map[string]string{}), remote)
+	require.NoError(t, err)
+	assert.Same(t, remote, got)
+
+	got, err = withMemo(env(map[string]string{envVarRemoteMemoMisses: "10m"}), remote)
+	require.NoError(t, err)
+	assert.IsType(t, &cachers.MemoRemoteCache{}, got)
+
+	_, err = withMemo(env(map[string]string{envVarRemoteMemoHits: "soon"}), remote)
+	assert.ErrorContains(t, err, envVarRemoteMemoHits)
+
+	a := memoIdentity(&mapEnv{m: map[string]string{envVarS3BucketName: "a", envVarRemoteConcurrency: "4"}})
+	assert.Equal(t, a, memoIdentity(&mapEnv{m: map[string]string{envVarS3BucketName: "a"}}))
+	assert.NotEqual(t, a, memoIdentity(&mapEnv{m: map[string]string{envVarS3BucketName: "b"}}))
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+)
+
+// metricsJob is the job go-cacher pushes its metrics to a Pushgateway as.
+const metricsJob = "go-cacher"
+
+// A metric is a family of samples of the same measure.
+type metric struct {
+	name, typ, help string // typ is "counter", "gauge" or "summary"
+	samples         []sample
+}
+
+// A sample is a value of a metric, for the labels that set it apart from
+// the other samples of the metric.
+type sample struct {
+	suffix string // appended to the name of the metric, like "_count"
+	labels []label
+	value  float64
+}
+
+type label struct{ name, value string }
+
+// collectMetrics returns the metrics of cache and of the session proc, if
+// any, for the sinks to report.
+func collectMetrics(proc *cacheproc.Process, cache cachers.Cache) []metric {
+	vars := currentDebugVars(proc, cache)
+	var ms []metric
+	if proc != nil {
+		st := vars.Requests
+		byCmd := func(get, put int64) []sample {
+			return []sample{
+				{labels: []label{{"cmd", "get"}}, value: float64(get)},
+				{labels: []label{{"cmd", "put"}}, value: float64(put)},
+			}
+		}
+		ms = append(ms,
+			metric{"gocacher_requests_total", "counter", "Requests of the go command, by command.", byCmd(st.Gets, st.Puts)},
+			metric{"gocacher_request_errors_total", "counter", "Requests of the go command answered with an error, by command.", byCmd(st.GetErrors, st.PutErrors)},
+			metric{"gocacher_hits_total", "counter", "Gets of the go command that hit.", []sample{{value: float64(st.Hits)}}},
+			metric{"gocacher_misses_total", "counter", "Gets of the go command that missed.", []sample{{value: float64(st.Misses)}}},
+			metric{"gocacher_requests_in_flight", "gauge", "Requests of the go command being answered.", []sample{{value: float64(vars.InFlight)}}},
+		)
+
+		cmds := make([]string, 0, len(vars.Latencies))
+		for cmd := range vars.Latencies {
+			cmds = append(cmds, string(cmd))
+		}
+		sort.Strings(cmds)
+		dur := metric{name: "gocacher_request_duration_seconds", typ: "summary", help: "Time taken to answer the requests of the go command, by command."}
+		for _, cmd := range cmds {
+			l := vars.Latencies[wire.Cmd(cmd)]
+			for _, q := range []struct {
+				q string
+				d time.Duration
+			}{{"0.5", l.P50}, {"0.95", l.P95}, {"0.99", l.P99}} {
+				dur.samples = append(dur.samples, sample{labels: []label{{"cmd", cmd}, {"quantile", q.q}}, value: q.d.Seconds()})
+			}
+			dur.samples = append(dur.samples, sample{suffix: "_count", labels: []label{{"cmd", cmd}}, value: float64(l.Count)})
+		}
+		ms = append(ms, dur)
+	}
+
+	for _, m := range []struct {
+		name, typ, help string
+		value           func(cachers.TierStats) float64
+	}{
+		{"gocacher_backend_gets_total", "counter", "Gets sent to the backend.", func(s cachers.TierStats) float64 { return float64(s.Gets) }},
+		{"gocacher_backend_hits_total", "counter", "Gets of the backend that hit.", func(s cachers.TierStats) float64 { return float64(s.Hits) }},
+		{"gocacher_backend_misses_total", "counter", "Gets of the backend that missed.", func(s cachers.TierStats) float64 { return float64(s.Misses) }},
+		{"gocacher_backend_get_errors_total", "counter", "Gets of the backend that failed.", func(s cachers.TierStats) float64 { return float64(s.GetErrors) }},
+		{"gocacher_backend_puts_total", "counter", "Puts the backend stored.", func(s cachers.TierStats) float64 { return float64(s.Puts) }},
+		{"gocacher_backend_put_errors_total", "counter", "Puts of the backend that failed.", func(s cachers.TierStats) float64 { return float64(s.PutErrors) }},
+		{"gocacher_backend_hit_bytes_total", "counter", "Size of the outputs of the hits of the backend; only tracked for remotes.", func(s cachers.TierStats) float64 { return float64(s.HitBytes) }},
+		{"gocacher_backend_put_bytes_total", "counter", "Size of the outputs the backend stored.", func(s cachers.TierStats) float64 { return float64(s.PutBytes) }},
+		{"gocacher_backend_get_seconds_total", "counter", "Time spent in the gets of the backend.", func(s cachers.TierStats) float64 { return s.GetTime.Seconds() }},
+		{"gocacher_backend_put_seconds_total", "counter", "Time spent in the puts of the backend.", func(s cachers.TierStats) float64 { return s.PutTime.Seconds() }},
+	} {
+		if len(vars.Tiers) == 0 {
+			break
+		}
+		bm := metric{name: m.name, typ: m.typ, help: m.help}
+		for _, s := range vars.Tiers {
+			bm.samples = append(bm.samples, sample{labels: []label{{"tier", s.Tier}, {"kind", s.Kind}}, value: m.value(s)})
+		}
+		ms = append(ms, bm)
+	}
+	if len(vars.Tiers) > 0 {
+		errs := metric{name: "gocacher_backend_errors_total", typ: "counter", help: "Failed operations of the backend, by the class of their errors."}
+		for _, s := range vars.Tiers {
+			for _, class := range cachers.ErrorClasses {
+				errs.samples = append(errs.samples, sample{labels: []label{{"tier", s.Tier}, {"kind", s.Kind}, {"class", class}}, value: float64(s.Errors[class])})
+			}
+		}
+		ms = append(ms, errs)
+		lat := metric{name: "gocacher_backend_operation_duration_seconds", typ: "histogram", help: "Latencies of the operations of the backend, by operation."}
+		for _, s := range vars.Tiers {
+			lat.samples = append(lat.samples, histogramSamples([]label{{"tier", s.Tier}, {"kind", s.Kind}, {"op", "get"}}, s.GetLatency)...)
+			lat.samples = append(lat.samples, histogramSamples([]label{{"tier", s.Tier}, {"kind", s.Kind}, {"op", "put"}}, s.PutLatency)...)
+		}
+		ms = append(ms, lat)
+	}
+	return ms
+}
+
+// metricsLabels are the labels of the metrics GOCACHE_METRICS_LABELS
+// chooses from. The others, quantile and le, are part of the samples of
+// summaries and histograms, and always kept.
+var metricsLabels = []string{"cmd", "tier", "kind", "op", "class", "namespace"}
+
+// defaultMaxSeries is how many series of labels each metric has at most by
+// default, which is plenty for the labels go-cacher has.
+const defaultMaxSeries = 100
+
+// A metricsConfig chooses the labels of the metrics, and bounds their
+// series, so that the metrics of a large fleet stay cheap to store. The
+// tags of GOCACHE_TAGS are added to every sample.
+type metricsConfig struct {
+	labels    map[string]bool // the labels of metricsLabels kept
+	constant  []label         // added to every sample: the namespace and the tags
+	maxSeries int             // of each metric, or 0 for unlimited
+}
+
+// newMetricsConfig returns the metricsConfig of the settings of env.
+func newMetricsConfig(ctx context.Context, env Env) (*metricsConfig, error) {
+	cfg := &metricsConfig{labels: map[string]bool{}, maxSeries: defaultMaxSeries}
+	if v := env.Get(envVarMetricsLabels); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if !slices.Contains(metricsLabels, name) {
+				return nil, fmt.Errorf("%s: unknown label %q; want some of %s", envVarMetricsLabels, name, strings.Join(metricsLabels, ", "))
+			}
+			cfg.labels[name] = true
+		}
+	} else {
+		for _, name := range metricsLabels {
+			cfg.labels[name] = name != "namespace"
+		}
+	}
+	if cfg.labels["namespace"] {
+		cfg.constant = []label{{"namespace", namespace(currentToolchain(ctx, env), env.Get(envVarKeySuffix))}}
+	}
+	tags, err := parseTags(env)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cfg.constant = append(cfg.constant, label{k, tags[k]})
+	}
+	if v := env.Get(envVarMetricsMaxSeries); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: invalid limit %q", envVarMetricsMaxSeries, v)
+		}
+		cfg.maxSeries = n
+	}
+	return cfg, nil
+}
+
+// apply returns ms with the labels of cfg: the samples of a metric that
+// only differ by the labels left out are summed, or for the quantiles of
+// summaries, which don't add up, the largest is kept. A nil cfg keeps ms
+// as they are.
+func (cfg *metricsConfig) apply(ms []metric) []metric {
+	if cfg == nil {
+		return ms
+	}
+	out := make([]metric, 0, len(ms))
+	for _, m := range ms {
+		am := metric{name: m.name, typ: m.typ, help: m.help}
+		index := map[string]int{}   // of the samples of am, by suffix and labels
+		series := map[string]bool{} // the labels of am but quantile and le
+		for _, s := range m.samples {
+			labels := append([]label(nil), cfg.constant...)
+			for _, l := range s.labels {
+				if !slices.Contains(metricsLabels, l.name) || cfg.labels[l.name] {
+					labels = append(labels, l)
+				}
+			}
+			if key := labelsKey(labels, true); !series[key] {
+				if cfg.maxSeries > 0 && len(series) >= cfg.maxSeries {
+					for i, l := range labels {
+						if l.name != "namespace" && slices.Contains(metricsLabels, l.name) {
+							labels[i].value = "other"
+						}
+					}
+					key = labelsKey(labels, true)
+				}
+				series[key] = true
+			}
+			k := s.suffix + "\x00" + labelsKey(labels, false)
+			i, ok := index[k]
+			if !ok {
+				index[k] = len(am.samples)
+				am.samples = append(am.samples, sample{suffix: s.suffix, labels: labels, value: s.value})
+				continue
+			}
+			if hasLabel(labels, "quantile") {
+				am.samples[i].value = max(am.samples[i].value, s.value)
+			} else {
+				am.samples[i].value += s.value
+			}
+		}
+		out = append(out, am)
+	}
+	return out
+}
+
+// labelsKey returns a key identifying labels, leaving out the quantile
+// and le labels of the samples of summaries and histograms for the key of
+// their series.
+func labelsKey(labels []label, series bool) string {
+	var b strings.Builder
+	for _, l := range labels {
+		if series && (l.name == "quantile" || l.name == "le") {
+			continue
+		}
+		b.WriteString(l.name)
+		b.WriteByte('=')
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func hasLabel(labels []label, name string) bool {
+	for _, l := range labels {
+		if l.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// histogramSamples returns the samples of the cumulative buckets, the sum
+// and the count of h, which is empty if nil, with labels.
+func histogramSamples(labels []label, h *cachers.Histogram) []sample {
+	if h == nil {
+		h = &cachers.Histogram{Counts: make([]int64, len(cachers.LatencyBuckets)+1)}
+	}
+	with := func(l label) []label { return append(labels[:len(labels):len(labels)], l) }
+	var samples []sample
+	var cum int64
+	for i, n := range h.Counts {
+		cum += n
+		le := "+Inf"
+		if i < len(cachers.LatencyBuckets) {
+			le = strconv.FormatFloat(cachers.LatencyBuckets[i].Seconds(), 'g', -1, 64)
+		}
+		samples = append(samples, sample{suffix: "_bucket", labels: with(label{"le", le}), value: float64(cum)})
+	}
+	return append(samples,
+		sample{suffix: "_sum", labels: labels, value: h.Sum.Seconds()},
+		sample{suffix: "_count", labels: labels, value: float64(h.Count)},
+	)
+}
+
+// writeMetrics writes the metrics of cache and of the session proc, if
+// any, to w in the Prometheus text format.
+func writeMetrics(w io.Writer, proc *cacheproc.Process, cache cachers.Cache) {
+	writePrometheus(w, collectMetrics(proc, cache))
+}
+
+func writePrometheus(w io.Writer, ms []metric) {
+	for _, m := range ms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, s := range m.samples {
+			var labels string
+			if len(s.labels) > 0 {
+				kvs := make([]string, len(s.labels))
+				for i, l := range s.labels {
+					kvs[i] = fmt.Sprintf("%s=%q", l.name, l.value)
+				}
+				labels = "{" + strings.Join(kvs, ",") + "}"
+			}
+			fmt.Fprintf(w, "%s%s%s %s\n", m.name, s.suffix, labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+// serveMetrics serves the metrics of proc, which may be nil, and cache at
+// /metrics on addr in the background, for Prometheus to scrape, with the
+// labels of cfg. An addr without a host, like ":9090", listens on
+// localhost only.
+func serveMetrics(addr string, cfg *metricsConfig, proc *cacheproc.Process, cache cachers.Cache) error {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("localhost", port)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, cfg.apply(collectMetrics(proc, cache)))
+	})
+	slog.Info("metrics server listening", "addr", ln.Addr().String())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			slog.Error("metrics server failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// A metricsSink is a service go-cacher pushes its metrics to.
+type metricsSink interface {
+	// send reports ms, the current values of the metrics.
+	send(ctx context.Context, ms []metric) error
+	String() string
+}
+
+// metricsSinks returns the sinks that env configures.
+func metricsSinks(env Env) ([]metricsSink, error) {
+	var sinks []metricsSink
+	if u := env.Get(envVarMetricsPushURL); u != "" {
+		pg, err := newPushgateway(u)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, pg)
+	}
+	if addr := env.Get(envVarStatsdAddr); addr != "" {
+		var dogstatsd bool
+		switch f := env.Get(envVarStatsdFormat); f {
+		case "", "statsd":
+		case "dogstatsd":
+			dogstatsd = true
+		default:
+			return nil, fmt.Errorf("%s: unknown format %q; want statsd or dogstatsd", envVarStatsdFormat, f)
+		}
+		prefix := env.Get(envVarStatsdPrefix)
+		if prefix == "" {
+			prefix = "gocacher."
+		}
+		s, err := newStatsdSink(addr, prefix, env.Get(envVarStatsdTags), dogstatsd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarStatsdAddr, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// startMetricsSinks sends the metrics of proc, which may be nil, and cache,
+// with the labels of cfg, to the sinks of env every
+// GOCACHE_METRICS_INTERVAL, until stop is called, which sends them a last
+// time.
+func startMetricsSinks(env Env, cfg *metricsConfig, proc *cacheproc.Process, cache cachers.Cache) (stop func(), err error) {
+	sinks, err := metricsSinks(env)
+	if err != nil || len(sinks) == 0 {
+		return func() {}, err
+	}
+	interval, err := parseDuration(env.Get(envVarMetricsInterval), 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarMetricsInterval, err)
+	}
+	// failing records the sinks whose last send failed, to warn only once
+	// while they are down.
+	failing := make([]bool, len(sinks))
+	sendAll := func(final bool) {
+		ms := cfg.apply(collectMetrics(proc, cache))
+		for i, s := range sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := s.send(ctx, ms)
+			cancel()
+			if err != nil && (final || !failing[i]) {
+				slog.Warn("failed to send the metrics", "sink", s.String(), "err", err)
+			}
+			failing[i] = err != nil
+		}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				sendAll(false)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			sendAll(true)
+		})
+	}, nil
+}
+
+// A pushgateway is a Prometheus Pushgateway, which go-cacher pushes its
+// metrics to grouped by the job go-cacher and the host name as the
+// instance.
+type pushgateway struct {
+	url string
+}
+
+func newPushgateway(base string) (*pushgateway, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &pushgateway{
+		url: strings.TrimSuffix(base, "/") + "/metrics/job/" + url.PathEscape(metricsJob) + "/instance/" + url.PathEscape(host),
+	}, nil
+}
+
+func (p *pushgateway) String() string { return "pushgateway" }
+
+func (p *pushgateway) send(ctx context.Context, ms []metric) error {
+	var body bytes.Buffer
+	writePrometheus(&body, ms)
+	req, err := http.NewRequestWithContext(ctx, "PUT", p.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("pushing metrics to %s: %s: %s", p.url, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	ctx := context.Background()
+	cache := cachers.NewLocalCacheWithCounts(cachers.NewSimpleDiskCache(false, t.TempDir()), "local", false)
+	require.NoError(t, cache.Start(ctx))
+	_, _, err := cache.Get(ctx, "a1")
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	writeMetrics(&out, cacheproc.NewCacheProc(cache), cache)
+	assert.Contains(t, out.String(), "# TYPE gocacher_requests_total counter\n")
+	assert.Contains(t, out.String(), `gocacher_requests_total{cmd="get"} 0`+"\n")
+	assert.Contains(t, out.String(), `gocacher_backend_gets_total{tier="local",kind="disk"} 1`+"\n")
+	assert.Contains(t, out.String(), `gocacher_backend_misses_total{tier="local",kind="disk"} 1`+"\n")
+	assert.Contains(t, out.String(), `gocacher_backend_get_seconds_total{tier="local",kind="disk"} `)
+	assert.Contains(t, out.String(), `gocacher_backend_errors_total{tier="local",kind="disk",class="throttled"} 0`+"\n")
+	assert.Contains(t, out.String(), "# TYPE gocacher_backend_operation_duration_seconds histogram\n")
+	assert.Contains(t, out.String(), `gocacher_backend_operation_duration_seconds_bucket{tier="local",kind="disk",op="get",le="+Inf"} 1`+"\n")
+	assert.Contains(t, out.String(), `gocacher_backend_operation_duration_seconds_count{tier="local",kind="disk",op="get"} 1`+"\n")
+	assert.Contains(t, out.String(), `gocacher_backend_operation_duration_seconds_bucket{tier="local",kind="disk",op="put",le="0.0005"} 0`+"\n")
+
+	out.Reset()
+	writeMetrics(&out, nil, cache)
+	assert.NotContains(t, out.String(), "gocacher_requests_total", "a daemon has no session")
+	assert.Contains(t, out.String(), "gocacher_backend_gets_total")
+}
+
+func TestPushMetrics(t *testing.T) {
+	var path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		path, body = r.Method+" "+r.URL.Path, string(b)
+	}))
+	defer srv.Close()
+	cache := cachers.NewLocalCacheWithCounts(cachers.NewSimpleDiskCache(false, t.TempDir()), "local", false)
+
+	pg, err := newPushgateway(srv.URL + "/")
+	require.NoError(t, err)
+	require.NoError(t, pg.send(context.Background(), collectMetrics(nil, cache)))
+	host, _ := os.Hostname()
+	assert.Equal(t, "PUT /metrics/job/go-cacher/instance/"+host, path)
+	assert.Contains(t, body, `gocacher_backend_gets_total{tier="local",kind="disk"} 0`)
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad metrics", http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	pg, err = newPushgateway(bad.URL)
+	require.NoError(t, err)
+	err = pg.send(context.Background(), collectMetrics(nil, cache))
+	assert.ErrorContains(t, err, "400 Bad Request: bad metrics")
+}
+
+func TestMetricsSinks(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		sinks, err := metricsSinks(&mapEnv{m: map[string]string{}})
+		require.NoError(t, err)
+		assert.Empty(t, sinks)
+	})
+	t.Run("pushgateway and statsd", func(t *testing.T) {
+		sinks, err := metricsSinks(&mapEnv{m: map[string]string{
+			envVarMetricsPushURL: "http://localhost:9091",
+			envVarStatsdAddr:     "localhost:8125",
+			envVarStatsdFormat:   "dogstatsd",
+		}})
+		require.NoError(t, err)
+		require.Len(t, sinks, 2)
+		assert.Equal(t, "pushgateway", sinks[0].String())
+		assert.True(t, sinks[1].(*statsdSink).dogstatsd)
+		assert.Equal(t, "gocacher.", sinks[1].(*statsdSink).prefix)
+	})
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := metricsSinks(&mapEnv{m: map[string]string{
+			envVarStatsdAddr:   "localhost:8125",
+			envVarStatsdFormat: "graphite",
+		}})
+		assert.ErrorContains(t, err, `unknown format "graphite"`)
+	})
+	t.Run("bad interval", func(t *testing.T) {
+		_, err := startMetricsSinks(&mapEnv{m: map[string]string{
+			envVarStatsdAddr:      "localhost:8125",
+			envVarMetricsInterval: "often",
+		}}, nil, nil, nil)
+		assert.ErrorContains(t, err, envVarMetricsInterval)
+	})
+}
+
+func TestMetricsConfig(t *testing.T) {
+	ctx := context.Background()
+	ms := []metric{
+		{name: "gocacher_backend_gets_total", typ: "counter", samples: []sample{
+			{labels: []label{{"tier", "local"}, {"kind", "disk"}}, value: 1},
+			{labels: []label{{"tier", "remote"}, {"kind", "s3"}}, value: 2},
+			{labels: []label{{"tier", "remote"}, {"kind", "http"}}, value: 4},
+		}},
+		{name: "gocacher_request_duration_seconds", typ: "summary", samples: []sample{
+			{labels: []label{{"cmd", "get"}, {"quantile", "0.5"}}, value: 0.1},
+			{suffix: "_count", labels: []label{{"cmd", "get"}}, value: 3},
+			{labels: []label{{"cmd", "put"}, {"quantile", "0.5"}}, value: 0.3},
+			{suffix: "_count", labels: []label{{"cmd", "put"}}, value: 2},
+		}},
+	}
+	write := func(cfg *metricsConfig) string {
+		var out bytes.Buffer
+		writePrometheus(&out, cfg.apply(ms))
+		return out.String()
+	}
+
+	t.Run("default", func(t *testing.T) {
+		cfg, err := newMetricsConfig(ctx, &mapEnv{m: map[string]string{}})
+		require.NoError(t, err)
+		var want bytes.Buffer
+		writePrometheus(&want, ms)
+		assert.Equal(t, want.String(), write(cfg))
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		cfg, err := newMetricsConfig(ctx, &mapEnv{m: map[string]string{envVarMetricsLabels: "tier"}})
+		require.NoError(t, err)
+		out := write(cfg)
+		assert.Contains(t, out, `gocacher_backend_gets_total{tier="local"} 1`+"\n")
+		assert.Contains(t, out, `gocacher_backend_gets_total{tier="remote"} 6`+"\n")
+		assert.Contains(t, out, `gocacher_request_duration_seconds{quantile="0.5"} 0.3`+"\n", "the largest quantile")
+		assert.Contains(t, out, "gocacher_request_duration_seconds_count 5\n")
+	})
+
+	t.Run("namespace", func(t *testing.T) {
+		cfg, err := newMetricsConfig(ctx, &mapEnv{m: map[string]string{
+			envVarMetricsLabels: "namespace,kind",
+			"GOVERSION":         "go1.22.1",
+			"GOOS":              "linux",
+			"GOARCH":            "amd64",
+		}})
+		require.NoError(t, err)
+		assert.Contains(t, write(cfg), `gocacher_backend_gets_total{namespace="go1.22.1/linux/amd64",kind="s3"} 2`+"\n")
+	})
+
+	t.Run("max series", func(t *testing.T) {
+		cfg, err := newMetricsConfig(ctx, &mapEnv{m: map[string]string{envVarMetricsMaxSeries: "1"}})
+		require.NoError(t, err)
+		out := write(cfg)
+		assert.Contains(t, out, `gocacher_backend_gets_total{tier="local",kind="disk"} 1`+"\n")
+		assert.Contains(t, out, `gocacher_backend_gets_total{tier="other",kind="other"} 6`+"\n")
+		assert.Contains(t, out, `gocacher_request_duration_seconds_count{cmd="other"} 2`+"\n")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newMetricsConfig(ctx, &mapEnv{m: map[string]string{envVarMetricsLabels: "tier,host"}})
+		assert.ErrorContains(t, err, `unknown label "host"`)
+		_, err = newMetricsConfig(ctx, &mapEnv{m: map[string]string{envVarMetricsMaxSeries: "lots"}})
+		assert.ErrorContains(t, err, envVarMetricsMaxSeries)
+	})
+}
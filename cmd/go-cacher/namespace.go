@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// toolchain is the configuration of the go command that runs go-cacher, as
+// far as it decides what is built.
+type toolchain struct {
+	GoVersion    string
+	GOOS         string
+	GOARCH       string
+	GOEXPERIMENT string
+}
+
+// currentToolchain returns the configuration of the go command. When
+// go-cacher runs as its GOCACHEPROG, the go command passes it in the
+// environment, GOVERSION included, which is used as is: the go found in
+// PATH could be another toolchain, for example after a GOTOOLCHAIN switch.
+// Otherwise it asks the go command in PATH and, if that fails, falls back
+// to the environment and the toolchain go-cacher was built with.
+func currentToolchain(ctx context.Context, env Env) toolchain {
+	tc := toolchain{
+		GoVersion:    env.Get("GOVERSION"),
+		GOOS:         env.Get("GOOS"),
+		GOARCH:       env.Get("GOARCH"),
+		GOEXPERIMENT: env.Get("GOEXPERIMENT"),
+	}
+	if tc.GOOS == "" {
+		tc.GOOS = runtime.GOOS
+	}
+	if tc.GOARCH == "" {
+		tc.GOARCH = runtime.GOARCH
+	}
+	if tc.GoVersion != "" {
+		return tc
+	}
+	tc.GoVersion = runtime.Version()
+	cmd := exec.CommandContext(ctx, "go", "env", "GOVERSION", "GOOS", "GOARCH", "GOEXPERIMENT")
+	// go env doesn't need a cache, and must not start another go-cacher.
+	cmd.Env = append(os.Environ(), "GOCACHEPROG=")
+	out, err := cmd.Output()
+	if err != nil {
+		slog.Warn("cannot ask the go command for its version; assuming the one go-cacher was built with", "version", tc.GoVersion, "err", err)
+		return tc
+	}
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) != 4 {
+		return tc
+	}
+	return toolchain{GoVersion: lines[0], GOOS: lines[1], GOARCH: lines[2], GOEXPERIMENT: lines[3]}
+}
+
+var unsafeKeyCharsRx = regexp.MustCompile(`[^A-Za-z0-9._,+-]`)
+
+// namespace returns the key prefix that keeps the entries of different
+// toolchains apart in a shared remote:
+// <go version>/<GOOS>/<GOARCH>[/<experiments>][/<suffix>].
+func namespace(tc toolchain, suffix string) string {
+	elems := []string{tc.GoVersion, tc.GOOS, tc.GOARCH}
+	if tc.GOEXPERIMENT != "" {
+		exps := strings.Split(tc.GOEXPERIMENT, ",")
+		sort.Strings(exps)
+		elems = append(elems, "exp-"+strings.Trim(strings.Join(exps, ","), ","))
+	}
+	if suffix != "" {
+		elems = append(elems, suffix)
+	}
+	for i, e := range elems {
+		elems[i] = unsafeKeyCharsRx.ReplaceAllString(e, "_")
+	}
+	return path.Join(elems...)
+}
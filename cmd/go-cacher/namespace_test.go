@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespace(t *testing.T) {
+	tc := toolchain{GoVersion: "go1.22.1", GOOS: "linux", GOARCH: "amd64"}
+	assert.Equal(t, "go1.22.1/linux/amd64", namespace(tc, ""))
+	assert.Equal(t, "go1.22.1/linux/amd64/main", namespace(tc, "main"))
+	assert.Equal(t, "go1.22.1/linux/amd64/feature_x", namespace(tc, "feature/x"))
+
+	tc.GOEXPERIMENT = "rangefunc,arenas"
+	assert.Equal(t, "go1.22.1/linux/amd64/exp-arenas,rangefunc", namespace(tc, ""))
+
+	tc.GoVersion = "devel go1.23-abc123 Mon Jan 1"
+	assert.Equal(t, "devel_go1.23-abc123_Mon_Jan_1/linux/amd64/exp-arenas,rangefunc", namespace(tc, ""))
+}
+
+func TestCurrentToolchain(t *testing.T) {
+	env := &mapEnv{m: map[string]string{
+		"GOVERSION":    "go1.24.2",
+		"GOOS":         "plan9",
+		"GOARCH":       "arm",
+		"GOEXPERIMENT": "arenas",
+	}}
+	assert.Equal(t, toolchain{GoVersion: "go1.24.2", GOOS: "plan9", GOARCH: "arm", GOEXPERIMENT: "arenas"},
+		currentToolchain(context.Background(), env))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// defaultOIDCAudience is the audience of the OIDC tokens requested from
+// GitHub Actions, the one AWS expects.
+const defaultOIDCAudience = "sts.amazonaws.com"
+
+// oidcTokenTimeout bounds the request of an OIDC token.
+const oidcTokenTimeout = 30 * time.Second
+
+// An oidcToken gets the OIDC token identifying the CI job: GOCACHE_OIDC_TOKEN,
+// like an id_token of GitLab CI, or else one requested from GitHub Actions,
+// which issues them to the jobs with the id-token: write permission.
+type oidcToken struct {
+	env Env
+}
+
+// GetIdentityToken implements stscreds.IdentityTokenRetriever.
+func (o oidcToken) GetIdentityToken() ([]byte, error) {
+	if token := o.env.Get(envVarOIDCToken); token != "" {
+		return []byte(token), nil
+	}
+	reqURL, reqToken := o.env.Get("ACTIONS_ID_TOKEN_REQUEST_URL"), o.env.Get("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if reqURL == "" || reqToken == "" {
+		return nil, fmt.Errorf("no OIDC token: set %s, or run in GitHub Actions with the id-token: write permission", envVarOIDCToken)
+	}
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("ACTIONS_ID_TOKEN_REQUEST_URL: %w", err)
+	}
+	audience := o.env.Get(envVarOIDCAudience)
+	if audience == "" {
+		audience = defaultOIDCAudience
+	}
+	q := u.Query()
+	q.Set("audience", audience)
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTokenTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+reqToken)
+	req.Header.Set("Accept", "application/json")
+	client, err := proxyClient(o.env)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting an OIDC token from GitHub Actions: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("requesting an OIDC token from GitHub Actions: %s: %s", res.Status, msg)
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("requesting an OIDC token from GitHub Actions: %w", err)
+	}
+	if body.Value == "" {
+		return nil, errors.New("requesting an OIDC token from GitHub Actions: empty token")
+	}
+	logRedactor.add(body.Value)
+	return []byte(body.Value), nil
+}
+
+// oidcCredentials returns the provider of the credentials of the role
+// GOCACHE_AWS_ROLE_ARN, assumed with the OIDC token of the CI job and
+// assumed again when they expire, based on cfg.
+func oidcCredentials(env Env, cfg aws.Config) aws.CredentialsProvider {
+	provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), env.Get(envVarS3AwsRoleArn), oidcToken{env: env},
+		func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = "go-cacher"
+		})
+	return aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = credentialRefreshMargin
+	})
+}
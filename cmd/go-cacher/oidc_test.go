@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newGitHubTokenServer returns a server issuing the OIDC token "jwt", like
+// GitHub Actions, and the settings of a job using it.
+func newGitHubTokenServer(t *testing.T) (*httptest.Server, map[string]string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer req-t0ken" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"value":"jwt-for-` + r.URL.Query().Get("audience") + `"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, map[string]string{
+		"ACTIONS_ID_TOKEN_REQUEST_URL":   srv.URL + "/token?api-version=2.0",
+		"ACTIONS_ID_TOKEN_REQUEST_TOKEN": "req-t0ken",
+	}
+}
+
+func TestOIDCToken(t *testing.T) {
+	t.Run("GitHub Actions", func(t *testing.T) {
+		_, m := newGitHubTokenServer(t)
+		token, err := oidcToken{env: &mapEnv{m: m}}.GetIdentityToken()
+		require.NoError(t, err)
+		assert.Equal(t, "jwt-for-sts.amazonaws.com", string(token))
+
+		m[envVarOIDCAudience] = "cache"
+		token, err = oidcToken{env: &mapEnv{m: m}}.GetIdentityToken()
+		require.NoError(t, err)
+		assert.Equal(t, "jwt-for-cache", string(token))
+
+		m["ACTIONS_ID_TOKEN_REQUEST_TOKEN"] = "wrong"
+		_, err = oidcToken{env: &mapEnv{m: m}}.GetIdentityToken()
+		assert.ErrorContains(t, err, "401")
+	})
+
+	t.Run("token setting", func(t *testing.T) {
+		token, err := oidcToken{env: &mapEnv{m: map[string]string{envVarOIDCToken: "gitlab-jwt"}}}.GetIdentityToken()
+		require.NoError(t, err)
+		assert.Equal(t, "gitlab-jwt", string(token))
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		_, err := oidcToken{env: &mapEnv{m: map[string]string{}}}.GetIdentityToken()
+		assert.ErrorContains(t, err, envVarOIDCToken)
+	})
+}
+
+func TestOIDCCredentials(t *testing.T) {
+	var form url.Values
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>AKID</AccessKeyId><SecretAccessKey>SECRET</SecretAccessKey><SessionToken>SESSION</SessionToken>
+<Expiration>2100-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", sts.URL)
+
+	_, m := newGitHubTokenServer(t)
+	m[envVarS3AwsRoleArn] = "arn:aws:iam::123456789012:role/cache"
+	cfg, err := getAwsConfigFromEnv(context.Background(), &mapEnv{m: m})
+	require.NoError(t, err)
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "AKID", creds.AccessKeyID)
+	assert.Equal(t, "SESSION", creds.SessionToken)
+	assert.True(t, creds.CanExpire)
+	assert.Equal(t, "AssumeRoleWithWebIdentity", form.Get("Action"))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/cache", form.Get("RoleArn"))
+	assert.Equal(t, "jwt-for-sts.amazonaws.com", form.Get("WebIdentityToken"))
+}
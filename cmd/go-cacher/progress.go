@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// progress is the line logged every GOCACHE_PROGRESS_INTERVAL.
+type progress struct {
+	gets, hits, misses, puts, errors int64
+	inFlight, uploads, retries       int64
+	downloaded, uploaded             int64
+}
+
+func currentProgress(proc *cacheproc.Process, cache cachers.Cache) progress {
+	st := proc.Stats()
+	q := cachers.CacheQueues(cache)
+	p := progress{
+		gets:     st.Gets,
+		hits:     st.Hits,
+		misses:   st.Misses,
+		puts:     st.Puts,
+		errors:   st.GetErrors + st.PutErrors,
+		inFlight: proc.InFlight(),
+		uploads:  q.Uploads,
+		retries:  q.Retries,
+	}
+	for _, ts := range cachers.CacheStats(cache) {
+		if strings.HasPrefix(ts.Tier, "remote") {
+			p.downloaded += ts.HitBytes
+			p.uploaded += ts.PutBytes
+		}
+	}
+	return p
+}
+
+func (p progress) attrs() []any {
+	return []any{"gets", p.gets, "hits", p.hits, "misses", p.misses, "puts", p.puts, "errors", p.errors,
+		"in_flight", p.inFlight, "uploads_queued", p.uploads, "retries_queued", p.retries,
+		"downloaded", p.downloaded, "uploaded", p.uploaded}
+}
+
+// logProgress logs the stats of the session proc so far every interval
+// until ctx is done, so that a long build shows how the cache is doing
+// before the summary. Nothing is logged while the session is idle.
+func logProgress(ctx context.Context, interval time.Duration, proc *cacheproc.Process, cache cachers.Cache) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	var last progress
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if p := currentProgress(proc, cache); p != last {
+			last = p
+			slog.Info("progress", p.attrs()...)
+		}
+	}
+}
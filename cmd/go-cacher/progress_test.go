@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogProgress(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	cache := cachers.NewLocalCacheWithCounts(cachers.NewSimpleDiskCache(false, t.TempDir()), "local", false)
+	proc := cacheproc.NewCacheProc(cache)
+	in := strings.NewReader(`{"ID":1,"Command":"get","ActionID":"qg=="}` + "\n")
+	require.NoError(t, proc.Serve(context.Background(), in, io.Discard))
+	logs.Reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	logProgress(ctx, 10*time.Millisecond, proc, cache)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 1, "an idle session logs its progress once")
+	var ev map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &ev))
+	assert.Equal(t, "progress", ev["msg"])
+	assert.Equal(t, float64(1), ev["gets"])
+	assert.Equal(t, float64(1), ev["misses"])
+	assert.Equal(t, float64(0), ev["in_flight"])
+	assert.Equal(t, float64(0), ev["downloaded"])
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces the secrets in logs and errors.
+const redacted = "********"
+
+// secretPatterns match the credentials that can show up in the errors of
+// the backends and in URLs, even when they aren't settings: the signature
+// and credentials of presigned URLs, AWS access key IDs, bearer tokens and
+// the passwords of URLs. The first group of each, and its second if any,
+// are kept.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)([?&](?:x-amz-signature|x-amz-credential|x-amz-security-token|signature|awsaccesskeyid|sig|token|access_token)=)[^&\s"'<>]+`),
+	regexp.MustCompile(`\b((?:AKIA|ASIA))[A-Z0-9]{16}\b`),
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+(@)`),
+}
+
+// A redactor masks secrets in text: the values of the secret settings, those
+// added as they are got, like the tokens of credential helpers, and those
+// secretPatterns match.
+type redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// logRedactor masks the secrets in the logs and the fatal errors.
+var logRedactor = &redactor{}
+
+// add makes r mask secret. Values too short to be secrets, which would mask
+// common words, are ignored.
+func (r *redactor) add(secret string) {
+	if len(secret) < 6 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.secrets {
+		if s == secret {
+			return
+		}
+	}
+	r.secrets = append(r.secrets, secret)
+}
+
+// addSettings makes r mask the values of the secret settings of env.
+func (r *redactor) addSettings(env Env) {
+	for _, key := range secretSettings {
+		r.add(env.Get(key))
+	}
+}
+
+// redact returns s with its secrets masked.
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	r.mu.RUnlock()
+	for _, re := range secretPatterns {
+		s = re.ReplaceAllString(s, "${1}"+redacted+"${2}")
+	}
+	return s
+}
+
+// A redactingHandler is a slog.Handler masking, with a redactor, the
+// secrets of the messages and the attributes of the records it passes on
+// to the handler it wraps.
+type redactingHandler struct {
+	slog.Handler
+	r *redactor
+}
+
+func newRedactingHandler(h slog.Handler, r *redactor) slog.Handler {
+	return &redactingHandler{Handler: h, r: r}
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	out := slog.NewRecord(rec.Time, rec.Level, h.r.redact(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = h.redactAttr(a)
+	}
+	return &redactingHandler{Handler: h.Handler.WithAttrs(redactedAttrs), r: h.r}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{Handler: h.Handler.WithGroup(name), r: h.r}
+}
+
+// redactAttr masks the secrets of the strings, errors and Stringers of a.
+func (h *redactingHandler) redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(h.r.redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		attrs := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			attrs[i] = h.redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(attrs...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			a.Value = slog.StringValue(h.r.redact(x.Error()))
+		case fmt.Stringer:
+			a.Value = slog.StringValue(h.r.redact(x.String()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+)
+
+const replayUsage = `usage: go-cacher replay [flags] file
+
+Replay serves the requests of a session recorded with --record to the cache
+configured by the environment, as fast as it answers them, and reports how
+long that took and how many responses differ from the recording: a way to
+benchmark and compare caches on real workloads without running builds.
+
+`
+
+func runReplay(ctx context.Context, env Env, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), replayUsage)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opts, err := procOptions(env)
+	if err != nil {
+		return err
+	}
+	cache, _ := getCache(ctx, env, *verbose)
+	st, err := cacheproc.Replay(ctx, cacheproc.NewCacheProc(cache, opts...), f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d requests in %v: %d gets (%d hits, %d misses, %d errors), %d puts (%d errors); %d responses differ from the recording\n",
+		st.Requests, st.Elapsed.Round(time.Millisecond), st.Gets, st.Hits, st.Misses, st.GetErrors, st.Puts, st.PutErrors, st.Changed)
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cacheproc"
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/bradfitz/go-tool-cache/wire"
+)
+
+const (
+	// errorReportTimeout bounds the sending of a report, and how long
+	// go-cacher waits on exit for the reports being sent.
+	errorReportTimeout = 5 * time.Second
+	// defaultErrorReportThreshold is the number of failures in a row of a
+	// remote that are reported.
+	defaultErrorReportThreshold = 10
+)
+
+// errorReports reports the crashes and fatal errors of go-cacher, if
+// GOCACHE_SENTRY_DSN or GOCACHE_ERROR_WEBHOOK is set.
+var errorReports *errorReporter
+
+// pendingReports tracks the reports being sent in the background, which
+// go-cacher waits for on exit.
+var pendingReports sync.WaitGroup
+
+// An errorReporter sends reports of what went wrong to Sentry or to a
+// webhook, so that the operators of a cache hear of its failures from
+// go-cacher rather than from the developers whose builds are slow.
+type errorReporter struct {
+	sentry    *sentryDSN // or nil
+	webhook   string     // or ""
+	client    *http.Client
+	threshold int // of the failures in a row of a remote
+	context   errorContext
+}
+
+// errorContext is what is reported with every error, to tell where it
+// happened.
+type errorContext struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"go_version"`
+	Platform  string            `json:"platform"`
+	Host      string            `json:"host,omitempty"`
+	CIJob     string            `json:"ci_job,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// An errorReport is a report of an error, and the JSON body posted to
+// GOCACHE_ERROR_WEBHOOK.
+type errorReport struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"` // "crash", "fatal" or "backend"
+	Message  string    `json:"message"`
+	Class    string    `json:"class,omitempty"`    // of the error, like "auth" or "network"
+	Remote   string    `json:"remote,omitempty"`   // the failing remote of a "backend" report
+	Failures int       `json:"failures,omitempty"` // in a row, of a "backend" report
+	Stack    string    `json:"stack,omitempty"`    // of a "crash" report
+	errorContext
+}
+
+// newErrorReporter returns the errorReporter of the settings of env, or nil
+// if neither GOCACHE_SENTRY_DSN nor GOCACHE_ERROR_WEBHOOK is set.
+func newErrorReporter(env Env) (*errorReporter, error) {
+	dsn, webhook := env.Get(envVarSentryDSN), env.Get(envVarErrorWebhook)
+	if dsn == "" && webhook == "" {
+		return nil, nil
+	}
+	r := &errorReporter{webhook: webhook, threshold: defaultErrorReportThreshold}
+	if dsn != "" {
+		d, err := parseSentryDSN(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarSentryDSN, err)
+		}
+		r.sentry = d
+	}
+	if webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("%s: want an http:// or https:// URL", envVarErrorWebhook)
+		}
+	}
+	if v := env.Get(envVarErrorReportThreshold); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%s: invalid threshold %q", envVarErrorReportThreshold, v)
+		}
+		r.threshold = n
+	}
+	client, err := proxyClient(env)
+	if err != nil {
+		return nil, err
+	}
+	r.client = &http.Client{Transport: client.Transport, Timeout: errorReportTimeout}
+	tags, err := parseTags(env)
+	if err != nil {
+		return nil, err
+	}
+	version, goVersion := "(unknown)", runtime.Version()
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		version = bi.Main.Version
+	}
+	host, _ := os.Hostname()
+	r.context = errorContext{
+		Version:   version,
+		GoVersion: goVersion,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Host:      host,
+		CIJob:     ciJob(env),
+		Tags:      tags,
+	}
+	return r, nil
+}
+
+// withFailureReports returns remotes wrapped to report, with r, the remotes
+// that keep failing. A nil r reports nothing.
+func (r *errorReporter) withFailureReports(remotes []cachers.RemoteCache) []cachers.RemoteCache {
+	if r == nil {
+		return remotes
+	}
+	for i, remote := range remotes {
+		kind := remote.Kind()
+		remotes[i] = cachers.NewFailureReportRemoteCache(remote, r.threshold, func(failures int, err error) {
+			r.reportInBackground(errorReport{
+				Kind:     "backend",
+				Message:  fmt.Sprintf("%s remote failed %d times in a row: %v", kind, failures, err),
+				Class:    cachers.ClassifyError(err),
+				Remote:   kind,
+				Failures: failures,
+			})
+		})
+	}
+	return remotes
+}
+
+// panicHandler returns the handler of the panics of the protocol process
+// reporting them with r.
+func (r *errorReporter) panicHandler() cacheproc.Option {
+	return cacheproc.WithPanicHandler(func(cmd wire.Cmd, v any, stack []byte) {
+		r.reportInBackground(errorReport{
+			Kind:    "crash",
+			Message: fmt.Sprintf("panic handling %s: %v", cmd, v),
+			Stack:   string(stack),
+		})
+	})
+}
+
+// crash reports v, with which go-cacher panics, and its stack. A nil r
+// reports nothing.
+func (r *errorReporter) crash(v any, stack []byte) {
+	if r == nil {
+		return
+	}
+	r.report(errorReport{Kind: "crash", Message: fmt.Sprintf("panic: %v", v), Stack: string(stack)})
+}
+
+// fatal reports err, of kind, with which go-cacher exits. Errors in the
+// settings, which are the user's to fix, and interruptions are not
+// reported. A nil r reports nothing.
+func (r *errorReporter) fatal(err error, kind string) {
+	if r == nil || kind == "config" || errors.Is(err, context.Canceled) {
+		return
+	}
+	r.report(errorReport{Kind: "fatal", Message: err.Error(), Class: kind})
+}
+
+// reportInBackground sends rep without waiting for it, registering it with
+// pendingReports.
+func (r *errorReporter) reportInBackground(rep errorReport) {
+	pendingReports.Add(1)
+	go func() {
+		defer pendingReports.Done()
+		r.report(rep)
+	}()
+}
+
+// report sends rep, logging the failures to send it.
+func (r *errorReporter) report(rep errorReport) {
+	if rep.Time.IsZero() {
+		rep.Time = time.Now().UTC()
+	}
+	rep.Message = logRedactor.redact(rep.Message)
+	rep.errorContext = r.context
+	if r.sentry != nil {
+		if err := r.sendSentry(rep); err != nil {
+			slog.Warn("sending error report to Sentry failed", "err", err)
+		}
+	}
+	if r.webhook != "" {
+		body, _ := json.Marshal(rep)
+		if err := r.post(r.webhook, "application/json", nil, body); err != nil {
+			slog.Warn("sending error report failed", "err", err)
+		}
+	}
+}
+
+func (r *errorReporter) post(url, contentType string, header http.Header, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), errorReportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", logRedactor.redact(url), res.Status)
+	}
+	return nil
+}
+
+// waitReports waits, for up to errorReportTimeout, for the reports being
+// sent in the background.
+func waitReports() {
+	done := make(chan struct{})
+	go func() {
+		pendingReports.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(errorReportTimeout):
+	}
+}
+
+// reportPanic reports a panic of the main goroutine with errorReports, and
+// panics again. It must be deferred.
+func reportPanic() {
+	if v := recover(); v != nil {
+		errorReports.crash(v, debug.Stack())
+		panic(v)
+	}
+}
+
+// A sentryDSN is the parsed DSN of a Sentry project, like
+// "https://KEY@o1.ingest.sentry.io/42".
+type sentryDSN struct {
+	dsn      string
+	key      string
+	envelope string // the URL events are posted to
+}
+
+func parseSentryDSN(s string) (*sentryDSN, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("want a DSN like https://KEY@HOST/PROJECT")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := path[:max(i, 0)], path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("no project in the DSN")
+	}
+	return &sentryDSN{
+		dsn:      s,
+		key:      u.User.Username(),
+		envelope: u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/envelope/",
+	}, nil
+}
+
+// sendSentry posts rep to Sentry as an event, in an envelope.
+func (r *errorReporter) sendSentry(rep errorReport) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	level := "error"
+	if rep.Kind != "backend" {
+		level = "fatal"
+	}
+	tags := map[string]string{"kind": rep.Kind, "platform": rep.Platform, "go_version": rep.GoVersion}
+	for k, v := range rep.Tags {
+		tags[k] = v
+	}
+	if rep.Class != "" {
+		tags["class"] = rep.Class
+	}
+	if rep.Remote != "" {
+		tags["remote"] = rep.Remote
+	}
+	extra := map[string]any{}
+	if rep.CIJob != "" {
+		extra["ci_job"] = rep.CIJob
+	}
+	if rep.Failures > 0 {
+		extra["failures"] = rep.Failures
+	}
+	if rep.Stack != "" {
+		extra["stack"] = rep.Stack
+	}
+	event := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   rep.Time.Format(time.RFC3339Nano),
+		"level":       level,
+		"platform":    "go",
+		"logger":      "go-cacher",
+		"release":     "go-cacher@" + rep.Version,
+		"server_name": rep.Host,
+		"message":     map[string]string{"formatted": rep.Message},
+		"tags":        tags,
+		"extra":       extra,
+	}
+	if rep.Kind == "backend" {
+		// Group the reports of a remote by what is wrong rather than by
+		// the text of the errors, which varies with the keys.
+		event["fingerprint"] = []string{"backend", rep.Remote, rep.Class}
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, v := range []any{
+		map[string]string{"event_id": event["event_id"].(string), "dsn": r.sentry.dsn},
+		map[string]string{"type": "event"},
+		event,
+	} {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=go-cacher/%s", r.sentry.key, rep.Version)
+	return r.post(r.sentry.envelope, "application/x-sentry-envelope", http.Header{"X-Sentry-Auth": {auth}}, body.Bytes())
+}
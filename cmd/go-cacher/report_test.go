@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingRemote is a RemoteCache whose every operation fails with err.
+type failingRemote struct {
+	nopRemote
+	err error
+}
+
+func (r failingRemote) Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
+	return "", 0, nil, r.err
+}
+
+func TestParseSentryDSN(t *testing.T) {
+	d, err := parseSentryDSN("https://abc123@o1.ingest.sentry.io/42")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", d.key)
+	assert.Equal(t, "https://o1.ingest.sentry.io/api/42/envelope/", d.envelope)
+
+	d, err = parseSentryDSN("https://abc123@sentry.example.com/prefix/7/")
+	require.NoError(t, err)
+	assert.Equal(t, "https://sentry.example.com/prefix/api/7/envelope/", d.envelope)
+
+	for _, s := range []string{"https://sentry.example.com/42", "https://abc123@sentry.example.com", "ftp://abc@host/1"} {
+		_, err := parseSentryDSN(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestErrorReporter(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]any
+	var reports []errorReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/api/42/envelope/":
+			assert.Contains(t, r.Header.Get("X-Sentry-Auth"), "sentry_key=abc123")
+			sc := bufio.NewScanner(r.Body)
+			sc.Buffer(nil, 1<<20)
+			var lines []string
+			for sc.Scan() {
+				lines = append(lines, sc.Text())
+			}
+			require.Len(t, lines, 3)
+			assert.Equal(t, `{"type":"event"}`, lines[1])
+			var event map[string]any
+			require.NoError(t, json.Unmarshal([]byte(lines[2]), &event))
+			events = append(events, event)
+		case "/hook":
+			var rep errorReport
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&rep))
+			reports = append(reports, rep)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	env := &mapEnv{m: map[string]string{
+		envVarSentryDSN:            strings.Replace(srv.URL, "http://", "http://abc123@", 1) + "/42",
+		envVarErrorWebhook:         srv.URL + "/hook",
+		envVarErrorReportThreshold: "2",
+		envVarTags:                 "team=build",
+		"GITHUB_SERVER_URL":        "https://github.com",
+		"GITHUB_REPOSITORY":        "acme/widgets",
+		"GITHUB_RUN_ID":            "7",
+	}}
+	r, err := newErrorReporter(env)
+	require.NoError(t, err)
+
+	remotes := r.withFailureReports([]cachers.RemoteCache{failingRemote{err: errors.New("dial tcp: connection refused")}})
+	for i := 0; i < 3; i++ {
+		_, _, _, err := remotes[0].Get(context.Background(), "a1")
+		require.Error(t, err)
+	}
+	waitReports()
+	r.fatal(errors.New("GOCACHEPROG: unexpected EOF"), "protocol")
+	r.fatal(errors.New("GOCACHE_BACKENDS: unknown backend"), "config")
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, reports, 2)
+	assert.Equal(t, "backend", reports[0].Kind)
+	assert.Equal(t, "nop", reports[0].Remote)
+	assert.Equal(t, 2, reports[0].Failures)
+	assert.Equal(t, cachers.ErrorOther, reports[0].Class)
+	assert.Equal(t, "nop remote failed 2 times in a row: dial tcp: connection refused", reports[0].Message)
+	assert.Equal(t, "https://github.com/acme/widgets/actions/runs/7", reports[0].CIJob)
+	assert.Equal(t, map[string]string{"team": "build"}, reports[0].Tags)
+	assert.Equal(t, "fatal", reports[1].Kind)
+	assert.Equal(t, "protocol", reports[1].Class)
+
+	require.Len(t, events, 2)
+	assert.Equal(t, "error", events[0]["level"])
+	assert.Equal(t, []any{"backend", "nop", cachers.ErrorOther}, events[0]["fingerprint"])
+	assert.Equal(t, "build", events[0]["tags"].(map[string]any)["team"])
+	assert.Equal(t, "fatal", events[1]["level"])
+
+	t.Run("off", func(t *testing.T) {
+		r, err := newErrorReporter(&mapEnv{m: map[string]string{}})
+		require.NoError(t, err)
+		assert.Nil(t, r)
+		r.fatal(errors.New("boom"), "error")
+		remotes := []cachers.RemoteCache{nopRemote{}}
+		assert.Equal(t, remotes, r.withFailureReports(remotes))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newErrorReporter(&mapEnv{m: map[string]string{envVarErrorWebhook: srv.URL, envVarErrorReportThreshold: "0"}})
+		assert.ErrorContains(t, err, envVarErrorReportThreshold)
+		_, err = newErrorReporter(&mapEnv{m: map[string]string{envVarSentryDSN: "not a dsn"}})
+		assert.ErrorContains(t, err, envVarSentryDSN)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// secretSettings are the credential settings, which are masked when shown
+// and whose values may say where to get the secret instead of being it:
+// "file:PATH" reads it from a file, "env:VAR" from another environment
+// variable, and "exec:COMMAND ARGS..." from the output of a command.
+var secretSettings = []string{
+	envVarS3AwsAccessKey,
+	envVarS3AwsSecretAccessKey,
+	envVarS3AwsSessionToken,
+	envVarS3AwsWriteAccessKey,
+	envVarS3AwsWriteSecretKey,
+	envVarS3AwsWriteSessionToken,
+	envVarOIDCToken,
+	envVarHttpToken,
+	envVarHttpWriteToken,
+	envVarHttpHMACSecret,
+	envVarEncryptionKey,
+	envVarSigningKey,
+	envVarSentryDSN,
+	envVarErrorWebhook,
+}
+
+// secretEnv is an Env resolving the references to secrets of the settings
+// of base.
+type secretEnv struct {
+	base Env
+	vars map[string]string // the resolved secrets
+	refs map[string]string // the references they were resolved from
+}
+
+func (e *secretEnv) Get(key string) string {
+	if v, ok := e.vars[key]; ok {
+		return v
+	}
+	return e.base.Get(key)
+}
+
+func (e *secretEnv) source(key string) string {
+	src := settingSource(e.base, key)
+	if ref, ok := e.refs[key]; ok {
+		return strings.TrimSpace(src + " via " + ref)
+	}
+	return src
+}
+
+// resolveSecrets returns base with the references to secrets of its
+// secret settings replaced by the secrets.
+func resolveSecrets(base Env) (Env, error) {
+	e := &secretEnv{base: base, vars: map[string]string{}, refs: map[string]string{}}
+	for _, key := range secretSettings {
+		ref := base.Get(key)
+		secret, ok, err := resolveSecret(ref)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if ok {
+			e.vars[key], e.refs[key] = secret, ref
+		}
+	}
+	if len(e.vars) == 0 {
+		return base, nil
+	}
+	return e, nil
+}
+
+// resolveSecret returns the secret ref refers to, and false if ref is not
+// a reference but the secret itself.
+func resolveSecret(ref string) (secret string, ok bool, err error) {
+	kind, arg, _ := strings.Cut(ref, ":")
+	switch kind {
+	case "file":
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return "", true, err
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", true, fmt.Errorf("%s is not set", arg)
+		}
+		return v, true, nil
+	case "exec":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return "", true, fmt.Errorf("no command in %q", ref)
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", true, fmt.Errorf("%s: %w", arg, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), true, nil
+	default:
+		return ref, false, nil
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("from-file\n"), 0600))
+	t.Setenv("GO_CACHER_TEST_SECRET", "from-env")
+
+	env, err := resolveSecrets(&mapEnv{m: map[string]string{
+		envVarHttpToken:            "file:" + path,
+		envVarS3AwsSecretAccessKey: "env:GO_CACHER_TEST_SECRET",
+		envVarS3AwsAccessKey:       "AKIALITERAL",
+		envVarS3BucketName:         "file:not-a-secret",
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", env.Get(envVarHttpToken))
+	assert.Equal(t, "from-env", env.Get(envVarS3AwsSecretAccessKey))
+	assert.Equal(t, "AKIALITERAL", env.Get(envVarS3AwsAccessKey))
+	assert.Equal(t, "file:not-a-secret", env.Get(envVarS3BucketName), "only credentials are resolved")
+	assert.Equal(t, "via file:"+path, settingSource(env, envVarHttpToken))
+
+	t.Run("exec", func(t *testing.T) {
+		if _, err := exec.LookPath("echo"); err != nil {
+			t.Skip(err)
+		}
+		env, err := resolveSecrets(&mapEnv{m: map[string]string{envVarHttpWriteToken: "exec:echo s3cret"}})
+		require.NoError(t, err)
+		assert.Equal(t, "s3cret", env.Get(envVarHttpWriteToken))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, ref := range []string{
+			"file:" + filepath.Join(t.TempDir(), "missing"),
+			"env:GO_CACHER_TEST_UNSET",
+			"exec:",
+		} {
+			_, err := resolveSecrets(&mapEnv{m: map[string]string{envVarHttpToken: ref}})
+			assert.ErrorContains(t, err, envVarHttpToken+": ", ref)
+		}
+	})
+
+	t.Run("no references", func(t *testing.T) {
+		base := &mapEnv{m: map[string]string{envVarHttpToken: "literal"}}
+		env, err := resolveSecrets(base)
+		require.NoError(t, err)
+		assert.Same(t, base, env)
+	})
+}
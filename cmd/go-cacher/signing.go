@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// withSigning returns remote wrapped to sign its entries with the key of
+// GOCACHE_SIGNING_KEY and accept only those of the trusted keys, if either
+// that or GOCACHE_SIGNING_TRUSTED_KEYS is set.
+func withSigning(env Env, remote cachers.RemoteCache) (cachers.RemoteCache, error) {
+	keyVal, trustedVal := env.Get(envVarSigningKey), env.Get(envVarSigningTrustedKeys)
+	if keyVal == "" && trustedVal == "" {
+		return remote, nil
+	}
+	var key ed25519.PrivateKey
+	if keyVal != "" {
+		var err error
+		if key, err = parseSigningKey(keyVal); err != nil {
+			return nil, fmt.Errorf("%s: %w", envVarSigningKey, err)
+		}
+	}
+	trusted, err := parseTrustedKeys(trustedVal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", envVarSigningTrustedKeys, err)
+	}
+	return cachers.NewSignedRemoteCache(remote, key, trusted), nil
+}
+
+// verifyOnly reports whether env configures keys to verify the entries of
+// the remotes with, but none to sign them, so that the remotes are only
+// read.
+func verifyOnly(env Env) bool {
+	return env.Get(envVarSigningTrustedKeys) != "" && env.Get(envVarSigningKey) == ""
+}
+
+// parseSigningKey parses the GOCACHE_SIGNING_KEY setting: a PEM PKCS #8
+// private key, like that of "openssl genpkey -algorithm ed25519", or a
+// 32-byte seed in hex or base64.
+func parseSigningKey(s string) (ed25519.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%T is not an ed25519 key", k)
+		}
+		return key, nil
+	}
+	seed, err := decodeKeyBytes(s, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// parseTrustedKeys parses the GOCACHE_SIGNING_TRUSTED_KEYS setting: PEM
+// PKIX public keys, like those of "openssl pkey -pubout", or
+// comma-separated 32-byte keys in hex or base64.
+func parseTrustedKeys(s string) ([]ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	var keys []ed25519.PublicKey
+	if strings.HasPrefix(s, "-----BEGIN") {
+		rest := []byte(s)
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("%T is not an ed25519 key", k)
+			}
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		key, err := decodeKeyBytes(v, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", v, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// decodeKeyBytes decodes s, n bytes in hex or in standard or URL base64,
+// with or without padding.
+func decodeKeyBytes(s string, n int) ([]byte, error) {
+	if len(s) == 2*n {
+		if b, err := hex.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			if len(b) != n {
+				return nil, fmt.Errorf("key of %d bytes; want %d", len(b), n)
+			}
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("want %d bytes in hex or base64", n)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSigningKey(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	for _, s := range []string{
+		hex.EncodeToString(key.Seed()),
+		base64.StdEncoding.EncodeToString(key.Seed()),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	} {
+		got, err := parseSigningKey(s)
+		require.NoError(t, err, s)
+		assert.True(t, key.Equal(got), s)
+	}
+	_, err = parseSigningKey(base64.StdEncoding.EncodeToString(pub[:16]))
+	assert.ErrorContains(t, err, "want 32")
+}
+
+func TestParseTrustedKeys(t *testing.T) {
+	pub1, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	pub2, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	keys, err := parseTrustedKeys(base64.StdEncoding.EncodeToString(pub1) + ", " + hex.EncodeToString(pub2))
+	require.NoError(t, err)
+	assert.Equal(t, []ed25519.PublicKey{pub1, pub2}, keys)
+
+	var bundle []byte
+	for _, pub := range []ed25519.PublicKey{pub1, pub2} {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		require.NoError(t, err)
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	keys, err = parseTrustedKeys(string(bundle))
+	require.NoError(t, err)
+	assert.Equal(t, []ed25519.PublicKey{pub1, pub2}, keys)
+
+	_, err = parseTrustedKeys("not-a-key")
+	assert.Error(t, err)
+}
+
+func TestMaybeRemoteCacheSigning(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	pub := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+
+	t.Run("writer", func(t *testing.T) {
+		env := &mapEnv{m: map[string]string{
+			envVarHttpCacheServerBase: "http://localhost:8080",
+			envVarSigningKey:          hex.EncodeToString(key.Seed()),
+		}}
+		remote, err := maybeRemoteCache(context.Background(), env)
+		require.NoError(t, err)
+		assert.IsType(t, &cachers.SignedRemoteCache{}, remote)
+		p, err := remoteTierPolicy(env)
+		require.NoError(t, err)
+		assert.False(t, p.ReadOnly)
+	})
+
+	t.Run("verifier", func(t *testing.T) {
+		env := &mapEnv{m: map[string]string{
+			envVarHttpCacheServerBase: "http://localhost:8080",
+			envVarSigningTrustedKeys:  pub,
+		}}
+		remote, err := maybeRemoteCache(context.Background(), env)
+		require.NoError(t, err)
+		assert.IsType(t, &cachers.SignedRemoteCache{}, remote)
+		p, err := remoteTierPolicy(env)
+		require.NoError(t, err)
+		assert.True(t, p.ReadOnly, "no key to sign the entries with")
+	})
+
+	t.Run("bad key", func(t *testing.T) {
+		_, err := maybeRemoteCache(context.Background(), &mapEnv{m: map[string]string{
+			envVarHttpCacheServerBase: "http://localhost:8080",
+			envVarSigningTrustedKeys:  strings.Repeat("z", 10),
+		}})
+		assert.ErrorContains(t, err, envVarSigningTrustedKeys)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxStatsdPacket is the largest UDP packet sent to StatsD, which fits in
+// the MTU of an Ethernet link.
+const maxStatsdPacket = 1432
+
+// A statsdSink sends the metrics to a StatsD server over UDP. Counters and
+// the buckets of histograms are sent as the increments since the previous
+// send, the other metrics as gauges.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	// dogstatsd sends the labels of the samples and tags as DogStatsD tags,
+	// rather than appending the labels to the names.
+	dogstatsd bool
+	tags      []string
+
+	// sent are the values of the counters last sent, by line.
+	sent map[string]float64
+}
+
+// newStatsdSink returns a sink sending to the StatsD server at addr, with
+// prefix before the names of the metrics, and the comma-separated tags to
+// a DogStatsD server.
+func newStatsdSink(addr, prefix, tags string, dogstatsd bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsdSink{conn: conn, prefix: prefix, dogstatsd: dogstatsd, sent: map[string]float64{}}
+	for _, t := range strings.Split(tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			s.tags = append(s.tags, t)
+		}
+	}
+	return s, nil
+}
+
+func (s *statsdSink) String() string { return "statsd" }
+
+func (s *statsdSink) send(ctx context.Context, ms []metric) error {
+	if d, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(d)
+	}
+	var packet []byte
+	flush := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+	for _, m := range ms {
+		for _, smp := range m.samples {
+			line, ok := s.line(m, smp)
+			if !ok {
+				continue
+			}
+			if len(packet) > 0 && len(packet)+1+len(line) > maxStatsdPacket {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	return flush()
+}
+
+// line returns the StatsD line of smp, a sample of m, like
+// "gocacher.backend_gets:3|c|#tier:local,kind:disk", or false if there is
+// nothing to send, for a counter that didn't change.
+func (s *statsdSink) line(m metric, smp sample) (string, bool) {
+	name := s.prefix + strings.TrimPrefix(m.name, "gocacher_")
+	if m.typ == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	name += smp.suffix
+	var tags []string
+	for _, l := range smp.labels {
+		if s.dogstatsd {
+			tags = append(tags, l.name+":"+l.value)
+		} else {
+			name += "." + statsdSanitize(l.value)
+		}
+	}
+	if s.dogstatsd {
+		tags = append(tags, s.tags...)
+	}
+	var suffix string
+	if len(tags) > 0 {
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+
+	v, typ := smp.value, "g"
+	// The samples of histograms only grow, like counters.
+	if m.typ == "counter" || m.typ == "histogram" {
+		key := name + suffix
+		v, typ = smp.value-s.sent[key], "c"
+		if v < 0 {
+			// The counter was reset, by a reload of the configuration.
+			v = smp.value
+		}
+		s.sent[key] = smp.value
+		if v == 0 {
+			return "", false
+		}
+	}
+	return name + ":" + strconv.FormatFloat(v, 'g', -1, 64) + "|" + typ + suffix, true
+}
+
+// statsdSanitize replaces the characters StatsD gives a meaning to in v.
+func statsdSanitize(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenStatsd returns the address of a UDP listener and a function that
+// returns the lines of the next packet it receives.
+func listenStatsd(t *testing.T) (string, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String(), func() []string {
+		buf := make([]byte, 64<<10)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+}
+
+func TestStatsdSink(t *testing.T) {
+	ctx := context.Background()
+	ms := func(gets float64) []metric {
+		return []metric{
+			{name: "gocacher_backend_gets_total", typ: "counter", samples: []sample{
+				{labels: []label{{"tier", "local"}, {"kind", "disk"}}, value: gets},
+			}},
+			{name: "gocacher_requests_in_flight", typ: "gauge", samples: []sample{{value: 2}}},
+			{name: "gocacher_backend_operation_duration_seconds", typ: "histogram", samples: []sample{
+				{suffix: "_bucket", labels: []label{{"op", "get"}, {"le", "0.01"}}, value: gets},
+			}},
+			{name: "gocacher_request_duration_seconds", typ: "summary", samples: []sample{
+				{labels: []label{{"cmd", "get"}, {"quantile", "0.5"}}, value: 0.25},
+				{suffix: "_count", labels: []label{{"cmd", "get"}}, value: 4},
+			}},
+		}
+	}
+
+	t.Run("statsd", func(t *testing.T) {
+		addr, recv := listenStatsd(t)
+		s, err := newStatsdSink(addr, "gocacher.", "env:ci", false)
+		require.NoError(t, err)
+		require.NoError(t, s.send(ctx, ms(3)))
+		assert.Equal(t, []string{
+			"gocacher.backend_gets.local.disk:3|c",
+			"gocacher.requests_in_flight:2|g",
+			"gocacher.backend_operation_duration_seconds_bucket.get.0_01:3|c",
+			"gocacher.request_duration_seconds.get.0_5:0.25|g",
+			"gocacher.request_duration_seconds_count.get:4|g",
+		}, recv())
+
+		// Counters are sent as increments, and not when they don't change.
+		require.NoError(t, s.send(ctx, ms(5)))
+		packet := recv()
+		assert.Equal(t, "gocacher.backend_gets.local.disk:2|c", packet[0])
+		assert.Contains(t, packet, "gocacher.backend_operation_duration_seconds_bucket.get.0_01:2|c")
+		require.NoError(t, s.send(ctx, ms(5)))
+		assert.Equal(t, "gocacher.requests_in_flight:2|g", recv()[0])
+	})
+
+	t.Run("dogstatsd", func(t *testing.T) {
+		addr, recv := listenStatsd(t)
+		s, err := newStatsdSink(addr, "ci.", " env:ci, team:build ", true)
+		require.NoError(t, err)
+		require.NoError(t, s.send(ctx, ms(3)))
+		assert.Equal(t, []string{
+			"ci.backend_gets:3|c|#tier:local,kind:disk,env:ci,team:build",
+			"ci.requests_in_flight:2|g|#env:ci,team:build",
+			"ci.backend_operation_duration_seconds_bucket:3|c|#op:get,le:0.01,env:ci,team:build",
+			"ci.request_duration_seconds:0.25|g|#cmd:get,quantile:0.5,env:ci,team:build",
+			"ci.request_duration_seconds_count:4|g|#cmd:get,env:ci,team:build",
+		}, recv())
+	})
+
+	t.Run("packets", func(t *testing.T) {
+		addr, recv := listenStatsd(t)
+		s, err := newStatsdSink(addr, "gocacher.", "", false)
+		require.NoError(t, err)
+		m := metric{name: "gocacher_requests_in_flight", typ: "gauge"}
+		for i := 0; i < 100; i++ {
+			m.samples = append(m.samples, sample{labels: []label{{"n", strings.Repeat("x", 20)}}, value: float64(i)})
+		}
+		require.NoError(t, s.send(ctx, []metric{m}))
+		var lines int
+		for lines < 100 {
+			packet := recv()
+			assert.LessOrEqual(t, len(strings.Join(packet, "\n")), maxStatsdPacket)
+			lines += len(packet)
+		}
+		assert.Equal(t, 100, lines)
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// tagKeyRx matches the keys of GOCACHE_TAGS, which are also the names of
+// labels of the metrics.
+var tagKeyRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseTags parses the GOCACHE_TAGS setting, expanding the variables in
+// its values with env.
+func parseTags(env Env) (map[string]string, error) {
+	v := env.Get(envVarTags)
+	if v == "" {
+		return nil, nil
+	}
+	tags := map[string]string{}
+	for _, kv := range strings.Split(v, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: want key=value, got %q", envVarTags, kv)
+		}
+		k = strings.TrimSpace(k)
+		if !tagKeyRx.MatchString(k) {
+			return nil, fmt.Errorf("%s: invalid key %q; want letters, digits and underscores", envVarTags, k)
+		}
+		if slices.Contains(metricsLabels, k) || k == "quantile" || k == "le" {
+			return nil, fmt.Errorf("%s: key %q is a label of the metrics", envVarTags, k)
+		}
+		tags[k] = os.Expand(strings.TrimSpace(val), env.Get)
+	}
+	return tags, nil
+}
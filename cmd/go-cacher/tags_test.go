@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(&mapEnv{m: map[string]string{
+		envVarTags:         "team=build, pipeline=${CI_PIPELINE_ID},branch=$CI_COMMIT_BRANCH,",
+		"CI_PIPELINE_ID":   "42",
+		"CI_COMMIT_BRANCH": "main",
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "build", "pipeline": "42", "branch": "main"}, tags)
+
+	tags, err = parseTags(&mapEnv{m: map[string]string{}})
+	require.NoError(t, err)
+	assert.Nil(t, tags)
+
+	for _, bad := range []string{"team", "my-team=build", "tier=fast"} {
+		_, err := parseTags(&mapEnv{m: map[string]string{envVarTags: bad}})
+		assert.ErrorContains(t, err, envVarTags, bad)
+	}
+}
+
+func TestTagsEverywhere(t *testing.T) {
+	env := &mapEnv{m: map[string]string{
+		envVarHttpCacheServerBase: "http://localhost:8080",
+		envVarTags:                "team=build,pipeline=42",
+	}}
+	remote, err := maybeRemoteCache(context.Background(), env)
+	require.NoError(t, err)
+	assert.IsType(t, &cachers.TaggedRemoteCache{}, remote)
+
+	cfg, err := newMetricsConfig(context.Background(), env)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	writePrometheus(&out, cfg.apply([]metric{{name: "gocacher_hits_total", typ: "counter", samples: []sample{{value: 3}}}}))
+	assert.Contains(t, out.String(), `gocacher_hits_total{pipeline="42",team="build"} 3`+"\n")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/internal/trace"
+)
+
+// startTracing returns ctx with the tracer the OpenTelemetry variables of
+// env configure, if any, and the function exporting its last spans.
+func startTracing(ctx context.Context, env Env) (context.Context, func(), error) {
+	cfg, err := trace.ConfigFromEnv(env.Get)
+	if err != nil || cfg == nil {
+		return ctx, func() {}, err
+	}
+	cfg.OnError = func(err error) {
+		slog.Warn("tracing", "err", err)
+	}
+	t := trace.NewTracer(*cfg)
+	slog.Info("exporting traces", "endpoint", cfg.Endpoint)
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if err := t.Shutdown(ctx); err != nil {
+			slog.Warn("failed to export the last spans", "err", err)
+		}
+	}
+	return trace.WithTracer(ctx, t), stop, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+const versionUsage = `usage: go-cacher version
+
+Version prints the version of go-cacher, the VCS revision and Go version it
+was built from, and the backends the configuration enables, to identify in
+bug reports and audits what is deployed.
+
+`
+
+func runVersion(ctx context.Context, env Env, args []string) error {
+	fs := newFlagSet("version", versionUsage)
+	_ = fs.Parse(args)
+	bi, _ := debug.ReadBuildInfo()
+	writeVersion(os.Stdout, bi, env)
+	return nil
+}
+
+// writeVersion writes the build metadata of bi, which may be nil, and the
+// backends enabled by env to w.
+func writeVersion(w io.Writer, bi *debug.BuildInfo, env Env) {
+	version, goVersion := "(unknown)", runtime.Version()
+	settings := map[string]string{}
+	if bi != nil {
+		if bi.Main.Version != "" {
+			version = bi.Main.Version
+		}
+		goVersion = bi.GoVersion
+		for _, s := range bi.Settings {
+			settings[s.Key] = s.Value
+		}
+	}
+	fmt.Fprintf(w, "go-cacher %s\n", version)
+	if rev := settings["vcs.revision"]; rev != "" {
+		var details []string
+		if t := settings["vcs.time"]; t != "" {
+			details = append(details, t)
+		}
+		if settings["vcs.modified"] == "true" {
+			details = append(details, "modified")
+		}
+		if len(details) > 0 {
+			rev += " (" + strings.Join(details, ", ") + ")"
+		}
+		fmt.Fprintf(w, "revision: %s\n", rev)
+	}
+	fmt.Fprintf(w, "go: %s %s/%s\n", goVersion, runtime.GOOS, runtime.GOARCH)
+	if list, err := backends(env); err != nil {
+		fmt.Fprintf(w, "backends: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "backends: %s\n", strings.Join(list, ", "))
+	}
+}
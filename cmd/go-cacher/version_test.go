@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteVersion(t *testing.T) {
+	bi := &debug.BuildInfo{
+		GoVersion: "go1.24.2",
+		Main:      debug.Module{Path: "github.com/bradfitz/go-tool-cache", Version: "v1.2.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123abc"},
+			{Key: "vcs.time", Value: "2025-01-02T03:04:05Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	var out bytes.Buffer
+	writeVersion(&out, bi, &mapEnv{m: map[string]string{envVarHttpCacheServerBase: "http://cache:31364", envVarS3BucketName: "b"}})
+	assert.Equal(t, "go-cacher v1.2.0\n"+
+		"revision: 0123abc (2025-01-02T03:04:05Z, modified)\n"+
+		"go: go1.24.2 "+runtime.GOOS+"/"+runtime.GOARCH+"\n"+
+		"backends: disk, s3\n", out.String())
+
+	out.Reset()
+	writeVersion(&out, nil, &mapEnv{m: map[string]string{}})
+	assert.Equal(t, "go-cacher (unknown)\n"+
+		"go: "+runtime.Version()+" "+runtime.GOOS+"/"+runtime.GOARCH+"\n"+
+		"backends: disk\n", out.String())
+
+	out.Reset()
+	writeVersion(&out, nil, &mapEnv{m: map[string]string{envVarHttpCacheServerBase: "http://cache:31364", envVarS3BucketName: "b", envVarBackends: "disk,http,s3"}})
+	assert.Contains(t, out.String(), "backends: disk, http, s3\n")
+}
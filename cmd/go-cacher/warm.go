@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+	"golang.org/x/sync/errgroup"
+)
+
+const warmUsage = `usage: go-cacher warm [flags] [packages]
+
+Warm downloads cache entries ahead of a build so that the build itself only
+hits the local disk. Action IDs are computed by running
+"go build -n" with GODEBUG=gocachehash=1 for the given packages,
+or read from a file with -f. The file may contain bare hex action IDs, one
+per line, or the stderr of any go command run with GODEBUG=gocachehash=1.
+
+`
+
+// warmSubkeys are the descriptions cmd/go derives auxiliary cache keys from
+// (see cache.Subkey), fetched alongside each action's main output.
+var warmSubkeys = []string{"srcfiles", "stdout"}
+
+func runWarm(ctx context.Context, env Env, args []string) error {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), warmUsage)
+		fs.PrintDefaults()
+	}
+	file := fs.String("f", "", "read action IDs from `file` (\"-\" for stdin) instead of running go build -n")
+	jobs := fs.Int("j", 16, "number of concurrent downloads")
+	_ = fs.Parse(args)
+
+	var ids []string
+	switch {
+	case *file == "-":
+		ids = parseActionIDs(os.Stdin)
+	case *file != "":
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		ids = parseActionIDs(f)
+		_ = f.Close()
+	default:
+		pkgs := fs.Args()
+		if len(pkgs) == 0 {
+			pkgs = []string{"."}
+		}
+		var err error
+		if ids, err = dryRunActionIDs(ctx, pkgs); err != nil {
+			return err
+		}
+	}
+	ids = withSubkeys(ids)
+	keys := len(ids)
+
+	cache, _ := getCache(ctx, env, *verbose)
+	if err := cache.Start(ctx); err != nil {
+		return err
+	}
+	var hits, misses, failed atomic.Int64
+	// Most of the subkeys are of actions without them: the caches that can
+	// tell which keys they store at once spare their lookups one by one.
+	if exists, err := cachers.BatchExists(ctx, cache, ids); err == nil {
+		stored := ids[:0]
+		for i, id := range ids {
+			if exists[i] {
+				stored = append(stored, id)
+			}
+		}
+		misses.Add(int64(len(ids) - len(stored)))
+		ids = stored
+	} else if !errors.Is(err, errors.ErrUnsupported) && *verbose {
+		slog.Debug("warm batch lookup failed", "err", err)
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(*jobs, 1))
+	for _, id := range ids {
+		id := id
+		g.Go(func() error {
+			outputID, _, err := cache.Get(gctx, id)
+			switch {
+			case err != nil:
+				failed.Add(1)
+				if *verbose {
+					slog.Debug("warm failed", "action", id, "err", err)
+				}
+			case outputID == "":
+				misses.Add(1)
+			default:
+				hits.Add(1)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	slog.Info("warmed", "keys", keys, "hits", hits.Load(), "misses", misses.Load(), "errors", failed.Load())
+	return cache.Close()
+}
+
+// dryRunActionIDs runs "go build -n" on pkgs and collects the action IDs
+// cmd/go reports with GODEBUG=gocachehash=1.
+func dryRunActionIDs(ctx context.Context, pkgs []string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "go", append([]string{"build", "-n"}, pkgs...)...)
+	// The dry run doesn't need a cache, and must not start another go-cacher.
+	cmd.Env = append(os.Environ(), "GODEBUG=gocachehash=1", "GOCACHEPROG=")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go build -n: %v\n%s", err, lastLines(stderr.String(), 10))
+	}
+	return parseActionIDs(&stderr), nil
+}
+
+var (
+	bareActionIDRx = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	// Matches the final line for an action, like "HASH[build fmt]: <hex>",
+	// but not the lines for the individual hash inputs.
+	hashActionIDRx = regexp.MustCompile(`^HASH\[(?:build|link) [^\]]*\]: ([0-9a-f]{64})$`)
+)
+
+// parseActionIDs returns the unique action IDs in r, in order.
+func parseActionIDs(r io.Reader) []string {
+	var ids []string
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		id := ""
+		if bareActionIDRx.MatchString(line) {
+			id = line
+		} else if m := hashActionIDRx.FindStringSubmatch(line); m != nil {
+			id = m[1]
+		}
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// withSubkeys returns ids followed by the auxiliary keys of each of them.
+func withSubkeys(ids []string) []string {
+	all := append([]string(nil), ids...)
+	for _, id := range ids {
+		parent, err := hex.DecodeString(id)
+		if err != nil {
+			continue
+		}
+		for _, desc := range warmSubkeys {
+			all = append(all, subkey(parent, desc))
+		}
+	}
+	return all
+}
+
+// subkey mirrors cmd/go/internal/cache.Subkey.
+func subkey(parent []byte, desc string) string {
+	h := sha256.New()
+	h.Write([]byte("subkey:"))
+	h.Write(parent)
+	h.Write([]byte(desc))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
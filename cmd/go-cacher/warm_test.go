@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseActionIDs(t *testing.T) {
+	const (
+		id1 = "1ff3bd38486d1e0247cebd516dd958cde9651dbd714fb2dedb249a218c777f1d"
+		id2 = "03ea3f3f2353856896f1edea16dbcd67526dde78244052762aafcb7d23a509d7"
+	)
+	input := strings.Join([]string{
+		"HASH[build fmt]",
+		`HASH[build fmt]: "go1.24"`,
+		"HASH[build fmt]: " + id1,
+		"HASH[moduleIndex]: " + id2,
+		"mkdir -p $WORK/b001/",
+		id2,
+		"  " + id1 + "  ",
+		"not-hex",
+	}, "\n")
+	assert.Equal(t, []string{id1, id2}, parseActionIDs(strings.NewReader(input)))
+}
+
+func TestWithSubkeys(t *testing.T) {
+	const id = "1ff3bd38486d1e0247cebd516dd958cde9651dbd714fb2dedb249a218c777f1d"
+	parent, _ := hex.DecodeString(id)
+	got := withSubkeys([]string{id})
+	assert.Equal(t, []string{id, subkey(parent, "srcfiles"), subkey(parent, "stdout")}, got)
+	assert.Len(t, got[1], 64)
+}
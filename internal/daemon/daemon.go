@@ -0,0 +1,31 @@
+// Package daemon implements the transport between a shared go-cacher
+// daemon and the stubs that cmd/go runs as GOCACHEPROG, which proxy the
+// protocol over it: a Unix socket, or a named pipe on Windows.
+package daemon
+
+import (
+	"net"
+	"os"
+)
+
+// EnvVar names the environment variable holding the address of the
+// daemon, for both the daemon and the stubs.
+const EnvVar = "GOCACHE_DAEMON_SOCKET"
+
+// Addr returns the address of the daemon: the value of EnvVar if it is
+// set, the default for the platform otherwise.
+func Addr() (string, error) {
+	if addr := os.Getenv(EnvVar); addr != "" {
+		return addr, nil
+	}
+	return defaultAddr()
+}
+
+// CloseWrite shuts down the writing side of conn, so that the other end
+// reads EOF, if conn supports it, and closes conn otherwise.
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "sub", "d.sock")
+	defer syscall.Umask(syscall.Umask(0))
+	ln, err := Listen(addr)
+	require.NoError(t, err)
+	fi, err := os.Stat(addr)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "whatever the umask")
+
+	_, err = Listen(addr)
+	assert.ErrorContains(t, err, "already listening")
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := Dial(addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, CloseWrite(conn))
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	conn.Close()
+	require.NoError(t, ln.Close())
+
+	// A socket left behind by a crashed daemon is replaced.
+	require.NoError(t, os.WriteFile(addr, nil, 0600))
+	ln, err = Listen(addr)
+	require.NoError(t, err)
+	ln.Close()
+}
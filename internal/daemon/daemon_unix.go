@@ -0,0 +1,51 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// defaultAddr is "daemon.sock" in the default go-cacher directory.
+func defaultAddr() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-cacher", "daemon.sock"), nil
+}
+
+// Listen listens on the Unix socket at addr, which only the user may
+// connect to. A socket left behind by a daemon that is gone is replaced,
+// but Listen fails if another daemon is listening on it.
+func Listen(addr string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", addr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", addr)
+	}
+	if err := os.Remove(addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is created with the mode the umask leaves.
+	if err := os.Chmod(addr, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Dial connects to the daemon listening at addr.
+func Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
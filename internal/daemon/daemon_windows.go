@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// defaultAddr is a named pipe of the current user.
+func defaultAddr() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return `\\.\pipe\go-cacher-` + u.Uid, nil
+}
+
+// Listen listens on the named pipe at addr, like `\\.\pipe\go-cacher`,
+// which only the current user may connect to. It fails if another daemon
+// is listening on it.
+func Listen(addr string) (net.Listener, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	if conn, err := Dial(addr); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", addr)
+	}
+	return winio.ListenPipe(addr, &winio.PipeConfig{
+		// Full access for the current user (whose Uid is their SID) only.
+		SecurityDescriptor: "D:P(A;;GA;;;" + u.Uid + ")",
+		// Message mode is needed for CloseWrite.
+		MessageMode: true,
+	})
+}
+
+// Dial connects to the daemon listening at addr.
+func Dial(addr string) (net.Conn, error) {
+	timeout := 5 * time.Second
+	return winio.DialPipe(addr, &timeout)
+}
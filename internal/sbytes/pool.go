@@ -0,0 +1,148 @@
+package sbytes
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+)
+
+// The size classes of the pooled slices are the powers of two from
+// minPooledSize to maxPooledSize. Larger slices are allocated, and left to
+// the garbage collector, as they are rare enough.
+const (
+	minPooledShift = 12 // 4KiB
+	maxPooledShift = 26 // 64MiB
+	minPooledSize  = 1 << minPooledShift
+	maxPooledSize  = 1 << maxPooledShift
+)
+
+// copyBufferSize is the size of the buffers of Copy, the one of io.Copy.
+const copyBufferSize = 32 << 10
+
+// pools are the pools of the size classes, of *[]byte not to allocate when
+// putting a slice back.
+var pools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+// sizeClass returns the index in pools of the smallest class of at least n
+// bytes, or -1 if n is larger than maxPooledSize.
+func sizeClass(n int) int {
+	if n > maxPooledSize {
+		return -1
+	}
+	if n <= minPooledSize {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minPooledShift
+}
+
+// Get returns a slice of n bytes, of any content, from the pool of its size
+// class. It is to be given back with Put once no longer used.
+func Get(n int) []byte {
+	i := sizeClass(n)
+	if i < 0 {
+		return make([]byte, n)
+	}
+	if p, ok := pools[i].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, 1<<(i+minPooledShift))
+}
+
+// Put gives b, from Get, back to its pool. Neither b nor the slices of it
+// may be used afterwards. Slices not from Get, whose capacity is not that
+// of a size class, are ignored.
+func Put(b []byte) {
+	c := cap(b)
+	i := sizeClass(c)
+	if i < 0 || c != 1<<(i+minPooledShift) {
+		return
+	}
+	b = b[:0]
+	pools[i].Put(&b)
+}
+
+// Copy is io.Copy with a pooled buffer, rather than one allocated for
+// every copy.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	if wt, ok := src.(io.WriterTo); ok {
+		return wt.WriteTo(dst)
+	}
+	if _, ok := src.(*os.File); ok {
+		// The writers that read from files, other files and connections,
+		// have the kernel copy them.
+		return io.Copy(dst, src)
+	}
+	buf := Get(copyBufferSize)
+	defer Put(buf)
+	// Hide the ReadFrom of dst, which would allocate its own buffer.
+	return io.CopyBuffer(writerOnly{dst}, src, buf)
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+// ErrFenceClosed is the error of the reads of a closed Fence.
+var ErrFenceClosed = errors.New("sbytes: read of a closed fence")
+
+// A Fence guards a Buffer lent to a reader that may still read it after it
+// is done with, like the body of an http.Request, which the transport keeps
+// sending after an early response or an error. Once the Fence is closed, it
+// no longer reads from the Buffer, whose bytes can then be given back with
+// Put.
+type Fence struct {
+	mu     sync.Mutex
+	r      io.Reader // a *Buffer, or the io.Seeker of FenceReader
+	closed bool
+}
+
+// NewFence returns a Fence reading b.
+func NewFence(b *Buffer) *Fence {
+	return &Fence{r: b}
+}
+
+// FenceReader returns a reader of r fenced off like by a Fence once closed,
+// for the readers that may hide pooled bytes, like an io.MultiReader of a
+// Buffer. It can seek if r can.
+func FenceReader(r io.Reader) io.ReadCloser {
+	if _, ok := r.(io.Seeker); ok {
+		return &Fence{r: r}
+	}
+	return readFence{&Fence{r: r}}
+}
+
+// readFence is a Fence without Seek, of a reader that can't.
+type readFence struct {
+	f *Fence
+}
+
+func (f readFence) Read(p []byte) (int, error) { return f.f.Read(p) }
+func (f readFence) Close() error               { return f.f.Close() }
+
+func (f *Fence) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, ErrFenceClosed
+	}
+	return f.r.Read(p)
+}
+
+func (f *Fence) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, ErrFenceClosed
+	}
+	return f.r.(io.Seeker).Seek(offset, whence)
+}
+
+// Close stops the reads of the Buffer, waiting for one in progress.
+func (f *Fence) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,94 @@
+package sbytes
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	for n, want := range map[int]int{
+		0:                 minPooledSize,
+		1:                 minPooledSize,
+		minPooledSize:     minPooledSize,
+		minPooledSize + 1: 2 * minPooledSize,
+		5 << 20:           8 << 20,
+		maxPooledSize:     maxPooledSize,
+		maxPooledSize + 1: maxPooledSize + 1,
+	} {
+		b := Get(n)
+		assert.Len(t, b, n)
+		assert.Equal(t, want, cap(b), n)
+		Put(b)
+	}
+
+	// Slices not from the pools, of other capacities, are not pooled.
+	Put(nil)
+	Put(make([]byte, 10, 5000))
+	assert.Equal(t, 2*minPooledSize, cap(Get(5000)))
+}
+
+func TestCopy(t *testing.T) {
+	src := strings.Repeat("go build ", 10000)
+	var dst bytes.Buffer
+	n, err := Copy(&dst, io.LimitReader(strings.NewReader(src), int64(len(src))))
+	require.NoError(t, err)
+	assert.EqualValues(t, len(src), n)
+	assert.Equal(t, src, dst.String())
+
+	dst.Reset()
+	n, err = Copy(&dst, NewBufferString(src))
+	require.NoError(t, err)
+	assert.EqualValues(t, len(src), n)
+	assert.Equal(t, src, dst.String())
+}
+
+func TestFence(t *testing.T) {
+	f := NewFence(NewBufferString("hello, world"))
+	p := make([]byte, 5)
+	n, err := f.Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(p[:n]))
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	// A read in progress finishes before Close returns.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.ReadAll(f)
+	}()
+	require.NoError(t, f.Close())
+	_, err = f.Read(p)
+	assert.ErrorIs(t, err, ErrFenceClosed)
+	_, err = f.Seek(0, io.SeekStart)
+	assert.ErrorIs(t, err, ErrFenceClosed)
+	wg.Wait()
+}
+
+func TestFenceReader(t *testing.T) {
+	f := FenceReader(io.MultiReader(NewBufferString("hello, "), NewBufferString("world")))
+	_, ok := f.(io.Seeker)
+	assert.False(t, ok, "can't seek a reader that can't")
+	p := make([]byte, 5)
+	n, err := f.Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(p[:n]))
+	require.NoError(t, f.Close())
+	_, err = f.Read(p)
+	assert.ErrorIs(t, err, ErrFenceClosed)
+
+	s, ok := FenceReader(strings.NewReader("hello")).(io.ReadSeeker)
+	require.True(t, ok)
+	_, err = s.Seek(1, io.SeekStart)
+	require.NoError(t, err)
+	b, err := io.ReadAll(s)
+	require.NoError(t, err)
+	assert.Equal(t, "ello", string(b))
+}
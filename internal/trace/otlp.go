@@ -0,0 +1,259 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of a Tracer.
+type Config struct {
+	// Endpoint is the URL spans are posted to, like
+	// "http://localhost:4318/v1/traces".
+	Endpoint string
+	// Headers are sent with each export, for authentication.
+	Headers map[string]string
+	// Timeout bounds each export.
+	Timeout time.Duration
+	// Resource describes the process, with at least service.name.
+	Resource []Attr
+	// Parent, if set, parents the spans started without another span, to
+	// join a trace started by the caller of the process.
+	Parent *SpanContext
+	// OnError, if set, is called with the errors of background exports.
+	OnError func(error)
+}
+
+// ConfigFromEnv returns the configuration of the standard OpenTelemetry
+// environment variables that getenv returns, or nil if they don't enable
+// the export of traces. Exports are enabled by an OTLP endpoint or by
+// OTEL_TRACES_EXPORTER=otlp, and only the http/json protocol is supported.
+// TRACEPARENT, if set, parents the spans.
+func ConfigFromEnv(getenv func(string) string) (*Config, error) {
+	if v := getenv("OTEL_SDK_DISABLED"); v != "" {
+		if disabled, err := strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("OTEL_SDK_DISABLED: %w", err)
+		} else if disabled {
+			return nil, nil
+		}
+	}
+	exporter := getenv("OTEL_TRACES_EXPORTER")
+	switch exporter {
+	case "", "otlp":
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER: unsupported exporter %q; want otlp or none", exporter)
+	}
+	cfg := &Config{Endpoint: getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), Timeout: 10 * time.Second}
+	if cfg.Endpoint == "" {
+		base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			if exporter == "" {
+				return nil, nil
+			}
+			base = "http://localhost:4318"
+		}
+		cfg.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if _, err := url.ParseRequestURI(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("OTLP endpoint: %w", err)
+	}
+	for _, key := range []string{"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if v := getenv(key); v != "" {
+			if v != "http/json" {
+				return nil, fmt.Errorf("%s: unsupported protocol %q; only http/json is", key, v)
+			}
+			break
+		}
+	}
+	for _, key := range []string{"OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"} {
+		if v := getenv(key); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("%s: want a positive number of milliseconds, got %q", key, v)
+			}
+			cfg.Timeout = time.Duration(ms) * time.Millisecond
+			break
+		}
+	}
+	cfg.Headers = map[string]string{}
+	for _, key := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		if err := parseList(getenv(key), func(k, v string) { cfg.Headers[k] = v }); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	service := "go-cacher"
+	err := parseList(getenv("OTEL_RESOURCE_ATTRIBUTES"), func(k, v string) {
+		if k == "service.name" {
+			service = v
+			return
+		}
+		cfg.Resource = append(cfg.Resource, String(k, v))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	if v := getenv("OTEL_SERVICE_NAME"); v != "" {
+		service = v
+	}
+	cfg.Resource = append([]Attr{String("service.name", service)}, cfg.Resource...)
+	if v := getenv("TRACEPARENT"); v != "" {
+		sc, err := ParseTraceparent(v)
+		if err != nil {
+			return nil, fmt.Errorf("TRACEPARENT: %w", err)
+		}
+		cfg.Parent = &sc
+	}
+	return cfg, nil
+}
+
+// parseList parses a list like "k1=v1,k2=v2", of percent-encoded values.
+func parseList(s string, f func(k, v string)) error {
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("want key=value, got %q", kv)
+		}
+		v, err := url.PathUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		f(strings.TrimSpace(k), v)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of spans.
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope  `json:"scope"`
+		Spans []span `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	span struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              Kind       `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            *status    `json:"status,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// statusError is the OTLP status code of failed spans.
+const statusError = 2
+
+func keyValues(attrs []Attr) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v anyValue
+		switch x := a.Value.(type) {
+		case int64:
+			s := strconv.FormatInt(x, 10)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &x
+		case float64:
+			v.DoubleValue = &x
+		default:
+			s := fmt.Sprint(x)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, keyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
+
+// export posts spans to the collector.
+func (t *Tracer) export(ctx context.Context, spans []spanData) error {
+	out := make([]span, 0, len(spans))
+	for _, d := range spans {
+		s := span{
+			TraceID:           hex.EncodeToString(d.sc.TraceID[:]),
+			SpanID:            hex.EncodeToString(d.sc.SpanID[:]),
+			Name:              d.name,
+			Kind:              d.kind,
+			StartTimeUnixNano: strconv.FormatInt(d.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(d.end.UnixNano(), 10),
+			Attributes:        keyValues(d.attrs),
+		}
+		if d.parent != ([8]byte{}) {
+			s.ParentSpanID = hex.EncodeToString(d.parent[:])
+		}
+		if d.err != "" {
+			s.Status = &status{Code: statusError, Message: d.err}
+		}
+		out = append(out, s)
+	}
+	body, err := json.Marshal(exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: keyValues(t.cfg.Resource)},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "github.com/bradfitz/go-tool-cache"}, Spans: out}},
+	}}})
+	if err != nil {
+		return err
+	}
+	if t.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.cfg.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("exporting spans: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("exporting spans to %s: %s: %s", t.cfg.Endpoint, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
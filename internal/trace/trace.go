@@ -0,0 +1,266 @@
+// Package trace records OpenTelemetry spans and exports them to a
+// collector with OTLP over HTTP, in its JSON encoding. It is configured
+// with the standard OTEL_* environment variables.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Kind is the role of a span in the request it is part of.
+type Kind int
+
+// The kinds of spans, as numbered by OTLP.
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+// An Attr is an attribute of a span or a resource.
+type Attr struct {
+	Key   string
+	Value any // a string, int64, bool or float64
+}
+
+func String(key, v string) Attr        { return Attr{key, v} }
+func Int(key string, v int64) Attr     { return Attr{key, v} }
+func Bool(key string, v bool) Attr     { return Attr{key, v} }
+func Float(key string, v float64) Attr { return Attr{key, v} }
+
+// A SpanContext identifies a span, to parent others.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// ParseTraceparent parses a W3C traceparent, like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", s, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q: %w", s, err)
+	}
+	if sc.TraceID == ([16]byte{}) || sc.SpanID == ([8]byte{}) {
+		return sc, fmt.Errorf("invalid traceparent %q: zero ID", s)
+	}
+	return sc, nil
+}
+
+// A Span is an operation of a trace. The methods of a nil Span, which
+// Start returns without a Tracer, do nothing.
+type Span struct {
+	t      *Tracer
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent [8]byte // zero for a root span
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs []Attr
+	ended bool
+}
+
+// SetAttrs adds attrs to s.
+func (s *Span) SetAttrs(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// End ends s, as failed with err if it isn't nil, and queues it for
+// export. Only the first End counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	d := spanData{
+		name:   s.name,
+		kind:   s.kind,
+		sc:     s.sc,
+		parent: s.parent,
+		start:  s.start,
+		end:    end,
+		attrs:  s.attrs,
+	}
+	s.mu.Unlock()
+	if err != nil {
+		d.err = err.Error()
+	}
+	s.t.record(d)
+}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// WithTracer returns a copy of ctx whose spans are recorded by t.
+func WithTracer(ctx context.Context, t *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// Start starts a span named name, as a child of the span of ctx, or else
+// of the parent of the Tracer of ctx, and returns it with a copy of ctx
+// carrying it. Without a Tracer in ctx, it returns ctx and a nil Span.
+func Start(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	t, _ := ctx.Value(tracerKey{}).(*Tracer)
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{t: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	switch parent, _ := ctx.Value(spanKey{}).(*Span); {
+	case parent != nil:
+		s.sc.TraceID, s.parent = parent.sc.TraceID, parent.sc.SpanID
+	case t.cfg.Parent != nil:
+		s.sc.TraceID, s.parent = t.cfg.Parent.TraceID, t.cfg.Parent.SpanID
+	default:
+		_, _ = rand.Read(s.sc.TraceID[:])
+	}
+	_, _ = rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanData is an ended span.
+type spanData struct {
+	name       string
+	kind       Kind
+	sc         SpanContext
+	parent     [8]byte
+	start, end time.Time
+	attrs      []Attr
+	err        string
+}
+
+const (
+	// batchSize is the number of ended spans that triggers an export.
+	batchSize = 512
+	// maxQueued is the number of spans kept while the collector is down;
+	// more are dropped.
+	maxQueued = 8 * batchSize
+	// exportInterval is the longest ended spans wait to be exported.
+	exportInterval = 5 * time.Second
+)
+
+// A Tracer records spans and exports them in the background.
+type Tracer struct {
+	cfg Config
+
+	mu      sync.Mutex
+	pending []spanData
+	dropped int64
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewTracer returns a Tracer exporting spans as cfg says. Shutdown stops
+// it.
+func NewTracer(cfg Config) *Tracer {
+	t := &Tracer{
+		cfg:  cfg,
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+func (t *Tracer) record(d spanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= maxQueued {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, d)
+	if len(t.pending) >= batchSize {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	tick := time.NewTicker(exportInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-tick.C:
+		case <-t.kick:
+		}
+		if err := t.flush(context.Background()); err != nil && t.cfg.OnError != nil {
+			t.cfg.OnError(err)
+		}
+	}
+}
+
+// flush exports the pending spans. Spans that fail to export are kept for
+// the next attempt.
+func (t *Tracer) flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	err := t.export(ctx, spans)
+	if err != nil {
+		t.mu.Lock()
+		t.pending = append(spans, t.pending...)
+		if n := len(t.pending) - maxQueued; n > 0 {
+			t.pending = t.pending[n:]
+			t.dropped += int64(n)
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// Shutdown exports the pending spans and stops t.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() { close(t.stop) })
+	<-t.done
+	err := t.flush(ctx)
+	t.mu.Lock()
+	dropped := t.dropped
+	t.mu.Unlock()
+	if dropped > 0 {
+		err = errors.Join(err, fmt.Errorf("dropped %d spans", dropped))
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collector is an OTLP/HTTP collector recording the spans posted to it.
+type collector struct {
+	*httptest.Server
+	mu      sync.Mutex
+	spans   []span
+	headers http.Header
+	res     []keyValue
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header
+		for _, rs := range req.ResourceSpans {
+			c.res = rs.Resource.Attributes
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestTracer(t *testing.T) {
+	c := newCollector(t)
+	tr := NewTracer(Config{
+		Endpoint: c.URL + "/v1/traces",
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+		Resource: []Attr{String("service.name", "go-cacher")},
+	})
+	ctx := WithTracer(context.Background(), tr)
+	ctx, parent := Start(ctx, "gocacheprog get", Server, Int("gocacheprog.request_id", 1))
+	_, child := Start(ctx, "disk get", Internal)
+	child.SetAttrs(Bool("gocacheprog.hit", false))
+	child.End(errors.New("boom"))
+	child.End(nil)
+	parent.End(nil)
+	require.NoError(t, tr.Shutdown(context.Background()))
+
+	require.Len(t, c.spans, 2)
+	got, p := c.spans[0], c.spans[1]
+	assert.Equal(t, "disk get", got.Name)
+	assert.Equal(t, Internal, got.Kind)
+	assert.Equal(t, p.TraceID, got.TraceID)
+	assert.Equal(t, p.SpanID, got.ParentSpanID)
+	assert.Empty(t, p.ParentSpanID)
+	assert.Equal(t, &status{Code: statusError, Message: "boom"}, got.Status)
+	assert.Equal(t, "gocacheprog.hit", got.Attributes[0].Key)
+	assert.Equal(t, "1", *p.Attributes[0].Value.IntValue)
+	assert.Equal(t, "Bearer secret", c.headers.Get("Authorization"))
+	assert.Equal(t, "service.name", c.res[0].Key)
+
+	t.Run("no tracer", func(t *testing.T) {
+		ctx, s := Start(context.Background(), "disk get", Internal)
+		assert.Nil(t, s)
+		s.SetAttrs(Bool("gocacheprog.hit", true))
+		s.End(nil)
+		assert.Equal(t, context.Background(), ctx)
+	})
+
+	t.Run("parent", func(t *testing.T) {
+		sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		require.NoError(t, err)
+		c := newCollector(t)
+		tr := NewTracer(Config{Endpoint: c.URL, Parent: &sc})
+		_, s := Start(WithTracer(context.Background(), tr), "gocacheprog put", Server)
+		s.End(nil)
+		require.NoError(t, tr.Shutdown(context.Background()))
+		require.Len(t, c.spans, 1)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.spans[0].TraceID)
+		assert.Equal(t, "00f067aa0ba902b7", c.spans[0].ParentSpanID)
+	})
+
+	t.Run("collector down", func(t *testing.T) {
+		down := httptest.NewServer(nil)
+		down.Close()
+		tr := NewTracer(Config{Endpoint: down.URL})
+		_, s := Start(WithTracer(context.Background(), tr), "gocacheprog put", Server)
+		s.End(nil)
+		assert.ErrorContains(t, tr.Shutdown(context.Background()), "exporting spans")
+	})
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	env := func(m map[string]string) func(string) string {
+		return func(key string) string { return m[key] }
+	}
+	cfg, err := ConfigFromEnv(env(nil))
+	require.NoError(t, err)
+	assert.Nil(t, cfg, "disabled without an endpoint")
+
+	cfg, err = ConfigFromEnv(env(map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT":       "http://collector:4318/",
+		"OTEL_EXPORTER_OTLP_HEADERS":        "x-team=build,authorization=Bearer%20a",
+		"OTEL_EXPORTER_OTLP_TRACES_HEADERS": "authorization=Bearer%20b",
+		"OTEL_RESOURCE_ATTRIBUTES":          "service.name=ignored,ci.job=42",
+		"OTEL_SERVICE_NAME":                 "cacher",
+		"OTEL_EXPORTER_OTLP_TIMEOUT":        "2500",
+		"TRACEPARENT":                       "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "http://collector:4318/v1/traces", cfg.Endpoint)
+	assert.Equal(t, map[string]string{"x-team": "build", "authorization": "Bearer b"}, cfg.Headers)
+	assert.Equal(t, []Attr{String("service.name", "cacher"), String("ci.job", "42")}, cfg.Resource)
+	assert.EqualValues(t, 2500e6, cfg.Timeout)
+	require.NotNil(t, cfg.Parent)
+
+	cfg, err = ConfigFromEnv(env(map[string]string{"OTEL_TRACES_EXPORTER": "otlp"}))
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:4318/v1/traces", cfg.Endpoint)
+
+	for _, m := range []map[string]string{
+		{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4317", "OTEL_SDK_DISABLED": "true"},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4317", "OTEL_TRACES_EXPORTER": "none"},
+	} {
+		cfg, err := ConfigFromEnv(env(m))
+		require.NoError(t, err)
+		assert.Nil(t, cfg)
+	}
+	for _, m := range []map[string]string{
+		{"OTEL_TRACES_EXPORTER": "zipkin"},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4317", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"},
+		{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318", "TRACEPARENT": "bad"},
+	} {
+		_, err := ConfigFromEnv(env(m))
+		assert.Error(t, err, m)
+	}
+}
@@ -54,6 +54,10 @@ type Request struct {
 
 	// BodySize is the number of bytes of Body. If zero, the body isn't written.
 	BodySize int64 `json:",omitempty"`
+
+	// ObjectID is the name OutputID had while GOCACHEPROG was an experiment,
+	// before Go 1.24. Go 1.24 sends both, and later versions only OutputID.
+	ObjectID []byte `json:",omitempty"`
 }
 
 // Response is the JSON response from the child process to cmd/go.
@@ -88,4 +92,21 @@ type Response struct {
 	// a "get" request's ActionID (on cache hit) or a "put" request's
 	// provided ObjectID.
 	DiskPath string `json:",omitempty"`
+
+	// For close requests.
+
+	// Stats summarizes the requests the child served, once all of them
+	// have finished. It is an extension that cmd/go ignores, for tools
+	// driving a cache helper directly.
+	Stats *Stats `json:",omitempty"`
+}
+
+// Stats are the request counts reported in the response to a close request.
+type Stats struct {
+	Gets      int64
+	Hits      int64
+	Misses    int64
+	GetErrors int64 `json:",omitempty"`
+	Puts      int64
+	PutErrors int64 `json:",omitempty"`
 }